@@ -35,6 +35,7 @@ import (
 	apiTypes "github.com/purpose168/edgevpn/api/types"
 
 	"github.com/labstack/echo/v4"
+	"github.com/purpose168/edgevpn/pkg/blockchain"
 	"github.com/purpose168/edgevpn/pkg/node"
 	"github.com/purpose168/edgevpn/pkg/protocol"
 	"github.com/purpose168/edgevpn/pkg/services"
@@ -54,6 +55,18 @@ func getFileSystem() http.FileSystem {
 	return http.FS(fsys)
 }
 
+// listMachines 列出网络中的机器。双栈的机器也以IPv6地址为键保存，每台机器只返回一次
+// ledger: 账本
+func listMachines(ledger *blockchain.Ledger) []types.Machine {
+	machines := []types.Machine{}
+	for key, m := range types.Machines(ledger).List() {
+		if key == m.Address {
+			machines = append(machines, m)
+		}
+	}
+	return machines
+}
+
 // API 端点常量定义
 const (
 	MachineURL    = "/api/machines"   // 机器列表端点
@@ -119,11 +132,9 @@ func API(ctx context.Context, l string, defaultInterval, timeout time.Duration,
 	}
 	// 从账本获取文件数据
 	ec.GET(FileURL, func(c echo.Context) error {
-		list := []*types.File{}
-		for _, v := range ledger.CurrentData()[protocol.FilesLedgerKey] {
-			machine := &types.File{}
-			v.Unmarshal(machine)
-			list = append(list, machine)
+		list := []types.File{}
+		for _, f := range types.Files(ledger).List() {
+			list = append(list, f)
 		}
 		return c.JSON(http.StatusOK, list)
 	})
@@ -150,7 +161,7 @@ func API(ctx context.Context, l string, defaultInterval, timeout time.Duration,
 	// 系统摘要端点
 	ec.GET(SummaryURL, func(c echo.Context) error {
 		files := len(ledger.CurrentData()[protocol.FilesLedgerKey])
-		machines := len(ledger.CurrentData()[protocol.MachinesLedgerKey])
+		machines := len(listMachines(ledger))
 		users := len(ledger.CurrentData()[protocol.UsersLedgerKey])
 		services := len(ledger.CurrentData()[protocol.ServicesLedgerKey])
 		peers, err := e.MessageHub.ListPeers()
@@ -181,10 +192,8 @@ func API(ctx context.Context, l string, defaultInterval, timeout time.Duration,
 
 		online := services.AvailableNodes(ledger, 20*time.Minute)
 
-		for _, v := range ledger.CurrentData()[protocol.MachinesLedgerKey] {
-			machine := &types.Machine{}
-			v.Unmarshal(machine)
-			m := &apiTypes.Machine{Machine: *machine}
+		for _, machine := range listMachines(ledger) {
+			m := &apiTypes.Machine{Machine: machine}
 			// 检查连接状态
 			if e.Host().Network().Connectedness(peer.ID(machine.PeerID)) == network.Connected {
 				m.Connected = true
@@ -253,10 +262,8 @@ func API(ctx context.Context, l string, defaultInterval, timeout time.Duration,
 
 	// 用户列表端点
 	ec.GET(UsersURL, func(c echo.Context) error {
-		user := []*types.User{}
-		for _, v := range ledger.CurrentData()[protocol.UsersLedgerKey] {
-			u := &types.User{}
-			v.Unmarshal(u)
+		user := []types.User{}
+		for _, u := range types.Users(ledger).List() {
 			user = append(user, u)
 		}
 		return c.JSON(http.StatusOK, user)
@@ -264,10 +271,8 @@ func API(ctx context.Context, l string, defaultInterval, timeout time.Duration,
 
 	// 服务列表端点
 	ec.GET(ServiceURL, func(c echo.Context) error {
-		list := []*types.Service{}
-		for _, v := range ledger.CurrentData()[protocol.ServicesLedgerKey] {
-			srvc := &types.Service{}
-			v.Unmarshal(srvc)
+		list := []types.Service{}
+		for _, srvc := range types.Services(ledger).List() {
 			list = append(list, srvc)
 		}
 		return c.JSON(http.StatusOK, list)
@@ -314,9 +319,7 @@ func API(ctx context.Context, l string, defaultInterval, timeout time.Duration,
 	// DNS 记录列表端点
 	ec.GET(DNSURL, func(c echo.Context) error {
 		res := []apiTypes.DNS{}
-		for r, e := range ledger.CurrentData()[protocol.DNSKey] {
-			var t types.DNS
-			e.Unmarshal(&t)
+		for r, t := range types.DNSRecords(ledger).List() {
 			d := map[string]string{}
 
 			for k, v := range t {
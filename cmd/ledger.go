@@ -0,0 +1,370 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package cmd
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/ipfs/go-log"
+	"github.com/purpose168/edgevpn/pkg/blockchain"
+	"github.com/purpose168/edgevpn/pkg/config"
+	"github.com/purpose168/edgevpn/pkg/logger"
+	"github.com/urfave/cli/v2"
+)
+
+// ledgerStateFlags 返回打开账本状态目录的参数，包括解密状态目录所需的密钥
+func ledgerStateFlags(flags ...cli.Flag) []cli.Flag {
+	return append([]cli.Flag{
+		&cli.StringFlag{
+			Name:    "ledger-state",
+			Usage:   "账本状态目录，节点必须处于停止状态",
+			EnvVars: []string{"EDGEVPNLEDGERSTATE"},
+		},
+		&cli.StringFlag{
+			Name:    "config",
+			Usage:   "edgevpn 配置文件路径，用于派生加密状态目录的密钥",
+			EnvVars: []string{"EDGEVPNCONFIG"},
+		},
+		&cli.StringFlag{
+			Name:    "token",
+			Usage:   "edgevpn 令牌，用于派生加密状态目录的密钥",
+			EnvVars: []string{"EDGEVPNTOKEN"},
+		},
+		&cli.BoolFlag{
+			Name:    "ledger-encrypt",
+			Usage:   "状态目录使用从网络令牌派生的密钥加密",
+			EnvVars: []string{"EDGEVPNLEDGERENCRYPT"},
+		},
+		&cli.StringFlag{
+			Name:    "ledger-passphrase",
+			Usage:   "状态目录的口令",
+			EnvVars: []string{"EDGEVPNLEDGERPASSPHRASE"},
+		},
+		&cli.StringFlag{
+			Name:    "ledger-keyfile",
+			Usage:   "状态目录的密钥文件",
+			EnvVars: []string{"EDGEVPNLEDGERKEYFILE"},
+		},
+	}, flags...)
+}
+
+// openState 打开账本状态目录，create为false时目录必须已经存在
+// 目录中旧的diskv状态会被迁移，加密时旧的明文区块会被删除，只读取状态的命令使用openStateReadOnly
+func openState(c *cli.Context, create bool) (*blockchain.BoltStore, error) {
+	dir := c.String("ledger-state")
+	if dir == "" {
+		return nil, errors.New("需要使用 --ledger-state 指定账本状态目录")
+	}
+	if _, err := os.Stat(dir); err != nil && !create {
+		return nil, err
+	}
+
+	secret, err := stateSecret(c)
+	if err != nil {
+		return nil, err
+	}
+	return config.OpenLedgerState(logger.New(log.LevelInfo), dir, config.Ledger{}, secret)
+}
+
+// openStateReadOnly 以只读方式打开账本状态目录，不迁移、不删除也不创建任何文件
+// 返回账本存储和关闭它的函数
+func openStateReadOnly(c *cli.Context) (blockchain.HistoryStore, func() error, error) {
+	dir := c.String("ledger-state")
+	if dir == "" {
+		return nil, nil, errors.New("需要使用 --ledger-state 指定账本状态目录")
+	}
+
+	secret, err := stateSecret(c)
+	if err != nil {
+		return nil, nil, err
+	}
+	return config.OpenLedgerStateReadOnly(dir, secret)
+}
+
+// stateSecret 返回从参数派生的状态目录密钥材料，状态目录不加密时返回nil
+func stateSecret(c *cli.Context) ([]byte, error) {
+	return config.Config{
+		NetworkConfig: c.String("config"),
+		NetworkToken:  c.String("token"),
+		Ledger: config.Ledger{
+			Encrypt:    c.Bool("ledger-encrypt"),
+			Passphrase: c.String("ledger-passphrase"),
+			KeyFile:    c.String("ledger-keyfile"),
+		},
+	}.StateSecret()
+}
+
+// newSecret 返回rekey使用的新密钥材料，--decrypt时返回nil
+func newSecret(c *cli.Context) ([]byte, error) {
+	set := 0
+	for _, f := range []string{"new-token", "new-passphrase", "new-keyfile", "decrypt"} {
+		if c.IsSet(f) {
+			set++
+		}
+	}
+	if set != 1 {
+		return nil, errors.New("需要指定 --new-token、--new-passphrase、--new-keyfile 或 --decrypt 中的一个")
+	}
+
+	switch {
+	case c.IsSet("new-keyfile"):
+		dat, err := os.ReadFile(c.String("new-keyfile"))
+		if err != nil {
+			return nil, err
+		}
+		return []byte(strings.TrimSpace(string(dat))), nil
+	case c.IsSet("new-passphrase"):
+		return []byte(c.String("new-passphrase")), nil
+	case c.IsSet("new-token"):
+		return []byte(c.String("new-token")), nil
+	}
+	return nil, nil
+}
+
+// readArchive 读取并验证归档文件，路径为"-"时从标准输入读取
+func readArchive(path string) (*blockchain.Archive, error) {
+	var r io.Reader = os.Stdin
+	if path != "-" {
+		f, err := os.Open(path)
+		if err != nil {
+			return nil, err
+		}
+		defer f.Close()
+		r = f
+	}
+	a, err := blockchain.ReadArchive(r)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return a, nil
+}
+
+func Ledger() *cli.Command {
+	return &cli.Command{
+		Name:        "ledger",
+		Usage:       "ledger export|import|inspect|rekey|diff",
+		Description: `离线备份、恢复、检查和重新加密账本状态目录`,
+		Subcommands: cli.Commands{
+			{
+				Name:      "export",
+				Usage:     "将账本状态目录导出为归档",
+				UsageText: "edgevpn ledger export --ledger-state /var/lib/edgevpn [--output ledger.json]",
+				Flags: ledgerStateFlags(
+					&cli.StringFlag{
+						Name:  "output",
+						Usage: "归档文件，默认写入标准输出",
+						Value: "-",
+					},
+				),
+				Action: func(c *cli.Context) error {
+					store, closeStore, err := openStateReadOnly(c)
+					if err != nil {
+						return err
+					}
+					a := blockchain.NewArchive(store)
+					closeStore()
+
+					if c.String("output") == "-" {
+						return a.Write(os.Stdout)
+					}
+
+					f, err := os.Create(c.String("output"))
+					if err != nil {
+						return err
+					}
+					if err := a.Write(f); err != nil {
+						f.Close()
+						return err
+					}
+					return f.Close()
+				},
+			},
+			{
+				Name:      "import",
+				Usage:     "从归档恢复账本状态目录",
+				UsageText: "edgevpn ledger import --ledger-state /var/lib/edgevpn ledger.json",
+				Flags: ledgerStateFlags(
+					&cli.BoolFlag{
+						Name:  "force",
+						Usage: "替换状态目录中已有的区块",
+					},
+				),
+				Action: func(c *cli.Context) error {
+					if c.Args().Len() != 1 {
+						return errors.New("需要提供归档文件作为参数")
+					}
+					a, err := readArchive(c.Args().First())
+					if err != nil {
+						return err
+					}
+
+					store, err := openState(c, true)
+					if err != nil {
+						return err
+					}
+					defer store.Close()
+
+					if store.Last().Hash != "" && !c.Bool("force") {
+						return errors.New("状态目录中已经有区块，使用 --force 替换")
+					}
+					if err := store.Replace(a.Blocks...); err != nil {
+						return err
+					}
+					fmt.Printf("已导入 %d 个区块，最后一个区块: %d %s\n", len(a.Blocks), a.Last().Index, a.Last().Hash)
+					return nil
+				},
+			},
+			{
+				Name:      "inspect",
+				Usage:     "打印账本的存储桶和键并验证哈希链",
+				UsageText: "edgevpn ledger inspect [--ledger-state /var/lib/edgevpn | ledger.json]",
+				Flags: ledgerStateFlags(
+					&cli.StringFlag{
+						Name:  "bucket",
+						Usage: "只打印指定的存储桶",
+					},
+				),
+				Action: func(c *cli.Context) error {
+					var a *blockchain.Archive
+					if c.Args().Len() > 0 {
+						var err error
+						if a, err = readArchive(c.Args().First()); err != nil {
+							return err
+						}
+					} else {
+						store, closeStore, err := openStateReadOnly(c)
+						if err != nil {
+							return err
+						}
+						a = blockchain.NewArchive(store)
+						closeStore()
+					}
+
+					last := a.Last()
+					fmt.Printf("区块: %d 个 (最后一个: %d)\n", len(a.Blocks), last.Index)
+					fmt.Printf("哈希: %s\n", last.Hash)
+					fmt.Printf("时间: %s\n", last.Timestamp)
+
+					buckets := []string{}
+					for b := range last.Storage {
+						if c.String("bucket") == "" || c.String("bucket") == b {
+							buckets = append(buckets, b)
+						}
+					}
+					sort.Strings(buckets)
+					for _, b := range buckets {
+						fmt.Printf("\n[%s] %d 个键\n", b, len(last.Storage[b]))
+						keys := []string{}
+						for k := range last.Storage[b] {
+							keys = append(keys, k)
+						}
+						sort.Strings(keys)
+						for _, k := range keys {
+							fmt.Printf("  %s = %s\n", k, last.Storage[b][k])
+						}
+					}
+
+					if err := a.Verify(); err != nil {
+						return fmt.Errorf("哈希链无效: %w", err)
+					}
+					fmt.Println("\n哈希链有效")
+					return nil
+				},
+			},
+			{
+				Name:      "rekey",
+				Usage:     "使用新的密钥重新加密账本状态目录",
+				UsageText: "edgevpn ledger rekey --ledger-state /var/lib/edgevpn [--ledger-passphrase old] --new-passphrase new",
+				Description: `使用当前的密钥（--token、--ledger-passphrase或--ledger-keyfile）打开状态目录，
+使用新的密钥将所有区块写入一个新的数据库文件，然后替换原来的文件并用零覆盖它。
+未加密的状态目录不需要当前的密钥，--decrypt 将状态目录恢复为明文。`,
+				Flags: ledgerStateFlags(
+					&cli.StringFlag{
+						Name:  "new-token",
+						Usage: "从网络令牌派生新的密钥",
+					},
+					&cli.StringFlag{
+						Name:  "new-passphrase",
+						Usage: "新的口令",
+					},
+					&cli.StringFlag{
+						Name:  "new-keyfile",
+						Usage: "新的密钥文件",
+					},
+					&cli.BoolFlag{
+						Name:  "decrypt",
+						Usage: "解密状态目录",
+					},
+				),
+				Action: func(c *cli.Context) error {
+					secret, err := newSecret(c)
+					if err != nil {
+						return err
+					}
+
+					store, err := openState(c, false)
+					if err != nil {
+						return err
+					}
+					defer store.Close()
+
+					if err := store.Rekey(secret); err != nil {
+						return err
+					}
+					if store.Encrypted() {
+						fmt.Println("已使用新的密钥重新加密账本状态目录")
+					} else {
+						fmt.Println("已解密账本状态目录")
+					}
+					return nil
+				},
+			},
+			{
+				Name:      "diff",
+				Usage:     "比较两个归档的最后状态",
+				UsageText: "edgevpn ledger diff old.json new.json",
+				Action: func(c *cli.Context) error {
+					if c.Args().Len() != 2 {
+						return errors.New("需要提供两个归档文件作为参数")
+					}
+					old, err := readArchive(c.Args().Get(0))
+					if err != nil {
+						return err
+					}
+					new, err := readArchive(c.Args().Get(1))
+					if err != nil {
+						return err
+					}
+
+					for _, e := range blockchain.Diff(old.Last(), new.Last()) {
+						switch e.Type {
+						case blockchain.KeyAdded:
+							fmt.Printf("+ %s/%s = %s\n", e.Bucket, e.Key, e.New)
+						case blockchain.KeyDeleted:
+							fmt.Printf("- %s/%s = %s\n", e.Bucket, e.Key, e.Old)
+						case blockchain.KeyUpdated:
+							fmt.Printf("~ %s/%s: %s -> %s\n", e.Bucket, e.Key, e.Old, e.New)
+						}
+					}
+					return nil
+				},
+			},
+		},
+	}
+}
@@ -94,6 +94,11 @@ func MainFlags() []cli.Flag {
 			EnvVars: []string{"ADDRESS"},
 			Value:   "10.1.0.1/24",
 		},
+		&cli.StringFlag{
+			Name:    "address6",
+			Usage:   "双栈的 VPN 虚拟 IPv6 地址（CIDR）。设置为 auto 则从网络令牌和节点 ID 派生唯一本地地址",
+			EnvVars: []string{"ADDRESS6"},
+		},
 		&cli.StringFlag{
 			Name:    "dns",
 			Usage:   "DNS 监听地址。留空则禁用 DNS 服务器",
@@ -134,11 +139,56 @@ func MainFlags() []cli.Flag {
 			Usage:   "将所有数据包发送到此节点",
 			EnvVars: []string{"ROUTER"},
 		},
+		&cli.StringSliceFlag{
+			Name:    "route",
+			Usage:   "公告可以通过此节点到达的子网（CIDR），例如：10.20.0.0/16",
+			EnvVars: []string{"ROUTES"},
+		},
+		&cli.IntFlag{
+			Name:    "route-priority",
+			Usage:   "公告的子网的优先级，多个节点公告同一个子网时优先使用优先级较高的节点",
+			EnvVars: []string{"ROUTEPRIORITY"},
+		},
+		&cli.BoolFlag{
+			Name:    "sticky-routes",
+			Usage:   "为每个目标地址保持选择的路由节点，只有在它不可用时才切换",
+			EnvVars: []string{"STICKYROUTES"},
+		},
 		&cli.StringFlag{
 			Name:    "interface",
 			Usage:   "接口名称",
 			Value:   "edgevpn0",
 			EnvVars: []string{"IFACE"},
+		},
+		&cli.BoolFlag{
+			Name:    "tap",
+			Usage:   "使用 TAP 接口在第二层转发以太网帧，而不是按 IP 路由",
+			EnvVars: []string{"TAP"},
+		},
+		&cli.StringFlag{
+			Name:    "bridge",
+			Usage:   "TAP 模式下将接口加入的本地网桥，例如：br0",
+			EnvVars: []string{"BRIDGE"},
+		},
+		&cli.BoolFlag{
+			Name:    "userspace",
+			Usage:   "使用用户空间 TCP/IP 协议栈代替 TUN 设备，不需要 root 权限",
+			EnvVars: []string{"USERSPACE"},
+		},
+		&cli.StringFlag{
+			Name:    "socks5-listen",
+			Usage:   "用户空间模式下 SOCKS5 代理的监听地址，例如：127.0.0.1:1080",
+			EnvVars: []string{"SOCKS5LISTEN"},
+		},
+		&cli.StringFlag{
+			Name:    "http-proxy-listen",
+			Usage:   "用户空间模式下 HTTP 代理的监听地址，例如：127.0.0.1:3128",
+			EnvVars: []string{"HTTPPROXYLISTEN"},
+		},
+		&cli.StringSliceFlag{
+			Name:    "forward",
+			Usage:   "用户空间模式下的端口转发（本地地址=网络中的地址），例如：127.0.0.1:8022=10.1.0.12:22",
+			EnvVars: []string{"FORWARDS"},
 		}}, CommonFlags...)
 }
 
@@ -147,6 +197,7 @@ func Main() func(c *cli.Context) error {
 		if c.Bool("g") {
 			// 生成新配置并退出
 			newData := edgevpn.GenerateNewConnectionData(c.Int("key-otp-interval"))
+			newData.LedgerAdmins = c.StringSlice("ledger-admins")
 			if c.Bool("b") {
 				fmt.Print(newData.Base64())
 			} else {
@@ -164,14 +215,16 @@ func Main() func(c *cli.Context) error {
 				time.Duration(c.Int("aliveness-healthcheck-interval"))*time.Second,
 				time.Duration(c.Int("aliveness-healthcheck-scrub-interval"))*time.Second,
 				time.Duration(c.Int("aliveness-healthcheck-max-interval"))*time.Second)...)
+		// 子网的下一跳在健康检查超时后切换到其他候选节点
+		vpnOpts = append(vpnOpts,
+			vpn.WithRouteHealthTimeout(time.Duration(c.Int("aliveness-healthcheck-max-interval"))*time.Second))
 
 		if c.Bool("dhcp") {
-			// 添加 DHCP 服务器
-			address, _, err := net.ParseCIDR(c.String("address"))
-			if err != nil {
+			// 添加 DHCP 服务器，在 --address 的网络中分配地址
+			if _, _, err := net.ParseCIDR(c.String("address")); err != nil {
 				return err
 			}
-			nodeOpts, vO := vpn.DHCP(ll, 15*time.Minute, c.String("lease-dir"), address.String())
+			nodeOpts, vO := vpn.DHCP(ll, 15*time.Minute, c.String("lease-dir"), c.String("address"))
 			o = append(o, nodeOpts...)
 			vpnOpts = append(vpnOpts, vO...)
 		}
@@ -31,6 +31,7 @@ import (
 	rcmgr "github.com/libp2p/go-libp2p/p2p/host/resource-manager"
 	"github.com/multiformats/go-multiaddr"
 	"github.com/purpose168/edgevpn/internal"
+	"github.com/purpose168/edgevpn/pkg/blockchain"
 	"github.com/purpose168/edgevpn/pkg/config"
 
 	"github.com/purpose168/edgevpn/pkg/logger"
@@ -149,6 +150,54 @@ var CommonFlags []cli.Flag = []cli.Flag{
 		Usage:   "指定账本状态目录",
 		EnvVars: []string{"EDGEVPNLEDGERSTATE"},
 	},
+	&cli.StringFlag{
+		Name:    "ledger-fsync",
+		Usage:   "账本状态的fsync策略：always（每个区块）、never（由操作系统决定）或者fsync间隔（例如1s）",
+		EnvVars: []string{"EDGEVPNLEDGERFSYNC"},
+		Value:   "always",
+	},
+	&cli.BoolFlag{
+		Name:    "ledger-integrity-check",
+		Usage:   "启动时对整个账本状态数据库进行一致性检查，数据库较大时会延长启动时间",
+		EnvVars: []string{"EDGEVPNLEDGERINTEGRITYCHECK"},
+	},
+	&cli.BoolFlag{
+		Name:    "ledger-encrypt",
+		Usage:   "使用从网络令牌派生的密钥加密账本状态目录",
+		EnvVars: []string{"EDGEVPNLEDGERENCRYPT"},
+	},
+	&cli.StringFlag{
+		Name:    "ledger-passphrase",
+		Usage:   "使用口令加密账本状态目录",
+		EnvVars: []string{"EDGEVPNLEDGERPASSPHRASE"},
+	},
+	&cli.StringFlag{
+		Name:    "ledger-keyfile",
+		Usage:   "使用密钥文件加密账本状态目录",
+		EnvVars: []string{"EDGEVPNLEDGERKEYFILE"},
+	},
+	&cli.IntFlag{
+		Name:    "ledger-history-window",
+		Usage:   "保留的账本历史区块数量，用于审计键的修改。为0时禁用",
+		EnvVars: []string{"EDGEVPNLEDGERHISTORY"},
+	},
+	&cli.IntFlag{
+		Name:    "ledger-snapshot-interval",
+		Usage:   "账本历史中写入完整快照的区块间隔",
+		EnvVars: []string{"EDGEVPNLEDGERSNAPSHOTINTERVAL"},
+		Value:   blockchain.DefaultSnapshotInterval,
+	},
+	&cli.IntFlag{
+		Name:    "ledger-tombstone-retention",
+		Usage:   "已删除键的墓碑保留时间（秒），应该长于节点可能离线的最长时间。所有节点应该使用相同的值",
+		EnvVars: []string{"EDGEVPNLEDGERTOMBSTONERETENTION"},
+		Value:   int(blockchain.DefaultTombstoneRetention / time.Second),
+	},
+	&cli.StringSliceFlag{
+		Name:    "ledger-admins",
+		Usage:   "生成网络配置（-g）时写入其中的账本管理员的对等节点ID，管理员可以修改访问控制策略",
+		EnvVars: []string{"EDGEVPNLEDGERADMINS"},
+	},
 	&cli.BoolFlag{
 		Name:    "mdns",
 		Usage:   "启用 mDNS 进行对等节点发现",
@@ -204,7 +253,7 @@ var CommonFlags []cli.Flag = []cli.Flag{
 	},
 	&cli.IntFlag{
 		Name:    "aliveness-healthcheck-scrub-interval",
-		Usage:   "健康检查清理间隔",
+		Usage:   "健康检查存活时间（TTL），超过后未刷新的健康检查自动过期",
 		EnvVars: []string{"HEALTHCHECKSCRUBINTERVAL"},
 		Value:   600,
 	},
@@ -253,6 +302,12 @@ var CommonFlags []cli.Flag = []cli.Flag{
 		Usage:   "要限制的对等节点/CIDR 列表",
 		EnvVars: []string{"EDGEVPNBLACKLIST"},
 	},
+	&cli.StringFlag{
+		Name:    "sealer",
+		Usage:   "消息密封格式：compat（默认，同时接受两种格式，所有对等节点都升级之后自动使用新格式发送）、hkdf（只使用新格式）或者legacy（只使用旧格式发送，同时接受新格式）。网络中的所有节点都升级之后再设置为hkdf",
+		EnvVars: []string{"EDGEVPNSEALER"},
+		Value:   "compat",
+	},
 	&cli.StringFlag{
 		Name:    "token",
 		Usage:   "指定 edgevpn 令牌以代替配置文件",
@@ -420,12 +475,23 @@ func ConfigFromContext(c *cli.Context) *config.Config {
 		ListenMaddrs:      (c.StringSlice("listen-maddrs")),
 		DHTAnnounceMaddrs: stringsToMultiAddr(c.StringSlice("dht-announce-maddrs")),
 		Address:           c.String("address"),
+		Address6:          c.String("address6"),
 		Router:            c.String("router"),
+		Routes:            c.StringSlice("route"),
+		RoutePriority:     c.Int("route-priority"),
+		StickyRoutes:      c.Bool("sticky-routes"),
 		Interface:         c.String("interface"),
+		TAP:               c.Bool("tap"),
+		Bridge:            c.String("bridge"),
+		Userspace:         c.Bool("userspace"),
+		SOCKS5Listen:      c.String("socks5-listen"),
+		HTTPProxyListen:   c.String("http-proxy-listen"),
+		Forwards:          c.StringSlice("forward"),
 		Libp2pLogLevel:    c.String("libp2p-log-level"),
 		LogLevel:          c.String("log-level"),
 		LowProfile:        c.Bool("low-profile"),
 		Blacklist:         c.StringSlice("blacklist"),
+		Sealer:            c.String("sealer"),
 		Concurrency:       c.Int("concurrency"),
 		FrameTimeout:      c.String("timeout"),
 		ChannelBufferSize: c.Int("channel-buffer-size"),
@@ -435,8 +501,17 @@ func ConfigFromContext(c *cli.Context) *config.Config {
 		Whitelist:         stringsToMultiAddr(c.StringSlice("whitelist")),
 		Ledger: config.Ledger{
 			StateDir:         c.String("ledger-state"),
+			HistoryWindow:    c.Int("ledger-history-window"),
+			Fsync:            c.String("ledger-fsync"),
+			IntegrityCheck:   c.Bool("ledger-integrity-check"),
+			Encrypt:          c.Bool("ledger-encrypt"),
+			Passphrase:       c.String("ledger-passphrase"),
+			KeyFile:          c.String("ledger-keyfile"),
+			SnapshotInterval: c.Int("ledger-snapshot-interval"),
 			AnnounceInterval: time.Duration(c.Int("ledger-announce-interval")) * time.Second,
 			SyncInterval:     time.Duration(c.Int("ledger-synchronization-interval")) * time.Second,
+
+			TombstoneRetention: time.Duration(c.Int("ledger-tombstone-retention")) * time.Second,
 		},
 		NAT: config.NAT{
 			Service:           c.Bool("natservice"),
@@ -46,6 +46,7 @@ func main() {
 			cmd.FileSend(),       // 文件发送命令
 			cmd.DNS(),            // DNS 命令
 			cmd.Peergate(),       // 对等网关命令
+			cmd.Ledger(),         // 账本备份和检查命令
 		},
 
 		Action: cmd.Main(), // 默认动作
@@ -0,0 +1,264 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain
+
+import (
+	"log"
+	"math"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+	"github.com/purpose168/edgevpn/pkg/protocol"
+)
+
+// Policy 是存储桶的写入策略，保存在受保护的protocol.ACLLedgerKey存储桶中
+// 所有设置的条件都必须满足，没有策略的存储桶使用默认策略（见defaultPolicy），没有默认策略时任何人都可以写入。
+// 每次设置策略都会写入一个新的修订，写入按照其时钟生效的修订判断，与到达顺序无关
+type Policy struct {
+	// Writers 是允许写入的对等节点ID列表
+	Writers []string `json:",omitempty"`
+	// TrustZone 允许信任区域（protocol.TrustZoneKey）中的成员写入
+	TrustZone bool `json:",omitempty"`
+	// AdminOnly 只允许管理员写入
+	AdminOnly bool `json:",omitempty"`
+	// Self 只允许ID与键名相同的对等节点写入该键
+	Self bool `json:",omitempty"`
+	// PeerField 要求写入的值是JSON对象，并且该字段是写入者的对等节点ID，例如以IP为键的机器信息中的"PeerID"。
+	// 删除不检查该字段，与Owner一起使用时只有键的拥有者可以删除
+	PeerField string `json:",omitempty"`
+	// Owner 键的第一个写入者拥有该键，在其删除之前其他人不能修改
+	// 并发的第一次写入中最早的获胜，见lifetimeWins
+	Owner bool `json:",omitempty"`
+}
+
+// restricted 如果策略限制了写入者则返回true
+func (p Policy) restricted() bool {
+	return len(p.Writers) > 0 || p.TrustZone || p.AdminOnly
+}
+
+// defaultPolicy 返回存储桶的默认写入策略
+// 机器信息只能由其中记录的对等节点写入，地址属于第一个写入它的对等节点，在其删除之前其他对等节点不能覆盖或删除。
+// 配置了管理员时，信任区域只能由其成员修改，
+// 信任区域的认证数据和DNS记录只能由管理员修改
+// 参数 bucket 为存储桶名称，admins 为管理员的对等节点ID列表
+func defaultPolicy(bucket string, admins []string) (Policy, bool) {
+	switch {
+	case bucket == protocol.MachinesLedgerKey:
+		return Policy{PeerField: "PeerID", Owner: true}, true
+	case len(admins) == 0:
+		return Policy{}, false
+	case bucket == protocol.TrustZoneKey:
+		return Policy{TrustZone: true}, true
+	case bucket == protocol.TrustZoneAuthKey, bucket == protocol.DNSKey:
+		return Policy{AdminOnly: true}, true
+	}
+	return Policy{}, false
+}
+
+// authorize 检查操作是否满足策略
+// 参数 op 为已验证签名的操作，s 为写入前的状态
+func (p Policy) authorize(op Operation, s *state) error {
+	writer := op.Signer()
+
+	if p.restricted() && !contains(p.Writers, writer) && !(p.TrustZone && s.memberAt(writer, op.Clock)) {
+		return errors.Errorf("对等节点 %s 不允许写入存储桶 '%s'", writer, op.Bucket)
+	}
+
+	if p.Self && op.Key != writer {
+		return errors.Errorf("对等节点 %s 只能写入存储桶 '%s' 中自己的键", writer, op.Bucket)
+	}
+
+	if p.PeerField != "" && op.Type == OpSet {
+		var fields map[string]interface{}
+		if err := op.Value.Unmarshal(&fields); err != nil || fields[p.PeerField] != writer {
+			return errors.Errorf("对等节点 %s 只能写入存储桶 '%s' 中字段 '%s' 为自己的值", writer, op.Bucket, p.PeerField)
+		}
+	}
+
+	if p.Owner {
+		if v, exists := s.versions[op.Bucket][op.Key]; exists && !v.Deleted && v.Clock.Node != "" && v.Clock.Node != writer && !lifetimeWins(op, v) {
+			return errors.Errorf("键 '%s/%s' 属于 %s", op.Bucket, op.Key, v.Clock.Node)
+		}
+	}
+
+	return nil
+}
+
+// lifetimeWins 如果操作所属的所有权比当前版本所属的所有权更早开始则返回true
+// 所有权从键不存在或被删除之后的第一次写入开始（Since），并记录它之前的墓碑（After）。
+// 一个所有权开始于另一个所有权的墓碑之后时，后者已经结束；否则两者是并发的，开始较早的获胜。
+// 比较只依赖于两个写入本身，所有节点无论以什么顺序收到写入都得出相同的拥有者
+// 参数 op 为另一个写入者的写入，v 为当前版本
+func lifetimeWins(op Operation, v Version) bool {
+	since, current := op.Since, v.Since
+	if since == 0 {
+		since = op.Clock.Time
+	}
+	if current == 0 {
+		current = v.Clock.Time
+	}
+	switch {
+	case since < v.After:
+		return false
+	case current < op.After:
+		return true
+	case since != current:
+		return since < current
+	}
+	return op.Signer() < v.Clock.Node
+}
+
+// lifetime 为拥有者策略下的写入设置所有权的开始时间和之前的墓碑
+// 参数 op 为要签名的写入
+func (s *state) lifetime(op *Operation) {
+	op.Since, op.After = op.Clock.Time, 0
+	v, exists := s.versions[op.Bucket][op.Key]
+	switch {
+	case !exists:
+	case v.Deleted:
+		op.After = v.Clock.Time
+	case v.Clock.Node == op.Signer():
+		op.After = v.After
+		if v.Since != 0 {
+			op.Since = v.Since
+		} else {
+			op.Since = v.Clock.Time
+		}
+	}
+}
+
+// memberAt 如果写入者在时钟c时是信任区域的成员则返回true
+// 当前的成员总是被视为成员，被移除的成员在移除之前是成员
+// 参数 writer 为写入者的对等节点ID，c 为写入时钟
+func (s *state) memberAt(writer string, c Clock) bool {
+	v, exists := s.versions[protocol.TrustZoneKey][writer]
+	if !exists {
+		_, legacy := s.storage[protocol.TrustZoneKey][writer]
+		return legacy
+	}
+	if v.Deleted {
+		return c.Less(v.Clock)
+	}
+	return true
+}
+
+// policyKey 返回策略修订的键：存储桶名称和写入时钟
+// 参数 bucket 为存储桶名称，c 为写入时钟
+func policyKey(bucket string, c Clock) string {
+	return bucket + "@" + strconv.FormatInt(c.Time, 10) + "." + strconv.FormatUint(uint64(c.Counter), 10) + "." + c.Node
+}
+
+// policyBucket 返回策略修订的键对应的存储桶名称，旧版本的键就是存储桶名称
+// 参数 key 为策略存储桶中的键
+func policyBucket(key string) string {
+	if i := strings.LastIndex(key, "@"); i >= 0 {
+		return key[:i]
+	}
+	return key
+}
+
+// policyAt 返回对时钟为c的写入生效的存储桶策略：时钟早于c的最后一个策略修订，没有修订时使用默认策略
+// 参数 bucket 为存储桶名称，c 为写入时钟，admins 为管理员的对等节点ID列表
+func (s *state) policyAt(bucket string, c Clock, admins []string) (p Policy, exists bool) {
+	var (
+		found bool
+		clock Clock
+		value Data
+	)
+	for k, v := range s.storage[protocol.ACLLedgerKey] {
+		if policyBucket(k) != bucket {
+			continue
+		}
+		version := s.versions[protocol.ACLLedgerKey][k]
+		if !version.Clock.Less(c) || (found && version.Clock.Less(clock)) {
+			continue
+		}
+		found, clock, value = true, version.Clock, v
+	}
+	if !found {
+		return defaultPolicy(bucket, admins)
+	}
+	if err := value.Unmarshal(&p); err != nil {
+		// 无法解析的策略拒绝所有写入，只有管理员可以修复
+		return Policy{AdminOnly: true}, true
+	}
+	return p, true
+}
+
+// policy 返回存储桶当前的写入策略
+// 参数 bucket 为存储桶名称，admins 为管理员的对等节点ID列表
+func (s *state) policy(bucket string, admins []string) (Policy, bool) {
+	return s.policyAt(bucket, Clock{Time: math.MaxInt64}, admins)
+}
+
+// authorize 检查操作是否允许写入，按照操作的时钟生效的策略判断
+// 管理员可以写入任何存储桶，策略存储桶只有管理员可以写入，没有配置管理员时任何人都不能修改策略
+// 参数 op 为已验证签名的操作，admins 为管理员的对等节点ID列表
+func (s *state) authorize(op Operation, admins []string) error {
+	if contains(admins, op.Signer()) {
+		return nil
+	}
+
+	if op.Bucket == protocol.ACLLedgerKey {
+		return errors.Errorf("对等节点 %s 不是管理员，不允许修改访问控制策略", op.Signer())
+	}
+	p, exists := s.policyAt(op.Bucket, op.Clock, admins)
+	if !exists {
+		return nil
+	}
+	return p.authorize(op, s)
+}
+
+// revalidate 在策略或者信任区域变化之后重新检查每个键的最后一次写入，删除不再被允许的写入，返回是否删除了任何键
+// 写入可能在其之前生效的策略之前到达，重新检查使所有节点最终得到相同的结果
+// 参数 admins 为管理员的对等节点ID列表
+func (s *state) revalidate(admins []string) (changed bool) {
+	for bucket, keys := range s.storage {
+		if bucket == protocol.ACLLedgerKey {
+			continue
+		}
+		for k, value := range keys {
+			v, exists := s.versions[bucket][k]
+			if !exists {
+				continue
+			}
+			err := s.authorize(v.operation(bucket, k, value), admins)
+			if err == nil {
+				continue
+			}
+			log.Println(errors.Wrap(err, "删除写入"))
+			delete(keys, k)
+			delete(s.versions[bucket], k)
+			changed = true
+		}
+		if len(keys) == 0 {
+			delete(s.storage, bucket)
+		}
+		if len(s.versions[bucket]) == 0 {
+			delete(s.versions, bucket)
+		}
+	}
+	return
+}
+
+// contains 如果列表中包含s则返回true
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
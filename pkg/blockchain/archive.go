@@ -0,0 +1,119 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"sort"
+
+	"github.com/pkg/errors"
+)
+
+// ArchiveVersion 是当前的归档格式版本
+const ArchiveVersion = 1
+
+// Archive 是账本区块的离线备份
+type Archive struct {
+	Version  int     `json:"version"`  // 归档格式版本
+	Created  string  `json:"created"`  // 创建时间
+	Blocks   []Block `json:"blocks"`   // 按索引排序的区块
+	Checksum string  `json:"checksum"` // 区块的SHA256校验和
+}
+
+// NewArchive 从存储中保留的所有区块创建归档
+// 参数 s 为源存储
+func NewArchive(s HistoryStore) *Archive {
+	a := &Archive{Version: ArchiveVersion, Created: now()}
+	s.Range(0, s.Len(), func(b Block) bool {
+		a.Blocks = append(a.Blocks, b)
+		return true
+	})
+	a.Checksum = a.checksum()
+	return a
+}
+
+// checksum 计算区块的校验和
+func (a *Archive) checksum() string {
+	dat, _ := json.Marshal(a.Blocks)
+	h := sha256.Sum256(dat)
+	return hex.EncodeToString(h[:])
+}
+
+// Last 返回归档中的最后一个区块
+func (a *Archive) Last() Block {
+	if len(a.Blocks) == 0 {
+		return Block{}
+	}
+	return a.Blocks[len(a.Blocks)-1]
+}
+
+// Verify 检查归档的校验和以及区块的哈希链
+// 创世区块之外的第一个区块只检查自身的哈希，因为前一区块可能已经被修剪
+func (a *Archive) Verify() error {
+	if a.Checksum != a.checksum() {
+		return errors.New("归档校验和不匹配")
+	}
+	for i, b := range a.Blocks {
+		switch {
+		case i > 0:
+			if !b.IsValid(a.Blocks[i-1]) {
+				return errors.Errorf("区块 %d 与前一区块不连续", b.Index)
+			}
+		// 创世区块的哈希不是它自身的校验和
+		case b.Index > 0 && b.Checksum() != b.Hash:
+			return errors.Errorf("区块 %d 的哈希不匹配", b.Index)
+		}
+	}
+	return nil
+}
+
+// Write 将归档以JSON格式写入w
+// 参数 w 为输出
+func (a *Archive) Write(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", " ")
+	return enc.Encode(a)
+}
+
+// ReadArchive 读取归档并验证版本、校验和以及哈希链
+// 参数 r 为输入
+func ReadArchive(r io.Reader) (*Archive, error) {
+	a := &Archive{}
+	if err := json.NewDecoder(r).Decode(a); err != nil {
+		return nil, errors.Wrap(err, "无法解析归档")
+	}
+	if a.Version != ArchiveVersion {
+		return nil, errors.Errorf("不支持的归档版本 %d", a.Version)
+	}
+	if err := a.Verify(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Diff 返回从old到new的键变更，按存储桶和键排序
+// 参数 old 和 new 为要比较的区块
+func Diff(old, new Block) []Event {
+	events := changes(old, new)
+	sort.Slice(events, func(i, j int) bool {
+		if events[i].Bucket != events[j].Bucket {
+			return events[i].Bucket < events[j].Bucket
+		}
+		return events[i].Key < events[j].Key
+	})
+	return events
+}
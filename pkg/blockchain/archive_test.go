@@ -0,0 +1,83 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain_test
+
+import (
+	"bytes"
+	"path/filepath"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/purpose168/edgevpn/pkg/blockchain"
+)
+
+var _ = Describe("账本归档", func() {
+	var (
+		l     *Ledger
+		store *WindowStore
+		buf   *bytes.Buffer
+	)
+
+	BeforeEach(func() {
+		store = NewWindowStore(&MemoryKV{})
+		l = New(&wire{}, store)
+		l.Add("foo", map[string]interface{}{"a": "1", "b": "2"})
+		l.Add("bar", map[string]interface{}{"c": "3"})
+		l.Delete("foo", "b")
+
+		buf = &bytes.Buffer{}
+		Expect(NewArchive(store).Write(buf)).To(Succeed())
+	})
+
+	It("导出后导入到新的存储", func() {
+		a, err := ReadArchive(bytes.NewReader(buf.Bytes()))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(a.Blocks).To(HaveLen(4))
+		Expect(a.Last().Hash).To(Equal(l.LastBlock().Hash))
+
+		dst, err := NewBoltStore(filepath.Join(GinkgoT().TempDir(), "ledger.db"))
+		Expect(err).ToNot(HaveOccurred())
+		defer dst.Close()
+		Expect(dst.Replace(a.Blocks...)).To(Succeed())
+
+		Expect(New(&wire{}, dst).CurrentData()).To(Equal(l.CurrentData()))
+	})
+
+	It("拒绝被篡改的归档", func() {
+		tampered := strings.Replace(buf.String(), `\"1\"`, `\"9\"`, 1)
+		Expect(tampered).ToNot(Equal(buf.String()))
+		_, err := ReadArchive(strings.NewReader(tampered))
+		Expect(err).To(HaveOccurred())
+
+		a, err := ReadArchive(bytes.NewReader(buf.Bytes()))
+		Expect(err).ToNot(HaveOccurred())
+		a.Blocks[2].Storage["bar"]["c"] = Data(`"9"`)
+		Expect(a.Verify()).ToNot(Succeed())
+	})
+
+	It("比较两个状态", func() {
+		old := l.LastBlock()
+		l.Add("foo", map[string]interface{}{"a": "4"})
+		l.Delete("bar", "c")
+		l.Add("baz", map[string]interface{}{"d": "5"})
+
+		events := Diff(old, l.LastBlock())
+		Expect(events).To(HaveLen(3))
+		Expect(events[0]).To(Equal(Event{Type: KeyDeleted, Bucket: "bar", Key: "c", Old: Data(`"3"`)}))
+		Expect(events[1]).To(Equal(Event{Type: KeyAdded, Bucket: "baz", Key: "d", New: Data(`"5"`)}))
+		Expect(events[2]).To(Equal(Event{Type: KeyUpdated, Bucket: "foo", Key: "a", Old: Data(`"1"`), New: Data(`"4"`)}))
+	})
+})
@@ -20,28 +20,51 @@ import (
 	"time"
 )
 
+// 区块格式版本常量定义
+const (
+	// LegacyFormat 使用fmt.Sprint计算哈希，依赖Go的map打印格式和time.Time.String()
+	LegacyFormat = 0
+	// CanonicalFormat 对区块的规范JSON编码计算哈希，见Block.canonical
+	CanonicalFormat = 1
+
+	// BlockFormat 是新区块使用的格式
+	BlockFormat = CanonicalFormat
+)
+
 // DataString 数据字符串类型
 type DataString string
 
 // Block 表示区块链中的每个"项目"
 type Block struct {
+	Format    int                        `json:",omitempty"` // 区块格式版本，决定哈希的计算方式
 	Index     int                        // 区块索引
 	Timestamp string                     // 时间戳
 	Storage   map[string]map[string]Data // 存储数据
 	Hash      string                     // 当前区块哈希
 	PrevHash  string                     // 前一区块哈希
+
+	// Versions 记录每个键的最后一次写入（包括已删除键的墓碑），用于合并并发写入
+	Versions map[string]map[string]Version `json:",omitempty"`
+
+	// Horizon 是已回收的墓碑中最晚的写入时钟（Unix纳秒），不晚于它的未知键不会再被接受
+	Horizon int64 `json:",omitempty"`
 }
 
 // Blockchain 是一系列已验证的区块
 type Blockchain []Block
 
 // IsValid 通过检查索引和比较前一区块的哈希来确保区块有效
+// 在迁移期间两种格式的区块都被接受，但区块的格式不能低于前一区块
 // 参数 oldBlock 为前一区块
 func (newBlock Block) IsValid(oldBlock Block) bool {
 	if oldBlock.Index+1 != newBlock.Index {
 		return false
 	}
 
+	if newBlock.Format < oldBlock.Format {
+		return false
+	}
+
 	if oldBlock.Hash != newBlock.PrevHash {
 		return false
 	}
@@ -53,13 +76,88 @@ func (newBlock Block) IsValid(oldBlock Block) bool {
 	return true
 }
 
-// Checksum 对区块进行SHA256哈希计算
+// Checksum 按照区块的格式进行SHA256哈希计算
 func (b Block) Checksum() string {
-	record := fmt.Sprint(b.Index, b.Timestamp, b.Storage, b.PrevHash)
-	h := sha256.New()
-	h.Write([]byte(record))
-	hashed := h.Sum(nil)
-	return hex.EncodeToString(hashed)
+	var record []byte
+	switch b.Format {
+	case LegacyFormat:
+		record = []byte(fmt.Sprint(b.Index, b.Timestamp, b.Storage, b.PrevHash))
+		if len(b.Versions) > 0 {
+			record = append(record, fmt.Sprint(b.Versions)...)
+		}
+	default:
+		record = b.canonical()
+	}
+	h := sha256.Sum256(record)
+	return hex.EncodeToString(h[:])
+}
+
+// canonical 返回区块的规范编码，其他语言的实现必须逐字节地生成相同的编码才能计算出相同的哈希：
+//   - 一个不带任何空白的JSON对象，字段依次为format、index、timestamp、prevHash、storage、versions、horizon，
+//     horizon为0时省略；空的存储桶与不存在的存储桶等价，会被省略
+//   - storage和versions中对象的键按UTF-8字节顺序排序
+//   - 版本对象的字段依次为Clock（依次为Time、Counter、Node）、Deleted、Expires、Signature、Since、After，
+//     Clock及其字段总是输出，其他字段为零值（false、0或空）时省略
+//   - 整数使用不带正号、前导零和指数的十进制表示；Signature是带填充的标准Base64编码
+//   - 字符串中的"和\转义为\"和\\，\b、\f、\n、\r、\t使用两个字符的转义，其他小于U+0020的字符、
+//     U+2028和U+2029转义为小写十六进制的\u00XX和\u2028、\u2029；<、>和&不转义；
+//     每个无效的UTF-8字节替换为六个字符的转义\ufffd，而不是U+FFFD字符本身；其他字符（包括有效的U+FFFD）原样输出
+//   - 时间戳是RFC 3339格式的UTC时间，与其他字符串一样编码
+//
+// 编码由canonicalEncoder生成，不依赖encoding/json，不同版本的Go工具链生成相同的字节
+func (b Block) canonical() []byte {
+	e := &canonicalEncoder{}
+	e.WriteString(`{"format":`)
+	e.int(int64(b.Format))
+	e.WriteString(`,"index":`)
+	e.int(int64(b.Index))
+	e.key(false, "timestamp")
+	e.str(b.Timestamp)
+	e.key(false, "prevHash")
+	e.str(b.PrevHash)
+	e.key(false, "storage")
+	e.storage(b.Storage)
+	e.key(false, "versions")
+	e.versions(b.Versions)
+	if b.Horizon != 0 {
+		e.key(false, "horizon")
+		e.int(b.Horizon)
+	}
+	e.WriteByte('}')
+	return e.Bytes()
+}
+
+// Digest 返回区块状态（存储和版本信息）的摘要
+// 与Hash不同，它不依赖于区块在链中的位置，状态相同的节点摘要相同。
+// 摘要在节点之间比较，因此与规范编码一样不依赖encoding/json；
+// 编码是{"Storage":...,"Versions":...}，除了<、>和&转义为\u003c、\u003e和\u0026之外与规范编码的规则相同
+func (b Block) Digest() string {
+	e := &canonicalEncoder{html: true}
+	e.WriteString(`{"Storage":`)
+	e.storage(b.Storage)
+	e.WriteString(`,"Versions":`)
+	e.versions(b.Versions)
+	e.WriteByte('}')
+	h := sha256.Sum256(e.Bytes())
+	return hex.EncodeToString(h[:])
+}
+
+// legacyTimestampLayout 是旧格式区块的时间戳格式，即time.Time.String()的输出
+const legacyTimestampLayout = "2006-01-02 15:04:05.999999999 -0700 MST"
+
+// now 返回当前时间的区块时间戳
+func now() string {
+	return time.Now().UTC().Format(time.RFC3339Nano)
+}
+
+// blockTime 解析区块时间戳，无法解析时返回零时间
+// 参数 timestamp 为区块时间戳
+func blockTime(timestamp string) time.Time {
+	if t, err := time.Parse(time.RFC3339Nano, timestamp); err == nil {
+		return t
+	}
+	t, _ := time.Parse(legacyTimestampLayout, timestamp)
+	return t
 }
 
 // NewBlock 使用前一区块的哈希创建新区块
@@ -67,10 +165,9 @@ func (b Block) Checksum() string {
 func (oldBlock Block) NewBlock(s map[string]map[string]Data) Block {
 	var newBlock Block
 
-	t := time.Now().UTC()
-
+	newBlock.Format = BlockFormat
 	newBlock.Index = oldBlock.Index + 1
-	newBlock.Timestamp = t.String()
+	newBlock.Timestamp = now()
 	newBlock.Storage = s
 	newBlock.PrevHash = oldBlock.Hash
 	newBlock.Hash = newBlock.Checksum()
@@ -0,0 +1,112 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain_test
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/purpose168/edgevpn/pkg/blockchain"
+)
+
+var _ = Describe("区块哈希", func() {
+	block := func() Block {
+		return Block{
+			Format:    CanonicalFormat,
+			Index:     1,
+			Timestamp: "2022-01-02T03:04:05.000000006Z",
+			PrevHash:  "abc",
+			Storage: map[string]map[string]Data{
+				"machines": {
+					"10.1.0.1": Data(`{"Address":"10.1.0.1"}`),
+					"10.1.0.2": Data(`<&>`),
+				},
+				"empty": {},
+			},
+			Versions: map[string]map[string]Version{
+				"machines": {"10.1.0.1": {Clock: Clock{Time: 5, Counter: 1, Node: "Qm"}}},
+			},
+		}
+	}
+
+	It("使用规范编码计算哈希", func() {
+		// 与其他语言的实现使用相同规则计算的结果
+		Expect(block().Checksum()).To(Equal("7ee99cd9b72dd90337ea8a276621e36ee5be529e76bd8c149413ae2e15aee355"))
+	})
+
+	It("按照文档中的规则编码特殊字符、签名和墓碑", func() {
+		b := Block{
+			Format:    CanonicalFormat,
+			Index:     2,
+			Timestamp: "2022-01-02T03:04:05Z",
+			PrevHash:  "abc",
+			Storage: map[string]map[string]Data{
+				"b": {"k\u2028": Data("\"\\\b\f\n\r\t\x01\u2029<&>\xff\ufffdé")},
+			},
+			Versions: map[string]map[string]Version{
+				"b": {"k\u2028": {Clock: Clock{Time: 5, Node: "Qm"}, Expires: 7, Signature: []byte{0xfb, 0xff}, Since: 3}},
+				"a": {"x": {Clock: Clock{Time: -1, Counter: 2}, Deleted: true}},
+			},
+			Horizon: 4,
+		}
+
+		record := `{"format":1,"index":2,"timestamp":"2022-01-02T03:04:05Z","prevHash":"abc",` +
+			// 无效的字节使用转义，有效的U+FFFD字符原样输出
+			`"storage":{"b":{"k\u2028":"\"\\\b\f\n\r\t\u0001\u2029<&>\ufffd` + "\ufffd" + `é"}},` +
+			`"versions":{"a":{"x":{"Clock":{"Time":-1,"Counter":2,"Node":""},"Deleted":true}},` +
+			`"b":{"k\u2028":{"Clock":{"Time":5,"Counter":0,"Node":"Qm"},"Expires":7,"Signature":"+/8=","Since":3}}},` +
+			`"horizon":4}`
+		h := sha256.Sum256([]byte(record))
+		Expect(b.Checksum()).To(Equal(hex.EncodeToString(h[:])))
+	})
+
+	It("状态摘要转义HTML字符，不依赖区块的位置", func() {
+		b := block()
+		b.Storage["machines"]["10.1.0.2"] = Data("<&>\xff")
+		record := `{"Storage":{"machines":{"10.1.0.1":"{\"Address\":\"10.1.0.1\"}","10.1.0.2":"\u003c\u0026\u003e\ufffd"}},` +
+			`"Versions":{"machines":{"10.1.0.1":{"Clock":{"Time":5,"Counter":1,"Node":"Qm"}}}}}`
+		h := sha256.Sum256([]byte(record))
+		Expect(b.Digest()).To(Equal(hex.EncodeToString(h[:])))
+
+		b.Index, b.PrevHash = 7, "def"
+		Expect(b.Digest()).To(Equal(hex.EncodeToString(h[:])))
+	})
+
+	It("兼容旧格式的区块", func() {
+		b := block()
+		b.Format = LegacyFormat
+		b.Timestamp = "2022-01-02 03:04:05.000000006 +0000 UTC"
+
+		record := fmt.Sprint(b.Index, b.Timestamp, b.Storage, b.PrevHash) + fmt.Sprint(b.Versions)
+		h := sha256.Sum256([]byte(record))
+		Expect(b.Checksum()).To(Equal(hex.EncodeToString(h[:])))
+	})
+
+	It("在迁移期间接受两种格式，但不允许降级", func() {
+		legacy := Block{Index: 0, Storage: map[string]map[string]Data{}}
+		legacy.Hash = legacy.Checksum()
+
+		next := legacy.NewBlock(map[string]map[string]Data{"foo": {"a": Data(`"1"`)}})
+		Expect(next.Format).To(Equal(BlockFormat))
+		Expect(next.IsValid(legacy)).To(BeTrue())
+
+		downgrade := Block{Index: 2, Timestamp: next.Timestamp, Storage: next.Storage, PrevHash: next.Hash}
+		downgrade.Hash = downgrade.Checksum()
+		Expect(downgrade.IsValid(next)).To(BeFalse())
+	})
+})
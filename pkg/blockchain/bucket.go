@@ -0,0 +1,132 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain
+
+import (
+	"context"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Validator 由需要校验的值类型实现，Bucket在写入和读取时都会调用
+// 读取时无法通过校验的值（例如其他节点写入的无效数据）被视为不存在
+type Validator interface {
+	Validate() error
+}
+
+// Bucket 是存储桶的类型化视图，负责值的编码、解码和校验
+type Bucket[T any] struct {
+	ledger *Ledger
+	name   string
+}
+
+// NewBucket 返回账本中名为name的存储桶的类型化视图
+// 参数 l 为账本，name 为存储桶名称
+func NewBucket[T any](l *Ledger, name string) *Bucket[T] {
+	return &Bucket[T]{ledger: l, name: name}
+}
+
+// Name 返回存储桶名称
+func (b *Bucket[T]) Name() string {
+	return b.name
+}
+
+// validate 如果T实现了Validator则校验值
+func validate[T any](v T) error {
+	if val, ok := any(v).(Validator); ok {
+		return val.Validate()
+	}
+	if val, ok := any(&v).(Validator); ok {
+		return val.Validate()
+	}
+	return nil
+}
+
+// decode 解码并校验值
+func decode[T any](d Data) (T, error) {
+	var v T
+	if err := d.Unmarshal(&v); err != nil {
+		return v, err
+	}
+	return v, validate(v)
+}
+
+// Get 返回键的值，值不存在、无法解码或者无法通过校验时exists为false
+// 参数 key 为键名
+func (b *Bucket[T]) Get(key string) (v T, exists bool) {
+	d, exists := b.ledger.GetKey(b.name, key)
+	if !exists {
+		return v, false
+	}
+	v, err := decode[T](d)
+	return v, err == nil
+}
+
+// List 返回存储桶中所有有效的键和值
+func (b *Bucket[T]) List() map[string]T {
+	res := map[string]T{}
+	for k, d := range b.ledger.CurrentData()[b.name] {
+		if v, err := decode[T](d); err == nil {
+			res[k] = v
+		}
+	}
+	return res
+}
+
+// Exists 如果存储桶中有满足f的有效值则返回true
+// 参数 f 为判断函数
+func (b *Bucket[T]) Exists(f func(T) bool) bool {
+	return b.ledger.Exists(b.name, func(d Data) bool {
+		v, err := decode[T](d)
+		return err == nil && f(v)
+	})
+}
+
+// Put 校验值并写入键
+// 参数 key 为键名，v 为值，opts 为写入选项
+func (b *Bucket[T]) Put(key string, v T, opts ...WriteOption) error {
+	if err := validate(v); err != nil {
+		return errors.Wrapf(err, "存储桶 '%s' 中的键 '%s' 无效", b.name, key)
+	}
+	b.ledger.Add(b.name, map[string]interface{}{key: v}, opts...)
+	return nil
+}
+
+// Delete 删除键
+// 参数 key 为键名
+func (b *Bucket[T]) Delete(key string) {
+	b.ledger.Delete(b.name, key)
+}
+
+// Announce 在ctx的生命周期内持续公告键的值，账本中的值不同时重新写入
+// 使用WithTTL时键在过期之前被刷新，见Ledger.AnnounceUpdate
+// 参数 ctx 为上下文，interval 为间隔时间，key 为键名，v 为值，opts 为写入选项
+func (b *Bucket[T]) Announce(ctx context.Context, interval time.Duration, key string, v T, opts ...WriteOption) error {
+	if err := validate(v); err != nil {
+		return errors.Wrapf(err, "存储桶 '%s' 中的键 '%s' 无效", b.name, key)
+	}
+	b.ledger.AnnounceUpdate(ctx, interval, b.name, key, v, opts...)
+	return nil
+}
+
+// Persist 持续公告键的值，直到账本中的值与之相同或者超时
+// 参数 ctx 为上下文，interval 为间隔时间，timeout 为超时时间，key 为键名，v 为值
+func (b *Bucket[T]) Persist(ctx context.Context, interval, timeout time.Duration, key string, v T) error {
+	if err := validate(v); err != nil {
+		return errors.Wrapf(err, "存储桶 '%s' 中的键 '%s' 无效", b.name, key)
+	}
+	b.ledger.Persist(ctx, interval, timeout, b.name, key, v)
+	return nil
+}
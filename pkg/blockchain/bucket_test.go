@@ -0,0 +1,93 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain_test
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/purpose168/edgevpn/pkg/blockchain"
+)
+
+type route struct {
+	Peer string
+	Hops int
+}
+
+func (r route) Validate() error {
+	if r.Peer == "" {
+		return errors.New("缺少对等节点")
+	}
+	return nil
+}
+
+var _ = Describe("类型化存储桶", func() {
+	var (
+		l      *Ledger
+		routes *Bucket[route]
+	)
+
+	BeforeEach(func() {
+		l = New(&wire{}, &MemoryStore{})
+		routes = NewBucket[route](l, "routes")
+	})
+
+	It("编码和解码值", func() {
+		Expect(routes.Put("10.0.0.0/8", route{Peer: "a", Hops: 1})).To(Succeed())
+		Expect(routes.Put("10.1.0.0/16", route{Peer: "b", Hops: 2})).To(Succeed())
+
+		r, exists := routes.Get("10.0.0.0/8")
+		Expect(exists).To(BeTrue())
+		Expect(r).To(Equal(route{Peer: "a", Hops: 1}))
+		Expect(routes.List()).To(Equal(map[string]route{
+			"10.0.0.0/8":  {Peer: "a", Hops: 1},
+			"10.1.0.0/16": {Peer: "b", Hops: 2},
+		}))
+		Expect(routes.Exists(func(r route) bool { return r.Hops == 2 })).To(BeTrue())
+
+		routes.Delete("10.0.0.0/8")
+		_, exists = routes.Get("10.0.0.0/8")
+		Expect(exists).To(BeFalse())
+	})
+
+	It("校验写入和读取的值", func() {
+		Expect(routes.Put("10.0.0.0/8", route{})).ToNot(Succeed())
+		Expect(routes.Announce(context.Background(), time.Second, "10.0.0.0/8", route{})).ToNot(Succeed())
+		_, exists := l.GetKey("routes", "10.0.0.0/8")
+		Expect(exists).To(BeFalse())
+
+		// 其他写入者可能绕过校验
+		l.Add("routes", map[string]interface{}{"invalid": route{}, "garbage": "not a route"})
+		_, exists = routes.Get("invalid")
+		Expect(exists).To(BeFalse())
+		_, exists = routes.Get("garbage")
+		Expect(exists).To(BeFalse())
+		Expect(routes.List()).To(BeEmpty())
+	})
+
+	It("公告值直到账本中的值相同", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		Expect(routes.Persist(ctx, 10*time.Millisecond, time.Minute, "10.0.0.0/8", route{Peer: "a"})).To(Succeed())
+		Eventually(func() route {
+			r, _ := routes.Get("10.0.0.0/8")
+			return r
+		}).Should(Equal(route{Peer: "a"}))
+	})
+})
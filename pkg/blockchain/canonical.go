@@ -0,0 +1,180 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain
+
+import (
+	"bytes"
+	"encoding/base64"
+	"sort"
+	"strconv"
+	"unicode/utf8"
+)
+
+// canonicalEncoder 按照Block.canonical中的规则编码JSON，不依赖encoding/json，
+// 因此不同版本的Go工具链生成相同的字节
+type canonicalEncoder struct {
+	bytes.Buffer
+	html bool // 将<、>和&转义为\u003c、\u003e和\u0026
+}
+
+// hexDigits 是转义使用的小写十六进制数字
+const hexDigits = "0123456789abcdef"
+
+// str 编码字符串
+// 参数 s 为字符串
+func (e *canonicalEncoder) str(s string) {
+	e.WriteByte('"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		if c < utf8.RuneSelf {
+			switch {
+			case c == '"' || c == '\\':
+				e.WriteByte('\\')
+				e.WriteByte(c)
+			case c == '\b':
+				e.WriteString(`\b`)
+			case c == '\f':
+				e.WriteString(`\f`)
+			case c == '\n':
+				e.WriteString(`\n`)
+			case c == '\r':
+				e.WriteString(`\r`)
+			case c == '\t':
+				e.WriteString(`\t`)
+			case c < 0x20 || (e.html && (c == '<' || c == '>' || c == '&')):
+				e.WriteString(`\u00`)
+				e.WriteByte(hexDigits[c>>4])
+				e.WriteByte(hexDigits[c&0xf])
+			default:
+				e.WriteByte(c)
+			}
+			i++
+			continue
+		}
+
+		r, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case r == utf8.RuneError && size == 1:
+			e.WriteString(`\ufffd`)
+		case r == '\u2028':
+			e.WriteString(`\u2028`)
+		case r == '\u2029':
+			e.WriteString(`\u2029`)
+		default:
+			e.WriteString(s[i : i+size])
+		}
+		i += size
+	}
+	e.WriteByte('"')
+}
+
+// int 编码有符号整数
+// 参数 n 为整数
+func (e *canonicalEncoder) int(n int64) {
+	e.WriteString(strconv.FormatInt(n, 10))
+}
+
+// key 编码对象的键，first为false时先写入逗号
+// 参数 first 为是否是对象的第一个键，k 为键名
+func (e *canonicalEncoder) key(first bool, k string) {
+	if !first {
+		e.WriteByte(',')
+	}
+	e.str(k)
+	e.WriteByte(':')
+}
+
+// sortedKeys 返回按字节顺序排序的键
+func sortedKeys[T any](m map[string]T) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// storage 编码存储桶中的数据，空的存储桶被省略
+// 参数 s 为存储数据
+func (e *canonicalEncoder) storage(s map[string]map[string]Data) {
+	e.WriteByte('{')
+	first := true
+	for _, bucket := range sortedKeys(s) {
+		if len(s[bucket]) == 0 {
+			continue
+		}
+		e.key(first, bucket)
+		first = false
+		e.WriteByte('{')
+		for i, k := range sortedKeys(s[bucket]) {
+			e.key(i == 0, k)
+			e.str(string(s[bucket][k]))
+		}
+		e.WriteByte('}')
+	}
+	e.WriteByte('}')
+}
+
+// versions 编码存储桶中的版本信息，空的存储桶被省略
+// 参数 v 为版本信息
+func (e *canonicalEncoder) versions(v map[string]map[string]Version) {
+	e.WriteByte('{')
+	first := true
+	for _, bucket := range sortedKeys(v) {
+		if len(v[bucket]) == 0 {
+			continue
+		}
+		e.key(first, bucket)
+		first = false
+		e.WriteByte('{')
+		for i, k := range sortedKeys(v[bucket]) {
+			e.key(i == 0, k)
+			e.version(v[bucket][k])
+		}
+		e.WriteByte('}')
+	}
+	e.WriteByte('}')
+}
+
+// version 编码单个版本，零值字段被省略
+// 参数 v 为版本
+func (e *canonicalEncoder) version(v Version) {
+	e.WriteString(`{"Clock":{"Time":`)
+	e.int(v.Clock.Time)
+	e.WriteString(`,"Counter":`)
+	e.WriteString(strconv.FormatUint(uint64(v.Clock.Counter), 10))
+	e.WriteString(`,"Node":`)
+	e.str(v.Clock.Node)
+	e.WriteByte('}')
+	if v.Deleted {
+		e.WriteString(`,"Deleted":true`)
+	}
+	if v.Expires != 0 {
+		e.key(false, "Expires")
+		e.int(v.Expires)
+	}
+	if len(v.Signature) > 0 {
+		e.key(false, "Signature")
+		e.str(base64.StdEncoding.EncodeToString(v.Signature))
+	}
+	if v.Since != 0 {
+		e.key(false, "Since")
+		e.int(v.Since)
+	}
+	if v.After != 0 {
+		e.key(false, "After")
+		e.int(v.After)
+	}
+	e.WriteByte('}')
+}
@@ -0,0 +1,97 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain
+
+import "time"
+
+// Clock 是混合逻辑时钟（HLC），为所有节点的写入提供一致的全序
+// 物理时间相同时比较逻辑计数器，仍然相同时比较写入者标识
+type Clock struct {
+	Time    int64  // 物理时间（Unix纳秒）
+	Counter uint32 // 逻辑计数器
+	Node    string // 写入者标识（对等节点ID）
+}
+
+// Less 如果时钟c早于o则返回true
+func (c Clock) Less(o Clock) bool {
+	if c.Time != o.Time {
+		return c.Time < o.Time
+	}
+	if c.Counter != o.Counter {
+		return c.Counter < o.Counter
+	}
+	return c.Node < o.Node
+}
+
+// IsZero 如果时钟从未被设置则返回true
+func (c Clock) IsZero() bool {
+	return c == Clock{}
+}
+
+// Version 记录键的最后一次写入及其写入者的签名
+// 删除的键保留一个墓碑，以防止较旧的写入使其复活
+type Version struct {
+	Clock   Clock // 写入时钟，Node为写入者的对等节点ID
+	Deleted bool  `json:",omitempty"` // 是否为墓碑
+
+	Expires   int64  `json:",omitempty"` // 过期时间（Unix纳秒），0表示永不过期
+	Signature []byte `json:",omitempty"` // 写入者对该次写入的签名
+
+	// 拥有者策略下写入者对键的所有权，见lifetimeWins
+	Since int64 `json:",omitempty"` // 所有权开始的时间
+	After int64 `json:",omitempty"` // 所有权之前的墓碑的时间
+}
+
+// operation 返回产生该版本的写入操作
+// 参数 bucket 为存储桶名称，key 为键名，value 为键的值，墓碑没有值
+func (v Version) operation(bucket, key string, value Data) Operation {
+	if v.Deleted {
+		return Operation{Type: OpDelete, Bucket: bucket, Key: key, Clock: v.Clock, Signature: v.Signature}
+	}
+	return Operation{Type: OpSet, Bucket: bucket, Key: key, Value: value, Clock: v.Clock, Expires: v.Expires, Signature: v.Signature, Since: v.Since, After: v.After}
+}
+
+// Expired 如果键在时间now（Unix纳秒）已经过期则返回true
+func (v Version) Expired(now int64) bool {
+	return v.Expires != 0 && v.Expires <= now
+}
+
+// hlc 是本地的混合逻辑时钟
+type hlc struct {
+	last Clock
+}
+
+// tick 生成一个晚于所有已生成和已观察到的时钟的新时钟
+// 参数 node 为本地写入者标识
+func (h *hlc) tick(node string) Clock {
+	now := time.Now().UnixNano()
+	if now > h.last.Time {
+		h.last = Clock{Time: now}
+	} else {
+		h.last.Counter++
+	}
+	h.last.Node = node
+	return h.last
+}
+
+// observe 将远程时钟并入本地时钟，使之后的本地写入晚于该远程写入
+// 参数 c 为观察到的远程时钟
+func (h *hlc) observe(c Clock) {
+	switch {
+	case c.Time > h.last.Time:
+		h.last.Time, h.last.Counter = c.Time, c.Counter
+	case c.Time == h.last.Time && c.Counter > h.last.Counter:
+		h.last.Counter = c.Counter
+	}
+}
@@ -0,0 +1,218 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"log"
+	"sync"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/pkg/errors"
+)
+
+// ackKey 标识一次写入：存储桶、键和写入时钟
+type ackKey struct {
+	Bucket string
+	Key    string
+	Clock  Clock
+}
+
+// Ack 是对等节点对持有某次写入的确认，由确认者使用自己的私钥签名
+// 确认包含写入的值的摘要，以及确认者链上包含该写入的区块，确认者不能否认自己的区块中有这次写入
+type Ack struct {
+	Bucket string // 存储桶名称
+	Key    string // 键名
+	Clock  Clock  // 被确认的写入时钟
+	Digest string // 被确认的写入的值的摘要，见valueDigest
+	Index  int    // 确认者包含该写入的区块索引
+	Hash   string // 确认者包含该写入的区块哈希
+	Peer   string // 确认者的对等节点ID
+
+	Signature []byte `json:",omitempty"` // 确认者的签名
+}
+
+// payload 返回确认中被签名的字节
+func (a Ack) payload() []byte {
+	a.Signature = nil
+	b, _ := json.Marshal(a)
+	return b
+}
+
+// valueDigest 返回写入的值的SHA256摘要
+// 参数 v 为写入的值
+func valueDigest(v Data) string {
+	h := sha256.Sum256([]byte(v))
+	return hex.EncodeToString(h[:])
+}
+
+// Verify 使用确认者对等节点ID中的公钥验证确认的签名
+func (a Ack) Verify() error {
+	if len(a.Signature) == 0 {
+		return errors.Errorf("来自 '%s' 的确认缺少签名", a.Peer)
+	}
+
+	id, err := peer.Decode(a.Peer)
+	if err != nil {
+		return errors.Wrapf(err, "确认者 '%s' 无效", a.Peer)
+	}
+
+	pub, err := id.ExtractPublicKey()
+	if err != nil {
+		return errors.Wrapf(err, "无法从确认者 '%s' 提取公钥", a.Peer)
+	}
+
+	ok, err := pub.Verify(a.payload(), a.Signature)
+	if err != nil {
+		return errors.Wrapf(err, "验证来自 '%s' 的确认失败", a.Peer)
+	}
+	if !ok {
+		return errors.Errorf("来自 '%s' 的确认签名无效", a.Peer)
+	}
+	return nil
+}
+
+// confirmation 收集对一次写入的确认
+type confirmation struct {
+	sync.Mutex
+	quorum int
+	digest string         // 写入的值的摘要
+	acks   map[string]Ack // 确认者的对等节点ID到确认
+	done   chan struct{}
+}
+
+// add 记录确认，达到法定数量时关闭done
+// 参数 a 为已经验证的确认
+func (c *confirmation) add(a Ack) {
+	c.Lock()
+	defer c.Unlock()
+	if _, exists := c.acks[a.Peer]; exists || len(c.acks) >= c.quorum {
+		return
+	}
+	c.acks[a.Peer] = a
+	if len(c.acks) == c.quorum {
+		close(c.done)
+	}
+}
+
+// count 返回已经确认的不同对等节点数量
+func (c *confirmation) count() int {
+	c.Lock()
+	defer c.Unlock()
+	return len(c.acks)
+}
+
+// list 返回收到的确认
+func (c *confirmation) list() []Ack {
+	c.Lock()
+	defer c.Unlock()
+	acks := []Ack{}
+	for _, a := range c.acks {
+		acks = append(acks, a)
+	}
+	return acks
+}
+
+// ownWrite 返回本地写入者对键的当前写入，调用者必须持有锁
+// 参数 bucket 为存储桶名称，key 为键名
+func (l *Ledger) ownWrite(bucket, key string) (Operation, error) {
+	last := l.blockchain.Last()
+	v, exists := last.Versions[bucket][key]
+	if !exists || v.Deleted || v.Clock.Node != l.id {
+		return Operation{}, errors.Errorf("存储桶 '%s' 中的键 '%s' 没有被写入", bucket, key)
+	}
+	return v.operation(bucket, key, last.Storage[bucket][key]), nil
+}
+
+// expectAcks 开始收集对写入的确认
+// 参数 op 为写入操作，quorum 为需要确认的对等节点数量
+func (l *Ledger) expectAcks(op Operation, quorum int) *confirmation {
+	c := &confirmation{quorum: quorum, digest: valueDigest(op.Value), acks: map[string]Ack{}, done: make(chan struct{})}
+	l.confirmationsMu.Lock()
+	defer l.confirmationsMu.Unlock()
+	l.confirmations[ackKey{Bucket: op.Bucket, Key: op.Key, Clock: op.Clock}] = c
+	return c
+}
+
+// forgetAcks 停止收集对写入的确认
+// 参数 op 为写入操作
+func (l *Ledger) forgetAcks(op Operation) {
+	l.confirmationsMu.Lock()
+	defer l.confirmationsMu.Unlock()
+	delete(l.confirmations, ackKey{Bucket: op.Bucket, Key: op.Key, Clock: op.Clock})
+}
+
+// receiveConfirm 合并确认请求中的写入，并确认本地持有的写入以及包含它的最后一个区块
+// 已经被更新的写入覆盖的写入不会被确认
+// 参数 d 为请求确认的增量
+func (l *Ledger) receiveConfirm(d Delta) error {
+	if err := l.receiveDelta(d); err != nil {
+		return err
+	}
+
+	l.Lock()
+	last := l.blockchain.Last()
+	key, id := l.key, l.id
+	l.Unlock()
+
+	for _, op := range d.Ops {
+		if op.Signer() == id {
+			continue
+		}
+		if v, exists := last.Versions[op.Bucket][op.Key]; !exists || v.Clock != op.Clock {
+			continue
+		}
+
+		ack := Ack{
+			Bucket: op.Bucket,
+			Key:    op.Key,
+			Clock:  op.Clock,
+			Digest: valueDigest(last.Storage[op.Bucket][op.Key]),
+			Index:  last.Index,
+			Hash:   last.Hash,
+			Peer:   id,
+		}
+		sig, err := key.Sign(ack.payload())
+		if err != nil {
+			log.Println(errors.Wrap(err, "签名确认失败"))
+			continue
+		}
+		ack.Signature = sig
+		l.publish(ledgerMessage{Type: AckMessage, Ack: &ack})
+	}
+	return nil
+}
+
+// receiveAck 记录对本地等待确认的写入的确认，其他确认被忽略
+// 值的摘要与写入不同或者没有指明区块的确认被拒绝
+// 参数 a 为接收到的确认
+func (l *Ledger) receiveAck(a Ack) error {
+	l.confirmationsMu.Lock()
+	c, exists := l.confirmations[ackKey{Bucket: a.Bucket, Key: a.Key, Clock: a.Clock}]
+	l.confirmationsMu.Unlock()
+	if !exists || a.Peer == a.Clock.Node {
+		return nil
+	}
+
+	if err := a.Verify(); err != nil {
+		return errors.Wrap(err, "拒绝确认")
+	}
+	if a.Digest != c.digest || a.Hash == "" {
+		return errors.Errorf("拒绝来自 '%s' 的确认: 没有确认持有相同的值的区块", a.Peer)
+	}
+	c.add(a)
+	return nil
+}
@@ -0,0 +1,316 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain
+
+import (
+	"log"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/purpose168/edgevpn/pkg/protocol"
+)
+
+// DefaultTombstoneRetention 是默认的墓碑保留时间，超过后墓碑在区块创建时被回收。
+// 回收墓碑的区块记录被回收的最晚时钟（Horizon），之后不早于它的写入才会被接受，
+// 离线超过保留时间的节点带回的旧键会被拒绝，而不是使已删除的键复活
+const DefaultTombstoneRetention = 24 * time.Hour
+
+// OpType 增量操作类型
+type OpType string
+
+// 增量操作类型常量定义
+const (
+	OpSet    OpType = "set"    // 设置键值
+	OpDelete OpType = "delete" // 删除键（写入墓碑）
+)
+
+// Operation 表示对账本存储的单次写入操作
+type Operation struct {
+	Type   OpType // 操作类型
+	Bucket string // 存储桶名称
+	Key    string // 键名
+	Value  Data   `json:",omitempty"` // 值
+	Clock  Clock  // 写入时钟
+
+	Expires   int64  `json:",omitempty"` // 过期时间（Unix纳秒），0表示永不过期
+	Signature []byte `json:",omitempty"` // 写入者对操作的签名
+
+	// 拥有者策略下写入者对键的所有权，见lifetimeWins
+	Since int64 `json:",omitempty"` // 所有权开始的时间
+	After int64 `json:",omitempty"` // 所有权之前的墓碑的时间
+}
+
+// Rules 是生成区块时所有节点必须一致的规则
+type Rules struct {
+	Retention time.Duration // 墓碑保留时间
+	Admins    []string      // 账本管理员的对等节点ID
+}
+
+// Delta 表示一次写入产生的增量，引用其父区块的哈希
+// 接收方将操作合并到父区块上即可重建出完全相同的新区块
+type Delta struct {
+	Index     int         // 新区块索引
+	Timestamp string      // 新区块时间戳
+	PrevHash  string      // 父区块哈希
+	Hash      string      // 新区块哈希
+	Ops       []Operation // 操作列表
+}
+
+// state 是区块存储及其版本信息的可变副本
+type state struct {
+	storage  map[string]map[string]Data
+	versions map[string]map[string]Version
+	horizon  int64 // 已回收的墓碑中最晚的时钟时间
+}
+
+// newState 复制区块的存储和版本信息
+// 参数 b 为源区块，不会被修改
+func newState(b Block) *state {
+	versions := map[string]map[string]Version{}
+	for bucket, keys := range b.Versions {
+		versions[bucket] = map[string]Version{}
+		for k, v := range keys {
+			versions[bucket][k] = v
+		}
+	}
+	return &state{storage: buckets(b.Storage).copy(), versions: versions, horizon: b.Horizon}
+}
+
+// version 返回键的当前版本。没有版本信息的旧数据视为零时钟
+func (s *state) version(bucket, key string) (Version, bool) {
+	if v, exists := s.versions[bucket][key]; exists {
+		return v, true
+	}
+	_, exists := s.storage[bucket][key]
+	return Version{}, exists
+}
+
+// supersedes 如果操作会取代键的当前版本则返回true
+// 时钟晚于当前版本（包括墓碑）的操作取代它；拥有者策略下，所有权更早的写入即使时钟较早也取代其他写入者的版本。
+// 早于已回收墓碑的新键不会被接受
+// 参数 op 为要合并的操作，admins 为管理员的对等节点ID列表
+func (s *state) supersedes(op Operation, admins []string) bool {
+	current, exists := s.version(op.Bucket, op.Key)
+	switch {
+	case !exists:
+		return !s.stale(op)
+	case current.Clock.Less(op.Clock):
+		return true
+	case op.Type != OpSet || current.Deleted || current.Clock.Node == "" || current.Clock.Node == op.Signer():
+		return false
+	}
+	p, _ := s.policyAt(op.Bucket, op.Clock, admins)
+	return p.Owner && lifetimeWins(op, current)
+}
+
+// stale 如果操作写入的键没有任何版本，且时钟不晚于已回收的墓碑，则返回true。
+// 这样的操作可能是一个墓碑已经被回收的键，合并它会使已删除的键复活
+// 参数 op 为要检查的操作
+func (s *state) stale(op Operation) bool {
+	_, exists := s.version(op.Bucket, op.Key)
+	return !exists && s.horizon > 0 && op.Clock.Time <= s.horizon
+}
+
+// merge 按照最后写入者获胜的规则合并单个操作，只有取代当前版本的操作才会生效（见supersedes），返回状态是否发生变化
+// 参数 op 为要合并的操作，admins 为管理员的对等节点ID列表
+func (s *state) merge(op Operation, admins []string) bool {
+	if !s.supersedes(op, admins) {
+		return false
+	}
+
+	if _, exists := s.versions[op.Bucket]; !exists {
+		s.versions[op.Bucket] = map[string]Version{}
+	}
+
+	switch op.Type {
+	case OpSet:
+		if _, exists := s.storage[op.Bucket]; !exists {
+			s.storage[op.Bucket] = map[string]Data{}
+		}
+		s.storage[op.Bucket][op.Key] = op.Value
+		s.versions[op.Bucket][op.Key] = Version{Clock: op.Clock, Expires: op.Expires, Signature: op.Signature, Since: op.Since, After: op.After}
+	case OpDelete:
+		if _, exists := s.storage[op.Bucket]; exists {
+			delete(s.storage[op.Bucket], op.Key)
+			if len(s.storage[op.Bucket]) == 0 {
+				delete(s.storage, op.Bucket)
+			}
+		}
+		s.versions[op.Bucket][op.Key] = Version{Clock: op.Clock, Deleted: true, Signature: op.Signature}
+	default:
+		return false
+	}
+	return true
+}
+
+// forget 删除对方已经回收的本地键，并将本地的回收界限提前到对方的界限。
+// 对方区块中没有、时钟不晚于对方界限的键已经被对方删除并回收了墓碑。
+// 完整区块包含所有存储桶，部分快照只检查其中出现的存储桶；没有版本信息的旧数据不会被删除，
+// 返回状态是否发生变化
+// 参数 b 为对方的区块，full 为b是否是完整区块
+func (s *state) forget(b Block, full bool) (changed bool) {
+	if b.Horizon <= s.horizon {
+		return false
+	}
+
+	for bucket := range s.versions {
+		_, hasStorage := b.Storage[bucket]
+		_, hasVersions := b.Versions[bucket]
+		if !full && !hasStorage && !hasVersions {
+			continue
+		}
+		for k, v := range s.versions[bucket] {
+			if _, exists := b.Versions[bucket][k]; exists || v.Clock.Time > b.Horizon {
+				continue
+			}
+			delete(s.storage[bucket], k)
+			if len(s.storage[bucket]) == 0 {
+				delete(s.storage, bucket)
+			}
+			delete(s.versions[bucket], k)
+		}
+		if len(s.versions[bucket]) == 0 {
+			delete(s.versions, bucket)
+		}
+	}
+	s.horizon = b.Horizon
+	return true
+}
+
+// expire 回收在时间t之前过期的键和超过保留时间的墓碑，返回是否回收了任何内容
+// 参数 t 为区块时间，retention 为墓碑保留时间
+func (s *state) expire(t time.Time, retention time.Duration) (changed bool) {
+	if t.IsZero() {
+		return false
+	}
+	now := t.UnixNano()
+	oldest := t.Add(-retention).UnixNano()
+
+	for bucket, keys := range s.versions {
+		for k, v := range keys {
+			switch {
+			case v.Deleted && v.Clock.Time < oldest:
+				if v.Clock.Time > s.horizon {
+					s.horizon = v.Clock.Time
+				}
+			case !v.Deleted && v.Expired(now):
+				delete(s.storage[bucket], k)
+				if len(s.storage[bucket]) == 0 {
+					delete(s.storage, bucket)
+				}
+			default:
+				continue
+			}
+			delete(keys, k)
+			changed = true
+		}
+		if len(keys) == 0 {
+			delete(s.versions, bucket)
+		}
+	}
+	return
+}
+
+// operations 将区块的全部内容（包括墓碑）连同写入者的签名表示为操作列表
+// 没有版本信息的旧数据没有签名，对等节点会拒绝它们，见Ledger.ResignLegacy
+func (b Block) operations() []Operation {
+	ops := []Operation{}
+	for bucket, keys := range b.Storage {
+		for k, v := range keys {
+			ops = append(ops, b.Versions[bucket][k].operation(bucket, k, v))
+		}
+	}
+	for bucket, keys := range b.Versions {
+		for k, v := range keys {
+			if v.Deleted {
+				ops = append(ops, v.operation(bucket, k, ""))
+			}
+		}
+	}
+	return ops
+}
+
+// next 在父区块之上合并操作，并以区块时间回收过期的键，生成新区块
+// 违反访问控制策略的操作被丢弃并记录日志，策略或信任区域变化之后重新检查已有的写入。
+// 相同的父区块、时间戳、操作和规则总是生成相同的区块。如果状态没有变化，则返回false
+// 参数 timestamp 为新区块时间戳，ops 为操作列表，r 为规则
+func (oldBlock Block) next(timestamp string, ops []Operation, r Rules) (Block, bool) {
+	return oldBlock.build(newState(oldBlock), timestamp, ops, r)
+}
+
+// build 与next相同，但是从父区块的一个已修改的副本开始
+// 参数 s 为父区块状态的副本，timestamp 为新区块时间戳，ops 为操作列表，r 为规则
+func (oldBlock Block) build(s *state, timestamp string, ops []Operation, r Rules) (Block, bool) {
+	changed, acl := false, false
+	for _, op := range ops {
+		if !s.supersedes(op, r.Admins) {
+			continue
+		}
+		if err := s.authorize(op, r.Admins); err != nil {
+			log.Println(errors.Wrap(err, "丢弃写入"))
+			continue
+		}
+		if s.merge(op, r.Admins) {
+			changed = true
+			acl = acl || op.Bucket == protocol.ACLLedgerKey || op.Bucket == protocol.TrustZoneKey
+		}
+	}
+	if acl && s.revalidate(r.Admins) {
+		changed = true
+	}
+	// 使用父区块和新区块中较晚的时间回收，延迟到达的旧增量不会使过期的键复活
+	t := blockTime(timestamp)
+	if parent := blockTime(oldBlock.Timestamp); parent.After(t) {
+		t = parent
+	}
+	if s.expire(t, r.Retention) {
+		changed = true
+	}
+
+	newBlock := Block{
+		Format:    BlockFormat,
+		Index:     oldBlock.Index + 1,
+		Timestamp: timestamp,
+		Storage:   s.storage,
+		Versions:  s.versions,
+		Horizon:   s.horizon,
+		PrevHash:  oldBlock.Hash,
+	}
+	newBlock.Hash = newBlock.Checksum()
+	return newBlock, changed
+}
+
+// NewDelta 将操作合并到区块上，返回新区块和对应的增量
+// 参数 ops 为操作列表，r 为规则
+func (oldBlock Block) NewDelta(ops []Operation, r Rules) (Block, Delta) {
+	newBlock, _ := oldBlock.next(now(), ops, r)
+
+	return newBlock, Delta{
+		Index:     newBlock.Index,
+		Timestamp: newBlock.Timestamp,
+		PrevHash:  newBlock.PrevHash,
+		Hash:      newBlock.Hash,
+		Ops:       ops,
+	}
+}
+
+// Merge 将增量合并到任意父区块上
+// 如果父区块正是增量引用的区块，结果与写入者的区块完全相同；
+// 否则按照最后写入者获胜的规则合并，所有节点最终收敛到相同的状态。
+// 如果增量中没有任何操作生效（例如已经合并过），则返回false
+// 网络中的所有节点必须使用相同的规则
+// 参数 parent 为父区块，r 为规则
+func (d Delta) Merge(parent Block, r Rules) (Block, bool) {
+	return parent.next(d.Timestamp, d.Ops, r)
+}
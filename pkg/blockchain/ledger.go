@@ -17,16 +17,21 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/rand"
 	"encoding/json"
 	"io"
 	"io/ioutil"
 	"log"
+	mrand "math/rand"
 	"sync"
 	"time"
 
 	"github.com/purpose168/edgevpn/pkg/hub"
+	"github.com/purpose168/edgevpn/pkg/protocol"
 	"github.com/purpose168/edgevpn/pkg/utils"
 
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/pkg/errors"
 )
 
@@ -36,8 +41,33 @@ type Ledger struct {
 	blockchain Store // 区块链存储
 
 	channel io.Writer // 写入通道
+
+	key   crypto.PrivKey // 本地写入者的签名私钥
+	id    string         // 本地写入者的对等节点ID
+	clock hlc            // 混合逻辑时钟
+
+	rules Rules // 生成区块的规则：管理员和墓碑保留时间
+
+	watchersMu sync.Mutex            // 保护订阅者列表
+	watchers   map[*watcher]struct{} // 键变更的订阅者
+
+	lastSnapshot, lastBehind time.Time   // 最近一次发送快照和落后报告的时间
+	pendingSnapshot          *time.Timer // 等待发送的快照，看到其他对等节点的快照时取消
+
+	puller func(peer string) error // 直接从对等节点拉取状态，为空时通过广播请求快照
+
+	confirmationsMu sync.Mutex               // 保护等待确认的写入
+	confirmations   map[ackKey]*confirmation // 等待对等节点确认的写入
 }
 
+// syncThrottle 是发送完整快照和落后报告的最小间隔
+// 多个对等节点同时落后时，一次广播的快照即可满足所有请求
+const syncThrottle = time.Second
+
+// snapshotBackoff 是响应落后报告之前的最长随机等待时间。
+// 等待期间在房间中看到其他对等节点的快照则不再发送，因此通常只有一个对等节点响应
+const snapshotBackoff = 2 * time.Second
+
 // Store 存储接口
 type Store interface {
 	Add(Block)   // 添加区块
@@ -45,25 +75,100 @@ type Store interface {
 	Last() Block // 返回最后区块
 }
 
+// HistoryStore 是可以检索历史区块的存储接口
+type HistoryStore interface {
+	Store
+	Get(index int) (Block, bool)            // 返回指定索引的区块
+	Range(from, to int, f func(Block) bool) // 按顺序遍历索引范围内的区块，f返回false时停止
+}
+
 // New 创建新的账本，写入到指定的writer
 // 参数 w 为写入器，s 为存储器
+// 在调用SetIdentity之前，本地写入使用随机生成的临时身份签名
 func New(w io.Writer, s Store) *Ledger {
-	c := &Ledger{channel: w, blockchain: s}
+	c := &Ledger{channel: w, blockchain: s, rules: Rules{Retention: DefaultTombstoneRetention}, watchers: map[*watcher]struct{}{}, confirmations: map[ackKey]*confirmation{}}
 	if s.Len() == 0 {
 		c.newGenesis()
 	}
+
+	key, _, err := crypto.GenerateEd25519Key(rand.Reader)
+	if err != nil {
+		panic(err)
+	}
+	if err := c.SetIdentity(key); err != nil {
+		panic(err)
+	}
 	return c
 }
 
+// SetIdentity 设置本地写入者的身份，通常为节点的libp2p私钥
+// 每次写入都使用该私钥签名，并在区块中记录对应的对等节点ID作为写入者
+// 参数 k 为写入者的私钥
+func (l *Ledger) SetIdentity(k crypto.PrivKey) error {
+	id, err := peer.IDFromPrivateKey(k)
+	if err != nil {
+		return errors.Wrap(err, "无法从私钥获取对等节点ID")
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	l.key = k
+	l.id = id.String()
+	return nil
+}
+
+// SetAdmins 设置账本管理员的对等节点ID
+// 管理员不受访问控制策略的限制，只有管理员可以修改策略，没有管理员时策略不能被修改，只使用默认策略。
+// 网络中的所有节点必须配置相同的管理员，因此管理员应该来自网络配置
+// 参数 ids 为管理员的对等节点ID列表
+func (l *Ledger) SetAdmins(ids ...string) {
+	l.Lock()
+	defer l.Unlock()
+	l.rules.Admins = ids
+}
+
+// SetTombstoneRetention 设置墓碑保留时间，默认为DefaultTombstoneRetention
+// 网络中的所有节点应该使用相同的保留时间，并且它应该长于节点可能离线的最长时间：
+// 离线更久的节点带回的已删除键会被拒绝，节点自己的这些键会在同步时被删除
+// 参数 d 为保留时间，小于等于0时使用默认值
+func (l *Ledger) SetTombstoneRetention(d time.Duration) {
+	if d <= 0 {
+		d = DefaultTombstoneRetention
+	}
+	l.Lock()
+	defer l.Unlock()
+	l.rules.Retention = d
+}
+
+// SetPolicy 设置存储桶的写入策略，策略对时钟晚于它的写入生效
+// 每次设置都写入一个新的策略修订，之前的写入仍然按照之前的修订判断
+// 参数 bucket 为存储桶名称，p 为写入策略
+func (l *Ledger) SetPolicy(bucket string, p Policy) {
+	l.Lock()
+	clock := l.clock.tick(l.id)
+	l.Unlock()
+
+	dat, _ := json.Marshal(p)
+	l.commit([]Operation{{Type: OpSet, Bucket: protocol.ACLLedgerKey, Key: policyKey(bucket, clock), Value: Data(string(dat)), Clock: clock}})
+}
+
+// Policy 返回存储桶当前的写入策略，包括默认策略
+// 参数 bucket 为存储桶名称
+func (l *Ledger) Policy(bucket string) (Policy, bool) {
+	l.Lock()
+	defer l.Unlock()
+	return newState(l.blockchain.Last()).policy(bucket, l.rules.Admins)
+}
+
 // newGenesis 创建创世区块
 func (l *Ledger) newGenesis() {
-	t := time.Now()
-	genesisBlock := Block{}
-	genesisBlock = Block{0, t.String(), map[string]map[string]Data{}, genesisBlock.Checksum(), ""}
+	genesisBlock := Block{Format: BlockFormat}
+	genesisBlock = Block{Format: BlockFormat, Index: 0, Timestamp: now(), Storage: map[string]map[string]Data{}, Hash: genesisBlock.Checksum()}
 	l.blockchain.Add(genesisBlock)
 }
 
-// Syncronizer 启动一个goroutine，定期将区块链写入通道
+// Syncronizer 启动一个goroutine，定期公告链头（索引、哈希和状态摘要）
+// 状态不同的对等节点收到公告后会请求完整快照
 // 参数 ctx 为上下文，t 为时间间隔
 func (l *Ledger) Syncronizer(ctx context.Context, t time.Duration) {
 	go func() {
@@ -73,15 +178,11 @@ func (l *Ledger) Syncronizer(ctx context.Context, t time.Duration) {
 			select {
 			case <-t.C:
 				l.Lock()
-
-				bytes, err := json.Marshal(l.blockchain.Last())
-				if err != nil {
-					log.Println(err)
-				}
-
-				l.channel.Write(compress(bytes).Bytes())
-
+				l.expire()
+				last := l.blockchain.Last()
 				l.Unlock()
+
+				l.publish(ledgerMessage{Type: HeadMessage, Index: last.Index, Hash: last.Hash, Digest: last.Digest()})
 			case <-ctx.Done():
 				return
 			}
@@ -89,6 +190,18 @@ func (l *Ledger) Syncronizer(ctx context.Context, t time.Duration) {
 	}()
 }
 
+// publish 编码账本消息并写入通道
+// 参数 m 为要发送的消息
+func (l *Ledger) publish(m ledgerMessage) {
+	b, err := m.encode()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	l.channel.Write(b)
+}
+
 // compress 压缩字节数据
 // 参数 b 为要压缩的字节数据
 func compress(b []byte) *bytes.Buffer {
@@ -115,29 +228,203 @@ func deCompress(b []byte) (*bytes.Buffer, error) {
 }
 
 // Update 从消息更新区块链
+// 接受增量、链头公告、落后报告和完整快照
 // 参数 f 为账本，h 为消息，c 为消息通道
 func (l *Ledger) Update(f *Ledger, h *hub.Message, c chan *hub.Message) (err error) {
-	block := &Block{}
-
-	b, err := deCompress([]byte(h.Message))
+	m, err := decodeMessage([]byte(h.Message))
 	if err != nil {
-		err = errors.Wrap(err, "解压失败")
 		return
 	}
 
-	err = json.Unmarshal(b.Bytes(), block)
-	if err != nil {
-		err = errors.Wrap(err, "解析区块链数据失败")
+	switch m.Type {
+	case DeltaMessage:
+		if m.Delta == nil {
+			return errors.New("增量消息为空")
+		}
+		err = l.receiveDelta(*m.Delta)
+	case ConfirmMessage:
+		if m.Delta == nil {
+			return errors.New("确认请求为空")
+		}
+		err = l.receiveConfirm(*m.Delta)
+	case AckMessage:
+		if m.Ack == nil {
+			return errors.New("确认消息为空")
+		}
+		err = l.receiveAck(*m.Ack)
+	case HeadMessage:
+		l.receiveHead(h.SenderID, m.Digest)
+	case BehindMessage:
+		l.receiveBehind(m.Digest)
+	case SnapshotMessage:
+		if m.Block == nil {
+			return errors.New("快照消息为空")
+		}
+		err = l.receiveSnapshot(*m.Block)
+	default:
+		err = errors.Errorf("未知的账本消息类型 '%s'", m.Type)
+	}
+
+	return
+}
+
+// receiveDelta 将增量合并到最后一个区块
+// 并发写入按照键的时钟决定获胜者，因此与到达顺序无关。
+// 任何一个操作的签名无效都会拒绝整个增量
+// 参数 d 为接收到的增量
+func (l *Ledger) receiveDelta(d Delta) error {
+	for _, op := range d.Ops {
+		if err := op.Verify(); err != nil {
+			return errors.Wrap(err, "拒绝增量")
+		}
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	for _, op := range d.Ops {
+		l.clock.observe(op.Clock)
+	}
+
+	// 违反访问控制策略的操作被丢弃，其余的操作仍然合并
+	if newBlock, changed := d.Merge(l.blockchain.Last(), l.rules); changed {
+		l.apply(newBlock)
+	}
+	return nil
+}
+
+// receiveHead 处理链头公告，如果对方的状态与本地不同则直接从对方拉取不同的存储桶，
+// 无法拉取时请求完整快照
+// 参数 sender 为公告者的对等节点ID，digest 为对方的状态摘要
+func (l *Ledger) receiveHead(sender, digest string) {
+	if digest == l.LastBlock().Digest() {
+		return
+	}
+
+	l.Lock()
+	pull := l.puller
+	l.Unlock()
+	if pull == nil || sender == "" {
+		l.requestSnapshot()
 		return
 	}
 
+	go func() {
+		if err := pull(sender); err != nil {
+			log.Println(errors.Wrapf(err, "无法从 %s 拉取账本", sender))
+			l.requestSnapshot()
+		}
+	}()
+}
+
+// receiveBehind 处理快照请求，如果对方的状态与本地不同则在随机等待之后广播完整快照
+// 参数 digest 为请求者的状态摘要
+func (l *Ledger) receiveBehind(digest string) {
 	l.Lock()
-	if block.Index > l.blockchain.Len() {
-		l.blockchain.Add(*block)
+	defer l.Unlock()
+	if digest == l.blockchain.Last().Digest() || l.pendingSnapshot != nil || time.Since(l.lastSnapshot) < syncThrottle {
+		return
 	}
+	l.pendingSnapshot = time.AfterFunc(time.Duration(mrand.Int63n(int64(snapshotBackoff))), l.sendSnapshot)
+}
+
+// sendSnapshot 广播完整快照，除非等待期间已经看到其他对等节点的快照
+func (l *Ledger) sendSnapshot() {
+	l.Lock()
+	if l.pendingSnapshot == nil {
+		l.Unlock()
+		return
+	}
+	l.pendingSnapshot = nil
+	l.lastSnapshot = time.Now()
+	last := l.blockchain.Last()
 	l.Unlock()
 
-	return
+	l.publish(ledgerMessage{Type: SnapshotMessage, Block: &last})
+}
+
+// receiveSnapshot 验证完整快照的哈希并将其合并到本地状态，
+// 合并之后本地状态与快照相同时取消等待发送的快照
+// 参数 block 为接收到的区块
+func (l *Ledger) receiveSnapshot(block Block) error {
+	if block.Checksum() != block.Hash {
+		return errors.New("快照区块哈希不匹配")
+	}
+	err := l.Merge(block)
+
+	// 其他对等节点已经广播了与本地相同的状态，不需要再响应落后报告
+	l.Lock()
+	if l.pendingSnapshot != nil && l.blockchain.Last().Digest() == block.Digest() {
+		l.pendingSnapshot.Stop()
+		l.pendingSnapshot = nil
+	}
+	l.Unlock()
+	return err
+}
+
+// Merge 将区块中的每个键（包括墓碑）合并到本地状态，区块可以只包含部分存储桶
+// 只有会覆盖本地版本的键才需要验证签名，签名无效的键被丢弃，其余的键仍然合并。
+// 早于本地已回收墓碑的未知键被丢弃；如果对方回收了更晚的墓碑，本地在对方区块中已经不存在的旧键被删除
+// 参数 block 为要合并的区块
+func (l *Ledger) Merge(block Block) error {
+	l.Lock()
+	defer l.Unlock()
+
+	// 正常的回收界限至少比对方的区块时间早一个保留时间，远远晚于它的界限会拒绝所有写入
+	if block.Horizon > time.Now().Add(-l.rules.Retention/2).UnixNano() {
+		log.Printf("忽略快照中晚于保留时间的回收界限 %d", block.Horizon)
+		block.Horizon = 0
+	}
+
+	last := l.blockchain.Last()
+	current := newState(last)
+	// 部分快照没有区块哈希，哈希有效的是完整区块
+	forgot := current.forget(block, block.Hash != "" && block.Checksum() == block.Hash)
+
+	ops := []Operation{}
+	rejected, stale := 0, 0
+	var lastErr error
+	for _, op := range block.operations() {
+		if !current.supersedes(op, l.rules.Admins) {
+			if current.stale(op) {
+				stale++
+			}
+			continue
+		}
+		if err := op.Verify(); err != nil {
+			rejected++
+			lastErr = err
+			continue
+		}
+		l.clock.observe(op.Clock)
+		ops = append(ops, op)
+	}
+
+	if newBlock, changed := last.build(current, now(), ops, l.rules); changed || forgot {
+		l.apply(newBlock)
+	}
+
+	if stale > 0 {
+		log.Printf("丢弃快照中 %d 个早于已回收墓碑的键", stale)
+	}
+	if rejected > 0 {
+		return errors.Wrapf(lastErr, "快照中有 %d 个键的签名无效", rejected)
+	}
+	return nil
+}
+
+// requestSnapshot 报告本地状态不同，请求对等节点发送完整快照
+func (l *Ledger) requestSnapshot() {
+	l.Lock()
+	if time.Since(l.lastBehind) < syncThrottle {
+		l.Unlock()
+		return
+	}
+	l.lastBehind = time.Now()
+	last := l.blockchain.Last()
+	l.Unlock()
+
+	l.publish(ledgerMessage{Type: BehindMessage, Index: last.Index, Hash: last.Hash, Digest: last.Digest()})
 }
 
 // Announce 持续异步更新数据到区块链。
@@ -146,7 +433,12 @@ func (l *Ledger) Update(f *Ledger, h *hub.Message, c chan *hub.Message) (err err
 // 参数 ctx 为上下文，d 为时间间隔，async 为异步函数
 func (l *Ledger) Announce(ctx context.Context, d time.Duration, async func()) {
 	go func() {
-		t := utils.NewBackoffTicker(utils.BackoffMaxInterval(d))
+		// 初始间隔不超过公告间隔，带有过期时间的公告在过期之前被刷新
+		initial := 5 * time.Second
+		if d < initial {
+			initial = d
+		}
+		t := utils.NewBackoffTicker(utils.BackoffMaxInterval(d), utils.BackoffInitialInterval(initial))
 		defer t.Stop()
 		for {
 			select {
@@ -193,18 +485,30 @@ func (l *Ledger) AnnounceDeleteBucketKey(ctx context.Context, interval, timeout
 }
 
 // AnnounceUpdate 如果状态不同，持续向区块链公告内容
-// 参数 ctx 为上下文，interval 为间隔时间，bucket 为存储桶名称，key 为键名，value 为值
-func (l *Ledger) AnnounceUpdate(ctx context.Context, interval time.Duration, bucket, key string, value interface{}) {
+// 使用WithTTL等写入选项时，键在过期之前的两个间隔内被重新写入，写入者停止公告之后键在所有节点上过期
+// 参数 ctx 为上下文，interval 为间隔时间，bucket 为存储桶名称，key 为键名，value 为值，opts 为写入选项
+func (l *Ledger) AnnounceUpdate(ctx context.Context, interval time.Duration, bucket, key string, value interface{}, opts ...WriteOption) {
 	l.Announce(ctx, interval, func() {
 		v, exists := l.CurrentData()[bucket][key]
 		realv, _ := json.Marshal(value)
 		switch {
 		case !exists || string(v) != string(realv):
-			l.Add(bucket, map[string]interface{}{key: value})
+			l.Add(bucket, map[string]interface{}{key: value}, opts...)
+		case len(opts) > 0 && l.expiring(bucket, key, 2*interval):
+			l.Add(bucket, map[string]interface{}{key: value}, opts...)
 		}
 	})
 }
 
+// expiring 如果键没有过期时间或者将在d之内过期则返回true
+// 参数 bucket 为存储桶名称，key 为键名，d 为时间长度
+func (l *Ledger) expiring(bucket, key string, d time.Duration) bool {
+	l.Lock()
+	defer l.Unlock()
+	v := l.blockchain.Last().Versions[bucket][key]
+	return v.Expires == 0 || v.Expires-time.Now().UnixNano() < int64(d)
+}
+
 // Persist 持续向区块链公告内容，直到协调完成
 // 参数 ctx 为上下文，interval 为间隔时间，timeout 为超时时间，bucket 为存储桶名称，key 为键名，value 为值
 func (l *Ledger) Persist(ctx context.Context, interval, timeout time.Duration, bucket, key string, value interface{}) {
@@ -222,7 +526,53 @@ func (l *Ledger) Persist(ctx context.Context, interval, timeout time.Duration, b
 	})
 }
 
-// GetKey 从区块链检索当前键
+// PersistConfirmed 写入键并等待至少quorum个不同的对等节点确认持有该写入，
+// 等待期间按照间隔重新广播写入，因此错过增量的对等节点也会收到。
+// 每个节点按照自己的顺序生成区块，区块哈希在节点之间并不相同，
+// 因此每个对等节点确认写入本身（存储桶、键、写入时钟和值的摘要）以及自己链上包含该写入的区块，并使用自己的私钥签名。
+// 返回收到的确认；超时、写入被访问控制策略拒绝或者被其他写入覆盖时返回错误
+// 参数 ctx 为上下文，interval 为间隔时间，timeout 为超时时间，bucket 为存储桶名称，key 为键名，value 为值，quorum 为需要确认的对等节点数量
+func (l *Ledger) PersistConfirmed(ctx context.Context, interval, timeout time.Duration, bucket, key string, value interface{}, quorum int) ([]Ack, error) {
+	l.Add(bucket, map[string]interface{}{key: value})
+
+	l.Lock()
+	op, err := l.ownWrite(bucket, key)
+	l.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	if quorum <= 0 {
+		return nil, nil
+	}
+
+	c := l.expectAcks(op, quorum)
+	defer l.forgetAcks(op)
+
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	t := utils.NewBackoffTicker(utils.BackoffMaxInterval(interval))
+	defer t.Stop()
+	for {
+		l.publish(ledgerMessage{Type: ConfirmMessage, Delta: &Delta{Timestamp: now(), Ops: []Operation{op}}})
+
+		select {
+		case <-c.done:
+			return c.list(), nil
+		case <-t.C:
+			l.Lock()
+			current, err := l.ownWrite(bucket, key)
+			l.Unlock()
+			if err != nil || current.Clock != op.Clock {
+				return nil, errors.Errorf("存储桶 '%s' 中的键 '%s' 在确认之前被覆盖", bucket, key)
+			}
+		case <-ctx.Done():
+			return nil, errors.Wrapf(ctx.Err(), "存储桶 '%s' 中的键 '%s' 只有 %d/%d 个对等节点确认", bucket, key, c.count(), quorum)
+		}
+	}
+}
+
+// GetKey 从区块链检索当前键，永远不会返回已过期的键
 // 参数 b 为存储桶名称，s 为键名
 func (l *Ledger) GetKey(b, s string) (value Data, exists bool) {
 	l.Lock()
@@ -234,8 +584,8 @@ func (l *Ledger) GetKey(b, s string) (value Data, exists bool) {
 			return
 		}
 		value, exists = last.Storage[b][s]
-		if exists {
-			return
+		if exists && last.Versions[b][s].Expired(time.Now().UnixNano()) {
+			return "", false
 		}
 	}
 	return
@@ -247,7 +597,7 @@ func (l *Ledger) Exists(b string, f func(Data) bool) (exists bool) {
 	l.Lock()
 	defer l.Unlock()
 	if l.blockchain.Len() > 0 {
-		for _, bv := range l.blockchain.Last().Storage[b] {
+		for _, bv := range l.storage()[b] {
 			if f(bv) {
 				exists = true
 				return
@@ -258,12 +608,39 @@ func (l *Ledger) Exists(b string, f func(Data) bool) (exists bool) {
 	return
 }
 
-// CurrentData 返回当前账本数据（加锁）
+// CurrentData 返回当前账本数据（加锁），不包括已过期的键
 func (l *Ledger) CurrentData() map[string]map[string]Data {
 	l.Lock()
 	defer l.Unlock()
 
-	return buckets(l.blockchain.Last().Storage).copy()
+	return l.storage()
+}
+
+// storage 返回最后一个区块中未过期的数据副本，调用者必须持有锁
+func (l *Ledger) storage() map[string]map[string]Data {
+	last := l.blockchain.Last()
+	storage := buckets(last.Storage).copy()
+
+	now := time.Now().UnixNano()
+	for b, keys := range last.Versions {
+		for k, v := range keys {
+			if v.Expired(now) {
+				delete(storage[b], k)
+				if len(storage[b]) == 0 {
+					delete(storage, b)
+				}
+			}
+		}
+	}
+	return storage
+}
+
+// expire 如果最后一个区块中有已过期的键，则在本地生成一个回收它们的区块，调用者必须持有锁。
+// 回收是确定性的，不需要广播
+func (l *Ledger) expire() {
+	if newBlock, changed := l.blockchain.Last().next(now(), nil, l.rules); changed {
+		l.apply(newBlock)
+	}
 }
 
 // LastBlock 返回区块链中的最后一个区块
@@ -297,62 +674,60 @@ func (b buckets) copy() map[string]map[string]Data {
 	return copy
 }
 
+// WriteOption 是写入选项
+type WriteOption func(op *Operation)
+
+// WithTTL 设置写入的键的存活时间，过期的键在所有节点上被确定性地回收
+// 参数 ttl 为存活时间
+func WithTTL(ttl time.Duration) WriteOption {
+	return func(op *Operation) {
+		op.Expires = op.Clock.Time + int64(ttl)
+	}
+}
+
 // Add 向区块链添加数据
-// 参数 b 为存储桶名称，s 为键值对映射
-func (l *Ledger) Add(b string, s map[string]interface{}) {
+// 参数 b 为存储桶名称，s 为键值对映射，opts 为写入选项
+func (l *Ledger) Add(b string, s map[string]interface{}, opts ...WriteOption) {
 	l.Lock()
-	current := buckets(l.blockchain.Last().Storage).copy()
+	clock := l.clock.tick(l.id)
+	l.Unlock()
 
-	for s, k := range s {
-		if _, exists := current[b]; !exists {
-			current[b] = make(map[string]Data)
+	ops := []Operation{}
+	for k, v := range s {
+		dat, _ := json.Marshal(v)
+		op := Operation{Type: OpSet, Bucket: b, Key: k, Value: Data(string(dat)), Clock: clock}
+		for _, o := range opts {
+			o(&op)
 		}
-		dat, _ := json.Marshal(k)
-		current[b][s] = Data(string(dat))
+		ops = append(ops, op)
 	}
-	l.Unlock()
-	l.writeData(current)
+	l.commit(ops)
 }
 
 // Delete 从账本删除数据（加锁）
+// 删除会留下墓碑，较旧的并发写入不会使键复活
 // 参数 b 为存储桶名称，k 为键名
 func (l *Ledger) Delete(b string, k string) {
 	l.Lock()
-	new := make(map[string]map[string]Data)
-	for bb, kk := range l.blockchain.Last().Storage {
-		if _, exists := new[bb]; !exists {
-			new[bb] = make(map[string]Data)
-		}
-		// 复制除b/k以外的所有键值
-		for kkk, v := range kk {
-			if !(bb == b && kkk == k) {
-				new[bb][kkk] = v
-			}
-		}
-	}
+	clock := l.clock.tick(l.id)
 	l.Unlock()
-	l.writeData(new)
+
+	l.commit([]Operation{{Type: OpDelete, Bucket: b, Key: k, Clock: clock}})
 }
 
 // DeleteBucket 从账本删除存储桶（加锁）
+// 存储桶中当前的每个键都会被删除，之后的并发写入仍然会生效
 // 参数 b 为存储桶名称
 func (l *Ledger) DeleteBucket(b string) {
 	l.Lock()
-	new := make(map[string]map[string]Data)
-	for bb, kk := range l.blockchain.Last().Storage {
-		// 复制除指定存储桶以外的所有内容
-		if bb == b {
-			continue
-		}
-		if _, exists := new[bb]; !exists {
-			new[bb] = make(map[string]Data)
-		}
-		for kkk, v := range kk {
-			new[bb][kkk] = v
-		}
+	clock := l.clock.tick(l.id)
+	ops := []Operation{}
+	for k := range l.blockchain.Last().Storage[b] {
+		ops = append(ops, Operation{Type: OpDelete, Bucket: b, Key: k, Clock: clock})
 	}
 	l.Unlock()
-	l.writeData(new)
+
+	l.commit(ops)
 }
 
 // String 返回区块链的字符串表示
@@ -366,21 +741,101 @@ func (l *Ledger) Index() int {
 	return l.blockchain.Len()
 }
 
-// writeData 写入数据到区块链
-// 参数 s 为数据映射
-func (l *Ledger) writeData(s map[string]map[string]Data) {
-	newBlock := l.blockchain.Last().NewBlock(s)
-
-	if newBlock.IsValid(l.blockchain.Last()) {
-		l.Lock()
-		l.blockchain.Add(newBlock)
+// commit 签名操作，在最后一个区块之上合并生成新区块，并只广播增量
+// 参数 ops 为操作列表
+func (l *Ledger) commit(ops []Operation) {
+	l.Lock()
+	ops = l.authorized(ops)
+	if len(ops) == 0 {
 		l.Unlock()
+		return
 	}
+	for i := range ops {
+		if err := ops[i].sign(l.key); err != nil {
+			l.Unlock()
+			log.Println(errors.Wrap(err, "签名写入失败"))
+			return
+		}
+	}
+	newBlock, delta := l.blockchain.Last().NewDelta(ops, l.rules)
+	l.apply(newBlock)
+	l.Unlock()
 
-	bytes, err := json.Marshal(l.blockchain.Last())
-	if err != nil {
-		log.Println(err)
+	l.publish(ledgerMessage{Type: DeltaMessage, Delta: &delta})
+}
+
+// authorized 丢弃违反访问控制策略的本地写入并记录日志，调用者必须持有锁
+// 拥有者策略下的写入同时记录所有权，见lifetimeWins
+// 参数 ops 为本地写入的操作列表
+func (l *Ledger) authorized(ops []Operation) []Operation {
+	s := newState(l.blockchain.Last())
+	allowed := []Operation{}
+	for _, op := range ops {
+		if p, _ := s.policyAt(op.Bucket, op.Clock, l.rules.Admins); p.Owner {
+			s.lifetime(&op)
+		}
+		if err := s.authorize(op, l.rules.Admins); err != nil {
+			log.Println(errors.Wrap(err, "丢弃写入"))
+			continue
+		}
+		allowed = append(allowed, op)
+	}
+	return allowed
+}
+
+// Revision 是键在历史中的一次变更
+type Revision struct {
+	Index     int    // 区块索引
+	Timestamp string // 区块时间戳
+	Writer    string // 写入者的对等节点ID
+	Clock     Clock  // 写入时钟
+	Value     Data   `json:",omitempty"` // 写入的值
+	Deleted   bool   `json:",omitempty"` // 键被删除
+	Expired   bool   `json:",omitempty"` // 键过期被回收
+}
+
+// Block 返回指定索引的区块，如果存储不保留该区块则返回false
+// 参数 index 为区块索引
+func (l *Ledger) Block(index int) (Block, bool) {
+	if h, ok := l.blockchain.(HistoryStore); ok {
+		return h.Get(index)
+	}
+
+	last := l.LastBlock()
+	return last, last.Index == index
+}
+
+// KeyHistory 返回存储保留的历史区块中键的所有变更，按区块顺序排列
+// 用于审计谁在什么时候修改了键。如果存储不保留历史，只返回最后一个区块中的版本
+// 参数 bucket 为存储桶名称，key 为键名
+func (l *Ledger) KeyHistory(bucket, key string) (revisions []Revision) {
+	blocks := func(f func(Block) bool) { f(l.LastBlock()) }
+	if h, ok := l.blockchain.(HistoryStore); ok {
+		last := l.LastBlock().Index
+		blocks = func(f func(Block) bool) { h.Range(0, last, f) }
 	}
 
-	l.channel.Write(compress(bytes).Bytes())
+	var prev *Version
+	blocks(func(b Block) bool {
+		v, exists := b.Versions[bucket][key]
+		switch {
+		case exists && (prev == nil || !sameVersion(*prev, v)):
+			revisions = append(revisions, Revision{
+				Index:     b.Index,
+				Timestamp: b.Timestamp,
+				Writer:    v.Clock.Node,
+				Clock:     v.Clock,
+				Value:     b.Storage[bucket][key],
+				Deleted:   v.Deleted,
+			})
+			prev = &v
+		case !exists && prev != nil:
+			if !prev.Deleted {
+				revisions = append(revisions, Revision{Index: b.Index, Timestamp: b.Timestamp, Expired: true})
+			}
+			prev = nil
+		}
+		return true
+	})
+	return
 }
@@ -0,0 +1,1007 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/purpose168/edgevpn/pkg/blockchain"
+	"github.com/purpose168/edgevpn/pkg/hub"
+	"github.com/purpose168/edgevpn/pkg/protocol"
+)
+
+// wire 在内存中收集账本写入的消息，模拟区块链房间
+type wire struct {
+	sync.Mutex
+	messages []*hub.Message
+}
+
+func (w *wire) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+	w.messages = append(w.messages, hub.NewMessage(string(p)))
+	return len(p), nil
+}
+
+// flush 将收集的消息投递到其他账本，返回投递的消息数量
+func (w *wire) flush(to ...*Ledger) int {
+	w.Lock()
+	messages := w.messages
+	w.messages = nil
+	w.Unlock()
+
+	for _, m := range messages {
+		for _, l := range to {
+			l.Update(l, m, nil)
+		}
+	}
+	return len(messages)
+}
+
+// size 返回已收集消息的总字节数
+func (w *wire) size() (n int) {
+	w.Lock()
+	defer w.Unlock()
+	for _, m := range w.messages {
+		n += len(m.Message)
+	}
+	return
+}
+
+// sync2 在账本之间反复投递消息直到没有新的消息
+func sync2(a, b *Ledger, wa, wb *wire) {
+	for i := 0; i < 10; i++ {
+		if wa.flush(b)+wb.flush(a) == 0 {
+			return
+		}
+	}
+}
+
+// message 是线上账本消息的测试副本，用于构造被篡改的消息
+type message struct {
+	Type  string
+	Delta *Delta `json:",omitempty"`
+	Block *Block `json:",omitempty"`
+	Ack   *Ack   `json:",omitempty"`
+
+	Digest string `json:",omitempty"`
+}
+
+func decode(m *hub.Message) (msg message) {
+	r, err := gzip.NewReader(bytes.NewReader([]byte(m.Message)))
+	Expect(err).ToNot(HaveOccurred())
+	b, err := io.ReadAll(r)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(json.Unmarshal(b, &msg)).To(Succeed())
+	return
+}
+
+func encode(msg message) *hub.Message {
+	b, err := json.Marshal(msg)
+	Expect(err).ToNot(HaveOccurred())
+	var buf bytes.Buffer
+	gz := gzip.NewWriter(&buf)
+	gz.Write(b)
+	gz.Close()
+	return hub.NewMessage(buf.String())
+}
+
+// identity 为账本设置新的身份，返回其对等节点ID
+func identity(l *Ledger) string {
+	k, _, err := crypto.GenerateEd25519Key(nil)
+	Expect(err).ToNot(HaveOccurred())
+	Expect(l.SetIdentity(k)).To(Succeed())
+	id, err := peer.IDFromPrivateKey(k)
+	Expect(err).ToNot(HaveOccurred())
+	return id.String()
+}
+
+func value(l *Ledger, bucket, key string) (s string) {
+	v, exists := l.GetKey(bucket, key)
+	if exists {
+		v.Unmarshal(&s)
+	}
+	return
+}
+
+var _ = Describe("账本", func() {
+	var (
+		wa, wb *wire
+		a, b   *Ledger
+	)
+
+	BeforeEach(func() {
+		wa, wb = &wire{}, &wire{}
+		a = New(wa, &MemoryStore{})
+		b = New(wb, &MemoryStore{})
+	})
+
+	Context("增量复制", func() {
+		It("增量在相同的父区块上重建出相同的区块", func() {
+			a.Add("foo", map[string]interface{}{"bar": "baz"})
+			sync2(a, b, wa, wb)
+			Expect(value(b, "foo", "bar")).To(Equal("baz"))
+			Expect(b.LastBlock().Hash).To(Equal(a.LastBlock().Hash))
+
+			a.Add("foo", map[string]interface{}{"baz": "qux"})
+			Expect(wa.flush(b)).To(Equal(1))
+			// 同步后增量可以直接应用，不需要再请求快照
+			Expect(wb.flush(a)).To(Equal(0))
+			Expect(value(b, "foo", "baz")).To(Equal("qux"))
+			Expect(b.LastBlock().Hash).To(Equal(a.LastBlock().Hash))
+
+			a.Delete("foo", "bar")
+			wa.flush(b)
+			_, exists := b.GetKey("foo", "bar")
+			Expect(exists).To(BeFalse())
+
+			a.DeleteBucket("foo")
+			wa.flush(b)
+			Expect(b.CurrentData()).ToNot(HaveKey("foo"))
+			Expect(b.LastBlock().Hash).To(Equal(a.LastBlock().Hash))
+		})
+
+		It("写入只广播增量而不是完整区块", func() {
+			for i := 0; i < 100; i++ {
+				a.Add("big", map[string]interface{}{string(rune('a'+i%26)) + string(rune('a'+i/26)): i})
+			}
+			wa.flush()
+
+			a.Add("small", map[string]interface{}{"key": "value"})
+			full, err := json.Marshal(a.LastBlock())
+			Expect(err).ToNot(HaveOccurred())
+			Expect(wa.size()).To(BeNumerically("<", len(full)/10))
+		})
+
+		It("通过链头公告发现自己落后", func() {
+			a.Add("foo", map[string]interface{}{"bar": "baz"})
+			wa.flush()
+
+			// 增量丢失，只有链头公告到达
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			a.Syncronizer(ctx, 10*time.Millisecond)
+
+			Eventually(func() string {
+				sync2(a, b, wa, wb)
+				return value(b, "foo", "bar")
+			}, 5*time.Second, 10*time.Millisecond).Should(Equal("baz"))
+		})
+
+		It("落后报告通常只由一个对等节点响应", func() {
+			a.Add("foo", map[string]interface{}{"bar": "baz"})
+			wa.flush()
+
+			peers := []*Ledger{a}
+			wires := []*wire{wa}
+			for i := 0; i < 4; i++ {
+				w := &wire{}
+				p := New(w, &MemoryStore{})
+				Expect(p.Merge(a.LastBlock())).To(Succeed())
+				w.flush()
+				peers = append(peers, p)
+				wires = append(wires, w)
+			}
+
+			lagging := New(&wire{}, &MemoryStore{})
+			behind := encode(message{Type: "behind", Digest: lagging.LastBlock().Digest()})
+			for _, p := range peers {
+				p.Update(p, behind, nil)
+			}
+
+			// 每个快照立即投递给其他对等节点，它们取消自己的响应
+			snapshots := 0
+			deadline := time.Now().Add(3 * time.Second)
+			for time.Now().Before(deadline) {
+				for i, w := range wires {
+					w.Lock()
+					messages := w.messages
+					w.messages = nil
+					w.Unlock()
+					for _, m := range messages {
+						if decode(m).Type == "snapshot" {
+							snapshots++
+						}
+						lagging.Update(lagging, m, nil)
+						for j, p := range peers {
+							if i != j {
+								p.Update(p, m, nil)
+							}
+						}
+					}
+				}
+				time.Sleep(time.Millisecond)
+			}
+
+			Expect(snapshots).To(BeNumerically(">=", 1))
+			Expect(snapshots).To(BeNumerically("<=", 2))
+			Expect(value(lagging, "foo", "bar")).To(Equal("baz"))
+		})
+	})
+
+	Context("并发写入", func() {
+		It("无论到达顺序如何都收敛到相同的状态", func() {
+			wc := &wire{}
+			c := New(wc, &MemoryStore{})
+
+			a.Add("foo", map[string]interface{}{"bar": "a"})
+			b.Add("foo", map[string]interface{}{"bar": "b", "b": "b"})
+			c.Add("foo", map[string]interface{}{"c": "c"})
+
+			wa.Lock()
+			fromA := wa.messages
+			wa.Unlock()
+			wb.Lock()
+			fromB := wb.messages
+			wb.Unlock()
+			wc.Lock()
+			fromC := wc.messages
+			wc.Unlock()
+
+			// 每个节点以不同的顺序接收其他节点的增量
+			for _, m := range fromB {
+				a.Update(a, m, nil)
+			}
+			for _, m := range fromC {
+				a.Update(a, m, nil)
+			}
+			for _, m := range fromC {
+				b.Update(b, m, nil)
+			}
+			for _, m := range fromA {
+				b.Update(b, m, nil)
+			}
+			for _, m := range fromA {
+				c.Update(c, m, nil)
+			}
+			for _, m := range fromB {
+				c.Update(c, m, nil)
+			}
+
+			Expect(a.LastBlock().Digest()).To(Equal(b.LastBlock().Digest()))
+			Expect(b.LastBlock().Digest()).To(Equal(c.LastBlock().Digest()))
+			Expect(a.CurrentData()).To(Equal(c.CurrentData()))
+			Expect(value(a, "foo", "b")).To(Equal("b"))
+			Expect(value(a, "foo", "c")).To(Equal("c"))
+			Expect(value(a, "foo", "bar")).To(Equal(value(b, "foo", "bar")))
+		})
+
+		It("较晚的写入获胜，重复的增量被忽略", func() {
+			a.Add("foo", map[string]interface{}{"bar": "old"})
+			wa.Lock()
+			old := wa.messages
+			wa.Unlock()
+			sync2(a, b, wa, wb)
+
+			b.Add("foo", map[string]interface{}{"bar": "new"})
+			sync2(a, b, wa, wb)
+			Expect(value(a, "foo", "bar")).To(Equal("new"))
+
+			index := a.Index()
+			for _, m := range old {
+				a.Update(a, m, nil)
+			}
+			Expect(value(a, "foo", "bar")).To(Equal("new"))
+			Expect(a.Index()).To(Equal(index))
+		})
+
+		It("删除留下墓碑，较旧的写入不会使键复活", func() {
+			a.Add("foo", map[string]interface{}{"bar": "baz"})
+			wa.Lock()
+			old := wa.messages
+			wa.Unlock()
+			sync2(a, b, wa, wb)
+
+			b.DeleteBucket("foo")
+			sync2(a, b, wa, wb)
+			Expect(a.CurrentData()).ToNot(HaveKey("foo"))
+
+			for _, m := range old {
+				a.Update(a, m, nil)
+			}
+			Expect(a.CurrentData()).ToNot(HaveKey("foo"))
+		})
+
+		It("丢失增量的节点通过快照交换收敛", func() {
+			a.Add("foo", map[string]interface{}{"a": "a"})
+			b.Add("foo", map[string]interface{}{"b": "b"})
+			// 所有增量都丢失了
+			wa.flush()
+			wb.flush()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			a.Syncronizer(ctx, 10*time.Millisecond)
+			b.Syncronizer(ctx, 10*time.Millisecond)
+
+			Eventually(func() bool {
+				sync2(a, b, wa, wb)
+				return a.LastBlock().Digest() == b.LastBlock().Digest()
+			}, 5*time.Second, 10*time.Millisecond).Should(BeTrue())
+
+			Expect(value(b, "foo", "a")).To(Equal("a"))
+			Expect(value(a, "foo", "b")).To(Equal("b"))
+		})
+	})
+
+	Context("墓碑回收", func() {
+		var (
+			wc *wire
+			c  *Ledger
+		)
+
+		BeforeEach(func() {
+			wc = &wire{}
+			c = New(wc, &MemoryStore{})
+			for _, l := range []*Ledger{a, b, c} {
+				l.SetTombstoneRetention(100 * time.Millisecond)
+			}
+
+			a.Add("foo", map[string]interface{}{"k": "v"})
+			wa.flush(b, c)
+
+			// c离线期间键被删除，墓碑在保留时间之后被回收
+			a.Delete("foo", "k")
+			wa.flush(b)
+			time.Sleep(200 * time.Millisecond)
+			a.Add("bar", map[string]interface{}{"k": "v"})
+			wa.flush(b)
+			Expect(a.LastBlock().Versions).ToNot(HaveKey("foo"))
+			Expect(a.LastBlock().Horizon).ToNot(BeZero())
+			Expect(value(c, "foo", "k")).To(Equal("v"))
+		})
+
+		It("拒绝早于已回收墓碑的键，而不是使其复活", func() {
+			Expect(a.Merge(c.LastBlock())).To(Succeed())
+			Expect(value(a, "foo", "k")).To(BeEmpty())
+
+			for _, m := range wc.messages {
+				b.Update(b, m, nil)
+			}
+			wc.flush()
+			c.Add("foo", map[string]interface{}{"other": "v"})
+			wc.flush(b)
+			Expect(value(b, "foo", "k")).To(BeEmpty())
+			Expect(value(b, "foo", "other")).To(Equal("v"))
+		})
+
+		It("离线的节点删除对方已经回收的键", func() {
+			Expect(c.Merge(a.LastBlock())).To(Succeed())
+			Expect(value(c, "foo", "k")).To(BeEmpty())
+			Expect(c.LastBlock().Digest()).To(Equal(a.LastBlock().Digest()))
+
+			// 部分快照同样生效
+			d := New(&wire{}, &MemoryStore{})
+			d.SetTombstoneRetention(100 * time.Millisecond)
+			Expect(d.Merge(c.Snapshot("foo"))).To(Succeed())
+			Expect(value(d, "foo", "k")).To(BeEmpty())
+		})
+	})
+
+	Context("签名", func() {
+		var delta message
+
+		BeforeEach(func() {
+			a.Add("foo", map[string]interface{}{"bar": "baz"})
+			wa.Lock()
+			delta = decode(wa.messages[0])
+			wa.messages = nil
+			wa.Unlock()
+			Expect(delta.Delta.Ops).To(HaveLen(1))
+		})
+
+		It("记录写入者并接受签名有效的增量", func() {
+			Expect(b.Update(b, encode(delta), nil)).To(Succeed())
+			Expect(value(b, "foo", "bar")).To(Equal("baz"))
+
+			op := delta.Delta.Ops[0]
+			Expect(op.Verify()).To(Succeed())
+			Expect(b.LastBlock().Versions["foo"]["bar"].Clock.Node).To(Equal(op.Signer()))
+			Expect(b.LastBlock().Versions["foo"]["bar"].Signature).To(Equal(op.Signature))
+		})
+
+		It("拒绝被篡改的增量", func() {
+			delta.Delta.Ops[0].Value = Data(`"evil"`)
+			Expect(b.Update(b, encode(delta), nil)).ToNot(Succeed())
+			_, exists := b.GetKey("foo", "bar")
+			Expect(exists).To(BeFalse())
+		})
+
+		It("拒绝冒充其他写入者的增量", func() {
+			// b使用自己的私钥签名，但声称写入者是a
+			b.Add("foo", map[string]interface{}{"bar": "evil"})
+			wb.Lock()
+			forged := decode(wb.messages[0])
+			wb.messages = nil
+			wb.Unlock()
+			forged.Delta.Ops[0].Clock.Node = delta.Delta.Ops[0].Signer()
+
+			Expect(a.Update(a, encode(forged), nil)).ToNot(Succeed())
+			Expect(value(a, "foo", "bar")).To(Equal("baz"))
+		})
+
+		It("拒绝未签名的写入", func() {
+			delta.Delta.Ops[0].Signature = nil
+			Expect(b.Update(b, encode(delta), nil)).ToNot(Succeed())
+
+			// 旧版本节点发送的完整区块没有签名
+			legacy := Block{Index: 1, Storage: map[string]map[string]Data{"foo": {"bar": Data(`"evil"`)}}}
+			legacy.Hash = legacy.Checksum()
+			Expect(b.Update(b, encode(message{Type: "snapshot", Block: &legacy}), nil)).ToNot(Succeed())
+			_, exists := b.GetKey("foo", "bar")
+			Expect(exists).To(BeFalse())
+		})
+
+		It("重新签名属于本节点的旧数据", func() {
+			legacy := &MemoryStore{}
+			legacy.Add(Block{Storage: map[string]map[string]Data{}})
+			l := New(wa, legacy)
+			id := identity(l)
+			genesis := Block{Index: 1, Storage: map[string]map[string]Data{
+				"healthcheck": {id: Data(`"now"`), "other": Data(`"now"`)},
+				"machines":    {"10.1.0.1": Data(`{"PeerID":"` + id + `"}`), "10.1.0.2": Data(`{"PeerID":"other"}`)},
+			}}
+			genesis.Hash = genesis.Checksum()
+			legacy.Add(genesis)
+
+			Expect(l.ResignLegacy()).To(Equal(2))
+			Expect(l.ResignLegacy()).To(BeZero())
+			wa.flush(b)
+
+			Expect(b.CurrentData()["healthcheck"]).To(HaveKey(id))
+			Expect(b.CurrentData()["healthcheck"]).ToNot(HaveKey("other"))
+			Expect(b.CurrentData()["machines"]).To(HaveKey("10.1.0.1"))
+			Expect(b.CurrentData()["machines"]).ToNot(HaveKey("10.1.0.2"))
+		})
+
+		It("丢弃快照中被篡改的键，保留其余的键", func() {
+			a.Add("foo", map[string]interface{}{"baz": "qux"})
+			wa.Lock()
+			wa.messages = nil
+			wa.Unlock()
+
+			snapshot := a.LastBlock()
+			snapshot.Storage = a.CurrentData()
+			snapshot.Storage["foo"]["bar"] = Data(`"evil"`)
+			snapshot.Hash = snapshot.Checksum()
+
+			Expect(b.Update(b, encode(message{Type: "snapshot", Block: &snapshot}), nil)).ToNot(Succeed())
+			_, exists := b.GetKey("foo", "bar")
+			Expect(exists).To(BeFalse())
+			Expect(value(b, "foo", "baz")).To(Equal("qux"))
+		})
+	})
+
+	Context("访问控制", func() {
+		var (
+			wc       *wire
+			c        *Ledger
+			idA, idB string
+		)
+
+		BeforeEach(func() {
+			wc = &wire{}
+			c = New(wc, &MemoryStore{})
+			idA, idB = identity(a), identity(b)
+			identity(c)
+			a.SetAdmins(idA)
+			b.SetAdmins(idA)
+		})
+
+		It("只有允许的写入者可以写入受限的存储桶", func() {
+			a.SetPolicy("dns", Policy{Writers: []string{idA}})
+			sync2(a, b, wa, wb)
+			p, exists := b.Policy("dns")
+			Expect(exists).To(BeTrue())
+			Expect(p.Writers).To(Equal([]string{idA}))
+
+			// 本地违反策略的写入不会被提交
+			b.Add("dns", map[string]interface{}{"foo": "b"})
+			Expect(wb.size()).To(Equal(0))
+			_, exists = b.GetKey("dns", "foo")
+			Expect(exists).To(BeFalse())
+
+			// 不知道策略的节点写入的数据被接收方丢弃
+			c.Add("dns", map[string]interface{}{"foo": "c"})
+			wc.flush(a, b)
+			_, exists = a.GetKey("dns", "foo")
+			Expect(exists).To(BeFalse())
+			_, exists = b.GetKey("dns", "foo")
+			Expect(exists).To(BeFalse())
+
+			a.Add("dns", map[string]interface{}{"foo": "a"})
+			sync2(a, b, wa, wb)
+			Expect(value(b, "dns", "foo")).To(Equal("a"))
+		})
+
+		It("只有管理员可以修改策略", func() {
+			b.SetPolicy("dns", Policy{Writers: []string{idB}})
+			Expect(wb.size()).To(Equal(0))
+
+			c.SetPolicy("dns", Policy{Writers: []string{idB}})
+			wc.flush(a, b)
+			p, _ := a.Policy("dns")
+			Expect(p).To(Equal(Policy{AdminOnly: true}))
+			_, exists := b.Policy(protocol.ACLLedgerKey)
+			Expect(exists).To(BeFalse())
+		})
+
+		It("键的拥有者在删除之前独占该键", func() {
+			a.SetPolicy("machines", Policy{Owner: true})
+			sync2(a, b, wa, wb)
+
+			a.Add("machines", map[string]interface{}{"10.1.0.1": "a"})
+			sync2(a, b, wa, wb)
+
+			b.Add("machines", map[string]interface{}{"10.1.0.1": "b"})
+			sync2(a, b, wa, wb)
+			Expect(value(a, "machines", "10.1.0.1")).To(Equal("a"))
+			Expect(value(b, "machines", "10.1.0.1")).To(Equal("a"))
+
+			a.Delete("machines", "10.1.0.1")
+			sync2(a, b, wa, wb)
+			b.Add("machines", map[string]interface{}{"10.1.0.1": "b"})
+			sync2(a, b, wa, wb)
+			Expect(value(a, "machines", "10.1.0.1")).To(Equal("b"))
+		})
+
+		It("限制写入者为信任区域成员或只能写入自己的键", func() {
+			a.SetPolicy("healthcheck", Policy{TrustZone: true, Self: true})
+			sync2(a, b, wa, wb)
+
+			b.Add("healthcheck", map[string]interface{}{idB: "b"})
+			sync2(a, b, wa, wb)
+			_, exists := a.GetKey("healthcheck", idB)
+			Expect(exists).To(BeFalse())
+
+			a.Add(protocol.TrustZoneKey, map[string]interface{}{idB: ""})
+			sync2(a, b, wa, wb)
+
+			b.Add("healthcheck", map[string]interface{}{idA: "b"})
+			b.Add("healthcheck", map[string]interface{}{idB: "b"})
+			sync2(a, b, wa, wb)
+			Expect(value(a, "healthcheck", idB)).To(Equal("b"))
+			_, exists = a.GetKey("healthcheck", idA)
+			Expect(exists).To(BeFalse())
+		})
+
+		It("写入按照其时钟生效的策略判断，与到达顺序无关", func() {
+			c.Add("files", map[string]interface{}{"early": "c"})
+			a.SetPolicy("files", Policy{Writers: []string{idA}})
+			c.Add("files", map[string]interface{}{"late": "c"})
+
+			// b在策略之前收到两个写入，a在策略之后收到
+			wc.Lock()
+			writes := wc.messages
+			wc.Unlock()
+			wc.flush(b)
+			Expect(value(b, "files", "late")).To(Equal("c"))
+			sync2(a, b, wa, wb)
+			for _, m := range writes {
+				a.Update(a, m, nil)
+			}
+
+			for _, l := range []*Ledger{a, b} {
+				Expect(value(l, "files", "early")).To(Equal("c"))
+				_, exists := l.GetKey("files", "late")
+				Expect(exists).To(BeFalse())
+			}
+		})
+
+		It("没有管理员时任何人都不能修改策略", func() {
+			c.SetPolicy("files", Policy{Writers: []string{idB}})
+			_, exists := c.Policy("files")
+			Expect(exists).To(BeFalse())
+			Expect(wc.size()).To(Equal(0))
+		})
+
+		It("使用默认策略保护机器信息、信任区域和DNS", func() {
+			b.Add("machines", map[string]interface{}{"10.1.0.1": map[string]string{"PeerID": idA}})
+			b.Add("machines", map[string]interface{}{"10.1.0.2": map[string]string{"PeerID": idB}})
+			b.Add("dns", map[string]interface{}{"example.com": "b"})
+			b.Add(protocol.TrustZoneKey, map[string]interface{}{idB: ""})
+			a.Add("dns", map[string]interface{}{"example.org": "a"})
+			sync2(a, b, wa, wb)
+
+			Expect(a.CurrentData()["machines"]).To(HaveLen(1))
+			Expect(a.CurrentData()["machines"]).To(HaveKey("10.1.0.2"))
+			Expect(a.CurrentData()["dns"]).To(Equal(map[string]Data{"example.org": Data(`"a"`)}))
+			Expect(a.CurrentData()).ToNot(HaveKey(protocol.TrustZoneKey))
+		})
+
+		It("其他对等节点不能覆盖或删除机器信息", func() {
+			idC := identity(c)
+			machine := func(id string) map[string]interface{} {
+				return map[string]interface{}{"10.1.0.1": map[string]string{"PeerID": id}}
+			}
+			owner := func(l *Ledger) string {
+				var m struct{ PeerID string }
+				v, exists := l.GetKey("machines", "10.1.0.1")
+				Expect(exists).To(BeTrue())
+				Expect(v.Unmarshal(&m)).To(Succeed())
+				return m.PeerID
+			}
+
+			a.Add("machines", machine(idA))
+			sync2(a, b, wa, wb)
+
+			// b知道a的写入，本地的覆盖和删除不会被提交
+			b.Add("machines", machine(idB))
+			b.Delete("machines", "10.1.0.1")
+			Expect(wb.size()).To(Equal(0))
+
+			// c不知道a的写入，它的覆盖和删除被其他节点丢弃
+			c.Add("machines", machine(idC))
+			wc.flush(a, b)
+			c.Delete("machines", "10.1.0.1")
+			wc.flush(a, b)
+			sync2(a, b, wa, wb)
+			Expect(owner(a)).To(Equal(idA))
+			Expect(owner(b)).To(Equal(idA))
+
+			// 拥有者删除之后地址可以被重新分配
+			a.Delete("machines", "10.1.0.1")
+			sync2(a, b, wa, wb)
+			b.Add("machines", machine(idB))
+			sync2(a, b, wa, wb)
+			Expect(owner(a)).To(Equal(idB))
+		})
+
+		It("并发的第一次写入在所有节点上选出相同的拥有者", func() {
+			c.SetAdmins(idA)
+			a.SetPolicy("hosts", Policy{Owner: true})
+			wa.flush(b, c)
+
+			// a先写入，b在收到a的写入之前写入
+			a.Add("hosts", map[string]interface{}{"k": "a"})
+			b.Add("hosts", map[string]interface{}{"k": "b"})
+			wa.Lock()
+			fromA := wa.messages
+			wa.Unlock()
+			wb.Lock()
+			fromB := wb.messages
+			wb.Unlock()
+
+			// c先收到b的写入
+			for _, m := range append(fromB, fromA...) {
+				c.Update(c, m, nil)
+			}
+			sync2(a, b, wa, wb)
+			for _, l := range []*Ledger{a, b, c} {
+				Expect(value(l, "hosts", "k")).To(Equal("a"))
+			}
+
+			// 拥有者删除之后其他人可以写入，之前的写入不会使其复活
+			a.Delete("hosts", "k")
+			sync2(a, b, wa, wb)
+			b.Add("hosts", map[string]interface{}{"k": "b"})
+			sync2(a, b, wa, wb)
+			for _, m := range fromA {
+				b.Update(b, m, nil)
+			}
+			Expect(value(a, "hosts", "k")).To(Equal("b"))
+			Expect(value(b, "hosts", "k")).To(Equal("b"))
+		})
+	})
+
+	Context("TTL", func() {
+		It("过期的键不会被读取，并在所有节点上被回收", func() {
+			a.Add("healthcheck", map[string]interface{}{"a": "a"}, WithTTL(200*time.Millisecond))
+			a.Add("foo", map[string]interface{}{"bar": "baz"})
+			wa.Lock()
+			old := wa.messages
+			wa.Unlock()
+			sync2(a, b, wa, wb)
+			Expect(value(b, "healthcheck", "a")).To(Equal("a"))
+
+			Eventually(func() bool {
+				_, exists := b.GetKey("healthcheck", "a")
+				return exists
+			}, 2*time.Second, 10*time.Millisecond).Should(BeFalse())
+			Expect(a.CurrentData()).ToNot(HaveKey("healthcheck"))
+			Expect(b.CurrentData()).To(HaveKey("foo"))
+			Expect(a.Exists("healthcheck", func(Data) bool { return true })).To(BeFalse())
+
+			// 下一个区块回收过期的键，各节点的状态保持一致
+			a.Add("foo", map[string]interface{}{"baz": "qux"})
+			sync2(a, b, wa, wb)
+			Expect(a.LastBlock().Storage).ToNot(HaveKey("healthcheck"))
+			Expect(a.LastBlock().Versions).ToNot(HaveKey("healthcheck"))
+			Expect(b.LastBlock().Digest()).To(Equal(a.LastBlock().Digest()))
+
+			// 重放的过期写入不会复活
+			for _, m := range old {
+				b.Update(b, m, nil)
+			}
+			_, exists := b.GetKey("healthcheck", "a")
+			Expect(exists).To(BeFalse())
+			Expect(b.LastBlock().Storage).ToNot(HaveKey("healthcheck"))
+		})
+
+		It("重新写入会刷新TTL", func() {
+			a.Add("healthcheck", map[string]interface{}{"a": "a"}, WithTTL(300*time.Millisecond))
+			time.Sleep(200 * time.Millisecond)
+			a.Add("healthcheck", map[string]interface{}{"a": "a"}, WithTTL(300*time.Millisecond))
+			time.Sleep(200 * time.Millisecond)
+			Expect(value(a, "healthcheck", "a")).To(Equal("a"))
+
+			a.Add("healthcheck", map[string]interface{}{"a": "a"})
+			time.Sleep(400 * time.Millisecond)
+			Expect(value(a, "healthcheck", "a")).To(Equal("a"))
+		})
+
+		It("公告的键在过期之前被刷新，停止公告之后过期", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			a.AnnounceUpdate(ctx, 20*time.Millisecond, "users", "a", "a", WithTTL(150*time.Millisecond))
+
+			Eventually(func() string {
+				return value(a, "users", "a")
+			}, 2*time.Second, 10*time.Millisecond).Should(Equal("a"))
+			Consistently(func() string {
+				return value(a, "users", "a")
+			}, 500*time.Millisecond, 10*time.Millisecond).Should(Equal("a"))
+
+			cancel()
+			Eventually(func() bool {
+				_, exists := a.GetKey("users", "a")
+				return exists
+			}, 2*time.Second, 10*time.Millisecond).Should(BeFalse())
+		})
+
+		It("同步器在本地回收过期的键", func() {
+			a.Add("healthcheck", map[string]interface{}{"a": "a"}, WithTTL(50*time.Millisecond))
+			time.Sleep(100 * time.Millisecond)
+			Expect(a.LastBlock().Storage).To(HaveKey("healthcheck"))
+
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			a.Syncronizer(ctx, 10*time.Millisecond)
+
+			Eventually(func() map[string]map[string]Data {
+				return a.LastBlock().Storage
+			}, 2*time.Second, 10*time.Millisecond).ShouldNot(HaveKey("healthcheck"))
+		})
+	})
+
+	Context("直接同步", func() {
+		BeforeEach(func() {
+			a.Add("shared", map[string]interface{}{"k": "v"})
+			wa.flush(b)
+			a.Add("foo", map[string]interface{}{"a": "1"})
+			a.Delete("foo", "a")
+			b.Add("bar", map[string]interface{}{"b": "2"})
+		})
+
+		It("只拉取摘要不同的存储桶", func() {
+			Expect(b.Head().Diff(a.Head())).To(Equal([]string{"bar", "foo"}))
+
+			snapshot := a.Snapshot("bar", "foo")
+			Expect(snapshot.Storage).ToNot(HaveKey("shared"))
+			Expect(b.Merge(snapshot)).To(Succeed())
+
+			// 只有墓碑的存储桶也被同步
+			Expect(b.LastBlock().Versions["foo"]["a"].Deleted).To(BeTrue())
+			Expect(b.Head().Diff(a.Head())).To(Equal([]string{"bar"}))
+			Expect(value(b, "bar", "b")).To(Equal("2"))
+		})
+
+		It("丢弃签名无效的键", func() {
+			snapshot := a.Snapshot("shared")
+			snapshot.Storage["shared"] = map[string]Data{"k": Data(`"evil"`)}
+			v := snapshot.Versions["shared"]["k"]
+			v.Clock.Time++
+			snapshot.Versions["shared"] = map[string]Version{"k": v}
+
+			Expect(b.Merge(snapshot)).ToNot(Succeed())
+			Expect(value(b, "shared", "k")).To(Equal("v"))
+		})
+	})
+
+	Context("确认写入", func() {
+		var (
+			wc *wire
+			c  *Ledger
+		)
+
+		BeforeEach(func() {
+			wc = &wire{}
+			c = New(wc, &MemoryStore{})
+		})
+
+		// persistConfirmed 在后台确认写入，同时在账本之间投递消息直到写入返回
+		persistConfirmed := func(timeout time.Duration, quorum int, peers ...*Ledger) error {
+			done := make(chan error, 1)
+			go func() {
+				_, err := a.PersistConfirmed(context.Background(), 10*time.Millisecond, timeout, "dhcp", "10.1.0.2", "peer", quorum)
+				done <- err
+			}()
+
+			var err error
+			Eventually(func() bool {
+				wa.flush(peers...)
+				wb.flush(a)
+				wc.flush(a)
+				select {
+				case err = <-done:
+					return true
+				default:
+					return false
+				}
+			}).Should(BeTrue())
+			return err
+		}
+
+		It("等待不同的对等节点确认", func() {
+			Expect(persistConfirmed(time.Minute, 2, b, c)).To(Succeed())
+			Expect(value(b, "dhcp", "10.1.0.2")).To(Equal("peer"))
+			Expect(value(c, "dhcp", "10.1.0.2")).To(Equal("peer"))
+		})
+
+		It("确认者签名包含写入的区块", func() {
+			id := identity(b)
+			done := make(chan []Ack, 1)
+			go func() {
+				acks, err := a.PersistConfirmed(context.Background(), 10*time.Millisecond, time.Minute, "dhcp", "10.1.0.2", "peer", 1)
+				Expect(err).ToNot(HaveOccurred())
+				done <- acks
+			}()
+
+			var acks []Ack
+			Eventually(func() bool {
+				wa.flush(b)
+				wb.flush(a)
+				select {
+				case acks = <-done:
+					return true
+				default:
+					return false
+				}
+			}).Should(BeTrue())
+
+			Expect(acks).To(HaveLen(1))
+			Expect(acks[0].Peer).To(Equal(id))
+			Expect(acks[0].Hash).ToNot(BeEmpty())
+			Expect(b.LastBlock().Hash).To(Equal(acks[0].Hash))
+			Expect(acks[0].Verify()).To(Succeed())
+		})
+
+		It("确认不足时超时", func() {
+			// b反复确认也只计算一次
+			Expect(persistConfirmed(200*time.Millisecond, 2, b)).ToNot(Succeed())
+			Expect(value(b, "dhcp", "10.1.0.2")).To(Equal("peer"))
+		})
+
+		It("不接受伪造的确认", func() {
+			other := identity(c)
+			done := make(chan error, 1)
+			go func() {
+				_, err := a.PersistConfirmed(context.Background(), 10*time.Millisecond, 200*time.Millisecond, "dhcp", "10.1.0.2", "peer", 1)
+				done <- err
+			}()
+
+			// b的确认被冒充为c的确认转发给a
+			var err error
+			Eventually(func() bool {
+				wa.flush(b)
+				wb.Lock()
+				messages := wb.messages
+				wb.messages = nil
+				wb.Unlock()
+				for _, m := range messages {
+					msg := decode(m)
+					if msg.Ack != nil {
+						msg.Ack.Peer = other
+						a.Update(a, encode(msg), nil)
+					}
+				}
+				select {
+				case err = <-done:
+					return true
+				default:
+					return false
+				}
+			}).Should(BeTrue())
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("订阅", func() {
+		It("本地和远程写入产生键变更事件", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			events := b.Watch(ctx, "hosts", "10.1.")
+
+			a.Add("hosts", map[string]interface{}{"10.1.0.1": "a"})
+			a.Add("other", map[string]interface{}{"10.1.0.1": "a"})
+			sync2(a, b, wa, wb)
+			b.Add("hosts", map[string]interface{}{"10.1.0.1": "b", "10.2.0.1": "b"})
+			b.Delete("hosts", "10.1.0.1")
+
+			var e Event
+			Eventually(events).Should(Receive(&e))
+			Expect(e).To(Equal(Event{Type: KeyAdded, Bucket: "hosts", Key: "10.1.0.1", New: Data(`"a"`)}))
+			Eventually(events).Should(Receive(&e))
+			Expect(e).To(Equal(Event{Type: KeyUpdated, Bucket: "hosts", Key: "10.1.0.1", Old: Data(`"a"`), New: Data(`"b"`)}))
+			Eventually(events).Should(Receive(&e))
+			Expect(e).To(Equal(Event{Type: KeyDeleted, Bucket: "hosts", Key: "10.1.0.1", Old: Data(`"b"`)}))
+			Consistently(events, 100*time.Millisecond).ShouldNot(Receive())
+
+			cancel()
+			Eventually(events).Should(BeClosed())
+		})
+
+		It("订阅者落后时合并同一个键的事件", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			events := a.Watch(ctx, "hosts", "")
+
+			// 投递goroutine最多已经取出一个队列的事件，剩下的仍然超过队列的长度
+			for i := 0; i < 2100; i++ {
+				a.Add("hosts", map[string]interface{}{"a": i})
+			}
+
+			var e Event
+			Eventually(events).Should(Receive(&e))
+			Expect(e.Type).To(Equal(KeyAdded))
+			received := 1
+			for e.New != Data("2099") {
+				Eventually(events).Should(Receive(&e))
+				Expect(e.Type).To(Equal(KeyUpdated))
+				received++
+			}
+			Expect(received).To(BeNumerically("<", 2100))
+			Consistently(events, 100*time.Millisecond).ShouldNot(Receive())
+		})
+
+		It("排队的事件过多时投递重新同步事件", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			events := a.Watch(ctx, "hosts", "")
+
+			keys := map[string]interface{}{}
+			for i := 0; i < 1100; i++ {
+				keys[fmt.Sprint(i)] = i
+			}
+			a.Add("hosts", keys)
+
+			Eventually(events).Should(Receive(Equal(Event{Type: KeyResync, Bucket: "hosts"})))
+			Consistently(events, 100*time.Millisecond).ShouldNot(Receive())
+		})
+
+		It("过期的键在回收时产生删除事件", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+			events := a.Watch(ctx, "", "")
+
+			a.Add("healthcheck", map[string]interface{}{"a": "a"}, WithTTL(50*time.Millisecond))
+			Eventually(events).Should(Receive(HaveField("Type", KeyAdded)))
+
+			time.Sleep(100 * time.Millisecond)
+			a.Add("foo", map[string]interface{}{"bar": "baz"})
+			Eventually(events).Should(Receive(Equal(Event{Type: KeyDeleted, Bucket: "healthcheck", Key: "a", Old: Data(`"a"`)})))
+		})
+	})
+})
@@ -0,0 +1,81 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain
+
+import (
+	"encoding/json"
+
+	"github.com/pkg/errors"
+)
+
+// MessageType 账本消息类型
+type MessageType string
+
+// 账本消息类型常量定义
+const (
+	DeltaMessage    MessageType = "delta"    // 单次写入的增量
+	HeadMessage     MessageType = "head"     // 定期公告的链头
+	BehindMessage   MessageType = "behind"   // 对等节点报告自己落后或状态不同，请求完整快照
+	SnapshotMessage MessageType = "snapshot" // 完整区块快照
+	ConfirmMessage  MessageType = "confirm"  // 携带写入的增量，请求持有该版本的对等节点确认
+	AckMessage      MessageType = "ack"      // 对等节点对写入的签名确认
+)
+
+// ledgerMessage 是在区块链房间中交换的账本消息
+// 旧版本节点直接发送完整区块，此时Type为空
+type ledgerMessage struct {
+	Type  MessageType
+	Delta *Delta `json:",omitempty"` // 增量（DeltaMessage、ConfirmMessage）
+	Block *Block `json:",omitempty"` // 完整区块（SnapshotMessage）
+	Ack   *Ack   `json:",omitempty"` // 写入确认（AckMessage）
+	Index int    `json:",omitempty"` // 发送者的链头索引（HeadMessage、BehindMessage）
+	Hash  string `json:",omitempty"` // 发送者的链头哈希（HeadMessage、BehindMessage）
+
+	Digest string `json:",omitempty"` // 发送者的状态摘要（HeadMessage、BehindMessage）
+}
+
+// encode 将消息编码为压缩后的字节
+func (m ledgerMessage) encode() ([]byte, error) {
+	b, err := json.Marshal(m)
+	if err != nil {
+		return nil, err
+	}
+	return compress(b).Bytes(), nil
+}
+
+// decodeMessage 解码压缩后的账本消息
+// 参数 b 为压缩后的字节数据
+func decodeMessage(b []byte) (*ledgerMessage, error) {
+	buf, err := deCompress(b)
+	if err != nil {
+		return nil, errors.Wrap(err, "解压失败")
+	}
+
+	m := &ledgerMessage{}
+	if err := json.Unmarshal(buf.Bytes(), m); err != nil {
+		return nil, errors.Wrap(err, "解析账本消息失败")
+	}
+
+	// 兼容旧版本节点：消息体本身就是一个完整区块
+	if m.Type == "" {
+		block := &Block{}
+		if err := json.Unmarshal(buf.Bytes(), block); err != nil {
+			return nil, errors.Wrap(err, "解析区块链数据失败")
+		}
+		m.Type = SnapshotMessage
+		m.Block = block
+	}
+
+	return m, nil
+}
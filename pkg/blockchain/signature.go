@@ -0,0 +1,130 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain
+
+import (
+	"encoding/json"
+
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/pkg/errors"
+)
+
+// signedOperation 是写入者签名的操作内容
+type signedOperation struct {
+	Type   OpType
+	Bucket string
+	Key    string
+	Value  Data
+	Clock  Clock
+
+	Expires int64 `json:",omitempty"`
+	Since   int64 `json:",omitempty"`
+	After   int64 `json:",omitempty"`
+}
+
+// payload 返回操作中被签名的字节
+func (op Operation) payload() []byte {
+	b, _ := json.Marshal(signedOperation{
+		Type:   op.Type,
+		Bucket: op.Bucket,
+		Key:    op.Key,
+		Value:  op.Value,
+		Clock:  op.Clock,
+
+		Expires: op.Expires,
+		Since:   op.Since,
+		After:   op.After,
+	})
+	return b
+}
+
+// Signer 返回写入者的对等节点ID，记录在操作的时钟中
+func (op Operation) Signer() string {
+	return op.Clock.Node
+}
+
+// sign 使用写入者的私钥对操作签名
+// 参数 k 为写入者的私钥，其对等节点ID必须与时钟中记录的写入者一致
+func (op *Operation) sign(k crypto.PrivKey) (err error) {
+	op.Signature, err = k.Sign(op.payload())
+	return
+}
+
+// Verify 使用写入者对等节点ID中的公钥验证操作的签名
+// 没有签名或者写入者ID无法提取公钥的操作都被视为无效
+func (op Operation) Verify() error {
+	if len(op.Signature) == 0 {
+		return errors.Errorf("键 '%s/%s' 缺少签名", op.Bucket, op.Key)
+	}
+
+	id, err := peer.Decode(op.Signer())
+	if err != nil {
+		return errors.Wrapf(err, "键 '%s/%s' 的写入者 '%s' 无效", op.Bucket, op.Key, op.Signer())
+	}
+
+	pub, err := id.ExtractPublicKey()
+	if err != nil {
+		return errors.Wrapf(err, "无法从写入者 '%s' 提取公钥", op.Signer())
+	}
+
+	ok, err := pub.Verify(op.payload(), op.Signature)
+	if err != nil {
+		return errors.Wrapf(err, "验证键 '%s/%s' 的签名失败", op.Bucket, op.Key)
+	}
+	if !ok {
+		return errors.Errorf("键 '%s/%s' 的签名无效（写入者 %s）", op.Bucket, op.Key, op.Signer())
+	}
+	return nil
+}
+
+// ResignLegacy 使用本地写入者的身份重新写入旧数据中属于本节点的键，返回重新写入的键数量
+// 旧版本节点写入的键没有版本信息和签名，对等节点会拒绝它们。键名是本节点的对等节点ID，
+// 或者值是PeerID字段为本节点ID的JSON对象时，键被视为属于本节点，以新的时钟签名并广播。
+// 其他节点的旧键在其写入者升级并调用ResignLegacy之前不会被同步，
+// 只存在于从未升级的节点上的键会丢失一次，通常它们会被写入者重新公告
+func (l *Ledger) ResignLegacy() int {
+	l.Lock()
+	last := l.blockchain.Last()
+	ops := []Operation{}
+	var clock Clock
+	for bucket, keys := range last.Storage {
+		for k, v := range keys {
+			if _, exists := last.Versions[bucket][k]; exists || !l.ownsLegacy(k, v) {
+				continue
+			}
+			if len(ops) == 0 {
+				clock = l.clock.tick(l.id)
+			}
+			ops = append(ops, Operation{Type: OpSet, Bucket: bucket, Key: k, Value: v, Clock: clock})
+		}
+	}
+	l.Unlock()
+
+	if len(ops) == 0 {
+		return 0
+	}
+	l.commit(ops)
+	return len(ops)
+}
+
+// ownsLegacy 如果没有版本信息的键属于本地写入者则返回true，调用者必须持有锁
+// 参数 key 为键名，v 为值
+func (l *Ledger) ownsLegacy(key string, v Data) bool {
+	if key == l.id {
+		return true
+	}
+	var owner struct{ PeerID string }
+	return v.Unmarshal(&owner) == nil && owner.PeerID == l.id
+}
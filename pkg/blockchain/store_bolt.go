@@ -0,0 +1,479 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain
+
+import (
+	"crypto/cipher"
+	"encoding/binary"
+	"encoding/json"
+	"log"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/peterbourgon/diskv"
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	boltBlocks = []byte("blocks") // 区块存储桶，键为大端序的区块索引
+	boltMeta   = []byte("meta")   // 元数据存储桶
+	boltLast   = []byte("last")   // 最后一个区块的索引
+)
+
+// SyncPolicy 是BoltStore的fsync策略
+type SyncPolicy int
+
+// fsync策略常量定义
+const (
+	SyncAlways   SyncPolicy = iota // 每次添加区块都fsync，崩溃后不会丢失已添加的区块
+	SyncInterval                   // 定期fsync，崩溃后可能丢失最近一个间隔内的区块
+	SyncNever                      // 从不主动fsync，由操作系统决定何时写入磁盘
+)
+
+// ParseSyncPolicy 解析fsync策略，可以是"always"、"never"或者定期fsync的间隔（例如"1s"）
+// 参数 s 为策略字符串
+func ParseSyncPolicy(s string) (SyncPolicy, time.Duration, error) {
+	switch s {
+	case "", "always":
+		return SyncAlways, 0, nil
+	case "never":
+		return SyncNever, 0, nil
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil || d <= 0 {
+		return SyncAlways, 0, errors.Errorf("无效的fsync策略 '%s'", s)
+	}
+	return SyncInterval, d, nil
+}
+
+// BoltStore 是基于嵌入式bbolt数据库的事务性存储
+// 区块和索引在同一个事务中写入，崩溃后存储总是处于某一次添加之前或之后的状态
+type BoltStore struct {
+	sync.Mutex
+	db      *bolt.DB
+	path    string        // 数据库文件路径
+	options *bolt.Options // 打开数据库的选项，Rekey替换文件之后使用相同的选项重新打开
+
+	retention    int
+	policy       SyncPolicy
+	syncInterval time.Duration
+	check        bool
+	readOnly     bool
+
+	secret []byte      // 派生加密密钥的密钥材料，为空时不加密
+	aead   cipher.AEAD // 加密区块的密钥，为空时区块以明文保存
+
+	last Block
+	done chan struct{}
+}
+
+// BoltOption 是BoltStore的选项
+type BoltOption func(s *BoltStore)
+
+// WithSyncPolicy 设置fsync策略，SyncInterval策略使用interval作为间隔
+// 参数 p 为fsync策略，interval 为定期fsync的间隔
+func WithSyncPolicy(p SyncPolicy, interval time.Duration) BoltOption {
+	return func(s *BoltStore) {
+		s.policy = p
+		s.syncInterval = interval
+	}
+}
+
+// WithRetention 设置保留的区块数量，更旧的区块在添加时被删除。为0时保留全部区块
+// 参数 n 为区块数量
+func WithRetention(n int) BoltOption {
+	return func(s *BoltStore) {
+		s.retention = n
+	}
+}
+
+// WithIntegrityCheck 在打开时对整个数据库进行一致性检查
+func WithIntegrityCheck() BoltOption {
+	return func(s *BoltStore) {
+		s.check = true
+	}
+}
+
+// WithReadOnly 以只读方式打开已有的数据库，不创建文件，也不写入任何数据
+// 只读的存储不能添加区块，多个进程可以同时以只读方式打开同一个数据库
+func WithReadOnly() BoltOption {
+	return func(s *BoltStore) {
+		s.readOnly = true
+	}
+}
+
+// NewBoltStore 打开或创建path处的bbolt存储
+// 打开时验证数据库文件和最后一个区块，如果检测到损坏则返回错误
+// 参数 path 为数据库文件路径，opts 为选项
+func NewBoltStore(path string, opts ...BoltOption) (*BoltStore, error) {
+	s := &BoltStore{policy: SyncAlways, done: make(chan struct{})}
+	for _, o := range opts {
+		o(s)
+	}
+
+	s.path = path
+	s.options = &bolt.Options{
+		Timeout:  time.Second,
+		NoSync:   s.policy != SyncAlways,
+		ReadOnly: s.readOnly,
+	}
+	db, err := bolt.Open(path, 0600, s.options)
+	if err != nil {
+		return nil, errors.Wrapf(err, "无法打开账本数据库 '%s'", path)
+	}
+	s.db = db
+
+	init := db.Update
+	if s.readOnly {
+		init = db.View
+	}
+	if err := init(s.init); err != nil {
+		db.Close()
+		return nil, errors.Wrapf(err, "无法打开账本数据库 '%s'", path)
+	}
+	if err := s.open(); err != nil {
+		db.Close()
+		return nil, errors.Wrapf(err, "账本数据库 '%s' 已损坏", path)
+	}
+
+	if s.policy == SyncInterval && s.syncInterval > 0 && !s.readOnly {
+		go s.syncer()
+	}
+	return s, nil
+}
+
+// init 创建存储桶并检查密钥，只读的事务中只检查存储桶是否存在
+func (s *BoltStore) init(tx *bolt.Tx) error {
+	if !tx.Writable() {
+		if tx.Bucket(boltBlocks) == nil || tx.Bucket(boltMeta) == nil {
+			return errors.New("不是账本数据库")
+		}
+		return s.unlock(tx)
+	}
+	if _, err := tx.CreateBucketIfNotExists(boltBlocks); err != nil {
+		return err
+	}
+	if _, err := tx.CreateBucketIfNotExists(boltMeta); err != nil {
+		return err
+	}
+	return s.unlock(tx)
+}
+
+// open 检查数据库并加载最后一个区块
+func (s *BoltStore) open() error {
+	return s.db.View(func(tx *bolt.Tx) error {
+		if s.check {
+			// 必须读取所有错误，检查在事务结束之前完成
+			var first error
+			for err := range tx.Check() {
+				if first == nil {
+					first = err
+				}
+			}
+			if first != nil {
+				return first
+			}
+		}
+
+		index := tx.Bucket(boltMeta).Get(boltLast)
+		if index == nil {
+			return nil
+		}
+
+		blocks := tx.Bucket(boltBlocks)
+		last, err := s.decode(index, blocks.Get(index))
+		if err != nil {
+			return errors.Wrap(err, "无法解析最后一个区块")
+		}
+		// 创世区块的哈希不是它自身的校验和
+		if last.Index > 0 && last.Checksum() != last.Hash {
+			return errors.Errorf("区块 %d 的哈希不匹配", last.Index)
+		}
+		if dat := blocks.Get(itob(last.Index - 1)); last.Index > 0 && dat != nil {
+			prev, err := s.decode(itob(last.Index-1), dat)
+			if err != nil || !last.IsValid(prev) {
+				return errors.Errorf("区块 %d 与前一区块不连续", last.Index)
+			}
+		}
+
+		s.last = last
+		return nil
+	})
+}
+
+// syncer 定期将数据写入磁盘
+func (s *BoltStore) syncer() {
+	t := time.NewTicker(s.syncInterval)
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+			if err := s.Sync(); err != nil {
+				log.Println(err)
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// Sync 立即将数据写入磁盘，不受fsync策略的影响
+func (s *BoltStore) Sync() error {
+	return s.database().Sync()
+}
+
+// database 返回当前的数据库，Rekey会替换数据库
+// 在返回的数据库上进行的事务会推迟它被关闭
+func (s *BoltStore) database() *bolt.DB {
+	s.Lock()
+	defer s.Unlock()
+	return s.db
+}
+
+// Close 将数据写入磁盘并关闭数据库
+func (s *BoltStore) Close() error {
+	close(s.done)
+	s.Lock()
+	defer s.Unlock()
+	if s.readOnly {
+		return s.db.Close()
+	}
+	if err := s.db.Sync(); err != nil {
+		log.Println(err)
+	}
+	return s.db.Close()
+}
+
+// Add 在一个事务中添加区块、更新索引并删除超出保留数量的区块
+// 参数 b 为要添加的区块
+func (s *BoltStore) Add(b Block) {
+	if err := s.add(false, b); err != nil {
+		log.Println(errors.Wrapf(err, "无法保存区块 %d", b.Index))
+	}
+}
+
+// Replace 在一个事务中用blocks替换存储中的所有区块
+// 参数 blocks 为按索引排序的区块
+func (s *BoltStore) Replace(blocks ...Block) error {
+	return s.add(true, blocks...)
+}
+
+// add 在一个事务中添加区块，reset为true时先删除所有区块
+func (s *BoltStore) add(reset bool, blocks ...Block) error {
+	if len(blocks) == 0 {
+		return nil
+	}
+
+	s.Lock()
+	defer s.Unlock()
+
+	err := s.db.Update(func(tx *bolt.Tx) error {
+		if reset {
+			if err := tx.DeleteBucket(boltBlocks); err != nil {
+				return err
+			}
+			if _, err := tx.CreateBucket(boltBlocks); err != nil {
+				return err
+			}
+		}
+
+		bucket := tx.Bucket(boltBlocks)
+		for _, b := range blocks {
+			dat, err := s.encode(b)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(itob(b.Index), dat); err != nil {
+				return err
+			}
+		}
+
+		last := blocks[len(blocks)-1]
+		if err := tx.Bucket(boltMeta).Put(boltLast, itob(last.Index)); err != nil {
+			return err
+		}
+
+		// 删除比最后一个区块更新的区块（例如重新创建的创世区块）和超出保留数量的区块
+		c := bucket.Cursor()
+		for k, _ := c.Seek(itob(last.Index + 1)); k != nil; k, _ = c.Next() {
+			if err := c.Delete(); err != nil {
+				return err
+			}
+		}
+		if s.retention > 0 && last.Index-s.retention+1 > 0 {
+			first := itob(last.Index - s.retention + 1)
+			for k, _ := c.First(); k != nil && string(k) < string(first); k, _ = c.Next() {
+				if err := c.Delete(); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	s.last = blocks[len(blocks)-1]
+	return nil
+}
+
+// Len 返回最后一个区块的索引
+func (s *BoltStore) Len() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.last.Index
+}
+
+// Last 返回最后一个区块
+func (s *BoltStore) Last() Block {
+	s.Lock()
+	defer s.Unlock()
+	return s.last
+}
+
+// Get 返回指定索引的区块
+// 参数 index 为区块索引
+func (s *BoltStore) Get(index int) (b Block, exists bool) {
+	s.database().View(func(tx *bolt.Tx) error {
+		k := itob(index)
+		dat := tx.Bucket(boltBlocks).Get(k)
+		if dat == nil {
+			return nil
+		}
+		var err error
+		b, err = s.decode(k, dat)
+		exists = err == nil
+		return nil
+	})
+	return
+}
+
+// Range 按顺序遍历索引范围内的区块，f返回false时停止
+// 参数 from 和 to 为区块索引范围，f 为遍历函数
+func (s *BoltStore) Range(from, to int, f func(Block) bool) {
+	if from < 0 {
+		from = 0
+	}
+	s.database().View(func(tx *bolt.Tx) error {
+		c := tx.Bucket(boltBlocks).Cursor()
+		for k, v := c.Seek(itob(from)); k != nil && btoi(k) <= to; k, v = c.Next() {
+			b, err := s.decode(k, v)
+			if err != nil {
+				log.Println(err)
+				continue
+			}
+			if !f(b) {
+				return nil
+			}
+		}
+		return nil
+	})
+}
+
+// MigrateDiskStore 将diskv状态目录中的区块复制到BoltStore
+// 只复制目标存储保留的区块，源目录不会被修改。返回复制的区块数量
+// 参数 d 为旧的diskv状态目录，dst 为目标存储
+func MigrateDiskStore(d *diskv.Diskv, dst *BoltStore) (int, error) {
+	index, err := d.Read("index")
+	if err != nil {
+		return 0, errors.Wrap(err, "状态目录中没有区块索引")
+	}
+	last, err := strconv.Atoi(string(index))
+	if err != nil {
+		return 0, errors.Wrap(err, "无法解析区块索引")
+	}
+
+	first := 0
+	if dst.retention > 0 && last-dst.retention+1 > first {
+		first = last - dst.retention + 1
+	}
+
+	src := NewDiskStore(d)
+	blocks := []Block{}
+	for i := first; i <= last; i++ {
+		b, exists := src.Get(i)
+		if !exists {
+			return 0, errors.Errorf("无法读取区块 %d", i)
+		}
+		blocks = append(blocks, b)
+	}
+
+	return len(blocks), dst.add(false, blocks...)
+}
+
+// EraseDiskStore 删除diskv状态目录中的区块和区块索引，删除之前用零覆盖文件的内容并写入磁盘，
+// 区块迁移到加密的存储之后不会在磁盘上留下明文。目录中的其他文件不受影响
+// 参数 d 为旧的diskv状态目录
+func EraseDiskStore(d *diskv.Diskv) error {
+	for k := range d.Keys(nil) {
+		if _, err := strconv.Atoi(k); err != nil && k != "index" {
+			continue
+		}
+		if err := zeroFile(filepath.Join(d.BasePath, filepath.Join(d.Transform(k)...), k)); err != nil {
+			return errors.Wrapf(err, "无法覆盖状态文件 '%s'", k)
+		}
+		if err := d.Erase(k); err != nil {
+			return errors.Wrapf(err, "无法删除状态文件 '%s'", k)
+		}
+	}
+	return nil
+}
+
+// zeroFile 用零覆盖文件的内容并写入磁盘
+// 参数 path 为文件路径
+func zeroFile(path string) error {
+	f, err := os.OpenFile(path, os.O_WRONLY, 0)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return zero(f)
+}
+
+// zero 用零覆盖已打开的文件的内容并写入磁盘
+// 参数 f 为以写入方式打开的文件
+func zero(f *os.File) error {
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(make([]byte, info.Size())); err != nil {
+		return err
+	}
+	return f.Sync()
+}
+
+// decodeBlock 解析JSON编码的区块
+func decodeBlock(dat []byte) (Block, error) {
+	b := Block{}
+	err := json.Unmarshal(dat, &b)
+	return b, err
+}
+
+// itob 将区块索引编码为大端序字节，使键的字节顺序与索引顺序一致
+func itob(i int) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, uint64(i))
+	return b
+}
+
+// btoi 解码大端序的区块索引
+func btoi(b []byte) int {
+	return int(binary.BigEndian.Uint64(b))
+}
@@ -0,0 +1,246 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain_test
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/peterbourgon/diskv"
+	bolt "go.etcd.io/bbolt"
+
+	. "github.com/purpose168/edgevpn/pkg/blockchain"
+)
+
+var _ = Describe("bbolt存储", func() {
+	var path string
+
+	BeforeEach(func() {
+		path = filepath.Join(GinkgoT().TempDir(), "ledger.db")
+	})
+
+	fill := func(l *Ledger, n int) {
+		for i := 0; i < n; i++ {
+			l.Add("foo", map[string]interface{}{fmt.Sprint(i % 3): i})
+		}
+	}
+
+	It("重新打开时恢复区块链", func() {
+		store, err := NewBoltStore(path, WithIntegrityCheck())
+		Expect(err).ToNot(HaveOccurred())
+		l := New(&wire{}, store)
+		fill(l, 5)
+		last := l.LastBlock()
+		Expect(store.Close()).To(Succeed())
+
+		store, err = NewBoltStore(path, WithIntegrityCheck())
+		Expect(err).ToNot(HaveOccurred())
+		defer store.Close()
+
+		Expect(store.Len()).To(Equal(last.Index))
+		Expect(store.Last().Hash).To(Equal(last.Hash))
+
+		l2 := New(&wire{}, store)
+		Expect(l2.LastBlock().Hash).To(Equal(last.Hash))
+		Expect(l2.CurrentData()).To(Equal(l.CurrentData()))
+
+		for i := 1; i <= last.Index; i++ {
+			b, exists := store.Get(i)
+			Expect(exists).To(BeTrue())
+			prev, _ := store.Get(i - 1)
+			Expect(b.IsValid(prev)).To(BeTrue())
+		}
+	})
+
+	It("删除超出保留数量的区块", func() {
+		store, err := NewBoltStore(path, WithRetention(3), WithSyncPolicy(SyncNever, 0))
+		Expect(err).ToNot(HaveOccurred())
+		defer store.Close()
+
+		l := New(&wire{}, store)
+		fill(l, 6)
+		last := l.LastBlock().Index
+
+		indexes := []int{}
+		store.Range(0, last, func(b Block) bool {
+			indexes = append(indexes, b.Index)
+			return true
+		})
+		Expect(indexes).To(Equal([]int{last - 2, last - 1, last}))
+		_, exists := store.Get(last - 3)
+		Expect(exists).To(BeFalse())
+	})
+
+	It("打开时检测损坏的区块", func() {
+		store, err := NewBoltStore(path)
+		Expect(err).ToNot(HaveOccurred())
+		fill(New(&wire{}, store), 3)
+		last := store.Last()
+		Expect(store.Close()).To(Succeed())
+
+		db, err := bolt.Open(path, 0600, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(db.Update(func(tx *bolt.Tx) error {
+			last.Storage["foo"]["0"] = Data(`"tampered"`)
+			dat, err := json.Marshal(last)
+			if err != nil {
+				return err
+			}
+			key := make([]byte, 8)
+			binary.BigEndian.PutUint64(key, uint64(last.Index))
+			return tx.Bucket([]byte("blocks")).Put(key, dat)
+		})).To(Succeed())
+		Expect(db.Close()).To(Succeed())
+
+		_, err = NewBoltStore(path)
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("从diskv状态目录迁移", func() {
+		dir := GinkgoT().TempDir()
+		d := diskv.New(diskv.Options{BasePath: dir})
+		l := New(&wire{}, NewDiskStore(d))
+		fill(l, 5)
+
+		store, err := NewBoltStore(path, WithRetention(2))
+		Expect(err).ToNot(HaveOccurred())
+		defer store.Close()
+
+		n, err := MigrateDiskStore(d, store)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(n).To(Equal(2))
+		Expect(store.Last().Hash).To(Equal(l.LastBlock().Hash))
+		Expect(New(&wire{}, store).CurrentData()).To(Equal(l.CurrentData()))
+	})
+
+	It("加密保存的区块", func() {
+		store, err := NewBoltStore(path, WithEncryption([]byte("token")))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(store.Encrypted()).To(BeTrue())
+		l := New(&wire{}, store)
+		l.Add("trustzoneAuth", map[string]interface{}{"ecdsa": "very-secret-public-key"})
+		data := l.CurrentData()
+		Expect(store.Close()).To(Succeed())
+
+		raw, err := os.ReadFile(path)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(raw)).ToNot(ContainSubstring("very-secret-public-key"))
+
+		_, err = NewBoltStore(path)
+		Expect(err).To(HaveOccurred())
+		_, err = NewBoltStore(path, WithEncryption([]byte("wrong")))
+		Expect(err).To(HaveOccurred())
+
+		store, err = NewBoltStore(path, WithEncryption([]byte("token")), WithIntegrityCheck())
+		Expect(err).ToNot(HaveOccurred())
+		defer store.Close()
+		Expect(New(&wire{}, store).CurrentData()).To(Equal(data))
+	})
+
+	It("重新加密已有的区块", func() {
+		store, err := NewBoltStore(path)
+		Expect(err).ToNot(HaveOccurred())
+		l := New(&wire{}, store)
+		fill(l, 3)
+		data := l.CurrentData()
+		Expect(store.Close()).To(Succeed())
+
+		// 未加密的数据库不会被隐式加密
+		_, err = NewBoltStore(path, WithEncryption([]byte("passphrase")))
+		Expect(err).To(HaveOccurred())
+
+		store, err = NewBoltStore(path)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(store.Rekey([]byte("passphrase"))).To(Succeed())
+		Expect(store.Encrypted()).To(BeTrue())
+		Expect(store.Close()).To(Succeed())
+
+		store, err = NewBoltStore(path, WithEncryption([]byte("passphrase")))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(New(&wire{}, store).CurrentData()).To(Equal(data))
+		Expect(store.Rekey(nil)).To(Succeed())
+		Expect(store.Close()).To(Succeed())
+
+		store, err = NewBoltStore(path)
+		Expect(err).ToNot(HaveOccurred())
+		defer store.Close()
+		Expect(store.Encrypted()).To(BeFalse())
+		Expect(New(&wire{}, store).CurrentData()).To(Equal(data))
+	})
+
+	It("重新加密之后数据库文件中没有明文", func() {
+		store, err := NewBoltStore(path)
+		Expect(err).ToNot(HaveOccurred())
+		l := New(&wire{}, store)
+		// 多次覆盖同一个键，旧的值留在数据库的空闲页中
+		for i := 0; i < 20; i++ {
+			l.Add("trustzoneAuth", map[string]interface{}{"ecdsa": fmt.Sprintf("very-secret-public-key-%d", i)})
+		}
+		data := l.CurrentData()
+		Expect(store.Rekey([]byte("passphrase"))).To(Succeed())
+
+		// 替换之后存储仍然可用
+		l.Add("foo", map[string]interface{}{"bar": "baz"})
+		Expect(store.Close()).To(Succeed())
+
+		raw, err := os.ReadFile(path)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(raw)).ToNot(ContainSubstring("very-secret-public-key"))
+		Expect(path + ".rekey").ToNot(BeAnExistingFile())
+
+		store, err = NewBoltStore(path, WithEncryption([]byte("passphrase")), WithIntegrityCheck())
+		Expect(err).ToNot(HaveOccurred())
+		defer store.Close()
+		Expect(New(&wire{}, store).CurrentData()["trustzoneAuth"]).To(Equal(data["trustzoneAuth"]))
+		Expect(value(New(&wire{}, store), "foo", "bar")).To(Equal("baz"))
+	})
+
+	It("拒绝在记录之间交换的密文", func() {
+		store, err := NewBoltStore(path, WithEncryption([]byte("token")))
+		Expect(err).ToNot(HaveOccurred())
+		fill(New(&wire{}, store), 4)
+		Expect(store.Close()).To(Succeed())
+
+		key := func(i uint64) []byte {
+			return binary.BigEndian.AppendUint64(nil, i)
+		}
+		db, err := bolt.Open(path, 0600, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(db.Update(func(tx *bolt.Tx) error {
+			blocks := tx.Bucket([]byte("blocks"))
+			one := append([]byte{}, blocks.Get(key(1))...)
+			two := append([]byte{}, blocks.Get(key(2))...)
+			if err := blocks.Put(key(1), two); err != nil {
+				return err
+			}
+			return blocks.Put(key(2), one)
+		})).To(Succeed())
+		Expect(db.Close()).To(Succeed())
+
+		store, err = NewBoltStore(path, WithEncryption([]byte("token")))
+		Expect(err).ToNot(HaveOccurred())
+		defer store.Close()
+		_, exists := store.Get(1)
+		Expect(exists).To(BeFalse())
+		_, exists = store.Get(2)
+		Expect(exists).To(BeFalse())
+		_, exists = store.Get(3)
+		Expect(exists).To(BeTrue())
+	})
+})
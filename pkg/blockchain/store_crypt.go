@@ -0,0 +1,278 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+	bolt "go.etcd.io/bbolt"
+	"golang.org/x/crypto/scrypt"
+)
+
+var (
+	boltSalt  = []byte("salt")  // 派生密钥的盐，只存在于加密的数据库中
+	boltCheck = []byte("check") // 加密的已知明文，用于在打开时检查密钥
+)
+
+// keyCheck 是用于检查密钥的已知明文
+var keyCheck = []byte("edgevpn ledger")
+
+// WithEncryption 使用从secret派生的密钥加密保存的区块
+// secret可以是网络令牌、口令或者密钥文件的内容，每个数据库使用随机的盐派生密钥
+// 参数 secret 为密钥材料
+func WithEncryption(secret []byte) BoltOption {
+	return func(s *BoltStore) {
+		s.secret = secret
+	}
+}
+
+// newAEAD 从secret和盐派生AES-256-GCM密钥
+func newAEAD(secret, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key(secret, salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal 加密数据，密文前附加随机的nonce
+// 密文与附加数据ad绑定，通常是记录的键，不同记录之间交换的密文无法解密
+func seal(aead cipher.AEAD, dat, ad []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(dat)+aead.Overhead())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, dat, ad), nil
+}
+
+// unseal 解密seal使用相同的附加数据加密的数据
+func unseal(aead cipher.AEAD, dat, ad []byte) ([]byte, error) {
+	if len(dat) < aead.NonceSize() {
+		return nil, errors.New("密文太短")
+	}
+	return aead.Open(nil, dat[:aead.NonceSize()], dat[aead.NonceSize():], ad)
+}
+
+// setKey 在事务中为secret生成新的盐和密钥检查值，secret为空时删除加密信息
+func setKey(tx *bolt.Tx, secret []byte) (cipher.AEAD, error) {
+	meta := tx.Bucket(boltMeta)
+	if len(secret) == 0 {
+		if err := meta.Delete(boltSalt); err != nil {
+			return nil, err
+		}
+		return nil, meta.Delete(boltCheck)
+	}
+
+	salt := make([]byte, 16)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return nil, err
+	}
+	aead, err := newAEAD(secret, salt)
+	if err != nil {
+		return nil, err
+	}
+	check, err := seal(aead, keyCheck, boltCheck)
+	if err != nil {
+		return nil, err
+	}
+	if err := meta.Put(boltSalt, salt); err != nil {
+		return nil, err
+	}
+	return aead, meta.Put(boltCheck, check)
+}
+
+// unlock 在事务中检查数据库的加密状态与密钥是否匹配
+// 新的数据库在配置了密钥时被加密（只读打开时除外），已有的未加密数据库需要使用Rekey加密
+func (s *BoltStore) unlock(tx *bolt.Tx) error {
+	meta := tx.Bucket(boltMeta)
+	salt := meta.Get(boltSalt)
+	switch {
+	case salt == nil && len(s.secret) == 0:
+		return nil
+	case salt == nil && meta.Get(boltLast) == nil && !tx.Writable():
+		// 只读打开的空数据库没有需要解密的区块
+		return nil
+	case salt == nil && meta.Get(boltLast) == nil:
+		var err error
+		s.aead, err = setKey(tx, s.secret)
+		return err
+	case salt == nil:
+		return errors.New("账本数据库没有加密，需要先重新加密")
+	case len(s.secret) == 0:
+		return errors.New("账本数据库已加密，需要提供密钥")
+	}
+
+	aead, err := newAEAD(s.secret, salt)
+	if err != nil {
+		return err
+	}
+	if check, err := unseal(aead, meta.Get(boltCheck), boltCheck); err != nil || string(check) != string(keyCheck) {
+		return errors.New("账本数据库的密钥错误")
+	}
+	s.aead = aead
+	return nil
+}
+
+// encode 编码区块，数据库加密时加密编码后的区块，密文与区块的键绑定
+func (s *BoltStore) encode(b Block) ([]byte, error) {
+	dat, err := json.Marshal(b)
+	if err != nil || s.aead == nil {
+		return dat, err
+	}
+	return seal(s.aead, dat, itob(b.Index))
+}
+
+// decode 解码encode编码的区块
+// 参数 k 为区块在数据库中的键，dat 为编码后的区块
+func (s *BoltStore) decode(k, dat []byte) (Block, error) {
+	if s.aead == nil {
+		return decodeBlock(dat)
+	}
+	plain, err := unseal(s.aead, dat, k)
+	if err != nil {
+		return Block{}, errors.Wrap(err, "无法解密区块")
+	}
+	return decodeBlock(plain)
+}
+
+// Encrypted 如果保存的区块被加密则返回true
+func (s *BoltStore) Encrypted() bool {
+	s.Lock()
+	defer s.Unlock()
+	return s.aead != nil
+}
+
+// Rekey 使用从secret派生的新密钥重新加密所有区块，secret为空时解密所有区块。
+// 区块被写入一个新的数据库文件，写入磁盘之后原子地替换原来的文件，然后用零覆盖原来的文件，
+// 旧密钥加密的或者明文的区块不会留在数据库的空闲页中
+// 参数 secret 为新的密钥材料
+func (s *BoltStore) Rekey(secret []byte) error {
+	s.Lock()
+	defer s.Unlock()
+
+	tmp := s.path + ".rekey"
+	os.Remove(tmp)
+	next, err := bolt.Open(tmp, 0600, &bolt.Options{Timeout: time.Second})
+	if err != nil {
+		return errors.Wrap(err, "无法创建新的账本数据库")
+	}
+	aead, err := s.copyTo(next, secret)
+	if err == nil {
+		err = next.Sync()
+	}
+	if cerr := next.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	// 在替换之前打开原来的文件，替换之后仍然可以覆盖它的内容
+	old, err := os.OpenFile(s.path, os.O_WRONLY, 0)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	defer old.Close()
+
+	if err := s.db.Close(); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	if err := os.Rename(tmp, s.path); err != nil {
+		os.Remove(tmp)
+		if db, rerr := bolt.Open(s.path, 0600, s.options); rerr == nil {
+			s.db = db
+		}
+		return errors.Wrap(err, "无法替换账本数据库")
+	}
+	syncDir(filepath.Dir(s.path))
+
+	db, err := bolt.Open(s.path, 0600, s.options)
+	if err != nil {
+		return errors.Wrap(err, "无法打开重新加密的账本数据库")
+	}
+	s.db, s.secret, s.aead = db, secret, aead
+
+	if err := zero(old); err != nil {
+		return errors.Wrap(err, "无法覆盖原来的账本数据库")
+	}
+	return nil
+}
+
+// copyTo 将区块和元数据复制到新的数据库，使用从secret派生的新密钥加密，返回新的密钥
+// 参数 next 为新的空数据库，secret 为新的密钥材料
+func (s *BoltStore) copyTo(next *bolt.DB, secret []byte) (aead cipher.AEAD, err error) {
+	err = s.db.View(func(src *bolt.Tx) error {
+		return next.Update(func(dst *bolt.Tx) error {
+			blocks, err := dst.CreateBucket(boltBlocks)
+			if err != nil {
+				return err
+			}
+			meta, err := dst.CreateBucket(boltMeta)
+			if err != nil {
+				return err
+			}
+			// 加密信息由setKey重新生成
+			if err := src.Bucket(boltMeta).ForEach(func(k, v []byte) error {
+				if bytes.Equal(k, boltSalt) || bytes.Equal(k, boltCheck) {
+					return nil
+				}
+				return meta.Put(append([]byte{}, k...), append([]byte{}, v...))
+			}); err != nil {
+				return err
+			}
+
+			if aead, err = setKey(dst, secret); err != nil {
+				return err
+			}
+			to := &BoltStore{aead: aead}
+			return src.Bucket(boltBlocks).ForEach(func(k, v []byte) error {
+				b, err := s.decode(k, v)
+				if err != nil {
+					return errors.Wrapf(err, "区块 %d", btoi(k))
+				}
+				dat, err := to.encode(b)
+				if err != nil {
+					return err
+				}
+				return blocks.Put(itob(b.Index), dat)
+			})
+		})
+	})
+	return
+}
+
+// syncDir 将目录项写入磁盘，使重命名在崩溃之后仍然有效。不支持的平台上忽略错误
+// 参数 dir 为目录路径
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
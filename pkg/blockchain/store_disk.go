@@ -66,3 +66,27 @@ func (m *DiskStore) Last() Block {
 
 	return *b
 }
+
+// Get 返回指定索引的区块
+// 参数 index 为区块索引
+func (m *DiskStore) Get(index int) (Block, bool) {
+	b := Block{}
+	dat, err := m.chain.Read(fmt.Sprint(index))
+	if err != nil {
+		return b, false
+	}
+	if err := json.Unmarshal(dat, &b); err != nil {
+		return b, false
+	}
+	return b, true
+}
+
+// Range 按顺序遍历索引范围内的区块，f返回false时停止
+// 参数 from 和 to 为区块索引范围，f 为遍历函数
+func (m *DiskStore) Range(from, to int, f func(Block) bool) {
+	for i := from; i <= to; i++ {
+		if b, exists := m.Get(i); exists && !f(b) {
+			return
+		}
+	}
+}
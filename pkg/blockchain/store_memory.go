@@ -39,6 +39,30 @@ func (m *MemoryStore) Len() int {
 	return m.block.Index
 }
 
+// Get 返回指定索引的区块，内存存储只保留最后一个区块
+// 参数 index 为区块索引
+func (m *MemoryStore) Get(index int) (Block, bool) {
+	m.Lock()
+	defer m.Unlock()
+	if m.block == nil || m.block.Index != index {
+		return Block{}, false
+	}
+	return *m.block, true
+}
+
+// Range 遍历索引范围内的区块，内存存储只保留最后一个区块
+// 参数 from 和 to 为区块索引范围，f 为遍历函数
+func (m *MemoryStore) Range(from, to int, f func(Block) bool) {
+	m.Lock()
+	if m.block == nil || m.block.Index < from || m.block.Index > to {
+		m.Unlock()
+		return
+	}
+	b := *m.block
+	m.Unlock()
+	f(b)
+}
+
 // Last 返回最后一个区块
 func (m *MemoryStore) Last() Block {
 	m.Lock()
@@ -0,0 +1,459 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"sort"
+	"sync"
+)
+
+// KV 是WindowStore使用的键值存储后端，*diskv.Diskv实现了该接口
+type KV interface {
+	Read(key string) ([]byte, error)
+	Write(key string, val []byte) error
+	Erase(key string) error
+}
+
+// MemoryKV 是内存中的键值存储后端
+type MemoryKV struct {
+	sync.Mutex
+	data map[string][]byte
+}
+
+// Read 读取键的值
+func (m *MemoryKV) Read(key string) ([]byte, error) {
+	m.Lock()
+	defer m.Unlock()
+	v, exists := m.data[key]
+	if !exists {
+		return nil, fmt.Errorf("键 '%s' 不存在", key)
+	}
+	return v, nil
+}
+
+// Write 写入键的值
+func (m *MemoryKV) Write(key string, val []byte) error {
+	m.Lock()
+	defer m.Unlock()
+	if m.data == nil {
+		m.data = map[string][]byte{}
+	}
+	m.data[key] = val
+	return nil
+}
+
+// Erase 删除键
+func (m *MemoryKV) Erase(key string) error {
+	m.Lock()
+	defer m.Unlock()
+	delete(m.data, key)
+	return nil
+}
+
+// 默认的历史窗口和快照间隔
+const (
+	DefaultHistoryWindow    = 1000
+	DefaultSnapshotInterval = 100
+)
+
+// WindowStore 保留最近一个窗口的历史区块
+// 每个区块只保存相对于前一区块的变更，每隔固定数量的区块写入一个完整的压缩快照，
+// 窗口之外的区块和不再需要的快照被修剪
+type WindowStore struct {
+	sync.Mutex
+	kv KV
+
+	window, interval int
+
+	meta windowMeta
+	last Block
+}
+
+// windowMeta 是WindowStore持久化的索引信息
+type windowMeta struct {
+	First, Last int   // 保留的第一个和最后一个区块索引
+	Snapshots   []int // 快照的区块索引，升序
+}
+
+// blockDiff 是区块相对于前一区块的变更，nil值表示删除
+type blockDiff struct {
+	Format    int `json:",omitempty"`
+	Index     int
+	Timestamp string
+	Hash      string
+	PrevHash  string
+
+	Storage  map[string]map[string]*Data    `json:",omitempty"`
+	Versions map[string]map[string]*Version `json:",omitempty"`
+	Horizon  int64                          `json:",omitempty"`
+}
+
+// WindowOption 是WindowStore的选项
+type WindowOption func(w *WindowStore)
+
+// WithHistoryWindow 设置保留的历史区块数量
+// 参数 n 为区块数量
+func WithHistoryWindow(n int) WindowOption {
+	return func(w *WindowStore) {
+		w.window = n
+	}
+}
+
+// WithSnapshotInterval 设置写入完整快照的区块间隔
+// 参数 n 为区块数量
+func WithSnapshotInterval(n int) WindowOption {
+	return func(w *WindowStore) {
+		w.interval = n
+	}
+}
+
+// NewWindowStore 创建新的历史窗口存储，如果后端中已有数据则从中恢复
+// 参数 kv 为键值存储后端，opts 为选项
+func NewWindowStore(kv KV, opts ...WindowOption) *WindowStore {
+	w := &WindowStore{kv: kv, window: DefaultHistoryWindow, interval: DefaultSnapshotInterval}
+	for _, o := range opts {
+		o(w)
+	}
+	if w.window < 1 {
+		w.window = 1
+	}
+	if w.interval < 1 {
+		w.interval = 1
+	}
+
+	if dat, err := kv.Read("meta"); err == nil && json.Unmarshal(dat, &w.meta) == nil && len(w.meta.Snapshots) > 0 {
+		if b, err := w.get(w.meta.Last); err == nil {
+			w.last = b
+		} else {
+			log.Println(err)
+			w.meta = windowMeta{}
+		}
+	}
+	return w
+}
+
+// Add 添加区块，必要时写入快照并修剪窗口之外的区块
+// 参数 b 为要添加的区块
+func (w *WindowStore) Add(b Block) {
+	w.Lock()
+	defer w.Unlock()
+
+	empty := len(w.meta.Snapshots) == 0
+	switch {
+	case empty || b.Index != w.last.Index+1 || b.Index%w.interval == 0:
+		// 不连续的区块（例如创世区块）无法表示为变更，直接写入快照
+		if !empty && b.Index != w.last.Index+1 {
+			w.reset()
+		}
+		if err := w.write(fmt.Sprintf("snapshot-%d", b.Index), b); err != nil {
+			log.Println(err)
+			return
+		}
+		w.meta.Snapshots = append(w.meta.Snapshots, b.Index)
+		if len(w.meta.Snapshots) == 1 {
+			w.meta.First = b.Index
+		}
+	default:
+		if err := w.write(fmt.Sprintf("diff-%d", b.Index), diff(w.last, b)); err != nil {
+			log.Println(err)
+			return
+		}
+	}
+
+	w.meta.Last = b.Index
+	w.last = b
+	w.prune()
+
+	if err := w.write("meta", w.meta); err != nil {
+		log.Println(err)
+	}
+}
+
+// Len 返回最后一个区块的索引
+func (w *WindowStore) Len() int {
+	w.Lock()
+	defer w.Unlock()
+	return w.last.Index
+}
+
+// Last 返回最后一个区块
+func (w *WindowStore) Last() Block {
+	w.Lock()
+	defer w.Unlock()
+	return w.last
+}
+
+// Get 返回指定索引的历史区块，不在窗口内的区块返回false
+// 参数 index 为区块索引
+func (w *WindowStore) Get(index int) (Block, bool) {
+	w.Lock()
+	defer w.Unlock()
+
+	b, err := w.get(index)
+	return b, err == nil
+}
+
+// Range 按顺序遍历索引在[from, to]之间且仍在窗口内的区块，f返回false时停止
+// 参数 from 和 to 为区块索引范围，f 为遍历函数
+func (w *WindowStore) Range(from, to int, f func(Block) bool) {
+	w.Lock()
+	if from < w.meta.First {
+		from = w.meta.First
+	}
+	if to > w.meta.Last {
+		to = w.meta.Last
+	}
+	if len(w.meta.Snapshots) == 0 || from > to {
+		w.Unlock()
+		return
+	}
+
+	b, err := w.get(from)
+	if err != nil {
+		w.Unlock()
+		log.Println(err)
+		return
+	}
+	blocks := []Block{b}
+	for i := from + 1; i <= to; i++ {
+		if b, err = w.next(b, i); err != nil {
+			log.Println(err)
+			break
+		}
+		blocks = append(blocks, b)
+	}
+	w.Unlock()
+
+	for _, b := range blocks {
+		if !f(b) {
+			return
+		}
+	}
+}
+
+// get 从最近的快照开始重放变更重建区块，调用者必须持有锁
+func (w *WindowStore) get(index int) (Block, error) {
+	if index < w.meta.First || index > w.meta.Last || len(w.meta.Snapshots) == 0 {
+		return Block{}, fmt.Errorf("区块 %d 不在历史窗口内", index)
+	}
+
+	i := sort.SearchInts(w.meta.Snapshots, index+1) - 1
+	if i < 0 {
+		return Block{}, fmt.Errorf("区块 %d 没有可用的快照", index)
+	}
+
+	b := Block{}
+	if err := w.read(fmt.Sprintf("snapshot-%d", w.meta.Snapshots[i]), &b); err != nil {
+		return Block{}, err
+	}
+	for j := b.Index + 1; j <= index; j++ {
+		var err error
+		if b, err = w.next(b, j); err != nil {
+			return Block{}, err
+		}
+	}
+	return b, nil
+}
+
+// next 在区块上应用索引为index的变更，调用者必须持有锁
+func (w *WindowStore) next(b Block, index int) (Block, error) {
+	if w.isSnapshot(index) {
+		next := Block{}
+		err := w.read(fmt.Sprintf("snapshot-%d", index), &next)
+		return next, err
+	}
+
+	d := blockDiff{}
+	if err := w.read(fmt.Sprintf("diff-%d", index), &d); err != nil {
+		return Block{}, err
+	}
+	return d.apply(b), nil
+}
+
+// prune 删除窗口之外的区块，只保留重建窗口内区块所需的最近一个快照，调用者必须持有锁
+func (w *WindowStore) prune() {
+	first := w.meta.Last - w.window + 1
+	if first <= w.meta.First {
+		return
+	}
+
+	// 重建first所需的快照
+	i := sort.SearchInts(w.meta.Snapshots, first+1) - 1
+	if i <= 0 {
+		w.meta.First = first
+		return
+	}
+	base := w.meta.Snapshots[i]
+
+	// 最早保存的区块总是第一个快照
+	for j := w.meta.Snapshots[0]; j < base; j++ {
+		if w.isSnapshot(j) {
+			w.kv.Erase(fmt.Sprintf("snapshot-%d", j))
+		} else {
+			w.kv.Erase(fmt.Sprintf("diff-%d", j))
+		}
+	}
+	w.meta.Snapshots = w.meta.Snapshots[i:]
+	w.meta.First = first
+}
+
+// reset 删除所有保存的区块，调用者必须持有锁
+func (w *WindowStore) reset() {
+	if len(w.meta.Snapshots) == 0 {
+		return
+	}
+	for j := w.meta.Snapshots[0]; j <= w.meta.Last; j++ {
+		w.kv.Erase(fmt.Sprintf("snapshot-%d", j))
+		w.kv.Erase(fmt.Sprintf("diff-%d", j))
+	}
+	w.meta = windowMeta{}
+}
+
+// isSnapshot 如果索引处保存的是完整快照则返回true，调用者必须持有锁
+func (w *WindowStore) isSnapshot(index int) bool {
+	i := sort.SearchInts(w.meta.Snapshots, index)
+	return i < len(w.meta.Snapshots) && w.meta.Snapshots[i] == index
+}
+
+// write 编码并写入键的值
+func (w *WindowStore) write(key string, v interface{}) error {
+	dat, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return w.kv.Write(key, dat)
+}
+
+// read 读取并解码键的值
+func (w *WindowStore) read(key string, v interface{}) error {
+	dat, err := w.kv.Read(key)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(dat, v)
+}
+
+// diff 计算区块相对于前一区块的变更
+// 参数 old 为前一区块，new 为新区块
+func diff(old, new Block) blockDiff {
+	d := blockDiff{
+		Format:    new.Format,
+		Index:     new.Index,
+		Timestamp: new.Timestamp,
+		Hash:      new.Hash,
+		PrevHash:  new.PrevHash,
+		Storage:   map[string]map[string]*Data{},
+		Versions:  map[string]map[string]*Version{},
+		Horizon:   new.Horizon,
+	}
+
+	for bucket, keys := range new.Storage {
+		for k, v := range keys {
+			if prev, exists := old.Storage[bucket][k]; !exists || prev != v {
+				v := v
+				setDiff(d.Storage, bucket, k, &v)
+			}
+		}
+	}
+	for bucket, keys := range old.Storage {
+		for k := range keys {
+			if _, exists := new.Storage[bucket][k]; !exists {
+				setDiff(d.Storage, bucket, k, nil)
+			}
+		}
+	}
+
+	for bucket, keys := range new.Versions {
+		for k, v := range keys {
+			if prev, exists := old.Versions[bucket][k]; !exists || !sameVersion(prev, v) {
+				v := v
+				setDiff(d.Versions, bucket, k, &v)
+			}
+		}
+	}
+	for bucket, keys := range old.Versions {
+		for k := range keys {
+			if _, exists := new.Versions[bucket][k]; !exists {
+				setDiff(d.Versions, bucket, k, nil)
+			}
+		}
+	}
+	return d
+}
+
+// apply 在前一区块上应用变更，返回新区块
+// 参数 b 为前一区块，不会被修改
+func (d blockDiff) apply(b Block) Block {
+	s := newState(b)
+	for bucket, keys := range d.Storage {
+		for k, v := range keys {
+			if v == nil {
+				delete(s.storage[bucket], k)
+				if len(s.storage[bucket]) == 0 {
+					delete(s.storage, bucket)
+				}
+				continue
+			}
+			if _, exists := s.storage[bucket]; !exists {
+				s.storage[bucket] = map[string]Data{}
+			}
+			s.storage[bucket][k] = *v
+		}
+	}
+	for bucket, keys := range d.Versions {
+		for k, v := range keys {
+			if v == nil {
+				delete(s.versions[bucket], k)
+				if len(s.versions[bucket]) == 0 {
+					delete(s.versions, bucket)
+				}
+				continue
+			}
+			if _, exists := s.versions[bucket]; !exists {
+				s.versions[bucket] = map[string]Version{}
+			}
+			s.versions[bucket][k] = *v
+		}
+	}
+
+	next := Block{
+		Format:    d.Format,
+		Index:     d.Index,
+		Timestamp: d.Timestamp,
+		Storage:   s.storage,
+		Hash:      d.Hash,
+		PrevHash:  d.PrevHash,
+		Horizon:   d.Horizon,
+	}
+	if len(s.versions) > 0 {
+		next.Versions = s.versions
+	}
+	return next
+}
+
+// setDiff 记录存储桶中键的变更
+func setDiff[T any](m map[string]map[string]*T, bucket, key string, v *T) {
+	if _, exists := m[bucket]; !exists {
+		m[bucket] = map[string]*T{}
+	}
+	m[bucket][key] = v
+}
+
+// sameVersion 如果两个版本相同则返回true
+func sameVersion(a, b Version) bool {
+	return a.Clock == b.Clock && a.Deleted == b.Deleted && a.Expires == b.Expires && string(a.Signature) == string(b.Signature) && a.Since == b.Since && a.After == b.After
+}
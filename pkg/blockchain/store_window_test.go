@@ -0,0 +1,108 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain_test
+
+import (
+	"fmt"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/purpose168/edgevpn/pkg/blockchain"
+)
+
+var _ = Describe("历史窗口存储", func() {
+	var (
+		kv     *MemoryKV
+		store  *WindowStore
+		l      *Ledger
+		blocks map[int]Block
+	)
+
+	BeforeEach(func() {
+		kv = &MemoryKV{}
+		store = NewWindowStore(kv, WithHistoryWindow(5), WithSnapshotInterval(3))
+		l = New(&wire{}, store)
+
+		blocks = map[int]Block{}
+		blocks[0] = l.LastBlock()
+		for i := 0; i < 12; i++ {
+			l.Add("foo", map[string]interface{}{fmt.Sprint(i % 4): i})
+			blocks[l.LastBlock().Index] = l.LastBlock()
+			if i%5 == 0 {
+				l.Delete("foo", "0")
+				blocks[l.LastBlock().Index] = l.LastBlock()
+			}
+		}
+	})
+
+	It("从快照和变更重建窗口内的区块", func() {
+		last := l.LastBlock().Index
+		for i := last - 4; i <= last; i++ {
+			b, exists := store.Get(i)
+			Expect(exists).To(BeTrue(), fmt.Sprint(i))
+			Expect(b.Hash).To(Equal(blocks[i].Hash))
+			Expect(b.Digest()).To(Equal(blocks[i].Digest()))
+			Expect(b.IsValid(blocks[i-1])).To(BeTrue())
+		}
+
+		indexes := []int{}
+		store.Range(0, last, func(b Block) bool {
+			Expect(b.Digest()).To(Equal(blocks[b.Index].Digest()))
+			indexes = append(indexes, b.Index)
+			return true
+		})
+		Expect(indexes[0]).To(BeNumerically("<=", last-4))
+		Expect(indexes[len(indexes)-1]).To(Equal(last))
+	})
+
+	It("修剪窗口之外的区块和快照", func() {
+		_, exists := store.Get(1)
+		Expect(exists).To(BeFalse())
+		_, err := kv.Read("snapshot-0")
+		Expect(err).To(HaveOccurred())
+		_, err = kv.Read("diff-1")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("重新打开时从后端恢复", func() {
+		reopened := NewWindowStore(kv, WithHistoryWindow(5), WithSnapshotInterval(3))
+		Expect(reopened.Last().Hash).To(Equal(l.LastBlock().Hash))
+
+		l2 := New(&wire{}, reopened)
+		Expect(l2.LastBlock().Hash).To(Equal(l.LastBlock().Hash))
+		Expect(l2.CurrentData()).To(Equal(l.CurrentData()))
+	})
+
+	It("记录键的修改历史", func() {
+		wb := &wire{}
+		a := New(&wire{}, NewWindowStore(&MemoryKV{}))
+		b := New(wb, &MemoryStore{})
+		idA, idB := identity(a), identity(b)
+
+		a.Add("hosts", map[string]interface{}{"10.1.0.1": "a"})
+		b.Add("hosts", map[string]interface{}{"10.1.0.1": "b"})
+		wb.flush(a)
+		a.Delete("hosts", "10.1.0.1")
+
+		revisions := a.KeyHistory("hosts", "10.1.0.1")
+		Expect(revisions).To(HaveLen(3))
+		Expect(revisions[0].Writer).To(Equal(idA))
+		Expect(revisions[0].Value).To(Equal(Data(`"a"`)))
+		Expect(revisions[1].Writer).To(Equal(idB))
+		Expect(revisions[1].Value).To(Equal(Data(`"b"`)))
+		Expect(revisions[2].Writer).To(Equal(idA))
+		Expect(revisions[2].Deleted).To(BeTrue())
+	})
+})
@@ -0,0 +1,130 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"sort"
+)
+
+// Head 描述账本的当前状态，对等节点通过比较Head找出不同的存储桶
+type Head struct {
+	Index   int               // 最后一个区块的索引
+	Hash    string            // 最后一个区块的哈希
+	Digest  string            // 完整状态的摘要
+	Buckets map[string]string // 每个存储桶的状态摘要
+}
+
+// Diff 返回两个Head中摘要不同的存储桶，包括只存在于其中一方的存储桶
+// 参数 o 为对方的Head
+func (h Head) Diff(o Head) []string {
+	if h.Digest == o.Digest {
+		return nil
+	}
+
+	buckets := []string{}
+	for b, d := range h.Buckets {
+		if o.Buckets[b] != d {
+			buckets = append(buckets, b)
+		}
+	}
+	for b := range o.Buckets {
+		if _, exists := h.Buckets[b]; !exists {
+			buckets = append(buckets, b)
+		}
+	}
+	sort.Strings(buckets)
+	return buckets
+}
+
+// BucketDigests 返回每个存储桶（存储和版本信息）的摘要
+// 与Digest一样不依赖于区块在链中的位置，只有墓碑的存储桶也有摘要
+func (b Block) BucketDigests() map[string]string {
+	buckets := map[string]bool{}
+	for bucket, keys := range b.Storage {
+		buckets[bucket] = buckets[bucket] || len(keys) > 0
+	}
+	for bucket, keys := range b.Versions {
+		buckets[bucket] = buckets[bucket] || len(keys) > 0
+	}
+
+	digests := map[string]string{}
+	for bucket, nonEmpty := range buckets {
+		if !nonEmpty {
+			continue
+		}
+		record := struct {
+			Storage  map[string]Data
+			Versions map[string]Version
+		}{}
+		// 空的map与不存在的map等价
+		if len(b.Storage[bucket]) > 0 {
+			record.Storage = b.Storage[bucket]
+		}
+		if len(b.Versions[bucket]) > 0 {
+			record.Versions = b.Versions[bucket]
+		}
+		dat, _ := json.Marshal(record)
+		h := sha256.Sum256(dat)
+		digests[bucket] = hex.EncodeToString(h[:])
+	}
+	return digests
+}
+
+// Head 返回账本的当前状态
+func (l *Ledger) Head() Head {
+	last := l.LastBlock()
+	return Head{Index: last.Index, Hash: last.Hash, Digest: last.Digest(), Buckets: last.BucketDigests()}
+}
+
+// Snapshot 返回只包含指定存储桶的状态，对方可以通过Merge合并
+// 没有指定存储桶时返回完整状态
+// 参数 buckets 为存储桶名称
+func (l *Ledger) Snapshot(buckets ...string) Block {
+	last := l.LastBlock()
+	if len(buckets) == 0 {
+		return last
+	}
+
+	snapshot := Block{
+		Format:    last.Format,
+		Index:     last.Index,
+		Timestamp: last.Timestamp,
+		Storage:   map[string]map[string]Data{},
+		Versions:  map[string]map[string]Version{},
+		Horizon:   last.Horizon,
+	}
+	for _, bucket := range buckets {
+		if keys, exists := last.Storage[bucket]; exists {
+			snapshot.Storage[bucket] = keys
+		}
+		// 请求的存储桶总是出现在版本信息中，接收方据此知道对方没有哪些键
+		snapshot.Versions[bucket] = last.Versions[bucket]
+		if snapshot.Versions[bucket] == nil {
+			snapshot.Versions[bucket] = map[string]Version{}
+		}
+	}
+	return snapshot
+}
+
+// SetPuller 设置直接从对等节点拉取状态的函数
+// 收到状态不同的链头公告时调用f，f返回错误时回退到通过广播请求完整快照
+// 参数 f 为拉取函数，参数为公告者的对等节点ID
+func (l *Ledger) SetPuller(f func(peer string) error) {
+	l.Lock()
+	defer l.Unlock()
+	l.puller = f
+}
@@ -0,0 +1,218 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package blockchain
+
+import (
+	"context"
+	"strings"
+	"sync"
+)
+
+// EventType 键变更事件类型
+type EventType string
+
+// 键变更事件类型常量定义
+const (
+	KeyAdded   EventType = "added"   // 新增键
+	KeyUpdated EventType = "updated" // 键的值发生变化
+	KeyDeleted EventType = "deleted" // 删除键（包括过期回收）
+	KeyResync  EventType = "resync"  // 订阅者落后太多，排队的事件被丢弃，需要重新读取账本
+)
+
+// watchQueueSize 是每个订阅者最多排队的事件数量
+const watchQueueSize = 1024
+
+// Event 表示应用区块时单个键的变更
+type Event struct {
+	Type   EventType // 事件类型
+	Bucket string    // 存储桶名称
+	Key    string    // 键名
+	Old    Data      // 变更前的值（KeyAdded时为空）
+	New    Data      // 变更后的值（KeyDeleted时为空）
+}
+
+// watcher 是一个订阅者，事件在内部排队，不会阻塞账本
+type watcher struct {
+	sync.Mutex
+	bucket, prefix string
+
+	queue  []Event
+	notify chan struct{}
+}
+
+// matches 如果事件属于订阅的存储桶和键前缀则返回true
+func (w *watcher) matches(e Event) bool {
+	return (w.bucket == "" || w.bucket == e.Bucket) && strings.HasPrefix(e.Key, w.prefix)
+}
+
+// push 将事件加入队列并唤醒投递goroutine
+// 排队的事件达到watchQueueSize时，同一个键的事件被合并为一个，只保留变更前后的值；
+// 合并之后仍然太多时全部丢弃，改为投递一个KeyResync事件
+func (w *watcher) push(events []Event) {
+	w.Lock()
+	for _, e := range events {
+		if !w.matches(e) {
+			continue
+		}
+		if len(w.queue) == 1 && w.queue[0].Type == KeyResync {
+			break
+		}
+		if len(w.queue) >= watchQueueSize {
+			w.compact()
+		}
+		if len(w.queue) >= watchQueueSize {
+			w.queue = []Event{{Type: KeyResync, Bucket: w.bucket}}
+			break
+		}
+		w.queue = append(w.queue, e)
+	}
+	w.Unlock()
+
+	select {
+	case w.notify <- struct{}{}:
+	default:
+	}
+}
+
+// compact 将队列中同一个键的事件合并到它第一次出现的位置，调用者必须持有锁
+func (w *watcher) compact() {
+	pending := map[string]int{}
+	queue := w.queue[:0]
+	for _, e := range w.queue {
+		id := e.Bucket + "/" + e.Key
+		if i, exists := pending[id]; exists {
+			queue[i] = coalesce(queue[i], e)
+			continue
+		}
+		pending[id] = len(queue)
+		queue = append(queue, e)
+	}
+
+	// 删除值没有变化的事件
+	w.queue = queue[:0]
+	for _, e := range queue {
+		if e.Type != "" {
+			w.queue = append(w.queue, e)
+		}
+	}
+}
+
+// coalesce 将同一个键的两个连续事件合并为一个，值没有变化时返回空类型的事件
+// 参数 prev 为排队的事件，e 为之后的事件
+func coalesce(prev, e Event) Event {
+	merged := Event{Bucket: e.Bucket, Key: e.Key, Old: prev.Old, New: e.New}
+	switch {
+	case prev.Type == KeyAdded && e.Type == KeyDeleted:
+		// 添加后又删除，订阅者看不到变化
+	case prev.Type == KeyAdded:
+		merged.Type = KeyAdded
+	case e.Type == KeyDeleted:
+		merged.Type = KeyDeleted
+	case merged.Old != merged.New:
+		// 多次更新，或者删除后重新添加
+		merged.Type = KeyUpdated
+	}
+	return merged
+}
+
+// run 按顺序将排队的事件投递到out，直到上下文取消
+func (w *watcher) run(ctx context.Context, out chan<- Event) {
+	defer close(out)
+	for {
+		w.Lock()
+		queue := w.queue
+		w.queue = nil
+		w.Unlock()
+
+		for _, e := range queue {
+			select {
+			case out <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+
+		select {
+		case <-w.notify:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Watch 订阅存储桶中键的变更，返回的通道在上下文取消后关闭
+// 本地写入和接收到的远程区块在应用后都会产生事件，事件按照应用的顺序投递。
+// 过期的键在被回收时产生KeyDeleted事件。订阅者处理不及时、排队的事件过多时，同一个键的多次变更被合并；
+// 仍然太多时排队的事件被丢弃并改为投递KeyResync事件，订阅者应该重新读取订阅的存储桶
+// 参数 ctx 为上下文，bucket 为存储桶名称（为空时订阅所有存储桶），keyPrefix 为键前缀
+func (l *Ledger) Watch(ctx context.Context, bucket, keyPrefix string) <-chan Event {
+	w := &watcher{bucket: bucket, prefix: keyPrefix, notify: make(chan struct{}, 1)}
+	out := make(chan Event)
+
+	l.watchersMu.Lock()
+	l.watchers[w] = struct{}{}
+	l.watchersMu.Unlock()
+
+	go func() {
+		w.run(ctx, out)
+
+		l.watchersMu.Lock()
+		delete(l.watchers, w)
+		l.watchersMu.Unlock()
+	}()
+
+	return out
+}
+
+// changes 比较两个区块的存储，返回键的变更事件
+// 参数 old 为变更前的区块，new 为变更后的区块
+func changes(old, new Block) (events []Event) {
+	for bucket, keys := range new.Storage {
+		for k, v := range keys {
+			prev, exists := old.Storage[bucket][k]
+			switch {
+			case !exists:
+				events = append(events, Event{Type: KeyAdded, Bucket: bucket, Key: k, New: v})
+			case prev != v:
+				events = append(events, Event{Type: KeyUpdated, Bucket: bucket, Key: k, Old: prev, New: v})
+			}
+		}
+	}
+	for bucket, keys := range old.Storage {
+		for k, v := range keys {
+			if _, exists := new.Storage[bucket][k]; !exists {
+				events = append(events, Event{Type: KeyDeleted, Bucket: bucket, Key: k, Old: v})
+			}
+		}
+	}
+	return
+}
+
+// apply 将新区块添加到区块链并通知订阅者，调用者必须持有锁
+// 所有本地和远程的区块都通过这里应用
+// 参数 b 为新区块
+func (l *Ledger) apply(b Block) {
+	events := changes(l.blockchain.Last(), b)
+	l.blockchain.Add(b)
+
+	if len(events) == 0 {
+		return
+	}
+
+	l.watchersMu.Lock()
+	defer l.watchersMu.Unlock()
+	for w := range l.watchers {
+		w.push(events)
+	}
+}
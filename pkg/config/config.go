@@ -16,7 +16,9 @@ package config
 import (
 	"fmt"
 	"math/bits"
+	"net/netip"
 	"os"
+	"path/filepath"
 	"runtime"
 	"strings"
 	"time"
@@ -47,13 +49,23 @@ import (
 type Config struct {
 	NetworkConfig, NetworkToken                string                // 网络配置和网络令牌
 	Address                                    string                // IP地址
+	Address6                                   string                // 双栈的IPv6地址，为"auto"时自动派生
 	ListenMaddrs                               []string              // 监听多地址
 	DHTAnnounceMaddrs                          []multiaddr.Multiaddr // DHT公告多地址
 	Router                                     string                // 路由器地址
+	Routes                                     []string              // 公告可以通过本节点到达的子网
+	RoutePriority                              int                   // 公告的子网的优先级
+	StickyRoutes                               bool                  // 为每个目标地址保持选择的下一跳
 	Interface                                  string                // 接口名称
+	TAP                                        bool                  // 使用TAP接口在第二层转发以太网帧
+	Bridge                                     string                // TAP模式下将接口加入的本地网桥
+	Userspace                                  bool                  // 使用用户空间TCP/IP协议栈代替TUN设备
+	SOCKS5Listen, HTTPProxyListen              string                // 用户空间模式下SOCKS5代理和HTTP代理的监听地址
+	Forwards                                   []string              // 用户空间模式下的端口转发
 	Libp2pLogLevel, LogLevel                   string                // libp2p日志级别和日志级别
 	LowProfile, BootstrapIface                 bool                  // 低配置模式和引导接口
 	Blacklist                                  []string              // 黑名单
+	Sealer                                     string                // 消息密封格式："compat"（默认）、"hkdf"或者"legacy"，见node.WithLegacySealer
 	Concurrency                                int                   // 并发数
 	FrameTimeout                               string                // 帧超时
 	ChannelBufferSize, InterfaceMTU, PacketMTU int                   // 通道缓冲区大小、接口MTU、数据包MTU
@@ -98,6 +110,46 @@ type ResourceLimit struct {
 type Ledger struct {
 	AnnounceInterval, SyncInterval time.Duration // 公告间隔和同步间隔
 	StateDir                       string        // 状态目录
+
+	// HistoryWindow 是保留的历史区块数量，为0时只保留最后一个区块（使用磁盘时保留全部区块）
+	HistoryWindow    int
+	SnapshotInterval int    // 写入完整快照的区块间隔（仅用于内存中的历史窗口）
+	Fsync            string // 磁盘存储的fsync策略："always"、"never"或者fsync间隔
+	IntegrityCheck   bool   // 打开时对整个状态数据库进行一致性检查
+
+	// Encrypt 使用从网络令牌（或网络配置文件）派生的密钥加密状态目录
+	Encrypt    bool
+	Passphrase string // 加密状态目录的口令，优先于网络令牌
+	KeyFile    string // 加密状态目录的密钥文件，优先于口令
+
+	// TombstoneRetention 是已删除键的墓碑保留时间，为0时使用默认值
+	TombstoneRetention time.Duration
+}
+
+// StateSecret 返回加密账本状态目录的密钥材料，没有启用加密时返回nil
+// 依次使用密钥文件、口令和网络令牌（没有令牌时使用网络配置文件的内容）
+func (c Config) StateSecret() ([]byte, error) {
+	switch {
+	case c.Ledger.KeyFile != "":
+		dat, err := os.ReadFile(c.Ledger.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("无法读取账本密钥文件: %w", err)
+		}
+		return []byte(strings.TrimSpace(string(dat))), nil
+	case c.Ledger.Passphrase != "":
+		return []byte(c.Ledger.Passphrase), nil
+	case !c.Ledger.Encrypt:
+		return nil, nil
+	case c.NetworkToken != "":
+		return []byte(c.NetworkToken), nil
+	case c.NetworkConfig != "":
+		dat, err := os.ReadFile(c.NetworkConfig)
+		if err != nil {
+			return nil, fmt.Errorf("无法读取网络配置文件: %w", err)
+		}
+		return dat, nil
+	}
+	return nil, fmt.Errorf("加密账本状态目录需要网络令牌、口令或者密钥文件")
 }
 
 // Discovery 允许启用/禁用发现并设置引导节点
@@ -141,6 +193,38 @@ func (c Config) Validate() error {
 		c.NetworkToken == "" {
 		return fmt.Errorf("未提供EDGEVPNCONFIG或EDGEVPNTOKEN。至少需要一个配置文件")
 	}
+	if _, _, err := blockchain.ParseSyncPolicy(c.Ledger.Fsync); err != nil {
+		return err
+	}
+	if c.Address6 != "" && c.Address6 != vpn.AutoAddress6 {
+		if p, err := netip.ParsePrefix(c.Address6); err != nil || !p.Addr().Is6() {
+			return fmt.Errorf("无效的IPv6地址 '%s'", c.Address6)
+		}
+	}
+	if c.Bridge != "" && !c.TAP {
+		return fmt.Errorf("网桥需要TAP模式")
+	}
+	if c.Userspace && c.TAP {
+		return fmt.Errorf("用户空间模式不支持TAP")
+	}
+	if len(c.Routes) > 0 && c.TAP {
+		return fmt.Errorf("TAP模式不支持子网路由，使用网桥连接子网")
+	}
+	switch c.Sealer {
+	case "", "hkdf", "compat", "legacy":
+	default:
+		return fmt.Errorf("无效的密封格式 '%s'", c.Sealer)
+	}
+	for _, f := range c.Forwards {
+		if _, _, err := vpn.ParseForward(f); err != nil {
+			return err
+		}
+	}
+	for _, r := range c.Routes {
+		if _, err := netip.ParsePrefix(r); err != nil {
+			return fmt.Errorf("无效的路由 '%s': %w", r, err)
+		}
+	}
 	return nil
 }
 
@@ -228,12 +312,13 @@ func (c Config) ToOpts(l *logger.Logger) ([]node.Option, []vpn.Option, error) {
 		node.WithDiscoveryInterval(c.Discovery.Interval),
 		node.WithLedgerAnnounceTime(c.Ledger.AnnounceInterval),
 		node.WithLedgerInterval(c.Ledger.SyncInterval),
+		node.WithLedgerTombstoneRetention(c.Ledger.TombstoneRetention),
 		node.Logger(llger),
 		node.WithDiscoveryBootstrapPeers(addrsList),
 		node.WithBlacklist(c.Blacklist...),
 		node.LibP2PLogLevel(libp2plvl),
 		node.WithInterfaceAddress(address),
-		node.WithSealer(&crypto.AESSealer{}),
+		node.WithSealer(&crypto.HKDFSealer{}),
 		node.FromBase64(mDNS, dhtE, token, d, m),
 		node.FromYaml(mDNS, dhtE, config, d, m),
 	}
@@ -243,26 +328,53 @@ func (c Config) ToOpts(l *logger.Logger) ([]node.Option, []vpn.Option, error) {
 		opts = append(opts, node.WithStaticPeer(ip, peer))
 	}
 
+	// 默认同时接受旧的密封格式，所有对等节点都升级之后才使用新格式发送
+	switch c.Sealer {
+	case "hkdf":
+		opts = append(opts, node.WithLegacySealer(nil, false))
+	case "", "compat":
+		opts = append(opts, node.WithLegacySealer(&crypto.AESSealer{}, false))
+	case "legacy":
+		opts = append(opts, node.WithLegacySealer(&crypto.AESSealer{}, true))
+	}
+
 	// 添加私钥
 	if len(c.Privkey) > 0 {
 		opts = append(opts, node.WithPrivKey(c.Privkey))
 	}
 
+	var deviceType water.DeviceType = water.TUN
+	if c.TAP {
+		deviceType = water.TAP
+	}
+
 	vpnOpts := []vpn.Option{
 		vpn.WithConcurrency(c.Concurrency),
 		vpn.WithInterfaceAddress(address),
+		vpn.WithInterfaceAddress6(c.Address6),
 		vpn.WithLedgerAnnounceTime(c.Ledger.AnnounceInterval),
 		vpn.Logger(llger),
 		vpn.WithTimeout(c.FrameTimeout),
-		vpn.WithInterfaceType(water.TUN),
+		vpn.WithInterfaceType(deviceType),
+		vpn.WithBridge(c.Bridge),
+		vpn.Userspace(c.Userspace),
+		vpn.WithSOCKS5Listen(c.SOCKS5Listen),
+		vpn.WithHTTPProxyListen(c.HTTPProxyListen),
+		vpn.WithForwards(c.Forwards...),
 		vpn.NetLinkBootstrap(c.BootstrapIface),
 		vpn.WithChannelBufferSize(c.ChannelBufferSize),
 		vpn.WithInterfaceMTU(c.InterfaceMTU),
 		vpn.WithPacketMTU(c.PacketMTU),
 		vpn.WithRouterAddress(router),
+		vpn.WithRoutes(c.Routes...),
+		vpn.WithRoutePriority(c.RoutePriority),
 		vpn.WithInterfaceName(iface),
 	}
 
+	if c.StickyRoutes {
+		vpnOpts = append(vpnOpts, vpn.StickyRoutes)
+	}
+
 	libp2pOpts := []libp2p.Option{libp2p.UserAgent("edgevpn")}
 
 	// AutoRelay部分配置
@@ -468,12 +580,23 @@ func (c Config) ToOpts(l *logger.Logger) ([]node.Option, []vpn.Option, error) {
 	opts = append(opts, node.WithLibp2pOptions(libp2pOpts...))
 
 	// 账本存储配置
-	if ledgerState != "" {
-		opts = append(opts, node.WithStore(blockchain.NewDiskStore(diskv.New(diskv.Options{
-			BasePath:     ledgerState,
-			CacheSizeMax: uint64(50), // 50MB
-		}))))
-	} else {
+	switch {
+	case ledgerState != "":
+		secret, err := c.StateSecret()
+		if err != nil {
+			return nil, nil, err
+		}
+		store, err := OpenLedgerState(llger, ledgerState, c.Ledger, secret)
+		if err != nil {
+			return nil, nil, err
+		}
+		opts = append(opts, node.WithStore(store))
+	case c.Ledger.HistoryWindow > 0:
+		opts = append(opts, node.WithStore(blockchain.NewWindowStore(&blockchain.MemoryKV{},
+			blockchain.WithHistoryWindow(c.Ledger.HistoryWindow),
+			blockchain.WithSnapshotInterval(c.Ledger.SnapshotInterval),
+		)))
+	default:
 		opts = append(opts, node.WithStore(&blockchain.MemoryStore{}))
 	}
 
@@ -513,6 +636,105 @@ func (c Config) ToOpts(l *logger.Logger) ([]node.Option, []vpn.Option, error) {
 	return opts, vpnOpts, nil
 }
 
+// OpenLedgerState 打开状态目录中的账本数据库，同一时间只能被一个进程打开
+// 如果数据库还不存在而目录中有旧的diskv状态，则先将区块迁移到数据库中；
+// 启用加密时，旧的明文区块在迁移的区块写入磁盘之后被覆盖并删除，无法删除时拒绝打开
+// secret不为空时区块被加密保存，参见Config.StateSecret。启用IntegrityCheck时在打开时检查整个数据库
+// 参数 ll 为日志记录器，dir 为状态目录，c 为账本配置，secret 为加密的密钥材料
+func OpenLedgerState(ll log.StandardLogger, dir string, c Ledger, secret []byte) (*blockchain.BoltStore, error) {
+	policy, interval, err := blockchain.ParseSyncPolicy(c.Fsync)
+	if err != nil {
+		return nil, err
+	}
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, fmt.Errorf("无法创建账本状态目录: %w", err)
+	}
+
+	path := filepath.Join(dir, "ledger.db")
+	_, err = os.Stat(path)
+	migrate := os.IsNotExist(err)
+
+	opts := []blockchain.BoltOption{
+		blockchain.WithRetention(c.HistoryWindow),
+		blockchain.WithSyncPolicy(policy, interval),
+	}
+	if c.IntegrityCheck {
+		opts = append(opts, blockchain.WithIntegrityCheck())
+	}
+	if len(secret) > 0 {
+		opts = append(opts, blockchain.WithEncryption(secret))
+	}
+	store, err := blockchain.NewBoltStore(path, opts...)
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "index")); err != nil {
+		return store, nil
+	}
+	legacy := diskv.New(diskv.Options{
+		BasePath:     dir,
+		CacheSizeMax: uint64(50), // 50MB
+	})
+	if migrate {
+		n, err := blockchain.MigrateDiskStore(legacy, store)
+		if err != nil {
+			store.Close()
+			os.Remove(path)
+			return nil, fmt.Errorf("无法迁移账本状态目录: %w", err)
+		}
+		ll.Infof("已将 %d 个区块从旧的状态目录迁移到 %s", n, path)
+	}
+
+	// 加密时不能在目录中留下旧的明文区块，迁移的区块写入磁盘之后删除它们
+	if len(secret) > 0 {
+		err := store.Sync()
+		if err == nil {
+			err = blockchain.EraseDiskStore(legacy)
+		}
+		if err != nil {
+			store.Close()
+			return nil, fmt.Errorf("无法删除状态目录中未加密的旧区块: %w", err)
+		}
+		ll.Info("已删除状态目录中未加密的旧区块")
+	}
+
+	return store, nil
+}
+
+// OpenLedgerStateReadOnly 以只读方式打开状态目录中的账本，用于检查和导出
+// 与OpenLedgerState不同，它不创建目录、不迁移旧的diskv状态，也不删除任何文件：
+// 还没有迁移的状态目录直接从旧的diskv状态读取，密钥错误时返回错误而不修改状态目录
+// 参数 dir 为状态目录，secret 为加密的密钥材料
+// 返回账本存储和关闭它的函数
+func OpenLedgerStateReadOnly(dir string, secret []byte) (blockchain.HistoryStore, func() error, error) {
+	if _, err := os.Stat(dir); err != nil {
+		return nil, nil, err
+	}
+
+	path := filepath.Join(dir, "ledger.db")
+	if _, err := os.Stat(path); err == nil {
+		opts := []blockchain.BoltOption{blockchain.WithReadOnly()}
+		if len(secret) > 0 {
+			opts = append(opts, blockchain.WithEncryption(secret))
+		}
+		store, err := blockchain.NewBoltStore(path, opts...)
+		if err != nil {
+			return nil, nil, err
+		}
+		return store, store.Close, nil
+	}
+
+	if _, err := os.Stat(filepath.Join(dir, "index")); err != nil {
+		return nil, nil, fmt.Errorf("'%s' 不是账本状态目录", dir)
+	}
+	legacy := diskv.New(diskv.Options{
+		BasePath:     dir,
+		CacheSizeMax: uint64(50), // 50MB
+	})
+	return blockchain.NewDiskStore(legacy), func() error { return nil }, nil
+}
+
 // authProvider 创建认证提供者
 // 参数 ll 为日志记录器，s 为提供者类型，opts 为选项
 func authProvider(ll log.StandardLogger, s string, opts map[string]interface{}) (trustzone.AuthProvider, error) {
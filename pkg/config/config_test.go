@@ -0,0 +1,109 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package config_test
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/ipfs/go-log"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/peterbourgon/diskv"
+
+	"github.com/purpose168/edgevpn/pkg/blockchain"
+	. "github.com/purpose168/edgevpn/pkg/config"
+	"github.com/purpose168/edgevpn/pkg/logger"
+)
+
+var _ = Describe("账本状态目录", func() {
+	var dir string
+
+	// 在目录中创建旧的diskv状态
+	BeforeEach(func() {
+		dir = GinkgoT().TempDir()
+		l := blockchain.New(io.Discard, blockchain.NewDiskStore(diskv.New(diskv.Options{BasePath: dir})))
+		for _, v := range []string{"a", "very-secret-public-key"} {
+			l.Add("trustzoneAuth", map[string]interface{}{"ecdsa": v})
+		}
+		Expect(filepath.Join(dir, "index")).To(BeAnExistingFile())
+	})
+
+	// files 返回目录中所有文件的名称和内容
+	files := func() map[string]string {
+		entries, err := os.ReadDir(dir)
+		Expect(err).ToNot(HaveOccurred())
+		res := map[string]string{}
+		for _, e := range entries {
+			dat, err := os.ReadFile(filepath.Join(dir, e.Name()))
+			Expect(err).ToNot(HaveOccurred())
+			res[e.Name()] = string(dat)
+		}
+		return res
+	}
+
+	It("加密迁移之后不留下明文区块", func() {
+		store, err := OpenLedgerState(logger.New(log.LevelError), dir, Ledger{}, []byte("token"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(blockchain.New(io.Discard, store).CurrentData()["trustzoneAuth"]["ecdsa"]).To(Equal(blockchain.Data(`"very-secret-public-key"`)))
+		Expect(store.Close()).To(Succeed())
+
+		Expect(files()).To(HaveLen(1))
+		for name, content := range files() {
+			Expect(name).To(Equal("ledger.db"))
+			Expect(content).ToNot(ContainSubstring("very-secret-public-key"))
+		}
+	})
+
+	It("不加密时保留旧的状态目录", func() {
+		store, err := OpenLedgerState(logger.New(log.LevelError), dir, Ledger{}, nil)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(store.Close()).To(Succeed())
+
+		Expect(files()).To(HaveKey("index"))
+		Expect(files()).To(HaveKey("ledger.db"))
+	})
+
+	It("只读打开时不迁移也不删除旧的状态", func() {
+		before := files()
+		store, closeStore, err := OpenLedgerStateReadOnly(dir, []byte("token"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(blockchain.NewArchive(store).Last().Storage["trustzoneAuth"]["ecdsa"]).To(Equal(blockchain.Data(`"very-secret-public-key"`)))
+		Expect(closeStore()).To(Succeed())
+		Expect(files()).To(Equal(before))
+
+		_, _, err = OpenLedgerStateReadOnly(filepath.Join(dir, "missing"), nil)
+		Expect(err).To(HaveOccurred())
+		Expect(filepath.Join(dir, "missing")).ToNot(BeADirectory())
+	})
+
+	It("只读打开时密钥错误不修改数据库", func() {
+		store, err := OpenLedgerState(logger.New(log.LevelError), dir, Ledger{}, []byte("token"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(store.Close()).To(Succeed())
+		before := files()
+
+		_, _, err = OpenLedgerStateReadOnly(dir, []byte("wrong"))
+		Expect(err).To(HaveOccurred())
+		_, _, err = OpenLedgerStateReadOnly(dir, nil)
+		Expect(err).To(HaveOccurred())
+
+		ro, closeStore, err := OpenLedgerStateReadOnly(dir, []byte("token"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(blockchain.NewArchive(ro).Verify()).To(Succeed())
+		Expect(closeStore()).To(Succeed())
+		Expect(files()).To(Equal(before))
+	})
+})
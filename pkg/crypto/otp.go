@@ -16,6 +16,7 @@ package crypto
 import (
 	"encoding/base64"
 	"hash"
+	"time"
 
 	"github.com/creachadair/otp"
 )
@@ -24,14 +25,50 @@ import (
 // 参数 f 为哈希函数，digits 为输出位数，t 为时间步长，key 为密钥
 // 返回TOTP字符串
 func TOTP(f func() hash.Hash, digits int, t int, key string) string {
-	cfg := otp.Config{
-		Hash:     f,      // 默认为sha1.New
-		Digits:   digits, // 默认为6
-		TimeStep: otp.TimeWindow(t),
-		Key:      key,
+	return TOTPAt(f, digits, t, key, time.Now())
+}
+
+// TOTPAt 生成时间when所在时间步的一次性密码
+// 参数 f 为哈希函数，digits 为输出位数，t 为时间步长（秒），key 为密钥，when 为时间
+func TOTPAt(f func() hash.Hash, digits int, t int, key string, when time.Time) string {
+	return config(f, digits, key).HOTP(uint64(when.Unix()) / uint64(t))
+}
+
+// TOTPWindow 返回时间范围[now-skew, now+skew]内每个时间步的一次性密码，当前时间步的密码在最前面
+// 时钟偏差小于skew的对等节点总能在其中找到对方当前使用的密码
+// 参数 f 为哈希函数，digits 为输出位数，t 为时间步长（秒），key 为密钥，now 为当前时间，skew 为容忍的时钟偏差
+func TOTPWindow(f func() hash.Hash, digits int, t int, key string, now time.Time, skew time.Duration) []string {
+	cfg := config(f, digits, key)
+	codes := []string{}
+	for _, i := range TimeSteps(t, now, skew) {
+		codes = append(codes, cfg.HOTP(i))
+	}
+	return codes
+}
+
+// TimeSteps 返回时间范围[now-skew, now+skew]内的时间步，当前时间步在最前面
+// 参数 t 为时间步长（秒），now 为当前时间，skew 为容忍的时钟偏差
+func TimeSteps(t int, now time.Time, skew time.Duration) []uint64 {
+	step := func(when time.Time) uint64 { return uint64(when.Unix()) / uint64(t) }
+
+	current := step(now)
+	steps := []uint64{current}
+	for i := step(now.Add(-skew)); i <= step(now.Add(skew)); i++ {
+		if i != current {
+			steps = append(steps, i)
+		}
+	}
+	return steps
+}
+
+// config 返回生成一次性密码的配置
+func config(f func() hash.Hash, digits int, key string) otp.Config {
+	return otp.Config{
+		Hash:   f,      // 默认为sha1.New
+		Digits: digits, // 默认为6
+		Key:    key,
 		Format: func(hash []byte, nb int) string {
 			return base64.StdEncoding.EncodeToString(hash)[:nb]
 		},
 	}
-	return cfg.TOTP()
 }
@@ -0,0 +1,48 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package crypto_test
+
+import (
+	"crypto/sha256"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	. "github.com/purpose168/edgevpn/pkg/crypto"
+)
+
+var _ = Describe("一次性密码", func() {
+	totp := func(when time.Time) string {
+		return TOTPAt(sha256.New, 32, 60, "key", when)
+	}
+
+	It("在时间步内保持不变", func() {
+		start := time.Unix(6000, 0)
+		Expect(totp(start)).To(Equal(totp(start.Add(59 * time.Second))))
+		Expect(totp(start)).ToNot(Equal(totp(start.Add(60 * time.Second))))
+	})
+
+	It("返回时钟偏差范围内的所有密码", func() {
+		// 距离下一个时间步还有5秒
+		now := time.Unix(6055, 0)
+		Expect(TOTPWindow(sha256.New, 32, 60, "key", now, 0)).To(Equal([]string{totp(now)}))
+		Expect(TOTPWindow(sha256.New, 32, 60, "key", now, 10*time.Second)).To(Equal([]string{totp(now), totp(now.Add(10 * time.Second))}))
+
+		// 时钟快了10秒的对等节点已经使用下一个密码，时钟慢了10秒的对等节点仍然使用当前密码
+		ahead := TOTPWindow(sha256.New, 32, 60, "key", now.Add(10*time.Second), 10*time.Second)
+		Expect(ahead).To(ContainElement(totp(now)))
+		Expect(ahead[0]).To(Equal(totp(now.Add(10 * time.Second))))
+	})
+})
@@ -0,0 +1,114 @@
+// Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package crypto
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hkdf"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"io"
+)
+
+const (
+	// hkdfSaltSize 是每条消息随机盐值的长度
+	hkdfSaltSize = 16
+	// hkdfInfo 是派生密封密钥时的上下文信息
+	hkdfInfo = "edgevpn/sealer/v1"
+)
+
+// HKDFSealer 使用HKDF从密钥和每条消息的随机盐值派生AES-256-GCM密钥，
+// 并将消息作者作为附加数据进行认证：作者不同的消息无法解封。
+// 它的格式与AESSealer不兼容。节点默认同时接受两种格式，并在所有对等节点都宣告支持之后
+// 才使用它发送消息（见node.WithLegacySealer），因此从AESSealer升级的网络可以逐个节点升级
+type HKDFSealer struct{}
+
+// Seal 加密没有作者的消息
+// 参数 message 为要加密的消息，key 为密钥材料
+func (s *HKDFSealer) Seal(message, key string) (string, error) {
+	return s.SealFor(message, key, "")
+}
+
+// Unseal 解密没有作者的消息
+// 参数 message 为要解密的消息，key 为密钥材料
+func (s *HKDFSealer) Unseal(message, key string) (string, error) {
+	return s.UnsealFrom(message, key, "")
+}
+
+// SealFor 加密消息并绑定作者
+// 参数 message 为要加密的消息，key 为密钥材料，author 为消息作者
+// 返回十六进制编码的盐值、nonce和密文
+func (*HKDFSealer) SealFor(message, key, author string) (string, error) {
+	salt := make([]byte, hkdfSaltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return "", err
+	}
+	gcm, err := hkdfGCM(key, salt)
+	if err != nil {
+		return "", err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return "", err
+	}
+
+	sealed := append(salt, nonce...)
+	sealed = gcm.Seal(sealed, nonce, []byte(message), []byte(author))
+	return hex.EncodeToString(sealed), nil
+}
+
+// UnsealFrom 解密消息并验证作者，消息被篡改或者作者不符时返回错误
+// 参数 message 为要解密的消息，key 为密钥材料，author 为消息作者
+func (*HKDFSealer) UnsealFrom(message, key, author string) (string, error) {
+	sealed, err := hex.DecodeString(message)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < hkdfSaltSize {
+		return "", errors.New("密文格式错误")
+	}
+	gcm, err := hkdfGCM(key, sealed[:hkdfSaltSize])
+	if err != nil {
+		return "", err
+	}
+
+	sealed = sealed[hkdfSaltSize:]
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("密文格式错误")
+	}
+	plaintext, err := gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], []byte(author))
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+// hkdfGCM 返回使用从密钥材料和盐值派生的密钥的AES-GCM
+func hkdfGCM(key string, salt []byte) (cipher.AEAD, error) {
+	k, err := hkdf.Key(sha256.New, []byte(key), salt, hkdfInfo, 32)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(k)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
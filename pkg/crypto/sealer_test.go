@@ -52,4 +52,54 @@ var _ = Describe("加密工具", func() {
 			Expect(decoded).To(Equal(message))
 		})
 	})
+
+	Context("HKDFSealer", func() {
+		s := &HKDFSealer{}
+
+		It("编码/解码", func() {
+			key := RandStringRunes(32)
+
+			encoded, err := s.SealFor("foo", key, "author")
+			Expect(err).ToNot(HaveOccurred())
+			encoded2, err := s.SealFor("foo", key, "author")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(encoded2).ToNot(Equal(encoded))
+
+			decoded, err := s.UnsealFrom(encoded, key, "author")
+			Expect(err).ToNot(HaveOccurred())
+			Expect(decoded).To(Equal("foo"))
+
+			// 没有作者的消息
+			encoded, err = s.Seal("foo", key)
+			Expect(err).ToNot(HaveOccurred())
+			decoded, err = s.Unseal(encoded, key)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(decoded).To(Equal("foo"))
+		})
+
+		It("拒绝作者不符、密钥错误或被篡改的消息", func() {
+			key := RandStringRunes(32)
+			encoded, err := s.SealFor("foo", key, "author")
+			Expect(err).ToNot(HaveOccurred())
+
+			_, err = s.UnsealFrom(encoded, key, "relay")
+			Expect(err).To(HaveOccurred())
+			_, err = s.Unseal(encoded, key)
+			Expect(err).To(HaveOccurred())
+			_, err = s.UnsealFrom(encoded, RandStringRunes(32), "author")
+			Expect(err).To(HaveOccurred())
+
+			tampered := []byte(encoded)
+			if tampered[len(tampered)-1] == '0' {
+				tampered[len(tampered)-1] = '1'
+			} else {
+				tampered[len(tampered)-1] = '0'
+			}
+			_, err = s.UnsealFrom(string(tampered), key, "author")
+			Expect(err).To(HaveOccurred())
+
+			_, err = s.UnsealFrom("abcd", key, "author")
+			Expect(err).To(HaveOccurred())
+		})
+	})
 })
@@ -0,0 +1,111 @@
+// Copyright © 2022 Ettore Di Giacinto <mudler@c3os.io>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package hub
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// Channel 是应用程序定义的消息通道，房间主题由网络密钥和通道名称派生，
+// 与区块链房间一样随一次性密码轮换
+type Channel struct {
+	hub   *MessageHub
+	name  string // 通道名称
+	rooms *rooms // 通道的房间
+
+	Messages chan *Message // 接收的消息
+}
+
+// channelSalt 返回通道房间主题的盐值，与公共房间的主题不会冲突
+func channelSalt(name string) string {
+	return "channel:" + name
+}
+
+// Join 加入应用程序定义的通道，通道已经加入时返回已有的通道
+// 可以在Start之前调用，消息中心启动后加入通道的房间
+// 参数 name 为通道名称
+func (m *MessageHub) Join(name string) (*Channel, error) {
+	if name == "" {
+		return nil, errors.New("通道名称不能为空")
+	}
+
+	m.Lock()
+	defer m.Unlock()
+	if c, exists := m.channels[name]; exists {
+		return c, nil
+	}
+
+	c := &Channel{hub: m, name: name, rooms: newRooms(), Messages: make(chan *Message, roomBufSize)}
+	m.channels[name] = c
+	if m.ps != nil {
+		if err := m.update(m.ctx, m.host, c.rooms, m.topics(channelSalt(name)), c.Messages); err != nil {
+			c.rooms.leave()
+			delete(m.channels, name)
+			return nil, fmt.Errorf("无法加入通道 '%s': %w", name, err)
+		}
+	}
+	return c, nil
+}
+
+// Leave 离开通道的所有房间，之后通道不再接收消息
+// 参数 name 为通道名称
+func (m *MessageHub) Leave(name string) {
+	m.Lock()
+	defer m.Unlock()
+	if c, exists := m.channels[name]; exists {
+		c.rooms.leave()
+		delete(m.channels, name)
+	}
+}
+
+// rotateChannels 轮换所有通道的房间，调用者必须持有锁
+// 参数 ctx 为上下文，host 为libp2p主机
+func (m *MessageHub) rotateChannels(ctx context.Context, host host.Host) error {
+	for name, c := range m.channels {
+		if err := m.update(ctx, host, c.rooms, m.topics(channelSalt(name)), c.Messages); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Name 返回通道名称
+func (c *Channel) Name() string {
+	return c.name
+}
+
+// Publish 发布消息到通道的当前房间
+// 参数 mess 为要发布的消息
+func (c *Channel) Publish(mess *Message) error {
+	c.hub.Lock()
+	defer c.hub.Unlock()
+	return c.rooms.publish(mess)
+}
+
+// ListPeers 列出通道房间中的对等节点
+func (c *Channel) ListPeers() ([]peer.ID, error) {
+	c.hub.Lock()
+	defer c.hub.Unlock()
+	if len(c.rooms.joined) == 0 {
+		return nil, fmt.Errorf("通道 '%s' 没有可用的消息房间", c.name)
+	}
+	return c.rooms.peers(), nil
+}
@@ -18,13 +18,16 @@ package hub
 import (
 	"context"
 	"crypto/sha256"
+	"encoding/json"
 	"errors"
+	"fmt"
 	"strings"
 	"sync"
 	"time"
 
 	"github.com/purpose168/edgevpn/pkg/crypto"
 
+	lru "github.com/hashicorp/golang-lru"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/peer"
@@ -34,141 +37,224 @@ import (
 type MessageHub struct {
 	sync.Mutex
 
-	blockchain, public *room          // 区块链房间和公共房间
-	ps                 *pubsub.PubSub // 发布订阅服务
-	otpKey             string         // OTP密钥
-	maxsize            int            // 最大消息大小
-	keyLength          int            // 密钥长度
-	interval           int            // 间隔
-	joinPublic         bool           // 是否加入公共房间
+	blockchain, public *rooms              // 区块链房间和公共房间
+	ps                 *pubsub.PubSub      // 发布订阅服务
+	otpKey             string              // OTP密钥
+	maxsize            int                 // 最大消息大小
+	keyLength          int                 // 密钥长度
+	interval           int                 // 间隔
+	joinPublic         bool                // 是否加入公共房间
+	skew               time.Duration       // 容忍的时钟偏差
+	seen               *lru.Cache          // 最近收到的消息ID，用于去除在多个房间中收到的重复消息
+	channels           map[string]*Channel // 应用程序定义的通道
+	ctx                context.Context     // Start的上下文，用于在启动后加入通道
+	host               host.Host           // libp2p主机
 
-	ctxCancel                context.CancelFunc // 上下文取消函数
-	Messages, PublicMessages chan *Message      // 消息通道和公共消息通道
+	router          Router                      // pubsub路由器
+	gossipParams    *pubsub.GossipSubParams     // GossipSub参数，为空时使用默认值
+	scoreParams     *pubsub.PeerScoreParams     // 对等节点评分参数，为空时禁用评分
+	scoreThresholds *pubsub.PeerScoreThresholds // 对等节点评分阈值
+	topicScore      *pubsub.TopicScoreParams    // 每个房间主题的评分参数
+	validators      []Validator                 // 消息校验器
+
+	Messages, PublicMessages chan *Message // 消息通道和公共消息通道
 }
 
-// roomBufSize 是每个主题缓冲的传入消息数量
-const roomBufSize = 128
+const (
+	// roomBufSize 是每个主题缓冲的传入消息数量
+	roomBufSize = 128
+	// seenCacheSize 是用于去重的最近消息ID数量
+	seenCacheSize = 4096
+	// DefaultClockSkew 是默认容忍的时钟偏差
+	DefaultClockSkew = 10 * time.Second
+)
 
 // NewHub 创建新的消息中心
-// 参数 otp 为OTP密钥，maxsize 为最大消息大小，keyLength 为密钥长度，interval 为间隔，joinPublic 为是否加入公共房间
-func NewHub(otp string, maxsize, keyLength, interval int, joinPublic bool) *MessageHub {
-	return &MessageHub{otpKey: otp, maxsize: maxsize, keyLength: keyLength, interval: interval,
+// 参数 otp 为OTP密钥，maxsize 为最大消息大小，keyLength 为密钥长度，interval 为间隔，joinPublic 为是否加入公共房间，opts 为选项
+func NewHub(otp string, maxsize, keyLength, interval int, joinPublic bool, opts ...Option) *MessageHub {
+	seen, _ := lru.New(seenCacheSize)
+	m := &MessageHub{otpKey: otp, maxsize: maxsize, keyLength: keyLength, interval: interval, router: GossipSub,
+		skew: DefaultClockSkew, seen: seen, blockchain: newRooms(), public: newRooms(), channels: map[string]*Channel{},
 		Messages: make(chan *Message, roomBufSize), PublicMessages: make(chan *Message, roomBufSize), joinPublic: joinPublic}
+	for _, o := range opts {
+		o(m)
+	}
+	return m
 }
 
-// topicKey 生成主题密钥
-// 参数 salts 为可选的盐值
-func (m *MessageHub) topicKey(salts ...string) string {
-	totp := crypto.TOTP(sha256.New, m.keyLength, m.interval, m.otpKey)
-	if len(salts) > 0 {
-		return crypto.MD5(totp + strings.Join(salts, ":"))
+// ClockSkew 返回容忍的时钟偏差，密封消息的一次性密钥应该使用相同的容忍范围
+func (m *MessageHub) ClockSkew() time.Duration {
+	return m.skew
+}
+
+// newPubSub 使用配置的路由器创建PubSub服务
+// 参数 ctx 为上下文，host 为libp2p主机
+func (m *MessageHub) newPubSub(ctx context.Context, host host.Host) (*pubsub.PubSub, error) {
+	opts := []pubsub.Option{pubsub.WithMaxMessageSize(m.maxsize)}
+
+	switch m.router {
+	case FloodSub:
+		return pubsub.NewFloodSub(ctx, host, opts...)
+	case GossipSub:
+		if m.gossipParams != nil {
+			opts = append(opts, pubsub.WithGossipSubParams(*m.gossipParams))
+		}
+		if m.scoreParams != nil {
+			opts = append(opts, pubsub.WithPeerScore(m.scoreParams, m.scoreThresholds))
+		}
+		return pubsub.NewGossipSub(ctx, host, opts...)
 	}
-	return crypto.MD5(totp)
+	return nil, fmt.Errorf("未知的pubsub路由器 '%s'", m.router)
 }
 
-// joinRoom 加入房间
-// 参数 host 为libp2p主机
-func (m *MessageHub) joinRoom(host host.Host) error {
-	m.Lock()
-	defer m.Unlock()
+// validate 是每个房间主题的校验器，在消息被转发和推送到通道之前拒绝超过最大消息大小、
+// 无法解码或者被校验器拒绝的消息。启用评分时发送被拒绝消息的对等节点会被扣分
+func (m *MessageHub) validate(ctx context.Context, from peer.ID, msg *pubsub.Message) pubsub.ValidationResult {
+	if m.maxsize > 0 && len(msg.Data) > m.maxsize {
+		return pubsub.ValidationReject
+	}
 
-	// 取消之前的上下文
-	if m.ctxCancel != nil {
-		m.ctxCancel()
+	cm := new(Message)
+	if err := json.Unmarshal(msg.Data, cm); err != nil {
+		return pubsub.ValidationReject
+	}
+	for _, v := range m.validators {
+		if err := v(cm); err != nil {
+			return pubsub.ValidationReject
+		}
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	m.ctxCancel = cancel
+	// 保存解码后的消息，readLoop不需要再次解码
+	msg.ValidatorData = cm
+	return pubsub.ValidationAccept
+}
 
-	// 使用GossipSub路由器创建新的PubSub服务
-	ps, err := pubsub.NewGossipSub(ctx, host, pubsub.WithMaxMessageSize(m.maxsize))
-	if err != nil {
-		return err
+// join 注册校验器并加入房间
+// 参数 ctx 为上下文，ps 为PubSub服务，host 为libp2p主机，name 为房间名称，messageChan 为消息通道
+func (m *MessageHub) join(ctx context.Context, ps *pubsub.PubSub, host host.Host, name string, messageChan chan *Message) (*room, error) {
+	if err := ps.RegisterTopicValidator(name, m.validate); err != nil {
+		return nil, err
 	}
 
-	// 加入"聊天"房间
-	cr, err := connect(ctx, ps, host.ID(), m.topicKey(), m.Messages)
+	r, err := connect(ctx, ps, host.ID(), name, messageChan, m.seen)
 	if err != nil {
-		return err
+		ps.UnregisterTopicValidator(name)
+		return nil, err
+	}
+
+	if m.scoreParams != nil && m.topicScore != nil {
+		if err := r.Topic.SetScoreParams(m.topicScore); err != nil {
+			r.leave()
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// topics 返回时钟偏差容忍范围内的房间主题，当前主题在最前面
+// 参数 salts 为可选的盐值
+func (m *MessageHub) topics(salts ...string) []string {
+	topics := crypto.TOTPWindow(sha256.New, m.keyLength, m.interval, m.otpKey, time.Now(), m.skew)
+	for i, totp := range topics {
+		if len(salts) > 0 {
+			topics[i] = crypto.MD5(totp + strings.Join(salts, ":"))
+		} else {
+			topics[i] = crypto.MD5(totp)
+		}
 	}
+	return topics
+}
 
-	m.blockchain = cr
+// rotate 加入区块链房间、公共房间和通道在时钟偏差容忍范围内的房间并离开范围之外的房间。
+// 在一次性密码轮换前后，时钟略有偏差的对等节点总是至少共享一个房间
+// 参数 ctx 为上下文，host 为libp2p主机
+func (m *MessageHub) rotate(ctx context.Context, host host.Host) error {
+	m.Lock()
+	defer m.Unlock()
 
-	// 如果启用公共房间，也加入公共房间
+	if err := m.update(ctx, host, m.blockchain, m.topics(), m.Messages); err != nil {
+		return err
+	}
 	if m.joinPublic {
-		cr2, err := connect(ctx, ps, host.ID(), m.topicKey("public"), m.PublicMessages)
-		if err != nil {
+		if err := m.update(ctx, host, m.public, m.topics("public"), m.PublicMessages); err != nil {
 			return err
 		}
-		m.public = cr2
 	}
+	return m.rotateChannels(ctx, host)
+}
 
-	m.ps = ps
+// update 使房间集合与主题列表一致，列表中的第一个主题成为发布消息的当前房间
+// 参数 ctx 为上下文，host 为libp2p主机，r 为房间集合，topics 为主题列表，messageChan 为消息通道
+func (m *MessageHub) update(ctx context.Context, host host.Host, r *rooms, topics []string, messageChan chan *Message) error {
+	wanted := map[string]bool{}
+	for _, t := range topics {
+		wanted[t] = true
+		if _, joined := r.joined[t]; joined {
+			continue
+		}
+		cr, err := m.join(ctx, m.ps, host, t, messageChan)
+		if err != nil {
+			return err
+		}
+		r.joined[t] = cr
+	}
 
+	for t, cr := range r.joined {
+		if !wanted[t] {
+			cr.leave()
+			delete(r.joined, t)
+		}
+	}
+	r.current = topics[0]
 	return nil
 }
 
-// Start 启动消息中心
+// Start 启动消息中心，直到ctx结束
 // 参数 ctx 为上下文，host 为libp2p主机
 func (m *MessageHub) Start(ctx context.Context, host host.Host) error {
-	c := make(chan interface{})
-	go func(c context.Context, cc chan interface{}) {
-		k := ""
-		for {
-			select {
-			default:
-				currentKey := m.topicKey()
-				if currentKey != k {
-					k = currentKey
-					cc <- nil
-				}
-				time.Sleep(1 * time.Second)
-			case <-ctx.Done():
-				close(cc)
-				return
-			}
-		}
-	}(ctx, c)
-
-	for range c {
-		m.joinRoom(host)
+	ps, err := m.newPubSub(ctx, host)
+	if err != nil {
+		return err
 	}
+	m.Lock()
+	m.ps, m.ctx, m.host = ps, ctx, host
+	m.Unlock()
+
+	t := time.NewTicker(time.Second)
+	defer t.Stop()
+	for {
+		m.rotate(ctx, host)
 
-	// 关闭可能打开的上下文
-	if m.ctxCancel != nil {
-		m.ctxCancel()
+		select {
+		case <-t.C:
+		case <-ctx.Done():
+			return nil
+		}
 	}
-	return nil
 }
 
-// PublishMessage 发布消息到区块链房间
+// PublishMessage 发布消息到当前的区块链房间
 // 参数 mess 为要发布的消息
 func (m *MessageHub) PublishMessage(mess *Message) error {
 	m.Lock()
 	defer m.Unlock()
-	if m.blockchain != nil {
-		return m.blockchain.publishMessage(mess)
-	}
-	return errors.New("没有可用的消息房间")
+	return m.blockchain.publish(mess)
 }
 
-// PublishPublicMessage 发布消息到公共房间
+// PublishPublicMessage 发布消息到当前的公共房间
 // 参数 mess 为要发布的消息
 func (m *MessageHub) PublishPublicMessage(mess *Message) error {
 	m.Lock()
 	defer m.Unlock()
-	if m.public != nil {
-		return m.public.publishMessage(mess)
-	}
-	return errors.New("没有可用的消息房间")
+	return m.public.publish(mess)
 }
 
-// ListPeers 列出房间中的对等节点
+// ListPeers 列出区块链房间中的对等节点，包括时钟偏差容忍范围内的所有房间
 func (m *MessageHub) ListPeers() ([]peer.ID, error) {
 	m.Lock()
 	defer m.Unlock()
-	if m.blockchain != nil {
-		return m.blockchain.Topic.ListPeers(), nil
+	if len(m.blockchain.joined) == 0 {
+		return nil, errors.New("没有可用的消息房间")
 	}
-	return nil, errors.New("没有可用的消息房间")
+	return m.blockchain.peers(), nil
 }
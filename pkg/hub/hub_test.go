@@ -0,0 +1,239 @@
+// Copyright © 2022 Ettore Di Giacinto <mudler@c3os.io>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package hub_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/libp2p/go-libp2p"
+	"github.com/libp2p/go-libp2p/core/host"
+	"github.com/libp2p/go-libp2p/core/peer"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"gopkg.in/yaml.v2"
+
+	. "github.com/purpose168/edgevpn/pkg/hub"
+)
+
+// newHost creates a libp2p host listening on localhost
+func newHost() host.Host {
+	h, err := libp2p.New(libp2p.ListenAddrStrings("/ip4/127.0.0.1/tcp/0"))
+	Expect(err).ToNot(HaveOccurred())
+	DeferCleanup(h.Close)
+	return h
+}
+
+// startHubs starts one hub per option set on connected hosts and waits until they see each other
+func startHubs(ctx context.Context, opts ...[]Option) []*MessageHub {
+	return startRotatingHubs(ctx, 9000, opts...)
+}
+
+// startRotatingHubs is like startHubs, rotating rooms every interval seconds
+func startRotatingHubs(ctx context.Context, interval int, opts ...[]Option) []*MessageHub {
+	hosts, hubs := []host.Host{}, []*MessageHub{}
+	for _, o := range opts {
+		h := newHost()
+		for _, other := range hosts {
+			Expect(h.Connect(ctx, peer.AddrInfo{ID: other.ID(), Addrs: other.Addrs()})).To(Succeed())
+		}
+		hosts = append(hosts, h)
+
+		m := NewHub("otp", 1<<20, 43, interval, false, o...)
+		go m.Start(ctx, h)
+		hubs = append(hubs, m)
+	}
+
+	for _, m := range hubs {
+		Eventually(func() int {
+			peers, _ := m.ListPeers()
+			return len(peers)
+		}, 30*time.Second, 100*time.Millisecond).Should(Equal(len(hubs) - 1))
+	}
+	return hubs
+}
+
+var _ = Describe("Hub", func() {
+	Context("Config", func() {
+		It("parses router and gossip parameters", func() {
+			c := Config{}
+			Expect(yaml.Unmarshal([]byte(`
+router: gossipsub
+d: 4
+dlo: 3
+dhi: 8
+heartbeat_interval: 500ms
+score:
+  gossip_threshold: -10
+  publish_threshold: -50
+  graylist_threshold: -80
+  invalid_message_weight: -100
+  invalid_message_decay: 0.5
+`), &c)).To(Succeed())
+			Expect(c.HeartbeatInterval).To(Equal(500 * time.Millisecond))
+
+			opts, err := c.Options()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(opts).To(HaveLen(2))
+
+			opts, err = Config{}.Options()
+			Expect(err).ToNot(HaveOccurred())
+			Expect(opts).To(BeEmpty())
+		})
+
+		It("rejects invalid configurations", func() {
+			for _, c := range []Config{
+				{Router: "randomsub"},
+				{Router: "floodsub", D: 4},
+				{D: 10, Dhi: 8},
+				{Score: &ScoreConfig{GossipThreshold: -10, PublishThreshold: -5}},
+				{Score: &ScoreConfig{InvalidMessageWeight: -1}},
+			} {
+				_, err := c.Options()
+				Expect(err).To(HaveOccurred(), "%+v", c)
+			}
+		})
+	})
+
+	Context("ReplayCache", func() {
+		It("rejects duplicate, stale and out-of-window messages", func() {
+			r := NewReplayCache(2, 4, time.Minute)
+			now := time.Now()
+
+			Expect(r.Check("a", 10, now)).To(Succeed())
+			Expect(r.Check("a", 10, now)).To(MatchError(ErrReplayed))
+			// Out of order messages within the window are accepted once
+			Expect(r.Check("a", 12, now)).To(Succeed())
+			Expect(r.Check("a", 11, now)).To(Succeed())
+			Expect(r.Check("a", 11, now)).To(MatchError(ErrReplayed))
+			Expect(r.Check("a", 8, now)).To(MatchError(ErrOutOfWindow))
+			Expect(r.Check("a", 13, now.Add(-2*time.Minute))).To(MatchError(ErrOutOfWindow))
+			Expect(r.Check("a", 13, now.Add(2*time.Minute))).To(MatchError(ErrOutOfWindow))
+
+			// Senders are tracked independently
+			Expect(r.Check("b", 10, now)).To(Succeed())
+		})
+	})
+
+	It("exchanges messages over floodsub", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		hubs := startHubs(ctx, []Option{WithRouter(FloodSub)}, []Option{WithRouter(FloodSub)})
+		Expect(hubs[0].PublishMessage(NewMessage("hello"))).To(Succeed())
+		Eventually(hubs[1].Messages, 10*time.Second).Should(Receive(HaveField("Message", "hello")))
+	})
+
+	It("drops messages rejected by validators before they reach the channel", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		reject := WithValidator(func(m *Message) error {
+			if strings.HasPrefix(m.Message, "bad") {
+				return errors.New("rejected")
+			}
+			return nil
+		})
+		hubs := startHubs(ctx, nil, []Option{reject})
+
+		Expect(hubs[0].PublishMessage(NewMessage("bad"))).To(Succeed())
+		Expect(hubs[0].PublishMessage(NewMessage("good"))).To(Succeed())
+
+		var m *Message
+		Eventually(hubs[1].Messages, 10*time.Second).Should(Receive(&m))
+		Expect(m.Message).To(Equal("good"))
+		Consistently(hubs[1].Messages, 500*time.Millisecond).ShouldNot(Receive())
+	})
+
+	It("delivers channel messages only to hubs that joined the channel", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		hubs := startHubs(ctx, nil, nil, nil)
+		events, err := hubs[0].Join("events")
+		Expect(err).ToNot(HaveOccurred())
+		again, err := hubs[0].Join("events")
+		Expect(err).ToNot(HaveOccurred())
+		Expect(again).To(BeIdenticalTo(events))
+		_, err = hubs[0].Join("")
+		Expect(err).To(HaveOccurred())
+
+		listener, err := hubs[1].Join("events")
+		Expect(err).ToNot(HaveOccurred())
+		other, err := hubs[2].Join("other")
+		Expect(err).ToNot(HaveOccurred())
+
+		// Messages published before the mesh of a freshly joined topic is built may be lost
+		Eventually(func() *Message {
+			Expect(events.Publish(NewMessage("event"))).To(Succeed())
+			select {
+			case m := <-listener.Messages:
+				return m
+			case <-time.After(500 * time.Millisecond):
+				return nil
+			}
+		}, 30*time.Second).Should(HaveField("Message", "event"))
+		peers, err := events.ListPeers()
+		Expect(err).ToNot(HaveOccurred())
+		Expect(peers).To(HaveLen(1))
+
+		Consistently(other.Messages, 500*time.Millisecond).ShouldNot(Receive())
+		Consistently(hubs[1].Messages, 500*time.Millisecond).ShouldNot(Receive())
+
+		hubs[1].Leave("events")
+		for len(listener.Messages) > 0 {
+			<-listener.Messages
+		}
+		Expect(events.Publish(NewMessage("event"))).To(Succeed())
+		Consistently(listener.Messages, 500*time.Millisecond).ShouldNot(Receive())
+	})
+
+	It("does not lose messages while rotating rooms", func() {
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		skew := []Option{WithRouter(FloodSub), WithClockSkew(2 * time.Second)}
+		hubs := startRotatingHubs(ctx, 1, skew, skew)
+
+		received := map[string]bool{}
+		for i := 0; i < 40; i++ {
+			msg := fmt.Sprint(i)
+			Expect(hubs[0].PublishMessage(NewMessage(msg))).To(Succeed())
+			time.Sleep(100 * time.Millisecond)
+
+			for drained := false; !drained; {
+				select {
+				case m := <-hubs[1].Messages:
+					Expect(received).ToNot(HaveKey(m.Message))
+					received[m.Message] = true
+				default:
+					drained = true
+				}
+			}
+		}
+		Eventually(func() int {
+			select {
+			case m := <-hubs[1].Messages:
+				received[m.Message] = true
+			default:
+			}
+			return len(received)
+		}, 5*time.Second).Should(Equal(40))
+	})
+})
@@ -13,12 +13,19 @@ limitations under the License.
 
 package hub
 
-import "encoding/json"
+import (
+	"encoding/json"
+	"time"
+)
 
 // Message 消息结构体，在pubsub消息体中进行JSON转换
 type Message struct {
 	Message  string // 消息内容
-	SenderID string // 发送者ID
+	SenderID string // 消息作者的对等节点ID
+
+	// Sequence 和 Timestamp 是作者的消息序号和发送时间，在密封的负载中传输，不会以明文发布
+	Sequence  uint64    `json:"-"`
+	Timestamp time.Time `json:"-"`
 
 	Annotations map[string]interface{} // 注解信息
 }
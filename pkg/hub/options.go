@@ -0,0 +1,225 @@
+// Copyright © 2022 Ettore Di Giacinto <mudler@c3os.io>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package hub
+
+import (
+	"fmt"
+	"time"
+
+	pubsub "github.com/libp2p/go-libp2p-pubsub"
+)
+
+// Router 是消息中心使用的pubsub路由器
+type Router string
+
+// 路由器常量定义
+const (
+	GossipSub Router = "gossipsub" // 默认路由器，每个对等节点只向网格中的部分节点转发
+	FloodSub  Router = "floodsub"  // 向所有对等节点转发，适合小型网络
+)
+
+// Validator 在消息到达Messages通道之前校验消息，返回错误时消息被拒绝且不会被转发
+type Validator func(*Message) error
+
+// Option 是消息中心的选项
+type Option func(m *MessageHub)
+
+// WithRouter 设置pubsub路由器
+// 参数 r 为路由器
+func WithRouter(r Router) Option {
+	return func(m *MessageHub) {
+		m.router = r
+	}
+}
+
+// WithGossipSubParams 设置GossipSub的网格和心跳参数
+// 参数 p 为GossipSub参数
+func WithGossipSubParams(p pubsub.GossipSubParams) Option {
+	return func(m *MessageHub) {
+		m.gossipParams = &p
+	}
+}
+
+// WithPeerScore 启用GossipSub的对等节点评分，topic为每个房间主题的评分参数，可以为空
+// 参数 p 为评分参数，t 为评分阈值，topic 为主题评分参数
+func WithPeerScore(p *pubsub.PeerScoreParams, t *pubsub.PeerScoreThresholds, topic *pubsub.TopicScoreParams) Option {
+	return func(m *MessageHub) {
+		m.scoreParams, m.scoreThresholds, m.topicScore = p, t, topic
+	}
+}
+
+// WithValidator 添加消息校验器，超过最大消息大小或者无法解码的消息总是被拒绝
+// 参数 v 为校验器
+func WithValidator(v ...Validator) Option {
+	return func(m *MessageHub) {
+		m.validators = append(m.validators, v...)
+	}
+}
+
+// WithClockSkew 设置容忍的时钟偏差。消息中心同时订阅[now-d, now+d]内每个一次性密码对应的房间，
+// 只在当前房间发布消息，因此在密码轮换时以及与时钟偏差小于d的对等节点之间都不会丢失消息
+// 节点也使用d作为重放缓存接受的时间戳偏差
+// 参数 d 为时钟偏差
+func WithClockSkew(d time.Duration) Option {
+	return func(m *MessageHub) {
+		m.skew = d
+	}
+}
+
+// Config 是消息中心的pubsub配置，可以在网络配置中指定。网络中的所有节点应该使用相同的配置
+type Config struct {
+	Router string `yaml:"router,omitempty"` // 路由器："gossipsub"（默认）或"floodsub"
+
+	// GossipSub网格参数，为0时使用默认值
+	D                 int           `yaml:"d,omitempty"`
+	Dlo               int           `yaml:"dlo,omitempty"`
+	Dhi               int           `yaml:"dhi,omitempty"`
+	HeartbeatInterval time.Duration `yaml:"heartbeat_interval,omitempty"`
+
+	Score *ScoreConfig `yaml:"score,omitempty"` // 对等节点评分，为空时禁用
+
+	ClockSkew time.Duration `yaml:"clock_skew,omitempty"` // 容忍的时钟偏差，为0时使用DefaultClockSkew
+}
+
+// ScoreConfig 是GossipSub对等节点评分的配置，未设置的参数不参与评分
+type ScoreConfig struct {
+	GossipThreshold   float64 `yaml:"gossip_threshold"`              // 低于该分数时不与对等节点交换gossip
+	PublishThreshold  float64 `yaml:"publish_threshold"`             // 低于该分数时不向对等节点发布消息
+	GraylistThreshold float64 `yaml:"graylist_threshold"`            // 低于该分数时忽略对等节点的所有消息
+	AcceptPXThreshold float64 `yaml:"accept_px_threshold,omitempty"` // 接受对等节点交换的最低分数
+
+	IPColocationFactorWeight    float64 `yaml:"ip_colocation_factor_weight,omitempty"`    // 同一IP上过多对等节点的惩罚权重
+	IPColocationFactorThreshold int     `yaml:"ip_colocation_factor_threshold,omitempty"` // 同一IP上允许的对等节点数量
+	BehaviourPenaltyWeight      float64 `yaml:"behaviour_penalty_weight,omitempty"`       // 违反协议的惩罚权重
+	BehaviourPenaltyDecay       float64 `yaml:"behaviour_penalty_decay,omitempty"`        // 违反协议惩罚的衰减系数
+
+	InvalidMessageWeight float64 `yaml:"invalid_message_weight,omitempty"` // 被校验器拒绝的消息的惩罚权重
+	InvalidMessageDecay  float64 `yaml:"invalid_message_decay,omitempty"`  // 被拒绝消息惩罚的衰减系数
+}
+
+// Options 将配置转换为消息中心的选项，配置无效时返回错误
+func (c Config) Options() ([]Option, error) {
+	opts := []Option{}
+
+	gossip := c.D != 0 || c.Dlo != 0 || c.Dhi != 0 || c.HeartbeatInterval != 0 || c.Score != nil
+	switch Router(c.Router) {
+	case "", GossipSub:
+	case FloodSub:
+		if gossip {
+			return nil, fmt.Errorf("floodsub 不支持GossipSub参数和对等节点评分")
+		}
+		opts = append(opts, WithRouter(FloodSub))
+	default:
+		return nil, fmt.Errorf("未知的pubsub路由器 '%s'", c.Router)
+	}
+
+	if c.D != 0 || c.Dlo != 0 || c.Dhi != 0 || c.HeartbeatInterval != 0 {
+		p := pubsub.DefaultGossipSubParams()
+		if c.D > 0 {
+			p.D = c.D
+		}
+		if c.Dlo > 0 {
+			p.Dlo = c.Dlo
+		}
+		if c.Dhi > 0 {
+			p.Dhi = c.Dhi
+		}
+		if c.HeartbeatInterval > 0 {
+			p.HeartbeatInterval = c.HeartbeatInterval
+		}
+		if !(p.Dlo <= p.D && p.D <= p.Dhi) {
+			return nil, fmt.Errorf("GossipSub参数无效: 需要 dlo (%d) <= d (%d) <= dhi (%d)", p.Dlo, p.D, p.Dhi)
+		}
+		// 派生参数必须与网格大小保持一致
+		if p.Dscore > p.Dhi {
+			p.Dscore = p.Dhi
+		}
+		if p.Dout >= p.Dlo || p.Dout >= p.D/2 {
+			p.Dout = min(p.Dlo, p.D/2) - 1
+			if p.Dout < 0 {
+				p.Dout = 0
+			}
+		}
+		opts = append(opts, WithGossipSubParams(p))
+	}
+
+	if c.ClockSkew < 0 {
+		return nil, fmt.Errorf("clock_skew 不能为负数")
+	}
+	if c.ClockSkew > 0 {
+		opts = append(opts, WithClockSkew(c.ClockSkew))
+	}
+
+	if c.Score != nil {
+		p, t, topic, err := c.Score.params()
+		if err != nil {
+			return nil, err
+		}
+		opts = append(opts, WithPeerScore(p, t, topic))
+	}
+	return opts, nil
+}
+
+// params 返回评分参数，只校验会导致GossipSub拒绝启动的参数
+func (s ScoreConfig) params() (*pubsub.PeerScoreParams, *pubsub.PeerScoreThresholds, *pubsub.TopicScoreParams, error) {
+	if !(s.GraylistThreshold <= s.PublishThreshold && s.PublishThreshold <= s.GossipThreshold && s.GossipThreshold <= 0) {
+		return nil, nil, nil, fmt.Errorf("评分阈值无效: 需要 graylist <= publish <= gossip <= 0")
+	}
+	if s.AcceptPXThreshold < 0 {
+		return nil, nil, nil, fmt.Errorf("评分阈值无效: accept_px_threshold 不能为负数")
+	}
+	if s.IPColocationFactorWeight > 0 || s.BehaviourPenaltyWeight > 0 || s.InvalidMessageWeight > 0 {
+		return nil, nil, nil, fmt.Errorf("惩罚权重必须为负数")
+	}
+	if s.IPColocationFactorWeight != 0 && s.IPColocationFactorThreshold < 1 {
+		return nil, nil, nil, fmt.Errorf("ip_colocation_factor_threshold 至少为1")
+	}
+	if s.BehaviourPenaltyWeight != 0 && (s.BehaviourPenaltyDecay <= 0 || s.BehaviourPenaltyDecay >= 1) {
+		return nil, nil, nil, fmt.Errorf("behaviour_penalty_decay 必须在0和1之间")
+	}
+	if s.InvalidMessageWeight != 0 && (s.InvalidMessageDecay <= 0 || s.InvalidMessageDecay >= 1) {
+		return nil, nil, nil, fmt.Errorf("invalid_message_decay 必须在0和1之间")
+	}
+
+	p := &pubsub.PeerScoreParams{
+		SkipAtomicValidation:        true,
+		DecayInterval:               time.Second,
+		DecayToZero:                 0.01,
+		IPColocationFactorWeight:    s.IPColocationFactorWeight,
+		IPColocationFactorThreshold: s.IPColocationFactorThreshold,
+		BehaviourPenaltyWeight:      s.BehaviourPenaltyWeight,
+		BehaviourPenaltyDecay:       s.BehaviourPenaltyDecay,
+		Topics:                      map[string]*pubsub.TopicScoreParams{},
+	}
+	t := &pubsub.PeerScoreThresholds{
+		SkipAtomicValidation: true,
+		GossipThreshold:      s.GossipThreshold,
+		PublishThreshold:     s.PublishThreshold,
+		GraylistThreshold:    s.GraylistThreshold,
+		AcceptPXThreshold:    s.AcceptPXThreshold,
+	}
+
+	var topic *pubsub.TopicScoreParams
+	if s.InvalidMessageWeight != 0 {
+		topic = &pubsub.TopicScoreParams{
+			SkipAtomicValidation:           true,
+			TopicWeight:                    1,
+			InvalidMessageDeliveriesWeight: s.InvalidMessageWeight,
+			InvalidMessageDeliveriesDecay:  s.InvalidMessageDecay,
+		}
+	}
+	return p, t, topic, nil
+}
@@ -0,0 +1,91 @@
+// Copyright © 2022 Ettore Di Giacinto <mudler@c3os.io>
+//
+// This program is free software; you can redistribute it and/or modify
+// it under the terms of the GNU General Public License as published by
+// the Free Software Foundation; either version 2 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU General Public License for more details.
+//
+// You should have received a copy of the GNU General Public License along
+// with this program; if not, see <http://www.gnu.org/licenses/>.
+
+package hub
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+)
+
+var (
+	// ErrReplayed 表示消息的序号已经收到过
+	ErrReplayed = errors.New("重复的消息")
+	// ErrOutOfWindow 表示消息的时间戳或者序号超出了接受范围
+	ErrOutOfWindow = errors.New("消息超出了接受范围")
+)
+
+// ReplayCache 记录每个发送者最近收到的消息序号，拒绝重复的消息和时间戳超出容忍范围的消息
+// 发送者的数量和每个发送者记录的序号数量都是有限的
+type ReplayCache struct {
+	sync.Mutex
+
+	senders *lru.Cache    // 发送者到序号窗口的映射
+	window  uint64        // 每个发送者记录的序号数量
+	maxAge  time.Duration // 容忍的时间戳偏差
+}
+
+// replayWindow 是一个发送者最近收到的序号
+type replayWindow struct {
+	highest uint64              // 收到的最大序号
+	seen    map[uint64]struct{} // 范围(highest-window, highest]内收到的序号
+}
+
+// NewReplayCache 创建新的重放缓存
+// 参数 senders 为记录的发送者数量，window 为每个发送者记录的序号数量，maxAge 为容忍的时间戳偏差
+func NewReplayCache(senders, window int, maxAge time.Duration) *ReplayCache {
+	cache, _ := lru.New(senders)
+	return &ReplayCache{senders: cache, window: uint64(window), maxAge: maxAge}
+}
+
+// Check 检查并记录发送者的消息，消息被接受时返回nil
+// 比窗口中最小序号更旧的消息和时间戳与当前时间相差超过maxAge的消息被拒绝
+// 参数 sender 为发送者，seq 为消息序号，ts 为消息时间戳
+func (r *ReplayCache) Check(sender string, seq uint64, ts time.Time) error {
+	if d := time.Since(ts); d > r.maxAge || d < -r.maxAge {
+		return ErrOutOfWindow
+	}
+
+	r.Lock()
+	defer r.Unlock()
+
+	v, exists := r.senders.Get(sender)
+	if !exists {
+		r.senders.Add(sender, &replayWindow{highest: seq, seen: map[uint64]struct{}{seq: {}}})
+		return nil
+	}
+
+	w := v.(*replayWindow)
+	switch {
+	case seq > w.highest:
+		w.highest = seq
+		for s := range w.seen {
+			if s+r.window <= w.highest {
+				delete(w.seen, s)
+			}
+		}
+	case seq+r.window <= w.highest:
+		return ErrOutOfWindow
+	default:
+		if _, dup := w.seen[seq]; dup {
+			return ErrReplayed
+		}
+	}
+	w.seen[seq] = struct{}{}
+	return nil
+}
@@ -18,9 +18,11 @@ package hub
 import (
 	"context"
 	"encoding/json"
+	"errors"
 
 	"github.com/libp2p/go-libp2p/core/peer"
 
+	lru "github.com/hashicorp/golang-lru"
 	pubsub "github.com/libp2p/go-libp2p-pubsub"
 )
 
@@ -28,18 +30,20 @@ import (
 // 可以使用Room.Publish向主题发布消息，
 // 接收到的消息被推送到Messages通道。
 type room struct {
-	ctx   context.Context
-	ps    *pubsub.PubSub
-	Topic *pubsub.Topic
-	sub   *pubsub.Subscription
+	ctx    context.Context
+	cancel context.CancelFunc
+	ps     *pubsub.PubSub
+	Topic  *pubsub.Topic
+	sub    *pubsub.Subscription
 
-	roomName string  // 房间名称
-	self     peer.ID // 自身对等节点ID
+	roomName string     // 房间名称
+	self     peer.ID    // 自身对等节点ID
+	seen     *lru.Cache // 所有房间共享的最近消息ID
 }
 
 // connect 尝试订阅房间名称的PubSub主题，成功时返回Room
-// 参数 ctx 为上下文，ps 为PubSub服务，selfID 为自身ID，roomName 为房间名称，messageChan 为消息通道
-func connect(ctx context.Context, ps *pubsub.PubSub, selfID peer.ID, roomName string, messageChan chan *Message) (*room, error) {
+// 参数 ctx 为上下文，ps 为PubSub服务，selfID 为自身ID，roomName 为房间名称，messageChan 为消息通道，seen 为共享的最近消息ID
+func connect(ctx context.Context, ps *pubsub.PubSub, selfID peer.ID, roomName string, messageChan chan *Message, seen *lru.Cache) (*room, error) {
 	// 加入pubsub主题
 	topic, err := ps.Join(roomName)
 	if err != nil {
@@ -49,16 +53,20 @@ func connect(ctx context.Context, ps *pubsub.PubSub, selfID peer.ID, roomName st
 	// 订阅主题
 	sub, err := topic.Subscribe()
 	if err != nil {
+		topic.Close()
 		return nil, err
 	}
 
+	ctx, cancel := context.WithCancel(ctx)
 	cr := &room{
 		ctx:      ctx,
+		cancel:   cancel,
 		ps:       ps,
 		Topic:    topic,
 		sub:      sub,
 		self:     selfID,
 		roomName: roomName,
+		seen:     seen,
 	}
 
 	// 在循环中开始从订阅读取消息
@@ -66,6 +74,14 @@ func connect(ctx context.Context, ps *pubsub.PubSub, selfID peer.ID, roomName st
 	return cr, nil
 }
 
+// leave 取消订阅并离开房间
+func (cr *room) leave() {
+	cr.cancel()
+	cr.sub.Cancel()
+	cr.Topic.Close()
+	cr.ps.UnregisterTopicValidator(cr.roomName)
+}
+
 // publishMessage 向pubsub主题发送消息
 // 参数 m 为要发布的消息
 func (cr *room) publishMessage(m *Message) error {
@@ -84,19 +100,72 @@ func (cr *room) readLoop(messageChan chan *Message) {
 		if err != nil {
 			return
 		}
-		// 只转发由其他人发送的消息
-		if msg.ReceivedFrom == cr.self {
+		// 只转发由其他人发布的消息
+		if msg.GetFrom() == cr.self {
 			continue
 		}
-		cm := new(Message)
-		err = json.Unmarshal(msg.Data, cm)
-		if err != nil {
+		// 消息已经被校验器解码
+		cm, ok := msg.ValidatorData.(*Message)
+		if !ok {
+			cm = new(Message)
+			if err := json.Unmarshal(msg.Data, cm); err != nil {
+				continue
+			}
+		}
+
+		// 时钟偏差容忍范围内的多个房间中可能收到同一条消息
+		if dup, _ := cr.seen.ContainsOrAdd(msg.ID, nil); dup {
 			continue
 		}
 
-		cm.SenderID = msg.ReceivedFrom.String()
+		// 使用经过pubsub签名验证的作者，而不是转发消息的对等节点
+		cm.SenderID = msg.GetFrom().String()
 
 		// 将有效消息发送到Messages通道
 		messageChan <- cm
 	}
 }
+
+// rooms 是一个通道在时钟偏差容忍范围内订阅的所有房间，消息只发布到当前房间
+type rooms struct {
+	current string           // 当前房间名称
+	joined  map[string]*room // 已经加入的房间
+}
+
+// newRooms 创建空的房间集合
+func newRooms() *rooms {
+	return &rooms{joined: map[string]*room{}}
+}
+
+// publish 发布消息到当前房间
+// 参数 m 为要发布的消息
+func (r *rooms) publish(m *Message) error {
+	if cr, exists := r.joined[r.current]; exists {
+		return cr.publishMessage(m)
+	}
+	return errors.New("没有可用的消息房间")
+}
+
+// peers 返回所有房间中的对等节点
+func (r *rooms) peers() []peer.ID {
+	seen := map[peer.ID]struct{}{}
+	peers := []peer.ID{}
+	for _, cr := range r.joined {
+		for _, p := range cr.Topic.ListPeers() {
+			if _, exists := seen[p]; !exists {
+				seen[p] = struct{}{}
+				peers = append(peers, p)
+			}
+		}
+	}
+	return peers
+}
+
+// leave 离开所有房间
+func (r *rooms) leave() {
+	for t, cr := range r.joined {
+		cr.leave()
+		delete(r.joined, t)
+	}
+	r.current = ""
+}
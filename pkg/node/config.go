@@ -46,9 +46,18 @@ type Config struct {
 	// Handlers 是订阅VPN接口接收消息的处理器列表
 	Handlers, GenericChannelHandler []Handler
 
+	// RequestHandlers 是处理点对点消息的处理器列表
+	RequestHandlers []RequestHandler
+
+	// ChannelHandlers 是应用程序定义的通道及其处理器，节点启动时加入这些通道
+	ChannelHandlers map[string][]Handler
+
 	MaxMessageSize  int // 最大消息大小
 	SealKeyInterval int // 密封密钥间隔
 
+	PubSub     hub.Config   // 消息中心的pubsub配置
+	HubOptions []hub.Option // 消息中心的其他选项
+
 	ServiceDiscovery []ServiceDiscovery // 服务发现列表
 	NetworkServices  []NetworkService   // 网络服务列表
 	Logger           log.StandardLogger // 日志记录器
@@ -68,6 +77,9 @@ type Config struct {
 
 	Whitelist, Blacklist []string // 白名单和黑名单
 
+	LedgerAdmins             []string      // 账本管理员的对等节点ID
+	LedgerTombstoneRetention time.Duration // 账本中已删除键的墓碑保留时间
+
 	// GenericHub 启用通用中心
 	GenericHub bool
 
@@ -76,6 +88,11 @@ type Config struct {
 
 	Sealer    Sealer // 密封器
 	PeerGater Gater  // 对等节点门控器
+
+	// LegacySealer 是升级期间仍然接受的旧格式密封器，Sealer无法解封的消息再尝试使用它解封。
+	// 对等节点都支持Sealer的格式之前发出的消息也使用它密封，SealLegacy为true时始终使用它密封
+	LegacySealer Sealer
+	SealLegacy   bool
 }
 
 // Gater 对等节点门控器接口
@@ -92,6 +109,14 @@ type Sealer interface {
 	Unseal(string, string) (string, error) // 解封
 }
 
+// AuthenticatedSealer 是将消息作者作为附加数据认证的密封器
+// 节点使用从交换密钥和时间窗口派生的密钥材料，作者不符的消息无法解封
+type AuthenticatedSealer interface {
+	Sealer
+	SealFor(message, key, author string) (string, error)    // 密封并绑定作者
+	UnsealFrom(message, key, author string) (string, error) // 解封并验证作者
+}
+
 // NetworkService 是运行在网络上的服务。它接收上下文、节点和账本
 type NetworkService func(context.Context, Config, *Node, *blockchain.Ledger) error
 
@@ -101,6 +126,10 @@ type StreamHandler func(*Node, *blockchain.Ledger) func(stream network.Stream)
 // Handler 消息处理器类型
 type Handler func(*blockchain.Ledger, *hub.Message, chan *hub.Message) error
 
+// RequestHandler 处理对等节点通过SendTo直接发送的消息，SenderID为发送者的对等节点ID
+// 返回的消息作为回复发送给发送者，返回nil时交给下一个处理器
+type RequestHandler func(context.Context, *hub.Message) (*hub.Message, error)
+
 // ServiceDiscovery 服务发现接口
 type ServiceDiscovery interface {
 	Run(log.StandardLogger, context.Context, host.Host) error // 运行服务发现
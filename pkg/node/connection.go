@@ -17,9 +17,13 @@ import (
 	"context"
 	"crypto/rand"
 	"crypto/sha256"
+	"encoding/json"
+	"fmt"
 	"io"
 	mrand "math/rand"
 	"net"
+	"sync/atomic"
+	"time"
 
 	internalCrypto "github.com/purpose168/edgevpn/pkg/crypto"
 
@@ -245,6 +249,129 @@ func (e *Node) sealkey() string {
 	return internalCrypto.MD5(internalCrypto.TOTP(sha256.New, e.config.SealKeyLength, e.config.SealKeyInterval, e.config.ExchangeKey))
 }
 
+// sealkeys 返回消息中心时钟偏差容忍范围内的所有密封密钥，当前密钥在最前面
+func (e *Node) sealkeys() []string {
+	keys := internalCrypto.TOTPWindow(sha256.New, e.config.SealKeyLength, e.config.SealKeyInterval, e.config.ExchangeKey, time.Now(), e.MessageHub.ClockSkew())
+	for i, k := range keys {
+		keys[i] = internalCrypto.MD5(k)
+	}
+	return keys
+}
+
+// sealsecrets 返回消息中心时钟偏差容忍范围内每个时间窗口的密钥材料，当前时间窗口在最前面
+// 认证密封器使用HKDF从中派生每条消息的密钥
+func (e *Node) sealsecrets() []string {
+	secrets := []string{}
+	for _, step := range internalCrypto.TimeSteps(e.config.SealKeyInterval, time.Now(), e.MessageHub.ClockSkew()) {
+		secrets = append(secrets, fmt.Sprintf("%s:%d", e.config.ExchangeKey, step))
+	}
+	return secrets
+}
+
+// seal 使用当前的密钥密封本节点发出的消息
+// 参数 message 为要密封的消息
+func (e *Node) seal(message string) (string, error) {
+	if e.config.LegacySealer != nil && (e.config.SealLegacy || !e.sealUpgraded()) {
+		return e.config.LegacySealer.Seal(message, e.sealkey())
+	}
+	if s, ok := e.config.Sealer.(AuthenticatedSealer); ok {
+		return s.SealFor(message, e.sealsecrets()[0], e.host.ID().String())
+	}
+	return e.config.Sealer.Seal(message, e.sealkey())
+}
+
+// sealUpgraded 返回最近发送过消息的对等节点是否都支持Sealer的格式，切换发送格式时记录日志
+func (e *Node) sealUpgraded() bool {
+	upgraded, changed := e.sealers.upgraded(time.Now())
+	if changed && upgraded {
+		e.config.Logger.Info("所有对等节点都已升级，开始使用新格式密封消息")
+	} else if changed {
+		e.config.Logger.Info("发现尚未升级的对等节点，恢复使用旧格式密封消息")
+	}
+	return upgraded
+}
+
+// unseal 依次使用时钟偏差容忍范围内的密钥解封消息，
+// 刚刚轮换密钥或者时钟略有偏差的对等节点发送的消息也可以解封。
+// 设置了LegacySealer时，无法解封的消息再尝试使用旧格式解封
+// 参数 message 为密封的消息，author 为消息作者
+func (e *Node) unseal(message string, author peer.ID) (decoded string, err error) {
+	if decoded, err = e.unsealWith(e.config.Sealer, message, author); err == nil || e.config.LegacySealer == nil {
+		return
+	}
+	return e.unsealWith(e.config.LegacySealer, message, author)
+}
+
+// unsealWith 使用指定的密封器解封消息
+// 参数 sealer 为密封器，message 为密封的消息，author 为消息作者
+func (e *Node) unsealWith(sealer Sealer, message string, author peer.ID) (decoded string, err error) {
+	if s, ok := sealer.(AuthenticatedSealer); ok {
+		for _, k := range e.sealsecrets() {
+			if decoded, err = s.UnsealFrom(message, k, author.String()); err == nil {
+				return
+			}
+		}
+		return
+	}
+
+	for _, k := range e.sealkeys() {
+		if decoded, err = sealer.Unseal(message, k); err == nil {
+			return
+		}
+	}
+	return
+}
+
+// envelope 是密封在消息中的负载，序号和时间戳用于拒绝重放的消息
+type envelope struct {
+	Seq     uint64    // 单调递增的消息序号
+	Time    time.Time // 发送时间
+	Message []byte    // 消息内容，可能不是UTF-8编码的文本（例如压缩的账本区块）
+}
+
+// sealMessage 为消息分配序号和时间戳并密封
+// 参数 m 为要密封的消息
+func (e *Node) sealMessage(m *hub.Message) (string, error) {
+	return e.sealEnvelope([]byte(m.Message))
+}
+
+// sealEnvelope 将数据与新的序号和时间戳一起密封
+// 参数 dat 为要密封的数据
+func (e *Node) sealEnvelope(dat []byte) (string, error) {
+	dat, err := json.Marshal(envelope{Seq: atomic.AddUint64(&e.seq, 1), Time: time.Now(), Message: dat})
+	if err != nil {
+		return "", err
+	}
+	return e.seal(string(dat))
+}
+
+// openEnvelope 解封数据并检查重放缓存，拒绝重复的消息和时间戳超出容忍范围的消息
+// 参数 sealed 为密封的数据，author 为作者
+func (e *Node) openEnvelope(sealed string, author peer.ID) (envelope, error) {
+	env := envelope{}
+	str, err := e.unseal(sealed, author)
+	if err != nil {
+		return env, err
+	}
+	if err := json.Unmarshal([]byte(str), &env); err != nil {
+		return env, err
+	}
+	return env, e.replay.Check(author.String(), env.Seq, env.Time)
+}
+
+// openMessage 解封消息并检查重放缓存，拒绝重复的消息和时间戳超出容忍范围的消息
+// 参数 m 为收到的消息，author 为消息作者
+func (e *Node) openMessage(m *hub.Message, author peer.ID) (*hub.Message, error) {
+	env, err := e.openEnvelope(m.Message, author)
+	if err != nil {
+		return nil, err
+	}
+
+	c := m.Copy()
+	c.Message, c.Sequence, c.Timestamp = string(env.Message), env.Seq, env.Time
+	return c, nil
+}
+
 // handleEvents 处理事件循环
 // 参数 ctx 为上下文，inputChannel 为输入通道，roomMessages 为房间消息通道，pub 为发布函数，handlers 为处理器列表，peerGater 为是否启用对等节点门控
 func (e *Node) handleEvents(ctx context.Context, inputChannel chan *hub.Message, roomMessages chan *hub.Message, pub func(*hub.Message) error, handlers []Handler, peerGater bool) {
@@ -255,9 +382,19 @@ func (e *Node) handleEvents(ctx context.Context, inputChannel chan *hub.Message,
 				continue
 			}
 			c := m.Copy()
-			str, err := e.config.Sealer.Seal(c.Message, e.sealkey())
+			if _, ok := e.config.Sealer.(AuthenticatedSealer); ok {
+				// 宣告本节点可以解封新格式，注解是签名的消息内容的一部分
+				annotations := map[string]interface{}{}
+				for k, v := range m.Annotations {
+					annotations[k] = v
+				}
+				annotations[sealerAnnotation] = sealerAuthenticated
+				c.Annotations = annotations
+			}
+			str, err := e.sealMessage(c)
 			if err != nil {
-				e.config.Logger.Warnf("%w 来自 %s", err.Error(), c.SenderID)
+				e.config.Logger.Warnf("无法密封消息: %s", err)
+				continue
 			}
 			c.Message = str
 
@@ -270,10 +407,17 @@ func (e *Node) handleEvents(ctx context.Context, inputChannel chan *hub.Message,
 				continue
 			}
 
+			// SenderID是经过pubsub签名验证的消息作者，而不是转发消息的对等节点
+			author, err := peer.Decode(m.SenderID)
+			if err != nil {
+				e.config.Logger.Warnf("无效的消息作者 %s: %s", m.SenderID, err)
+				continue
+			}
+
 			// 对等节点门控检查
 			if peerGater {
-				if e.config.PeerGater != nil && e.config.PeerGater.Gate(e, peer.ID(m.SenderID)) {
-					e.config.Logger.Warnf("已门控来自 %s 的消息", m.SenderID)
+				if e.config.PeerGater != nil && e.config.PeerGater.Gate(e, author) {
+					e.config.Logger.Warnf("已门控来自 %s 的消息", author)
 					continue
 				}
 			}
@@ -281,22 +425,23 @@ func (e *Node) handleEvents(ctx context.Context, inputChannel chan *hub.Message,
 			if len(e.config.PeerTable) > 0 {
 				found := false
 				for _, p := range e.config.PeerTable {
-					if p.String() == peer.ID(m.SenderID).String() {
+					if p == author {
 						found = true
 					}
 				}
 				if !found {
-					e.config.Logger.Warnf("已门控来自 %s 的消息 - 不在对等节点表中", m.SenderID)
+					e.config.Logger.Warnf("已门控来自 %s 的消息 - 不在对等节点表中", author)
 					continue
 				}
 			}
 
-			c := m.Copy()
-			str, err := e.config.Sealer.Unseal(c.Message, e.sealkey())
+			// 丢弃无法认证或者重放的消息
+			c, err := e.openMessage(m, author)
 			if err != nil {
-				e.config.Logger.Warnf("%w 来自 %s", err.Error(), c.SenderID)
+				e.config.Logger.Debugf("已丢弃来自 %s 的消息: %s", author, err)
+				continue
 			}
-			c.Message = str
+			e.sealers.observe(author, m.Annotations[sealerAnnotation] == sealerAuthenticated, time.Now())
 			e.handleReceivedMessage(c, handlers, inputChannel)
 		case <-ctx.Done():
 			return
@@ -0,0 +1,153 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"github.com/purpose168/edgevpn/pkg/hub"
+	protocol "github.com/purpose168/edgevpn/pkg/protocol"
+)
+
+// messageTimeout 是一次点对点请求（包括处理器处理）的超时时间
+const messageTimeout = 30 * time.Second
+
+// messageResponse 是点对点请求的回复，处理失败时Error不为空
+type messageResponse struct {
+	Message *hub.Message `json:",omitempty"`
+	Error   string       `json:",omitempty"`
+}
+
+// messageHandler 响应对等节点的点对点请求
+func (e *Node) messageHandler(ctx context.Context) network.StreamHandler {
+	return func(s network.Stream) {
+		defer s.Close()
+		remote := s.Conn().RemotePeer()
+		if !e.trusted(remote) {
+			e.config.Logger.Warnf("已门控来自 %s 的消息", remote)
+			s.Reset()
+			return
+		}
+		s.SetDeadline(time.Now().Add(messageTimeout))
+
+		enc, dec := json.NewEncoder(s), json.NewDecoder(s)
+		m, err := e.readRequest(dec, remote)
+		if err != nil {
+			e.config.Logger.Debugf("来自 %s 的消息错误: %s", remote, err)
+			s.Reset()
+			return
+		}
+		m.SenderID = remote.String()
+
+		ctx, cancel := context.WithTimeout(ctx, messageTimeout)
+		defer cancel()
+
+		res := messageResponse{}
+		reply, err := e.handleRequest(ctx, m)
+		if err != nil {
+			res.Error = err.Error()
+		}
+		res.Message = reply
+		if err := e.writeSealed(enc, res); err != nil {
+			s.Reset()
+		}
+	}
+}
+
+// handleRequest 按顺序调用请求处理器，直到某个处理器返回回复或者错误
+func (e *Node) handleRequest(ctx context.Context, m *hub.Message) (*hub.Message, error) {
+	for _, h := range e.config.RequestHandlers {
+		reply, err := h(ctx, m.Copy())
+		if err != nil || reply != nil {
+			return reply, err
+		}
+	}
+	return nil, errors.New("没有处理消息的处理器")
+}
+
+// writeRequest 密封并写入直接发送的请求，与广播消息一样带有序号和时间戳
+// 参数 enc 为流的编码器，m 为请求
+func (e *Node) writeRequest(enc *json.Encoder, m *hub.Message) error {
+	dat, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	sealed, err := e.sealEnvelope(dat)
+	if err != nil {
+		return err
+	}
+	return enc.Encode(sealed)
+}
+
+// readRequest 读取并解封对等节点from直接发送的请求，重放的请求与广播消息一样被拒绝
+// 参数 dec 为流的解码器，from 为发送者
+func (e *Node) readRequest(dec *json.Decoder, from peer.ID) (*hub.Message, error) {
+	var sealed string
+	if err := dec.Decode(&sealed); err != nil {
+		return nil, err
+	}
+	env, err := e.openEnvelope(sealed, from)
+	if err != nil {
+		return nil, err
+	}
+	m := &hub.Message{}
+	return m, json.Unmarshal(env.Message, m)
+}
+
+// SendTo 将密封的消息直接发送给对等节点并等待回复，消息不会经过消息中心广播
+// 与广播消息一样，不在对等节点表中或者被门控的对等节点不能发送和接收消息。
+// 对方的处理器返回错误时返回该错误
+// 参数 ctx 为上下文，p 为对等节点ID，m 为消息
+func (e *Node) SendTo(ctx context.Context, p peer.ID, m *hub.Message) (*hub.Message, error) {
+	if !e.trusted(p) {
+		return nil, fmt.Errorf("已门控对等节点 %s", p)
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, messageTimeout)
+	defer cancel()
+
+	s, err := e.host.NewStream(ctx, p, protocol.MessageProtocol.ID())
+	if err != nil {
+		return nil, err
+	}
+	defer s.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		s.SetDeadline(deadline)
+	}
+
+	req := m.Copy()
+	req.SenderID = e.host.ID().String()
+	res := messageResponse{}
+	if err := e.writeRequest(json.NewEncoder(s), req); err != nil {
+		return nil, err
+	}
+	if err := e.readSealed(json.NewDecoder(s), p, &res); err != nil {
+		return nil, err
+	}
+	if res.Error != "" {
+		return nil, fmt.Errorf("%s: %s", p, res.Error)
+	}
+	if res.Message == nil {
+		return nil, fmt.Errorf("%s 没有回复", p)
+	}
+	res.Message.SenderID = p.String()
+	return res.Message, nil
+}
@@ -0,0 +1,231 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/event"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"github.com/purpose168/edgevpn/pkg/blockchain"
+	protocol "github.com/purpose168/edgevpn/pkg/protocol"
+)
+
+const (
+	// ledgerSyncTimeout 是一次账本同步的超时时间
+	ledgerSyncTimeout = 30 * time.Second
+	// ledgerSyncThrottle 是与同一个对等节点同步的最小间隔
+	ledgerSyncThrottle = 10 * time.Second
+)
+
+// syncRequest 是账本同步请求，Buckets为空时请求对方的链头
+type syncRequest struct {
+	Buckets []string `json:",omitempty"`
+}
+
+// syncResponse 是账本同步响应，包含链头或者请求的存储桶
+type syncResponse struct {
+	Head  *blockchain.Head  `json:",omitempty"`
+	Block *blockchain.Block `json:",omitempty"`
+}
+
+// writeSealed 使用网络的密钥密封v并写入流，只有网络中的节点才能读取
+func (e *Node) writeSealed(enc *json.Encoder, v interface{}) error {
+	dat, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	sealed, err := e.seal(string(dat))
+	if err != nil {
+		return err
+	}
+	return enc.Encode(sealed)
+}
+
+// readSealed 从流中读取并解封v，v必须由对等节点from密封
+func (e *Node) readSealed(dec *json.Decoder, from peer.ID, v interface{}) error {
+	var sealed string
+	if err := dec.Decode(&sealed); err != nil {
+		return err
+	}
+	dat, err := e.unseal(sealed, from)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal([]byte(dat), v)
+}
+
+// trusted 如果对等节点可以与我们交换账本则返回true
+// 与广播消息一样应用对等节点门控和对等节点表
+func (e *Node) trusted(p peer.ID) bool {
+	if e.config.PeerGater != nil && e.config.PeerGater.Gate(e, p) {
+		return false
+	}
+	if len(e.config.PeerTable) == 0 {
+		return true
+	}
+	for _, pp := range e.config.PeerTable {
+		if pp == p {
+			return true
+		}
+	}
+	return false
+}
+
+// ledgerSyncHandler 响应对等节点的账本同步请求
+// 参数 l 为账本
+func (e *Node) ledgerSyncHandler(l *blockchain.Ledger) network.StreamHandler {
+	return func(s network.Stream) {
+		defer s.Close()
+		if !e.trusted(s.Conn().RemotePeer()) {
+			e.config.Logger.Warnf("已门控来自 %s 的账本同步请求", s.Conn().RemotePeer())
+			s.Reset()
+			return
+		}
+		s.SetDeadline(time.Now().Add(ledgerSyncTimeout))
+
+		enc, dec := json.NewEncoder(s), json.NewDecoder(s)
+		for {
+			req := syncRequest{}
+			if err := e.readSealed(dec, s.Conn().RemotePeer(), &req); err != nil {
+				if !errors.Is(err, io.EOF) {
+					e.config.Logger.Debugf("账本同步请求错误 %s: %s", s.Conn().RemotePeer(), err)
+					s.Reset()
+				}
+				return
+			}
+
+			res := syncResponse{}
+			if len(req.Buckets) == 0 {
+				head := l.Head()
+				res.Head = &head
+			} else {
+				snapshot := l.Snapshot(req.Buckets...)
+				res.Block = &snapshot
+			}
+			if err := e.writeSealed(enc, res); err != nil {
+				s.Reset()
+				return
+			}
+		}
+	}
+}
+
+// SyncLedger 直接从对等节点拉取账本：比较双方每个存储桶的摘要，只拉取不同的存储桶并合并到本地
+// 拉取的键与广播的快照一样验证签名和访问控制策略
+// 参数 ctx 为上下文，p 为对等节点ID
+func (e *Node) SyncLedger(ctx context.Context, p peer.ID) error {
+	ledger, err := e.Ledger()
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, ledgerSyncTimeout)
+	defer cancel()
+
+	s, err := e.host.NewStream(ctx, p, protocol.LedgerProtocol.ID())
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		s.SetDeadline(deadline)
+	}
+
+	enc, dec := json.NewEncoder(s), json.NewDecoder(s)
+	res := syncResponse{}
+	if err := e.writeSealed(enc, syncRequest{}); err != nil {
+		return err
+	}
+	if err := e.readSealed(dec, p, &res); err != nil {
+		return err
+	}
+	if res.Head == nil {
+		return fmt.Errorf("%s 没有返回链头", p)
+	}
+
+	buckets := ledger.Head().Diff(*res.Head)
+	if len(buckets) == 0 {
+		return nil
+	}
+	e.config.Logger.Debugf("从 %s 拉取存储桶 %v", p, buckets)
+
+	res = syncResponse{}
+	if err := e.writeSealed(enc, syncRequest{Buckets: buckets}); err != nil {
+		return err
+	}
+	if err := e.readSealed(dec, p, &res); err != nil {
+		return err
+	}
+	if res.Block == nil {
+		return fmt.Errorf("%s 没有返回存储桶", p)
+	}
+	return ledger.Merge(*res.Block)
+}
+
+// pullLedger 与SyncLedger相同，但与同一个对等节点的同步间隔不小于ledgerSyncThrottle
+func (e *Node) pullLedger(ctx context.Context, p peer.ID) error {
+	if p == e.host.ID() {
+		return nil
+	}
+
+	e.syncMu.Lock()
+	if time.Since(e.lastSync[p]) < ledgerSyncThrottle {
+		e.syncMu.Unlock()
+		return nil
+	}
+	e.lastSync[p] = time.Now()
+	e.syncMu.Unlock()
+
+	return e.SyncLedger(ctx, p)
+}
+
+// syncOnJoin 在与支持账本同步协议的对等节点建立连接后立即拉取账本，
+// 而不是等待下一次链头广播
+func (e *Node) syncOnJoin(ctx context.Context) error {
+	sub, err := e.host.EventBus().Subscribe(new(event.EvtPeerIdentificationCompleted))
+	if err != nil {
+		return err
+	}
+
+	go func() {
+		defer sub.Close()
+		for {
+			select {
+			case ev := <-sub.Out():
+				id := ev.(event.EvtPeerIdentificationCompleted)
+				for _, proto := range id.Protocols {
+					if proto == protocol.LedgerProtocol.ID() {
+						go func() {
+							if err := e.pullLedger(ctx, id.Peer); err != nil {
+								e.config.Logger.Debugf("无法从 %s 同步账本: %s", id.Peer, err)
+							}
+						}()
+						break
+					}
+				}
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return nil
+}
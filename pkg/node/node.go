@@ -23,6 +23,7 @@ import (
 	"github.com/libp2p/go-libp2p"
 	"github.com/libp2p/go-libp2p/core/host"
 	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
 	"github.com/libp2p/go-libp2p/p2p/net/conngater"
 
 	"github.com/purpose168/edgevpn/pkg/crypto"
@@ -42,15 +43,33 @@ type Node struct {
 	inputCh      chan *hub.Message // 输入消息通道
 	genericHubCh chan *hub.Message // 通用中心通道
 
+	channels map[string]chan *hub.Message // 应用程序定义的通道的输入通道
+
 	seed   int64                           // 随机种子
 	host   host.Host                       // libp2p主机
 	cg     *conngater.BasicConnectionGater // 连接门控器
 	ledger *blockchain.Ledger              // 区块链账本
 	sync.Mutex
+
+	syncMu   sync.Mutex            // 保护lastSync
+	lastSync map[peer.ID]time.Time // 最近一次与对等节点同步账本的时间
+
+	seq    uint64           // 发布消息的序号，从启动时间开始递增，重启后仍然单调
+	replay *hub.ReplayCache // 收到的消息的重放缓存
+
+	sealers *sealerPeers // 对等节点是否都已支持Sealer的格式
 }
 
-// defaultChanSize 默认通道大小
-const defaultChanSize = 3000
+const (
+	// defaultChanSize 默认通道大小
+	defaultChanSize = 3000
+	// replayCacheSenders 是重放缓存记录的发送者数量
+	replayCacheSenders = 4096
+	// replayCacheWindow 是重放缓存为每个发送者记录的序号数量
+	replayCacheWindow = 1024
+	// replayDeliveryMargin 是在时钟偏差之外，消息在网络中转发和排队的最长时间
+	replayDeliveryMargin = 30 * time.Second
+)
 
 // defaultLibp2pOptions 默认libp2p选项
 var defaultLibp2pOptions = []libp2p.Option{
@@ -64,12 +83,14 @@ func New(p ...Option) (*Node, error) {
 	c := &Config{
 		DiscoveryInterval:        5 * time.Minute,                           // 发现间隔时间
 		StreamHandlers:           make(map[protocol.Protocol]StreamHandler), // 流处理器映射
+		ChannelHandlers:          make(map[string][]Handler),                // 通道处理器映射
 		LedgerAnnounceTime:       5 * time.Second,                           // 账本公告时间
 		LedgerSyncronizationTime: 5 * time.Second,                           // 账本同步时间
 		SealKeyLength:            defaultKeyLength,                          // 密钥长度
 		Options:                  defaultLibp2pOptions,                      // libp2p选项
 		Logger:                   logger.New(log.LevelDebug),                // 日志记录器
-		Sealer:                   &crypto.AESSealer{},                       // 密封器
+		Sealer:                   &crypto.HKDFSealer{},                      // 密封器
+		LegacySealer:             &crypto.AESSealer{},                       // 升级期间兼容的旧格式密封器
 		Store:                    &blockchain.MemoryStore{},                 // 存储器
 	}
 
@@ -77,11 +98,20 @@ func New(p ...Option) (*Node, error) {
 		return nil, err
 	}
 
+	channels := map[string]chan *hub.Message{}
+	for name := range c.ChannelHandlers {
+		channels[name] = make(chan *hub.Message, defaultChanSize)
+	}
+
 	return &Node{
 		config:       *c,
 		inputCh:      make(chan *hub.Message, defaultChanSize),
 		genericHubCh: make(chan *hub.Message, defaultChanSize),
+		channels:     channels,
 		seed:         0,
+		lastSync:     map[peer.ID]time.Time{},
+		seq:          uint64(time.Now().UnixNano()),
+		sealers:      newSealerPeers(time.Now()),
 	}, nil
 }
 
@@ -100,6 +130,8 @@ func (e *Node) Ledger() (*blockchain.Ledger, error) {
 	}
 
 	e.ledger = blockchain.New(mw, e.config.Store)
+	e.ledger.SetAdmins(e.config.LedgerAdmins...)
+	e.ledger.SetTombstoneRetention(e.config.LedgerTombstoneRetention)
 	return e.ledger, nil
 }
 
@@ -171,19 +203,49 @@ func (e *Node) startNetwork(ctx context.Context) error {
 		return err
 	}
 
+	// 使用节点的私钥签名本地写入，节点 ID 作为写入者记录在账本中
+	if err := ledger.SetIdentity(host.Peerstore().PrivKey(host.ID())); err != nil {
+		return err
+	}
+	// 旧版本写入的键没有签名，重新签名属于本节点的键，否则对等节点会拒绝它们
+	if n := ledger.ResignLegacy(); n > 0 {
+		e.config.Logger.Infof("重新签名了 %d 个旧版本写入的键", n)
+	}
+
+	// 中心在sealkey间隔内轮换
+	// 这个时间长度应该足够进行几次区块交换。理想情况下是分钟级别（10、20等）
+	// 它确保如果对加密消息尝试暴力破解，真实密钥不会被暴露
+	// 在处理器启动之前创建，解封消息时使用中心的时钟偏差容忍范围
+	hubOpts, err := e.config.PubSub.Options()
+	if err != nil {
+		return err
+	}
+	hubOpts = append(hubOpts, e.config.HubOptions...)
+	e.MessageHub = hub.NewHub(e.config.RoomName, e.config.MaxMessageSize, e.config.SealKeyLength, e.config.SealKeyInterval, e.config.GenericHub, hubOpts...)
+	e.replay = hub.NewReplayCache(replayCacheSenders, replayCacheWindow, e.MessageHub.ClockSkew()+replayDeliveryMargin)
+
 	// 设置流处理器
 	for pid, strh := range e.config.StreamHandlers {
 		host.SetStreamHandler(pid.ID(), network.StreamHandler(strh(e, ledger)))
 	}
 
+	// 加入网络或者发现状态不同时直接从对等节点拉取账本，稳定状态下仍然通过广播同步
+	host.SetStreamHandler(protocol.LedgerProtocol.ID(), e.ledgerSyncHandler(ledger))
+	host.SetStreamHandler(protocol.MessageProtocol.ID(), e.messageHandler(ctx))
+	ledger.SetPuller(func(p string) error {
+		id, err := peer.Decode(p)
+		if err != nil {
+			return err
+		}
+		return e.pullLedger(ctx, id)
+	})
+	if err := e.syncOnJoin(ctx); err != nil {
+		return err
+	}
+
 	e.config.Logger.Info("节点 ID:", host.ID())
 	e.config.Logger.Info("节点地址:", host.Addrs())
 
-	// 中心在sealkey间隔内轮换
-	// 这个时间长度应该足够进行几次区块交换。理想情况下是分钟级别（10、20等）
-	// 它确保如果对加密消息尝试暴力破解，真实密钥不会被暴露
-	e.MessageHub = hub.NewHub(e.config.RoomName, e.config.MaxMessageSize, e.config.SealKeyLength, e.config.SealKeyInterval, e.config.GenericHub)
-
 	// 启动服务发现
 	for _, sd := range e.config.ServiceDiscovery {
 		if err := sd.Run(e.config.Logger, ctx, host); err != nil {
@@ -200,10 +262,33 @@ func (e *Node) startNetwork(ctx context.Context) error {
 		go e.handleEvents(ctx, e.genericHubCh, e.MessageHub.PublicMessages, e.MessageHub.PublishPublicMessage, e.config.GenericChannelHandler, false)
 	}
 
+	// 应用程序定义的通道拥有自己的房间和处理器，服务可以交换自己的事件而不需要经过账本
+	for name, handlers := range e.config.ChannelHandlers {
+		ch, err := e.MessageHub.Join(name)
+		if err != nil {
+			return err
+		}
+		go e.handleEvents(ctx, e.channels[name], ch.Messages, ch.Publish, handlers, true)
+	}
+
 	e.config.Logger.Debug("网络已启动")
 	return nil
 }
 
+// PublishChannel 将消息发布到应用程序定义的通道
+// 参见 ChannelHandlers(..) 来加入通道并附加处理器以从此通道接收消息
+// 参数 name 为通道名称，m 为消息
+func (e *Node) PublishChannel(name string, m *hub.Message) error {
+	c, exists := e.channels[name]
+	if !exists {
+		return fmt.Errorf("没有加入通道 '%s'", name)
+	}
+
+	c <- m
+
+	return nil
+}
+
 // PublishMessage 将消息发布到通用通道（如果已启用）
 // 参见 GenericChannelHandlers(..) 来附加处理器以从此通道接收消息
 func (e *Node) PublishMessage(m *hub.Message) error {
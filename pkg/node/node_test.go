@@ -15,6 +15,7 @@ package node_test
 
 import (
 	"context"
+	"errors"
 	"time"
 
 	"github.com/ipfs/go-log"
@@ -23,6 +24,8 @@ import (
 	. "github.com/onsi/gomega"
 
 	"github.com/purpose168/edgevpn/pkg/blockchain"
+	"github.com/purpose168/edgevpn/pkg/crypto"
+	"github.com/purpose168/edgevpn/pkg/hub"
 	"github.com/purpose168/edgevpn/pkg/logger"
 	. "github.com/purpose168/edgevpn/pkg/node"
 )
@@ -40,6 +43,17 @@ var _ = Describe("Node", func() {
 			_, err = New(FromBase64(true, true, token, nil, nil), WithStore(&blockchain.MemoryStore{}), l)
 			Expect(err).ToNot(HaveOccurred())
 		})
+
+		It("fails if the pubsub configuration is not valid", func() {
+			c := GenerateNewConnectionData(25)
+			c.PubSub = hub.Config{Router: "floodsub", D: 4}
+			_, err := New(FromBase64(true, true, c.Base64(), nil, nil), WithStore(&blockchain.MemoryStore{}), l)
+			Expect(err).To(HaveOccurred())
+
+			c.PubSub = hub.Config{Router: "floodsub"}
+			_, err = New(FromBase64(true, true, c.Base64(), nil, nil), WithStore(&blockchain.MemoryStore{}), l)
+			Expect(err).ToNot(HaveOccurred())
+		})
 	})
 
 	Context("Connection", func() {
@@ -86,6 +100,141 @@ var _ = Describe("Node", func() {
 		})
 	})
 
+	Context("Sealer upgrade", func() {
+		It("upgraded nodes exchange messages with old nodes by default", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			old, _ := New(FromBase64(true, true, token, nil, nil), WithStore(&blockchain.MemoryStore{}), WithSealer(&crypto.AESSealer{}), WithDiscoveryInterval(10*time.Second), l)
+			upgraded, _ := New(FromBase64(true, true, token, nil, nil), WithStore(&blockchain.MemoryStore{}), WithDiscoveryInterval(10*time.Second), l)
+
+			old.Start(ctx)
+			upgraded.Start(ctx)
+
+			lo, err := old.Ledger()
+			Expect(err).ToNot(HaveOccurred())
+			lu, err := upgraded.Ledger()
+			Expect(err).ToNot(HaveOccurred())
+
+			lo.Announce(ctx, 2*time.Second, func() { lo.Add("foo", map[string]interface{}{"old": "a"}) })
+			lu.Announce(ctx, 2*time.Second, func() { lu.Add("foo", map[string]interface{}{"upgraded": "b"}) })
+
+			Eventually(func() bool {
+				_, fromOld := lu.GetKey("foo", "old")
+				_, fromUpgraded := lo.GetKey("foo", "upgraded")
+				return fromOld && fromUpgraded
+			}, 240*time.Second, 1*time.Second).Should(BeTrue())
+		})
+	})
+
+	Context("Ledger sync", func() {
+		It("pulls differing buckets directly from a peer", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			e, _ := New(FromBase64(true, true, token, nil, nil), WithStore(&blockchain.MemoryStore{}), l)
+			e2, _ := New(FromBase64(true, true, token, nil, nil), WithStore(&blockchain.MemoryStore{}), l)
+			other, _ := New(FromBase64(true, true, GenerateNewConnectionData(25).Base64(), nil, nil), WithStore(&blockchain.MemoryStore{}), l)
+
+			l1, err := e.Ledger()
+			Expect(err).ToNot(HaveOccurred())
+			l1.Add("foo", map[string]interface{}{"bar": "baz"})
+
+			Expect(e.Start(ctx)).To(Succeed())
+			Expect(e2.Start(ctx)).To(Succeed())
+			Expect(other.Start(ctx)).To(Succeed())
+
+			l2, err := e2.Ledger()
+			Expect(err).ToNot(HaveOccurred())
+			Eventually(func() error {
+				return e2.SyncLedger(ctx, e.Host().ID())
+			}, 240*time.Second, 1*time.Second).Should(Succeed())
+			_, exists := l2.GetKey("foo", "bar")
+			Expect(exists).To(BeTrue())
+			Expect(l2.Head().Buckets).To(Equal(l1.Head().Buckets))
+
+			// Nodes from another network cannot unseal our requests
+			Expect(other.Host().Connect(ctx, peer.AddrInfo{ID: e.Host().ID(), Addrs: e.Host().Addrs()})).To(Succeed())
+			Expect(other.SyncLedger(ctx, e.Host().ID())).ToNot(Succeed())
+			ol, err := other.Ledger()
+			Expect(err).ToNot(HaveOccurred())
+			_, exists = ol.GetKey("foo", "bar")
+			Expect(exists).To(BeFalse())
+		})
+	})
+
+	Context("Direct messages", func() {
+		It("sends a request to a peer and receives its reply", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			echo := func(ctx context.Context, m *hub.Message) (*hub.Message, error) {
+				if m.Message == "fail" {
+					return nil, errors.New("refused")
+				}
+				return m.WithMessage(m.Message + " from " + m.SenderID), nil
+			}
+			e, _ := New(FromBase64(true, true, token, nil, nil), WithStore(&blockchain.MemoryStore{}), RequestHandlers(echo), l)
+			e2, _ := New(FromBase64(true, true, token, nil, nil), WithStore(&blockchain.MemoryStore{}), l)
+			other, _ := New(FromBase64(true, true, GenerateNewConnectionData(25).Base64(), nil, nil), WithStore(&blockchain.MemoryStore{}), l)
+
+			Expect(e.Start(ctx)).To(Succeed())
+			Expect(e2.Start(ctx)).To(Succeed())
+			Expect(other.Start(ctx)).To(Succeed())
+
+			var reply *hub.Message
+			Eventually(func() (err error) {
+				reply, err = e2.SendTo(ctx, e.Host().ID(), hub.NewMessage("hello"))
+				return err
+			}, 240*time.Second, 1*time.Second).Should(Succeed())
+			Expect(reply.Message).To(Equal("hello from " + e2.Host().ID().String()))
+			Expect(reply.SenderID).To(Equal(e.Host().ID().String()))
+
+			// Handler errors are returned to the sender
+			_, err := e2.SendTo(ctx, e.Host().ID(), hub.NewMessage("fail"))
+			Expect(err).To(MatchError(ContainSubstring("refused")))
+
+			// Nodes without request handlers refuse requests
+			_, err = e.SendTo(ctx, e2.Host().ID(), hub.NewMessage("hello"))
+			Expect(err).To(HaveOccurred())
+
+			// Nodes from another network cannot unseal our requests
+			Expect(other.Host().Connect(ctx, peer.AddrInfo{ID: e.Host().ID(), Addrs: e.Host().Addrs()})).To(Succeed())
+			_, err = other.SendTo(ctx, e.Host().ID(), hub.NewMessage("hello"))
+			Expect(err).To(HaveOccurred())
+		})
+	})
+
+	Context("Channels", func() {
+		It("exchanges messages on application-defined channels", func() {
+			ctx, cancel := context.WithCancel(context.Background())
+			defer cancel()
+
+			received := make(chan *hub.Message, 100)
+			e, _ := New(FromBase64(true, true, token, nil, nil), WithStore(&blockchain.MemoryStore{}), ChannelHandlers("events"), l)
+			e2, _ := New(FromBase64(true, true, token, nil, nil), WithStore(&blockchain.MemoryStore{}),
+				ChannelHandlers("events", func(_ *blockchain.Ledger, m *hub.Message, _ chan *hub.Message) error {
+					received <- m
+					return nil
+				}), l)
+
+			Expect(e.PublishChannel("other", hub.NewMessage("event"))).ToNot(Succeed())
+
+			Expect(e.Start(ctx)).To(Succeed())
+			Expect(e2.Start(ctx)).To(Succeed())
+
+			Eventually(func() string {
+				Expect(e.PublishChannel("events", hub.NewMessage("event"))).To(Succeed())
+				select {
+				case m := <-received:
+					return m.Message
+				case <-time.After(time.Second):
+					return ""
+				}
+			}, 240*time.Second).Should(Equal("event"))
+		})
+	})
+
 	Context("connection gater", func() {
 		It("blacklists", func() {
 			ctx, cancel := context.WithCancel(context.Background())
@@ -24,6 +24,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/purpose168/edgevpn/pkg/blockchain"
 	discovery "github.com/purpose168/edgevpn/pkg/discovery"
+	"github.com/purpose168/edgevpn/pkg/hub"
 	"github.com/purpose168/edgevpn/pkg/protocol"
 	"github.com/purpose168/edgevpn/pkg/utils"
 	"gopkg.in/yaml.v2"
@@ -45,6 +46,18 @@ func WithSealer(i Sealer) Option {
 	}
 }
 
+// WithLegacySealer 设置升级期间接受的旧格式密封器，默认为AESSealer，i为nil时只接受Sealer的格式。
+// seal为false时，节点在最近发送过消息的对等节点都宣告支持Sealer的格式之后才使用它发送，
+// 之前以及发现旧版本节点时使用旧格式发送，因此网络可以逐个节点升级；seal为true时始终使用旧格式发送。
+// 参数 i 为旧格式的密封器，seal 为是否始终使用旧格式密封发出的消息
+func WithLegacySealer(i Sealer, seal bool) Option {
+	return func(cfg *Config) error {
+		cfg.LegacySealer = i
+		cfg.SealLegacy = seal
+		return nil
+	}
+}
+
 // WithLibp2pAdditionalOptions 添加额外的libp2p选项
 func WithLibp2pAdditionalOptions(i ...libp2p.Option) func(cfg *Config) error {
 	return func(cfg *Config) error {
@@ -109,6 +122,23 @@ func GenericChannelHandlers(h ...Handler) func(cfg *Config) error {
 	}
 }
 
+// ChannelHandlers 加入应用程序定义的通道，并添加处理器到列表，在该通道中每个接收的消息都会调用
+// 通道的消息与区块链消息一样被密封，并应用对等节点门控和对等节点表
+func ChannelHandlers(name string, h ...Handler) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		cfg.ChannelHandlers[name] = append(cfg.ChannelHandlers[name], h...)
+		return nil
+	}
+}
+
+// RequestHandlers 添加处理点对点消息的处理器，按顺序调用直到某个处理器返回回复
+func RequestHandlers(h ...RequestHandler) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		cfg.RequestHandlers = append(cfg.RequestHandlers, h...)
+		return nil
+	}
+}
+
 // WithStreamHandler 添加流处理器到列表，每个接收的消息都会调用
 func WithStreamHandler(id protocol.Protocol, h StreamHandler) func(cfg *Config) error {
 	return func(cfg *Config) error {
@@ -196,6 +226,27 @@ func LibP2PLogLevel(l log.LogLevel) func(cfg *Config) error {
 	}
 }
 
+// WithPubSub 设置消息中心的pubsub路由器、评分和校验参数，通常来自网络配置
+// 参数 c 为pubsub配置
+func WithPubSub(c hub.Config) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		if _, err := c.Options(); err != nil {
+			return err
+		}
+		cfg.PubSub = c
+		return nil
+	}
+}
+
+// WithHubOptions 添加消息中心的选项，例如消息校验器
+// 参数 opts 为消息中心选项
+func WithHubOptions(opts ...hub.Option) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		cfg.HubOptions = append(cfg.HubOptions, opts...)
+		return nil
+	}
+}
+
 // MaxMessageSize 设置最大消息大小
 func MaxMessageSize(i int) func(cfg *Config) error {
 	return func(cfg *Config) error {
@@ -228,6 +279,25 @@ func WithLedgerInterval(t time.Duration) func(cfg *Config) error {
 	}
 }
 
+// WithLedgerAdmins 设置账本管理员的对等节点ID
+// 管理员可以修改账本的访问控制策略并写入任何存储桶。
+// 网络配置（FromBase64、FromYaml）中的管理员会替换之前设置的管理员
+func WithLedgerAdmins(ids ...string) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		cfg.LedgerAdmins = append(cfg.LedgerAdmins, ids...)
+		return nil
+	}
+}
+
+// WithLedgerTombstoneRetention 设置账本中已删除键的墓碑保留时间，为0时使用默认值
+// 网络中的所有节点应该使用相同的保留时间
+func WithLedgerTombstoneRetention(t time.Duration) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		cfg.LedgerTombstoneRetention = t
+		return nil
+	}
+}
+
 // WithDiscoveryInterval 设置发现间隔
 func WithDiscoveryInterval(t time.Duration) func(cfg *Config) error {
 	return func(cfg *Config) error {
@@ -284,6 +354,11 @@ type YAMLConnectionConfig struct {
 	Rendezvous     string `yaml:"rendezvous"`       // 会合点
 	MDNS           string `yaml:"mdns"`             // mDNS
 	MaxMessageSize int    `yaml:"max_message_size"` // 最大消息大小
+
+	PubSub hub.Config `yaml:"pubsub,omitempty"` // 消息中心的pubsub路由器、评分和校验参数
+
+	// LedgerAdmins 是账本管理员的对等节点ID，所有节点必须使用相同的管理员，因此它是网络配置的一部分
+	LedgerAdmins []string `yaml:"ledger_admins,omitempty"`
 }
 
 // Base64 返回连接配置的base64字符串表示
@@ -327,6 +402,8 @@ func (y YAMLConnectionConfig) copy(mdns, dht bool, cfg *Config, d *discovery.DHT
 	}
 	cfg.SealKeyLength = y.OTP.Crypto.Length
 	cfg.MaxMessageSize = y.MaxMessageSize
+	cfg.PubSub = y.PubSub
+	cfg.LedgerAdmins = y.LedgerAdmins
 }
 
 // defaultKeyLength 默认密钥长度
@@ -387,6 +464,9 @@ func FromYaml(enablemDNS, enableDHT bool, path string, d *discovery.DHT, m *disc
 		if err := yaml.Unmarshal(data, &t); err != nil {
 			return errors.Wrap(err, "解析yaml")
 		}
+		if _, err := t.PubSub.Options(); err != nil {
+			return errors.Wrap(err, "无效的pubsub配置")
+		}
 
 		t.copy(enablemDNS, enableDHT, cfg, d, m)
 		return nil
@@ -409,6 +489,9 @@ func FromBase64(enablemDNS, enableDHT bool, bb string, d *discovery.DHT, m *disc
 		if err := yaml.Unmarshal(configDec, &t); err != nil {
 			return errors.Wrap(err, "解析yaml")
 		}
+		if _, err := t.PubSub.Options(); err != nil {
+			return errors.Wrap(err, "无效的pubsub配置")
+		}
 		t.copy(enablemDNS, enableDHT, cfg, d, m)
 		return nil
 	}
@@ -0,0 +1,105 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"sync/atomic"
+	"time"
+
+	"github.com/ipfs/go-log"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/purpose168/edgevpn/pkg/blockchain"
+	"github.com/purpose168/edgevpn/pkg/hub"
+	"github.com/purpose168/edgevpn/pkg/logger"
+)
+
+var _ = Describe("Replay protection", func() {
+	var (
+		e      *Node
+		ctx    context.Context
+		cancel context.CancelFunc
+	)
+
+	BeforeEach(func() {
+		ctx, cancel = context.WithCancel(context.Background())
+		var err error
+		e, err = New(FromBase64(false, false, GenerateNewConnectionData(25).Base64(), nil, nil), WithStore(&blockchain.MemoryStore{}), Logger(logger.New(log.LevelFatal)))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(e.Start(ctx)).To(Succeed())
+	})
+
+	AfterEach(func() {
+		cancel()
+	})
+
+	It("drops a sealed message published again", func() {
+		var received int32
+		handler := func(_ *blockchain.Ledger, m *hub.Message, _ chan *hub.Message) error {
+			if m.Message == "hello" {
+				atomic.AddInt32(&received, 1)
+			}
+			return nil
+		}
+
+		rooms := make(chan *hub.Message)
+		go e.handleEvents(ctx, make(chan *hub.Message), rooms, func(*hub.Message) error { return nil }, []Handler{handler}, false)
+
+		sealed, err := e.sealMessage(hub.NewMessage("hello"))
+		Expect(err).ToNot(HaveOccurred())
+		m := hub.NewMessage(sealed)
+		m.SenderID = e.Host().ID().String()
+
+		rooms <- m
+		rooms <- m.Copy()
+		Eventually(func() int32 { return atomic.LoadInt32(&received) }).Should(Equal(int32(1)))
+		Consistently(func() int32 { return atomic.LoadInt32(&received) }, 200*time.Millisecond).Should(Equal(int32(1)))
+	})
+
+	It("rejects a direct request sent again", func() {
+		req := hub.NewMessage("hello")
+		dat, err := json.Marshal(req)
+		Expect(err).ToNot(HaveOccurred())
+		sealed, err := e.sealEnvelope(dat)
+		Expect(err).ToNot(HaveOccurred())
+
+		stream := func() *json.Decoder {
+			r, w := io.Pipe()
+			go func() { json.NewEncoder(w).Encode(sealed); w.Close() }()
+			return json.NewDecoder(r)
+		}
+
+		m, err := e.readRequest(stream(), e.Host().ID())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(m.Message).To(Equal("hello"))
+
+		_, err = e.readRequest(stream(), e.Host().ID())
+		Expect(err).To(MatchError(hub.ErrReplayed))
+	})
+
+	It("tolerates delivery delays beyond the clock skew", func() {
+		dat, err := json.Marshal(envelope{Seq: 1, Time: time.Now().Add(-e.MessageHub.ClockSkew() - time.Second), Message: []byte("late")})
+		Expect(err).ToNot(HaveOccurred())
+		sealed, err := e.seal(string(dat))
+		Expect(err).ToNot(HaveOccurred())
+
+		env, err := e.openEnvelope(sealed, e.Host().ID())
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(env.Message)).To(Equal("late"))
+	})
+})
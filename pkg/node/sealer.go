@@ -0,0 +1,83 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node
+
+import (
+	"sync"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+const (
+	// sealerAnnotation 是消息中宣告发送者可以解封认证密封格式的注解，旧版本节点忽略它
+	sealerAnnotation = "sealer"
+	// sealerAuthenticated 是支持认证密封格式的节点使用的注解值
+	sealerAuthenticated = "hkdf"
+	// sealerUpgradeWindow 是判断网络是否已经全部升级的时间窗口，
+	// 窗口内发送过消息的所有对等节点都宣告支持认证密封格式之后才使用它发送消息
+	sealerUpgradeWindow = 5 * time.Minute
+)
+
+// sealerPeers 记录最近发送过消息的对等节点是否支持认证密封格式
+type sealerPeers struct {
+	sync.Mutex
+	started time.Time               // 开始记录的时间
+	seen    map[peer.ID]sealerState // 对等节点最近一次发送的消息
+	sending bool                    // 上一次判断的结果
+}
+
+// sealerState 是对等节点最近一次发送的消息
+type sealerState struct {
+	last     time.Time // 收到消息的时间
+	upgraded bool      // 消息是否宣告支持认证密封格式
+}
+
+// newSealerPeers 创建从now开始记录的sealerPeers
+func newSealerPeers(now time.Time) *sealerPeers {
+	return &sealerPeers{started: now, seen: map[peer.ID]sealerState{}}
+}
+
+// observe 记录对等节点发送的消息
+// 参数 p 为消息作者，upgraded 为消息是否宣告支持认证密封格式，now 为收到消息的时间
+func (s *sealerPeers) observe(p peer.ID, upgraded bool, now time.Time) {
+	s.Lock()
+	defer s.Unlock()
+	s.seen[p] = sealerState{last: now, upgraded: upgraded}
+}
+
+// upgraded 如果已经记录了一个完整的时间窗口，并且窗口内发送过消息的对等节点都支持认证密封格式则返回true。
+// 旧版本的节点重新出现时再次返回false。changed表示结果与上一次判断不同
+// 参数 now 为当前时间
+func (s *sealerPeers) upgraded(now time.Time) (upgraded, changed bool) {
+	s.Lock()
+	defer s.Unlock()
+
+	if now.Sub(s.started) >= sealerUpgradeWindow {
+		for p, st := range s.seen {
+			if now.Sub(st.last) > sealerUpgradeWindow {
+				delete(s.seen, p)
+				continue
+			}
+			if !st.upgraded {
+				upgraded = false
+				break
+			}
+			upgraded = true
+		}
+	}
+	changed = upgraded != s.sending
+	s.sending = upgraded
+	return
+}
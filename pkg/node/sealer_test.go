@@ -0,0 +1,67 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package node
+
+import (
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("Sealer upgrade tracking", func() {
+	var (
+		start time.Time
+		s     *sealerPeers
+	)
+
+	BeforeEach(func() {
+		start = time.Unix(1700000000, 0)
+		s = newSealerPeers(start)
+	})
+
+	upgraded := func(now time.Time) bool {
+		u, _ := s.upgraded(now)
+		return u
+	}
+
+	It("keeps the legacy format until a full window has passed", func() {
+		s.observe(peer.ID("a"), true, start)
+		Expect(upgraded(start.Add(sealerUpgradeWindow / 2))).To(BeFalse())
+		s.observe(peer.ID("a"), true, start.Add(sealerUpgradeWindow-time.Second))
+		Expect(upgraded(start.Add(sealerUpgradeWindow))).To(BeTrue())
+	})
+
+	It("does not switch without any peer", func() {
+		Expect(upgraded(start.Add(2 * sealerUpgradeWindow))).To(BeFalse())
+	})
+
+	It("switches back when an old peer shows up and forgets it once it is gone", func() {
+		now := start.Add(sealerUpgradeWindow)
+		s.observe(peer.ID("a"), true, now)
+		u, changed := s.upgraded(now)
+		Expect(u).To(BeTrue())
+		Expect(changed).To(BeTrue())
+
+		s.observe(peer.ID("b"), false, now.Add(time.Second))
+		u, changed = s.upgraded(now.Add(time.Second))
+		Expect(u).To(BeFalse())
+		Expect(changed).To(BeTrue())
+
+		later := now.Add(sealerUpgradeWindow + 2*time.Second)
+		s.observe(peer.ID("a"), true, later)
+		Expect(upgraded(later)).To(BeTrue())
+	})
+})
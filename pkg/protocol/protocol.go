@@ -23,12 +23,15 @@ const (
 	ServiceProtocol Protocol = "/edgevpn/service/0.1" // 服务协议
 	FileProtocol    Protocol = "/edgevpn/file/0.1"    // 文件协议
 	EgressProtocol  Protocol = "/edgevpn/egress/0.1"  // 出口协议
+	LedgerProtocol  Protocol = "/edgevpn/ledger/0.1"  // 账本同步协议
+	MessageProtocol Protocol = "/edgevpn/message/0.1" // 点对点消息协议
 )
 
 // 账本键常量定义
 const (
 	FilesLedgerKey    = "files"         // 文件账本键
 	MachinesLedgerKey = "machines"      // 机器账本键
+	RoutesLedgerKey   = "routes"        // 子网路由账本键
 	ServicesLedgerKey = "services"      // 服务账本键
 	UsersLedgerKey    = "users"         // 用户账本键
 	HealthCheckKey    = "healthcheck"   // 健康检查键
@@ -36,6 +39,7 @@ const (
 	EgressService     = "egress"        // 出口服务键
 	TrustZoneKey      = "trustzone"     // 信任区域键
 	TrustZoneAuthKey  = "trustzoneAuth" // 信任区域认证键
+	ACLLedgerKey      = "acl"           // 访问控制策略键
 )
 
 // Protocol 协议类型定义
@@ -21,16 +21,15 @@ import (
 
 	"github.com/purpose168/edgevpn/pkg/node"
 	"github.com/purpose168/edgevpn/pkg/protocol"
-	"github.com/purpose168/edgevpn/pkg/utils"
 
 	"github.com/purpose168/edgevpn/pkg/blockchain"
 )
 
 // AliveNetworkService 存活检测网络服务
-// 参数 announcetime 为公告时间间隔，scrubTime 为清理时间间隔，maxtime 为最大超时时间
+// 健康检查以scrubTime为TTL写入，停止公告的节点在所有节点上自动过期，不再需要领导者清理
+// 参数 announcetime 为公告时间间隔，scrubTime 为健康检查的存活时间，maxtime 为最大超时时间
 func AliveNetworkService(announcetime, scrubTime, maxtime time.Duration) node.NetworkService {
 	return func(ctx context.Context, c node.Config, n *node.Node, b *blockchain.Ledger) error {
-		t := time.Now()
 		// 通过定期向区块链公告我们的服务
 		b.Announce(
 			ctx,
@@ -39,33 +38,16 @@ func AliveNetworkService(announcetime, scrubTime, maxtime time.Duration) node.Ne
 				// 保持活跃
 				b.Add(protocol.HealthCheckKey, map[string]interface{}{
 					n.Host().ID().String(): time.Now().UTC().Format(time.RFC3339),
-				})
-
-				// 保持活跃清理
-				nodes := AvailableNodes(b, maxtime)
-				if len(nodes) == 0 {
-					return
-				}
-				lead := utils.Leader(nodes)
-				if !t.Add(scrubTime).After(time.Now()) {
-					// 更新计时器，防止非领导者在之后尝试删除存储桶
-					// 防止循环
-					t = time.Now()
-
-					if lead == n.Host().ID().String() {
-						// 一段时间后自动清理
-						b.DeleteBucket(protocol.HealthCheckKey)
-					}
-				}
+				}, blockchain.WithTTL(scrubTime))
 			},
 		)
 		return nil
 	}
 }
 
-// Alive 每隔公告时间公告节点，并定期清理健康检查
+// Alive 每隔公告时间公告节点，健康检查在scrubTime之后过期
 // maxtime 用于确定节点何时不可达（超过maxtime后，节点被视为不可达）
-// 参数 announcetime 为公告时间间隔，scrubTime 为清理时间间隔，maxtime 为最大超时时间
+// 参数 announcetime 为公告时间间隔，scrubTime 为健康检查的存活时间，maxtime 为最大超时时间
 func Alive(announcetime, scrubTime, maxtime time.Duration) []node.Option {
 	return []node.Option{
 		node.WithNetworkService(AliveNetworkService(announcetime, scrubTime, maxtime)),
@@ -75,7 +57,7 @@ func Alive(announcetime, scrubTime, maxtime time.Duration) []node.Option {
 // AvailableNodes 返回在最近maxTime时间内发送过健康检查的可用节点
 // 参数 b 为区块链账本，maxTime 为最大时间窗口
 func AvailableNodes(b *blockchain.Ledger, maxTime time.Duration) (active []string) {
-	for u, t := range b.LastBlock().Storage[protocol.HealthCheckKey] {
+	for u, t := range b.CurrentData()[protocol.HealthCheckKey] {
 		var s string
 		t.Unmarshal(&s)
 		parsed, _ := time.Parse(time.RFC3339, s)
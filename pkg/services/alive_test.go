@@ -69,64 +69,41 @@ var _ = Describe("存活服务", func() {
 		})
 	})
 
-	Context("存活清理", func() {
+	Context("存活过期", func() {
 		BeforeEach(func() {
 			opts = append(
-				Alive(10*time.Second, 30*time.Second, 15*time.Minute),
+				Alive(2*time.Second, 10*time.Second, 15*time.Minute),
 				node.WithDiscoveryInterval(10*time.Second),
 				node.FromBase64(true, true, token, nil, nil),
 				l)
 		})
 
-		It("一段时间后清理", func() {
+		It("停止公告的节点在TTL之后过期", func() {
 			ctx, cancel := context.WithCancel(context.Background())
 			defer cancel()
+			ctx2, cancel2 := context.WithCancel(ctx)
 			e2, _ := node.New(append(opts, node.WithStore(&blockchain.MemoryStore{}))...)
 			e1, _ := node.New(append(opts, node.WithStore(&blockchain.MemoryStore{}))...)
 
 			e1.Start(ctx)
-			time.Sleep(5 * time.Second)
-			e2.Start(ctx)
+			e2.Start(ctx2)
 
 			ll, _ := e1.Ledger()
 
-			ll.Persist(ctx, 5*time.Second, 100*time.Second, "t", "t", "test")
-
 			matches := And(ContainElement(e2.Host().ID().String()),
 				ContainElement(e1.Host().ID().String()))
 
-			index := ll.LastBlock().Index
 			Eventually(func() []string {
-				ll, err := e1.Ledger()
-				if err != nil {
-					return []string{}
-				}
 				return AvailableNodes(ll, 15*time.Minute)
 			}, 120*time.Second, 1*time.Second).Should(matches)
 
-			Expect(ll.LastBlock().Index).ToNot(Equal(index))
-			index = ll.LastBlock().Index
-
-			Eventually(func() []string {
-				ll, err := e1.Ledger()
-				if err != nil {
-					return []string{}
-				}
-				return AvailableNodes(ll, 15*time.Minute)
-			}, 360*time.Second, 1*time.Second).Should(BeEmpty())
-
-			Expect(ll.LastBlock().Index).ToNot(Equal(index))
-			index = ll.LastBlock().Index
+			// e2停止公告后，其健康检查在所有节点上过期，不需要领导者清理
+			cancel2()
 
 			Eventually(func() []string {
-				ll, err := e1.Ledger()
-				if err != nil {
-					return []string{}
-				}
 				return AvailableNodes(ll, 15*time.Minute)
-			}, 60*time.Second, 1*time.Second).Should(matches)
-			Expect(ll.LastBlock().Index).ToNot(Equal(index))
-
+			}, 60*time.Second, 1*time.Second).ShouldNot(ContainElement(e2.Host().ID().String()))
+			Expect(AvailableNodes(ll, 15*time.Minute)).To(ContainElement(e1.Host().ID().String()))
 		})
 	})
 })
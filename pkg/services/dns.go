@@ -27,7 +27,6 @@ import (
 	"github.com/pkg/errors"
 	"github.com/purpose168/edgevpn/pkg/blockchain"
 	"github.com/purpose168/edgevpn/pkg/node"
-	"github.com/purpose168/edgevpn/pkg/protocol"
 	"github.com/purpose168/edgevpn/pkg/types"
 )
 
@@ -66,16 +65,18 @@ func DNS(ll log.StandardLogger, listenAddr string, forwarder bool, forward []str
 // PersistDNSRecord 是账本的语法糖
 // 它将DNS记录持久化到区块链，直到看到它被协调。
 // 它会自动停止公告，并且不*保证*持久化数据。
+// 持久化的记录是网络的配置而不是写入者的存活状态，写入时不设置TTL，在被删除之前一直有效
 // 参数 ctx 为上下文，b 为区块链账本，announcetime 为公告时间，timeout 为超时时间，regex 为正则表达式，record 为DNS记录
 func PersistDNSRecord(ctx context.Context, b *blockchain.Ledger, announcetime, timeout time.Duration, regex string, record types.DNS) {
-	b.Persist(ctx, announcetime, timeout, protocol.DNSKey, regex, record)
+	types.DNSRecords(b).Persist(ctx, announcetime, timeout, regex, record)
 }
 
 // AnnounceDNSRecord 是账本的语法糖
-// 将DNS记录绑定公告到区块链，并在ctx生命周期内持续公告
+// 将DNS记录绑定公告到区块链，并在ctx生命周期内持续公告。
+// 记录以TTL写入，公告者停止之后记录在所有节点上自动过期
 // 参数 ctx 为上下文，b 为区块链账本，announcetime 为公告时间，regex 为正则表达式，record 为DNS记录
 func AnnounceDNSRecord(ctx context.Context, b *blockchain.Ledger, announcetime time.Duration, regex string, record types.DNS) {
-	b.AnnounceUpdate(ctx, announcetime, protocol.DNSKey, regex, record)
+	types.DNSRecords(b).Announce(ctx, announcetime, regex, record, blockchain.WithTTL(announceTTLIntervals*announcetime))
 }
 
 // dnsHandler DNS处理器结构体
@@ -96,11 +97,9 @@ func (d dnsHandler) parseQuery(m *dns.Msg, forward bool) *dns.Msg {
 	if len(m.Question) > 0 {
 		q := m.Question[0]
 		// 从区块链数据解析条目到IP
-		for k, v := range d.b.CurrentData()[protocol.DNSKey] {
+		for k, res := range types.DNSRecords(d.b).List() {
 			r, err := regexp.Compile(k)
 			if err == nil && r.MatchString(q.Name) {
-				var res types.DNS
-				v.Unmarshal(&res)
 				if val, exists := res[dns.Type(q.Qtype)]; exists {
 					rr, err := dns.NewRR(fmt.Sprintf("%s %s %s", q.Name, dns.TypeToString[q.Qtype], val))
 					if err == nil {
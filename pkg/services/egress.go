@@ -41,7 +41,7 @@ func egressHandler(n *node.Node, b *blockchain.Ledger) func(stream network.Strea
 		defer stream.Close()
 
 		// 从区块链中检索IP对应的当前ID
-		_, found := b.GetKey(protocol.UsersLedgerKey, stream.Conn().RemotePeer().String())
+		_, found := types.Users(b).Get(stream.Conn().RemotePeer().String())
 		// 如果不匹配，则更新区块链
 		if !found {
 			//		ll.Debugf("重置 '%s': 在账本中未找到", stream.Conn().RemotePeer().String())
@@ -104,23 +104,7 @@ func ProxyService(announceTime time.Duration, listenAddr string, deadtime time.D
 		}
 
 		// 公告我们自己，以便节点接受我们的连接
-		b.Announce(
-			ctx,
-			announceTime,
-			func() {
-				// 从区块链中检索IP对应的当前ID
-				_, found := b.GetKey(protocol.UsersLedgerKey, n.Host().ID().String())
-				// 如果不匹配，则更新区块链
-				if !found {
-					updatedMap := map[string]interface{}{}
-					updatedMap[n.Host().ID().String()] = &types.User{
-						PeerID:    n.Host().ID().String(),
-						Timestamp: time.Now().String(),
-					}
-					b.Add(protocol.UsersLedgerKey, updatedMap)
-				}
-			},
-		)
+		announceUser(ctx, b, announceTime, n.Host().ID().String())
 
 		go ps.Serve()
 		return nil
@@ -36,20 +36,17 @@ import (
 // 参数 announcetime 为公告时间间隔，fileID 为文件ID
 func SharefileNetworkService(announcetime time.Duration, fileID string) node.NetworkService {
 	return func(ctx context.Context, c node.Config, n *node.Node, b *blockchain.Ledger) error {
+		files := types.Files(b)
 		// 通过定期向区块链公告我们的服务
 		b.Announce(
 			ctx,
 			announcetime,
 			func() {
-				// 从区块链中检索当前IP对应的ID
-				existingValue, found := b.GetKey(protocol.FilesLedgerKey, fileID)
-				service := &types.Service{}
-				existingValue.Unmarshal(service)
+				// 从区块链中检索文件当前对应的ID
+				file, found := files.Get(fileID)
 				// 如果不匹配，则更新区块链
-				if !found || service.PeerID != n.Host().ID().String() {
-					updatedMap := map[string]interface{}{}
-					updatedMap[fileID] = types.File{PeerID: n.Host().ID().String(), Name: fileID}
-					b.Add(protocol.FilesLedgerKey, updatedMap)
+				if !found || file.PeerID != n.Host().ID().String() {
+					files.Put(fileID, types.File{PeerID: n.Host().ID().String(), Name: fileID})
 				}
 			},
 		)
@@ -78,7 +75,7 @@ func ShareFile(ll log.StandardLogger, announcetime time.Duration, fileID, filepa
 						ll.Infof("(文件 %s) 收到来自 %s 的连接", fileID, stream.Conn().RemotePeer().String())
 
 						// 从区块链中检索当前IP对应的ID
-						_, found := l.GetKey(protocol.UsersLedgerKey, stream.Conn().RemotePeer().String())
+						_, found := types.Users(l).Get(stream.Conn().RemotePeer().String())
 						// 如果不匹配，则更新区块链
 						if !found {
 							ll.Info("重置", stream.Conn().RemotePeer().String(), "在账本中未找到")
@@ -104,80 +101,56 @@ func ShareFile(ll log.StandardLogger, announcetime time.Duration, fileID, filepa
 // 参数 ctx 为上下文，ledger 为区块链账本，n 为节点实例，l 为日志记录器，announcetime 为公告时间间隔，fileID 为文件ID，path 为保存路径
 func ReceiveFile(ctx context.Context, ledger *blockchain.Ledger, n *node.Node, l log.StandardLogger, announcetime time.Duration, fileID string, path string) error {
 	// 公告我们自己，以便节点接受我们的连接
-	ledger.Announce(
-		ctx,
-		announcetime,
-		func() {
-			// 从区块链中检索当前IP对应的ID
-			_, found := ledger.GetKey(protocol.UsersLedgerKey, n.Host().ID().String())
-
-			// 如果不匹配，则更新区块链
-			if !found {
-				updatedMap := map[string]interface{}{}
-				updatedMap[n.Host().ID().String()] = &types.User{
-					PeerID:    n.Host().ID().String(),
-					Timestamp: time.Now().String(),
-				}
-				ledger.Add(protocol.UsersLedgerKey, updatedMap)
-			}
-		},
-	)
+	announceUser(ctx, ledger, announcetime, n.Host().ID().String())
+
+	// 文件公告到账本时立即开始下载，而不是轮询
+	events := ledger.Watch(ctx, protocol.FilesLedgerKey, fileID)
 
 	for {
-		select {
-		case <-ctx.Done():
-			return errors.New("上下文已取消")
-		default:
-			time.Sleep(5 * time.Second)
-
-			l.Debug("尝试在区块链中查找文件")
-
-			existingValue, found := ledger.GetKey(protocol.FilesLedgerKey, fileID)
-			fi := &types.File{}
-			existingValue.Unmarshal(fi)
-			// 如果不匹配，则更新区块链
-			if !found {
-				l.Debug("文件在区块链中未找到，5秒后重试")
-				continue
-			} else {
-				// 从区块链中检索当前IP对应的ID
-				existingValue, found := ledger.GetKey(protocol.FilesLedgerKey, fileID)
-				fi := &types.File{}
-				existingValue.Unmarshal(fi)
+		l.Debug("尝试在区块链中查找文件")
 
-				// 如果不匹配，则更新区块链
-				if !found {
-					return errors.New("文件未找到")
-				}
+		fi, found := types.Files(ledger).Get(fileID)
+		if !found {
+			l.Debug("文件在区块链中未找到，等待文件公告")
+			select {
+			case <-events:
+				continue
+			case <-ctx.Done():
+				return errors.New("上下文已取消")
+			}
+		}
 
-				// 解码对等节点
-				d, err := peer.Decode(fi.PeerID)
-				if err != nil {
-					return err
-				}
+		// 解码对等节点
+		d, err := peer.Decode(fi.PeerID)
+		if err != nil {
+			return err
+		}
 
-				l.Debug("文件在区块链中找到，正在打开流到", d)
+		l.Debug("文件在区块链中找到，正在打开流到", d)
 
-				// 打开流
-				stream, err := n.Host().NewStream(ctx, d, protocol.FileProtocol.ID())
-				if err != nil {
-					l.Debugf("连接 %s 失败，5秒后重试", d)
-					continue
-				}
+		// 打开流
+		stream, err := n.Host().NewStream(ctx, d, protocol.FileProtocol.ID())
+		if err != nil {
+			l.Debugf("连接 %s 失败，5秒后重试", d)
+			select {
+			case <-time.After(5 * time.Second):
+				continue
+			case <-ctx.Done():
+				return errors.New("上下文已取消")
+			}
+		}
 
-				l.Infof("正在保存文件 %s 到 %s", fileID, path)
+		l.Infof("正在保存文件 %s 到 %s", fileID, path)
 
-				f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
-				if err != nil {
-					return err
-				}
+		f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0755)
+		if err != nil {
+			return err
+		}
 
-				io.Copy(f, stream)
-				f.Close()
+		io.Copy(f, stream)
+		f.Close()
 
-				l.Infof("已接收文件 %s 到 %s", fileID, path)
-				return nil
-			}
-		}
+		l.Infof("已接收文件 %s 到 %s", fileID, path)
+		return nil
 	}
 }
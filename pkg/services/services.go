@@ -36,19 +36,16 @@ import (
 // 参数 announcetime 为公告时间间隔，serviceID 为服务ID
 func ExposeNetworkService(announcetime time.Duration, serviceID string) node.NetworkService {
 	return func(ctx context.Context, c node.Config, n *node.Node, b *blockchain.Ledger) error {
+		services := types.Services(b)
 		b.Announce(
 			ctx,
 			announcetime,
 			func() {
-				// 从区块链中检索当前IP对应的ID
-				existingValue, found := b.GetKey(protocol.ServicesLedgerKey, serviceID)
-				service := &types.Service{}
-				existingValue.Unmarshal(service)
+				// 从区块链中检索服务当前对应的ID
+				service, found := services.Get(serviceID)
 				// 如果不匹配，则更新区块链
 				if !found || service.PeerID != n.Host().ID().String() {
-					updatedMap := map[string]interface{}{}
-					updatedMap[serviceID] = types.Service{PeerID: n.Host().ID().String(), Name: serviceID}
-					b.Add(protocol.ServicesLedgerKey, updatedMap)
+					services.Put(serviceID, types.Service{PeerID: n.Host().ID().String(), Name: serviceID})
 				}
 			},
 		)
@@ -68,7 +65,7 @@ func RegisterService(ll log.StandardLogger, announcetime time.Duration, serviceI
 					ll.Infof("(服务 %s) 收到来自 %s 的连接", serviceID, stream.Conn().RemotePeer().String())
 
 					// 从区块链中检索当前IP对应的ID
-					_, found := l.GetKey(protocol.UsersLedgerKey, stream.Conn().RemotePeer().String())
+					_, found := types.Users(l).Get(stream.Conn().RemotePeer().String())
 					// 如果不匹配，则更新区块链
 					if !found {
 						ll.Debugf("重置 '%s': 在账本中未找到", stream.Conn().RemotePeer().String())
@@ -109,23 +106,7 @@ func ConnectNetworkService(announcetime time.Duration, serviceID string, srcaddr
 		//	ll.Info("绑定本地端口到", srcaddr)
 
 		// 公告我们自己，以便节点接受我们的连接
-		ledger.Announce(
-			ctx,
-			announcetime,
-			func() {
-				// 从区块链中检索当前IP对应的ID
-				_, found := ledger.GetKey(protocol.UsersLedgerKey, node.Host().ID().String())
-				// 如果不匹配，则更新区块链
-				if !found {
-					updatedMap := map[string]interface{}{}
-					updatedMap[node.Host().ID().String()] = &types.User{
-						PeerID:    node.Host().ID().String(),
-						Timestamp: time.Now().String(),
-					}
-					ledger.Add(protocol.UsersLedgerKey, updatedMap)
-				}
-			},
-		)
+		announceUser(ctx, ledger, announcetime, node.Host().ID().String())
 
 		defer l.Close()
 		for {
@@ -144,9 +125,7 @@ func ConnectNetworkService(announcetime time.Duration, serviceID string, srcaddr
 				// 在新的协程中处理连接，转发到P2P服务
 				go func() {
 					// 从区块链中检索当前IP对应的ID
-					existingValue, found := ledger.GetKey(protocol.ServicesLedgerKey, serviceID)
-					service := &types.Service{}
-					existingValue.Unmarshal(service)
+					service, found := types.Services(ledger).Get(serviceID)
 					// 如果不匹配，则更新区块链
 					if !found {
 						conn.Close()
@@ -192,3 +171,14 @@ func copyStream(closer chan struct{}, dst io.Writer, src io.Reader) {
 	defer func() { closer <- struct{}{} }() // 连接已关闭，发送信号停止代理
 	io.Copy(dst, src)
 }
+
+// announceTTLIntervals 是公告的键的存活时间相对于公告间隔的倍数
+// 键在过期之前的两个间隔内被刷新，停止公告的节点的键在这之后过期
+const announceTTLIntervals = 6
+
+// announceUser 定期将peerID公告为用户，提供服务的节点只接受用户的连接
+// 用户以TTL写入，离开网络的节点在所有节点上自动过期
+// 参数 ctx 为上下文，b 为区块链账本，announcetime 为公告时间间隔，peerID 为对等节点ID
+func announceUser(ctx context.Context, b *blockchain.Ledger, announcetime time.Duration, peerID string) {
+	types.Users(b).Announce(ctx, announcetime, peerID, types.User{PeerID: peerID, Timestamp: time.Now().String()}, blockchain.WithTTL(announceTTLIntervals*announcetime))
+}
@@ -22,6 +22,7 @@ import (
 	"github.com/purpose168/edgevpn/pkg/blockchain"
 	"github.com/purpose168/edgevpn/pkg/node"
 	"github.com/purpose168/edgevpn/pkg/protocol"
+	"github.com/purpose168/edgevpn/pkg/utils"
 )
 
 // PeerGater 对等节点门控器，用于控制对等节点的访问权限
@@ -89,26 +90,47 @@ func (pg *PeerGater) Gate(n *node.Node, p peer.ID) bool {
 
 // UpdaterService 是负责从账本状态同步回trustDB的服务。
 // 它是一个网络服务，检索信任区域中列出的发送者ID，
-// 并将其填充到用于门控区块链消息的trustDB中
+// 并将其填充到用于门控区块链消息的trustDB中。
+// 信任区域的每次变更都会立即更新trustDB，duration 为没有变更时重新同步的间隔
 // 参数 duration 为更新间隔时间
 func (pg *PeerGater) UpdaterService(duration time.Duration) node.NetworkService {
 	return func(ctx context.Context, c node.Config, n *node.Node, b *blockchain.Ledger) error {
-		b.Announce(ctx, duration, func() {
-			db := []peer.ID{}
-			// 获取信任区域数据
-			tz, found := b.CurrentData()[protocol.TrustZoneKey]
-			if found {
-				// 将信任区域中的对等节点ID添加到数据库
-				for k := range tz {
-					db = append(db, peer.ID(k))
+		events := b.Watch(ctx, protocol.TrustZoneKey, "")
+
+		go func() {
+			t := utils.NewBackoffTicker(utils.BackoffMaxInterval(duration))
+			defer t.Stop()
+			for {
+				pg.sync(b)
+				select {
+				case <-events:
+				case <-t.C:
+				case <-ctx.Done():
+					return
 				}
 			}
-			// 更新信任数据库
-			pg.Lock()
-			pg.trustDB = db
-			pg.Unlock()
-		})
+		}()
 
 		return nil
 	}
 }
+
+// sync 使用信任区域中的对等节点ID更新trustDB
+// 参数 b 为账本
+func (pg *PeerGater) sync(b *blockchain.Ledger) {
+	db := []peer.ID{}
+	// 获取信任区域数据
+	tz, found := b.CurrentData()[protocol.TrustZoneKey]
+	if found {
+		// 将信任区域中的对等节点ID添加到数据库
+		for k := range tz {
+			if p, err := peer.Decode(k); err == nil {
+				db = append(db, p)
+			}
+		}
+	}
+	// 更新信任数据库
+	pg.Lock()
+	pg.trustDB = db
+	pg.Unlock()
+}
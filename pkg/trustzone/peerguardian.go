@@ -55,7 +55,12 @@ func (pg *PeerGuardian) ReceiveMessage(l *blockchain.Ledger, m *hub.Message, c c
 			// 尝试认证
 			// 注意，我们可能不在这里的TZ中，因为我们无法检查（手头缺少节点信息）
 			// 无论如何，节点会忽略消息，而我们触发Authenticate对于两步（或更多）认证器是有用的
-			l.Persist(context.Background(), 5*time.Second, 120*time.Second, protocol.TrustZoneKey, m.SenderID, "")
+			// 至少一个其他对等节点确认后成员资格才算生效
+			go func(id string) {
+				if _, err := l.PersistConfirmed(context.Background(), 5*time.Second, 120*time.Second, protocol.TrustZoneKey, id, "", 1); err != nil {
+					pg.logger.Warn(err)
+				}
+			}(m.SenderID)
 			return nil
 		}
 	}
@@ -0,0 +1,49 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types
+
+import (
+	"github.com/purpose168/edgevpn/pkg/blockchain"
+	"github.com/purpose168/edgevpn/pkg/protocol"
+)
+
+// Machines 返回机器存储桶，键为机器的IP地址
+func Machines(l *blockchain.Ledger) *blockchain.Bucket[Machine] {
+	return blockchain.NewBucket[Machine](l, protocol.MachinesLedgerKey)
+}
+
+// Routes 返回子网路由存储桶，键为公告路由的对等节点ID
+func Routes(l *blockchain.Ledger) *blockchain.Bucket[Route] {
+	return blockchain.NewBucket[Route](l, protocol.RoutesLedgerKey)
+}
+
+// Services 返回服务存储桶，键为服务ID
+func Services(l *blockchain.Ledger) *blockchain.Bucket[Service] {
+	return blockchain.NewBucket[Service](l, protocol.ServicesLedgerKey)
+}
+
+// Files 返回文件存储桶，键为文件ID
+func Files(l *blockchain.Ledger) *blockchain.Bucket[File] {
+	return blockchain.NewBucket[File](l, protocol.FilesLedgerKey)
+}
+
+// Users 返回用户存储桶，键为用户的对等节点ID
+func Users(l *blockchain.Ledger) *blockchain.Bucket[User] {
+	return blockchain.NewBucket[User](l, protocol.UsersLedgerKey)
+}
+
+// DNSRecords 返回DNS存储桶，键为匹配域名的正则表达式
+func DNSRecords(l *blockchain.Ledger) *blockchain.Bucket[DNS] {
+	return blockchain.NewBucket[DNS](l, protocol.DNSKey)
+}
@@ -13,8 +13,26 @@ limitations under the License.
 
 package types
 
-import "github.com/miekg/dns"
+import (
+	"errors"
+	"fmt"
+
+	"github.com/miekg/dns"
+)
 
 // DNS DNS记录映射类型
 // 将DNS类型映射到对应的记录值
 type DNS map[dns.Type]string
+
+// Validate 检查DNS记录是否有效
+func (d DNS) Validate() error {
+	if len(d) == 0 {
+		return errors.New("没有DNS记录")
+	}
+	for t, v := range d {
+		if v == "" {
+			return fmt.Errorf("DNS记录 %s 为空", t)
+		}
+	}
+	return nil
+}
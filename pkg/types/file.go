@@ -13,9 +13,19 @@ limitations under the License.
 
 package types
 
+import "errors"
+
 // File 文件信息结构体
 // 用于表示网络中共享的文件信息
 type File struct {
 	PeerID string // 提供文件的对等节点ID
 	Name   string // 文件名称
 }
+
+// Validate 检查文件信息是否有效
+func (f File) Validate() error {
+	if f.PeerID == "" {
+		return errors.New("缺少对等节点ID")
+	}
+	return nil
+}
@@ -13,6 +13,12 @@ limitations under the License.
 
 package types
 
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
 // Machine 机器信息结构体
 // 用于表示网络中的机器节点信息
 type Machine struct {
@@ -21,5 +27,20 @@ type Machine struct {
 	OS       string // 操作系统类型
 	Arch     string // 系统架构
 	Address  string // IP地址
+	Address6 string // 双栈时的IPv6地址
 	Version  string // 软件版本
 }
+
+// Validate 检查机器信息是否有效
+func (m Machine) Validate() error {
+	if m.PeerID == "" {
+		return errors.New("缺少对等节点ID")
+	}
+	if m.Address != "" && net.ParseIP(m.Address) == nil {
+		return fmt.Errorf("无效的IP地址 '%s'", m.Address)
+	}
+	if ip := net.ParseIP(m.Address6); m.Address6 != "" && (ip == nil || ip.To4() != nil) {
+		return fmt.Errorf("无效的IPv6地址 '%s'", m.Address6)
+	}
+	return nil
+}
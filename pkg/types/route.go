@@ -0,0 +1,55 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package types
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+)
+
+// Route 子网路由公告
+// 节点公告可以通过它到达的子网，其他节点将目标为这些子网的数据包转发给它。
+// 公告默认路由（0.0.0.0/0 或 ::/0）的节点是路由器候选者
+type Route struct {
+	PeerID   string   // 公告路由的对等节点ID
+	Networks []string // 可以到达的CIDR子网
+	Priority int      // 多个节点公告同一个子网时，优先使用优先级较高的节点
+}
+
+// Prefixes 解析公告的子网
+func (r Route) Prefixes() ([]netip.Prefix, error) {
+	prefixes := []netip.Prefix{}
+	for _, n := range r.Networks {
+		p, err := netip.ParsePrefix(n)
+		if err != nil {
+			return nil, fmt.Errorf("无效的子网 '%s': %w", n, err)
+		}
+		// IPv4映射的IPv6子网与对应的IPv4子网等价，查找时地址也会被转换
+		if p.Addr().Is4In6() && p.Bits() >= 96 {
+			p = netip.PrefixFrom(p.Addr().Unmap(), p.Bits()-96)
+		}
+		prefixes = append(prefixes, p.Masked())
+	}
+	return prefixes, nil
+}
+
+// Validate 检查路由公告是否有效
+func (r Route) Validate() error {
+	if r.PeerID == "" {
+		return errors.New("缺少对等节点ID")
+	}
+	_, err := r.Prefixes()
+	return err
+}
@@ -13,9 +13,19 @@ limitations under the License.
 
 package types
 
+import "errors"
+
 // Service 服务信息结构体
 // 用于表示网络中提供的服务信息
 type Service struct {
 	PeerID string // 提供服务的对等节点ID
 	Name   string // 服务名称
 }
+
+// Validate 检查服务信息是否有效
+func (s Service) Validate() error {
+	if s.PeerID == "" {
+		return errors.New("缺少对等节点ID")
+	}
+	return nil
+}
@@ -13,9 +13,19 @@ limitations under the License.
 
 package types
 
+import "errors"
+
 // User 用户信息结构体
 // 用于表示网络中的用户信息
 type User struct {
 	PeerID    string // 对等节点ID
 	Timestamp string // 时间戳
 }
+
+// Validate 检查用户信息是否有效
+func (u User) Validate() error {
+	if u.PeerID == "" {
+		return errors.New("缺少对等节点ID")
+	}
+	return nil
+}
@@ -14,7 +14,9 @@ limitations under the License.
 package utils
 
 import (
+	"crypto/sha256"
 	"net"
+	"net/netip"
 	"sort"
 
 	"github.com/c-robinson/iplib"
@@ -47,3 +49,42 @@ func NextIP(defaultIP string, ips []string) string {
 	// 返回下一个IP地址
 	return iplib.NextIP(last).String()
 }
+
+// ULAPrefix 从种子确定性地派生IPv6唯一本地地址（ULA）前缀
+// 按照RFC 4193，前缀为 fd00::/8 加上从种子派生的40位全局ID和为0的子网ID
+// 参数 seed 为种子，例如网络密钥，使同一网络中的所有节点得到相同的前缀
+// 返回 /64 前缀
+func ULAPrefix(seed string) netip.Prefix {
+	sum := sha256.Sum256([]byte(seed))
+	var a [16]byte
+	a[0] = 0xfd
+	copy(a[1:6], sum[:5])
+	return netip.PrefixFrom(netip.AddrFrom16(a), 64)
+}
+
+// HostAddress 在前缀中确定性地派生主机地址
+// 主机部分从种子的哈希中获取，避免全0的子网路由器任播地址
+// 参数 p 为前缀，seed 为种子，例如对等节点ID
+func HostAddress(p netip.Prefix, seed string) netip.Addr {
+	p = p.Masked()
+	sum := sha256.Sum256([]byte(seed))
+	a := p.Addr().AsSlice()
+	for i := range a {
+		// 每个字节中属于前缀的位数
+		bits := p.Bits() - i*8
+		if bits >= 8 {
+			continue
+		}
+		mask := byte(0xff)
+		if bits > 0 {
+			mask >>= bits
+		}
+		a[i] |= sum[i%len(sum)] & mask
+	}
+	addr, _ := netip.AddrFromSlice(a)
+	if addr == p.Addr() {
+		// 主机部分全为0，使用下一个地址
+		addr = addr.Next()
+	}
+	return addr
+}
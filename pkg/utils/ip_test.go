@@ -14,6 +14,8 @@ limitations under the License.
 package utils_test
 
 import (
+	"net/netip"
+
 	. "github.com/onsi/ginkgo/v2"
 	. "github.com/onsi/gomega"
 
@@ -28,5 +30,29 @@ var _ = Describe("IP", func() {
 		It("返回默认值", func() {
 			Expect(NextIP("10.1.1.0", []string{})).To(Equal("10.1.1.0"))
 		})
+		It("生成新的IPv6地址", func() {
+			Expect(NextIP("fd00::1", []string{"fd00::1", "fd00::ff"})).To(Equal("fd00::100"))
+		})
+	})
+
+	Context("ULA", func() {
+		It("从种子派生相同的前缀", func() {
+			p := ULAPrefix("key")
+			Expect(p.Bits()).To(Equal(64))
+			Expect(p.Addr().As16()[0]).To(Equal(byte(0xfd)))
+			Expect(ULAPrefix("key")).To(Equal(p))
+			Expect(ULAPrefix("other")).ToNot(Equal(p))
+		})
+		It("在前缀中派生主机地址", func() {
+			p := ULAPrefix("key")
+			a := HostAddress(p, "peer")
+			Expect(p.Contains(a)).To(BeTrue())
+			Expect(a).ToNot(Equal(p.Addr()))
+			Expect(HostAddress(p, "peer")).To(Equal(a))
+			Expect(HostAddress(p, "other")).ToNot(Equal(a))
+
+			v4 := netip.MustParsePrefix("10.1.0.0/24")
+			Expect(v4.Contains(HostAddress(v4, "peer"))).To(BeTrue())
+		})
 	})
 })
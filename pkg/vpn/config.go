@@ -26,15 +26,35 @@ type Config struct {
 	InterfaceName    string           // 接口名称
 	InterfaceAddress string           // 接口IP地址（CIDR格式）
 	RouterAddress    string           // 路由器地址
+	Routes           []string         // 公告可以通过本节点到达的CIDR子网
+	RoutePriority    int              // 公告的子网的优先级
 	InterfaceMTU     int              // 接口MTU值
 	MTU              int              // 数据包MTU值
 	DeviceType       water.DeviceType // 设备类型（TUN/TAP）
 
+	// InterfaceAddress6 接口的IPv6地址（CIDR格式），用于双栈。
+	// 为AutoAddress6时从网络密钥派生ULA前缀，并从对等节点ID派生主机地址
+	InterfaceAddress6 string
+
+	// Bridge TAP模式下将接口加入的本地网桥，使远程节点加入本地局域网
+	Bridge string
+
+	// Userspace 使用用户空间TCP/IP协议栈代替TUN设备，不需要root权限。
+	// 本地进程通过SOCKS5代理、HTTP代理和端口转发访问网络中的地址
+	Userspace       bool
+	SOCKS5Listen    string   // 用户空间模式下SOCKS5代理的监听地址
+	HTTPProxyListen string   // 用户空间模式下HTTP代理的监听地址
+	Forwards        []string // 用户空间模式下的端口转发，格式为 本地地址=网络中的地址
+
 	LedgerAnnounceTime time.Duration      // 账本公告时间间隔
 	Logger             log.StandardLogger // 日志记录器
 
 	NetLinkBootstrap bool // 是否使用NetLink引导
 
+	// RouteHealthTimeout 健康检查超过此时间的节点不会被选为子网的下一跳，为0时不检查
+	RouteHealthTimeout time.Duration
+	StickyRoutes       bool // 是否为每个目标地址保持选择的下一跳
+
 	// Frame timeout 帧超时时间
 	Timeout time.Duration
 
@@ -44,6 +64,9 @@ type Config struct {
 	lowProfile        bool // 低配置模式
 }
 
+// AutoAddress6 使每个节点从网络密钥和对等节点ID派生唯一本地IPv6地址，无需协商
+const AutoAddress6 = "auto"
+
 // Option 配置选项函数类型
 type Option func(cfg *Config) error
 
@@ -117,6 +140,36 @@ func WithRouterAddress(i string) func(cfg *Config) error {
 	}
 }
 
+// WithRoutes 公告可以通过本节点到达的CIDR子网，其他节点将目标为这些子网的数据包转发给本节点
+func WithRoutes(cidrs ...string) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		cfg.Routes = append(cfg.Routes, cidrs...)
+		return nil
+	}
+}
+
+// WithRoutePriority 设置公告的子网的优先级，多个节点公告同一个子网时优先使用优先级较高的节点
+func WithRoutePriority(p int) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		cfg.RoutePriority = p
+		return nil
+	}
+}
+
+// WithRouteHealthTimeout 设置选择下一跳时使用的健康检查超时时间，超时的节点会被跳过
+func WithRouteHealthTimeout(t time.Duration) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		cfg.RouteHealthTimeout = t
+		return nil
+	}
+}
+
+// StickyRoutes 粘性路由选项，启用后目标地址的下一跳只在它不可用时才会改变，长连接不会被重新分配
+var StickyRoutes Option = func(cfg *Config) error {
+	cfg.StickyRoutes = true
+	return nil
+}
+
 // WithLedgerAnnounceTime 设置账本公告时间间隔的选项
 func WithLedgerAnnounceTime(t time.Duration) func(cfg *Config) error {
 	return func(cfg *Config) error {
@@ -157,6 +210,46 @@ func WithPacketMTU(i int) func(cfg *Config) error {
 	}
 }
 
+// WithBridge 设置TAP模式下将接口加入的本地网桥的选项
+func WithBridge(b string) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		cfg.Bridge = b
+		return nil
+	}
+}
+
+// Userspace 设置是否使用用户空间TCP/IP协议栈代替TUN设备的选项
+func Userspace(b bool) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		cfg.Userspace = b
+		return nil
+	}
+}
+
+// WithSOCKS5Listen 设置用户空间模式下SOCKS5代理监听地址的选项
+func WithSOCKS5Listen(addr string) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		cfg.SOCKS5Listen = addr
+		return nil
+	}
+}
+
+// WithHTTPProxyListen 设置用户空间模式下HTTP代理监听地址的选项
+func WithHTTPProxyListen(addr string) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		cfg.HTTPProxyListen = addr
+		return nil
+	}
+}
+
+// WithForwards 添加用户空间模式下的端口转发，格式为 本地地址=网络中的地址，例如 127.0.0.1:8022=10.1.0.12:22
+func WithForwards(f ...string) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		cfg.Forwards = append(cfg.Forwards, f...)
+		return nil
+	}
+}
+
 // WithInterfaceType 设置接口设备类型的选项
 func WithInterfaceType(d water.DeviceType) func(cfg *Config) error {
 	return func(cfg *Config) error {
@@ -180,3 +273,11 @@ func WithInterfaceAddress(i string) func(cfg *Config) error {
 		return nil
 	}
 }
+
+// WithInterfaceAddress6 设置接口IPv6地址的选项，为AutoAddress6时自动派生地址
+func WithInterfaceAddress6(i string) func(cfg *Config) error {
+	return func(cfg *Config) error {
+		cfg.InterfaceAddress6 = i
+		return nil
+	}
+}
@@ -19,6 +19,7 @@ import (
 	"context"
 	"fmt"
 	"io/ioutil"
+	"net/netip"
 	"os"
 	"path/filepath"
 	"time"
@@ -26,7 +27,6 @@ import (
 	"github.com/ipfs/go-log/v2"
 	"github.com/purpose168/edgevpn/pkg/crypto"
 	"github.com/purpose168/edgevpn/pkg/node"
-	"github.com/purpose168/edgevpn/pkg/protocol"
 	"github.com/purpose168/edgevpn/pkg/services"
 	"github.com/purpose168/edgevpn/pkg/types"
 	"github.com/purpose168/edgevpn/pkg/utils"
@@ -59,22 +59,81 @@ func contains(slice []string, elem string) bool {
 	return false
 }
 
+const (
+	// leaderBackoff 是宣布领导者没有得到确认之后第一次重试前的等待时间，之后每次失败加倍
+	leaderBackoff = 5 * time.Second
+	// maxLeaderBackoff 是宣布领导者失败之后最长的等待时间
+	maxLeaderBackoff = 2 * time.Minute
+)
+
+// dhcpNetwork 解析DHCP分配地址的网络
+// 参数 address 为基础地址，可以是CIDR格式。不带前缀长度时IPv4使用 /24，IPv6使用 /64
+func dhcpNetwork(address string) (netip.Prefix, error) {
+	if p, err := netip.ParsePrefix(address); err == nil {
+		return p, nil
+	}
+	a, err := netip.ParseAddr(address)
+	if err != nil {
+		return netip.Prefix{}, fmt.Errorf("无效的DHCP地址 '%s': %w", address, err)
+	}
+	if a.Is4() {
+		return netip.PrefixFrom(a, 24), nil
+	}
+	return netip.PrefixFrom(a, 64), nil
+}
+
+// dhcpAddress 返回机器在DHCP网络中使用的地址，双栈机器的IPv6地址保存在Address6中
+// 参数 network 为DHCP网络，m 为机器信息
+func dhcpAddress(network netip.Prefix, m types.Machine) (string, bool) {
+	for _, address := range []string{m.Address, m.Address6} {
+		if a, err := netip.ParseAddr(address); err == nil && network.Contains(a) {
+			return address, true
+		}
+	}
+	return "", false
+}
+
+// dhcpNextIP 返回DHCP网络中已使用的最大地址之后的地址，超出网络时返回错误。
+// IPv4网络的广播地址不会被分配
+// 参数 network 为DHCP网络，ips 为网络中已使用的地址
+func dhcpNextIP(network netip.Prefix, ips []string) (string, error) {
+	next, err := netip.ParseAddr(utils.NextIP(network.Addr().String(), ips))
+	if err != nil || !network.Contains(next) || (next.Is4() && network.Bits() < 31 && !network.Contains(next.Next())) {
+		return "", fmt.Errorf("DHCP网络 %s 中没有可用的地址", network.Masked())
+	}
+	return next.String(), nil
+}
+
 // DHCPNetworkService 返回一个DHCP网络服务
 // 参数 ip 为IP地址通道，l 为日志记录器，maxTime 为最大超时时间，leasedir 为租约目录，address 为基础地址
 func DHCPNetworkService(ip chan string, l log.StandardLogger, maxTime time.Duration, leasedir string, address string) node.NetworkService {
 	return func(ctx context.Context, c node.Config, n *node.Node, b *blockchain.Ledger) error {
+		network, err := dhcpNetwork(address)
+		if err != nil {
+			return err
+		}
+
 		// 创建租约目录
 		os.MkdirAll(leasedir, 0600)
 
 		// 如果存在则检索租约
 		var wantedIP = checkDHCPLease(c, leasedir)
 
+		// 机器、健康检查或领导者发生变化时立即重新评估，而不是等待下一次轮询
+		watch, cancel := context.WithCancel(ctx)
+		defer cancel()
+		events := b.Watch(watch, "", "")
+		backoff := leaderBackoff
+
 		// 任何需要新IP的节点：
 		//  1. 获取可用节点。从Machine中过滤掉没有IP的节点。
 		//  2. 在它们中选择领导者。如果我们不是，则等待
 		//  3. 如果我们是领导者，选择一个IP并使用该IP启动VPN
 		for wantedIP == "" {
-			time.Sleep(5 * time.Second)
+			waitForChanges(ctx, events, 5*time.Second)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
 
 			// 此网络服务是阻塞的，在VPN之前调用，因此需要在VPN之前注册
 			nodes := services.AvailableNodes(b, maxTime)
@@ -83,13 +142,20 @@ func DHCPNetworkService(ip chan string, l log.StandardLogger, maxTime time.Durat
 			ips := []string{}
 
 			// 遍历账本中的机器信息，收集当前IP分配情况
-			for _, t := range b.LastBlock().Storage[protocol.MachinesLedgerKey] {
-				var m types.Machine
-				t.Unmarshal(&m)
+			for key, m := range types.Machines(b).List() {
+				// 双栈的机器信息也以IPv6地址为键保存
+				if key != m.Address {
+					continue
+				}
 				currentIPs[m.PeerID] = m.Address
 
-				l.Debugf("%s 使用 %s", m.PeerID, m.Address)
-				ips = append(ips, m.Address)
+				// 只考虑分配的网络中的IP
+				used, ok := dhcpAddress(network, m)
+				if !ok {
+					continue
+				}
+				l.Debugf("%s 使用 %s", m.PeerID, used)
+				ips = append(ips, used)
 			}
 
 			// 找出没有IP的节点
@@ -129,7 +195,25 @@ func DHCPNetworkService(ip chan string, l log.StandardLogger, maxTime time.Durat
 
 			// 如果我们应该成为领导者，但还没有宣布或当前领导者不在需要IP的节点列表中
 			if shouldBeLeader == n.Host().ID().String() && (lead == "" || !contains(nodesWithNoIP, lead)) {
-				b.Persist(ctx, 5*time.Second, 15*time.Second, "dhcp", "leader", n.Host().ID().String())
+				// 等待其他节点确认，避免两个节点都认为自己是领导者并分配相同的IP
+				// 没有已知的对等节点时无法得到确认，直接写入
+				if peers, err := n.MessageHub.ListPeers(); err != nil || len(peers) == 0 {
+					b.Add("dhcp", map[string]interface{}{"leader": n.Host().ID().String()})
+					continue
+				}
+				if _, err := b.PersistConfirmed(ctx, 5*time.Second, 15*time.Second, "dhcp", "leader", n.Host().ID().String(), 1); err != nil {
+					c.Logger.Warnf("宣布领导者失败，%s 后重试: %s", backoff, err)
+					select {
+					case <-time.After(backoff):
+					case <-ctx.Done():
+						return ctx.Err()
+					}
+					if backoff *= 2; backoff > maxLeaderBackoff {
+						backoff = maxLeaderBackoff
+					}
+					continue
+				}
+				backoff = leaderBackoff
 				c.Logger.Info("宣布我们为领导者，退避中")
 				continue
 			}
@@ -146,7 +230,9 @@ func DHCPNetworkService(ip chan string, l log.StandardLogger, maxTime time.Durat
 			l.Debug("从中选择IP", ips)
 
 			// 获取下一个可用IP
-			wantedIP = utils.NextIP(address, ips)
+			if wantedIP, err = dhcpNextIP(network, ips); err != nil {
+				return err
+			}
 		}
 
 		// 将租约保存到磁盘
@@ -161,30 +247,58 @@ func DHCPNetworkService(ip chan string, l log.StandardLogger, maxTime time.Durat
 		ip <- wantedIP
 
 		// 从VPN限制连接
-		return n.BlockSubnet(fmt.Sprintf("%s/24", wantedIP))
+		return n.BlockSubnet(fmt.Sprintf("%s/%d", wantedIP, network.Bits()))
+	}
+}
+
+// waitForChanges 等待账本发生变化或超时，连续的多个变更只唤醒一次
+// 参数 ctx 为上下文，events 为账本变更事件，d 为最长等待时间
+func waitForChanges(ctx context.Context, events <-chan blockchain.Event, d time.Duration) {
+	select {
+	case <-events:
+	case <-time.After(d):
+	case <-ctx.Done():
+		return
+	}
+
+	for {
+		select {
+		case <-events:
+		default:
+			return
+		}
 	}
 }
 
 // DHCP 返回一个DHCP网络服务。它需要Alive服务来确定可用节点。
 // 可用节点用于确定哪些节点需要IP，当maxTime过期时，节点被标记为离线并不再考虑。
-// 参数 l 为日志记录器，maxTime 为最大超时时间，leasedir 为租约目录，address 为基础地址
+// 参数 l 为日志记录器，maxTime 为最大超时时间，leasedir 为租约目录，
+// address 为基础地址，可以是IPv4或IPv6的CIDR，前缀长度决定分配的网络
 // 返回节点选项和VPN选项
 func DHCP(l log.StandardLogger, maxTime time.Duration, leasedir string, address string) ([]node.Option, []Option) {
 	ip := make(chan string, 1)
 	return []node.Option{
 			func(cfg *node.Config) error {
+				network, err := dhcpNetwork(address)
+				if err != nil {
+					return err
+				}
 				// 如果存在则检索租约。在启动节点时由连接限制器消费
 				lease := checkDHCPLease(*cfg, leasedir)
 				if lease != "" {
-					cfg.InterfaceAddress = fmt.Sprintf("%s/24", lease)
+					cfg.InterfaceAddress = fmt.Sprintf("%s/%d", lease, network.Bits())
 				}
 				return nil
 			},
 			node.WithNetworkService(DHCPNetworkService(ip, l, maxTime, leasedir, address)),
 		}, []Option{
 			func(cfg *Config) error {
+				network, err := dhcpNetwork(address)
+				if err != nil {
+					return err
+				}
 				// 启动VPN时读取IP
-				cfg.InterfaceAddress = fmt.Sprintf("%s/24", <-ip)
+				cfg.InterfaceAddress = fmt.Sprintf("%s/%d", <-ip, network.Bits())
 				close(ip)
 				l.Debug("收到IP", cfg.InterfaceAddress)
 				return nil
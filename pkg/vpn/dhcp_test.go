@@ -0,0 +1,78 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"net/netip"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/purpose168/edgevpn/pkg/types"
+)
+
+var _ = Describe("DHCP network", func() {
+	DescribeTable("parses the address range",
+		func(address, expected string) {
+			p, err := dhcpNetwork(address)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(p).To(Equal(netip.MustParsePrefix(expected)))
+		},
+		Entry("an IPv4 address as /24", "10.1.0.1", "10.1.0.1/24"),
+		Entry("an IPv6 address as /64", "fd00::1", "fd00::1/64"),
+		Entry("an IPv4 CIDR", "10.1.0.1/16", "10.1.0.1/16"),
+		Entry("an IPv6 CIDR", "fd00:1::1/48", "fd00:1::1/48"),
+		// the base address is where allocation starts, so it is not masked
+		Entry("a CIDR keeping its base address", "10.1.0.10/24", "10.1.0.10/24"),
+	)
+
+	DescribeTable("rejects invalid addresses",
+		func(address string) {
+			_, err := dhcpNetwork(address)
+			Expect(err).To(HaveOccurred())
+		},
+		Entry("an empty address", ""),
+		Entry("a hostname", "example.com"),
+		Entry("an out of range octet", "10.1.0.256"),
+		Entry("an invalid prefix length", "10.1.0.1/33"),
+	)
+
+	It("collects the address of the range's family from dual-stack machines", func() {
+		m := types.Machine{Address: "10.1.0.2", Address6: "fd00::2"}
+		address, ok := dhcpAddress(netip.MustParsePrefix("fd00::1/64"), m)
+		Expect(ok).To(BeTrue())
+		Expect(address).To(Equal("fd00::2"))
+		address, ok = dhcpAddress(netip.MustParsePrefix("10.1.0.1/24"), m)
+		Expect(ok).To(BeTrue())
+		Expect(address).To(Equal("10.1.0.2"))
+		_, ok = dhcpAddress(netip.MustParsePrefix("10.2.0.1/24"), m)
+		Expect(ok).To(BeFalse())
+	})
+
+	It("allocates addresses after the last used one", func() {
+		network := netip.MustParsePrefix("10.1.0.1/24")
+		Expect(dhcpNextIP(network, nil)).To(Equal("10.1.0.1"))
+		Expect(dhcpNextIP(network, []string{"10.1.0.1", "10.1.0.7"})).To(Equal("10.1.0.8"))
+		Expect(dhcpNextIP(netip.MustParsePrefix("fd00::1/64"), []string{"fd00::1"})).To(Equal("fd00::2"))
+	})
+
+	It("fails when the range is exhausted", func() {
+		_, err := dhcpNextIP(netip.MustParsePrefix("10.1.0.1/30"), []string{"10.1.0.1", "10.1.0.2"})
+		Expect(err).To(HaveOccurred())
+		_, err = dhcpNextIP(netip.MustParsePrefix("10.1.0.1/24"), []string{"10.1.0.255"})
+		Expect(err).To(HaveOccurred())
+		_, err = dhcpNextIP(netip.MustParsePrefix("fd00::1/127"), []string{"fd00::1"})
+		Expect(err).To(HaveOccurred())
+	})
+})
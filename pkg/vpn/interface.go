@@ -17,6 +17,9 @@ limitations under the License.
 package vpn
 
 import (
+	"net"
+	"net/netip"
+
 	"github.com/mudler/water"
 	"github.com/vishvananda/netlink"
 )
@@ -34,7 +37,7 @@ func createInterface(c *Config) (*water.Interface, error) {
 }
 
 // prepareInterface 准备Linux等其他平台上的网络接口
-// 使用netlink库配置接口的MTU、IP地址并启用接口
+// 使用netlink库配置接口的MTU、IP地址（双栈时包括IPv6地址）或将其加入网桥，并启用接口
 func prepareInterface(c *Config) error {
 	// 根据名称获取网络链接
 	link, err := netlink.LinkByName(c.InterfaceName)
@@ -54,12 +57,35 @@ func prepareInterface(c *Config) error {
 		return err
 	}
 
+	// 加入网桥时，地址属于网桥而不是接口
+	if c.Bridge != "" {
+		bridge, err := netlink.LinkByName(c.Bridge)
+		if err != nil {
+			return err
+		}
+		if err := netlink.LinkSetMaster(link, bridge); err != nil {
+			return err
+		}
+		return netlink.LinkSetUp(link)
+	}
+
 	// 添加IP地址
 	err = netlink.AddrAdd(link, addr)
 	if err != nil {
 		return err
 	}
 
+	// 双栈时添加IPv6地址
+	if c.InterfaceAddress6 != "" {
+		addr6, err := netlink.ParseAddr(c.InterfaceAddress6)
+		if err != nil {
+			return err
+		}
+		if err := netlink.AddrAdd(link, addr6); err != nil {
+			return err
+		}
+	}
+
 	// 启用接口
 	err = netlink.LinkSetUp(link)
 	if err != nil {
@@ -67,3 +93,34 @@ func prepareInterface(c *Config) error {
 	}
 	return nil
 }
+
+// routeTo 返回经过VPN接口到达子网的路由
+// 参数 c 为VPN配置，p 为子网
+func routeTo(c *Config, p netip.Prefix) (*netlink.Route, error) {
+	link, err := netlink.LinkByName(c.InterfaceName)
+	if err != nil {
+		return nil, err
+	}
+	dst := &net.IPNet{IP: p.Addr().AsSlice(), Mask: net.CIDRMask(p.Bits(), p.Addr().BitLen())}
+	return &netlink.Route{LinkIndex: link.Attrs().Index, Dst: dst}, nil
+}
+
+// addRoute 添加经过VPN接口到达子网的路由
+// 参数 c 为VPN配置，p 为子网
+func addRoute(c *Config, p netip.Prefix) error {
+	r, err := routeTo(c, p)
+	if err != nil {
+		return err
+	}
+	return netlink.RouteReplace(r)
+}
+
+// delRoute 删除经过VPN接口到达子网的路由
+// 参数 c 为VPN配置，p 为子网
+func delRoute(c *Config, p netip.Prefix) error {
+	r, err := routeTo(c, p)
+	if err != nil {
+		return err
+	}
+	return netlink.RouteDel(r)
+}
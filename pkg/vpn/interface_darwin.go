@@ -17,7 +17,9 @@ limitations under the License.
 package vpn
 
 import (
+	"errors"
 	"net"
+	"net/netip"
 	"os/exec"
 	"strconv"
 
@@ -38,6 +40,10 @@ func createInterface(c *Config) (*water.Interface, error) {
 // prepareInterface 准备macOS平台上的网络接口
 // 使用ifconfig命令配置接口、MTU、IP地址和路由
 func prepareInterface(c *Config) error {
+	if c.Bridge != "" {
+		return errors.New("macOS不支持TAP接口，无法加入网桥")
+	}
+
 	// 根据名称获取网络接口
 	iface, err := net.InterfaceByName(c.InterfaceName)
 	if err != nil {
@@ -87,5 +93,30 @@ func prepareInterface(c *Config) error {
 		return err
 	}
 
+	// 双栈时添加IPv6地址，它的子网路由由前缀长度生成
+	if c.InterfaceAddress6 != "" {
+		ip6, ipNet6, err := net.ParseCIDR(c.InterfaceAddress6)
+		if err != nil {
+			return err
+		}
+		ones, _ := ipNet6.Mask.Size()
+		cmd = exec.Command("ifconfig", iface.Name, "inet6", ip6.String(), "prefixlen", strconv.Itoa(ones), "alias")
+		if err := cmd.Run(); err != nil {
+			return err
+		}
+	}
+
 	return nil
 }
+
+// addRoute 添加经过VPN接口到达子网的路由
+// 参数 c 为VPN配置，p 为子网
+func addRoute(c *Config, p netip.Prefix) error {
+	return exec.Command("route", "-n", "add", "-net", p.String(), "-interface", c.InterfaceName).Run()
+}
+
+// delRoute 删除经过VPN接口到达子网的路由
+// 参数 c 为VPN配置，p 为子网
+func delRoute(c *Config, p netip.Prefix) error {
+	return exec.Command("route", "-n", "delete", "-net", p.String(), "-interface", c.InterfaceName).Run()
+}
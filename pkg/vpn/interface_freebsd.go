@@ -19,6 +19,7 @@ package vpn
 import (
 	"fmt"
 	"github.com/mudler/water"
+	"net/netip"
 	"os/exec"
 )
 
@@ -41,11 +42,26 @@ func prepareInterface(c *Config) error {
 	if err != nil {
 		return err
 	}
+	// 加入网桥时，地址属于网桥而不是接口
+	if c.Bridge != "" {
+		err = sh(fmt.Sprintf("ifconfig %s addm %s", c.Bridge, c.InterfaceName))
+		if err != nil {
+			return err
+		}
+		return sh(fmt.Sprintf("ifconfig %s up", c.InterfaceName))
+	}
 	// 配置IP地址和子网掩码
 	err = sh(fmt.Sprintf("ifconfig %s inet %s %s netmask %s", c.InterfaceName, c.InterfaceAddress, c.InterfaceAddress, "255.255.255.0"))
 	if err != nil {
 		return err
 	}
+	// 双栈时添加IPv6地址
+	if c.InterfaceAddress6 != "" {
+		err = sh(fmt.Sprintf("ifconfig %s inet6 %s alias", c.InterfaceName, c.InterfaceAddress6))
+		if err != nil {
+			return err
+		}
+	}
 	// 启用接口
 	return sh(fmt.Sprintf("ifconfig %s up", c.InterfaceName))
 }
@@ -56,3 +72,15 @@ func sh(c string) (err error) {
 	_, err = exec.Command("/bin/sh", "-c", c).CombinedOutput()
 	return
 }
+
+// addRoute 添加经过VPN接口到达子网的路由
+// 参数 c 为VPN配置，p 为子网
+func addRoute(c *Config, p netip.Prefix) error {
+	return sh(fmt.Sprintf("route add -net %s -interface %s", p, c.InterfaceName))
+}
+
+// delRoute 删除经过VPN接口到达子网的路由
+// 参数 c 为VPN配置，p 为子网
+func delRoute(c *Config, p netip.Prefix) error {
+	return sh(fmt.Sprintf("route delete -net %s -interface %s", p, c.InterfaceName))
+}
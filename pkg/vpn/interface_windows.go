@@ -17,6 +17,7 @@ limitations under the License.
 package vpn
 
 import (
+	"errors"
 	"net/netip"
 
 	"github.com/mudler/water"
@@ -27,12 +28,11 @@ import (
 // prepareInterface 准备Windows平台上的网络接口
 // 设置IP地址和MTU等网络参数
 func prepareInterface(c *Config) error {
-	// 查找由water创建的接口
-	guid, err := windows.GUIDFromString("{00000000-FFFF-FFFF-FFE9-76E58C74063E}")
-	if err != nil {
-		return err
+	if c.Bridge != "" {
+		return errors.New("Windows不支持加入网桥")
 	}
-	luid, err := winipcfg.LUIDFromGUID(&guid)
+
+	luid, err := interfaceLUID()
 	if err != nil {
 		return err
 	}
@@ -43,20 +43,37 @@ func prepareInterface(c *Config) error {
 		return err
 	}
 	addresses := append([]netip.Prefix{}, prefix)
+	// 双栈时添加IPv6地址
+	if c.InterfaceAddress6 != "" {
+		prefix6, err := netip.ParsePrefix(c.InterfaceAddress6)
+		if err != nil {
+			return err
+		}
+		addresses = append(addresses, prefix6)
+	}
 	// 设置接口IP地址
 	if err := luid.SetIPAddresses(addresses); err != nil {
 		return err
 	}
 
-	// 获取IPv4接口配置
-	iface, err := luid.IPInterface(windows.AF_INET)
-	if err != nil {
-		return err
+	// 为接口使用的每个地址族设置MTU值
+	families := map[winipcfg.AddressFamily]bool{}
+	for _, a := range addresses {
+		if a.Addr().Is4() {
+			families[windows.AF_INET] = true
+		} else {
+			families[windows.AF_INET6] = true
+		}
 	}
-	// 设置MTU值
-	iface.NLMTU = uint32(c.InterfaceMTU)
-	if err := iface.Set(); err != nil {
-		return err
+	for family := range families {
+		iface, err := luid.IPInterface(family)
+		if err != nil {
+			return err
+		}
+		iface.NLMTU = uint32(c.InterfaceMTU)
+		if err := iface.Set(); err != nil {
+			return err
+		}
 	}
 	return nil
 }
@@ -70,3 +87,40 @@ func createInterface(c *Config) (*water.Interface, error) {
 	config.Name = c.InterfaceName
 	return water.New(config)
 }
+
+// interfaceLUID 查找由water创建的接口
+func interfaceLUID() (winipcfg.LUID, error) {
+	guid, err := windows.GUIDFromString("{00000000-FFFF-FFFF-FFE9-76E58C74063E}")
+	if err != nil {
+		return 0, err
+	}
+	return winipcfg.LUIDFromGUID(&guid)
+}
+
+// nextHop 返回直接经过接口的路由的下一跳
+func nextHop(p netip.Prefix) netip.Addr {
+	if p.Addr().Is4() {
+		return netip.IPv4Unspecified()
+	}
+	return netip.IPv6Unspecified()
+}
+
+// addRoute 添加经过VPN接口到达子网的路由
+// 参数 c 为VPN配置，p 为子网
+func addRoute(c *Config, p netip.Prefix) error {
+	luid, err := interfaceLUID()
+	if err != nil {
+		return err
+	}
+	return luid.AddRoute(p, nextHop(p), 0)
+}
+
+// delRoute 删除经过VPN接口到达子网的路由
+// 参数 c 为VPN配置，p 为子网
+func delRoute(c *Config, p netip.Prefix) error {
+	luid, err := interfaceLUID()
+	if err != nil {
+		return err
+	}
+	return luid.DeleteRoute(p, nextHop(p))
+}
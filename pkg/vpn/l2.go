@@ -0,0 +1,219 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/libp2p/go-libp2p/core/network"
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/songgao/packets/ethernet"
+
+	"github.com/purpose168/edgevpn/pkg/blockchain"
+	"github.com/purpose168/edgevpn/pkg/node"
+	"github.com/purpose168/edgevpn/pkg/types"
+)
+
+const (
+	// macTableSize 是MAC地址表记住的地址数量
+	macTableSize = 4096
+	// macAgeTime 是MAC地址表中的条目过期的时间，与Linux网桥的默认值相同
+	macAgeTime = 5 * time.Minute
+	// ethernetHeaderSize 是不带VLAN标签的以太网帧头部长度
+	ethernetHeaderSize = 14
+	// l2LengthSize 是TAP模式下流中每个帧之前的长度前缀的字节数
+	l2LengthSize = 2
+	// maxL2FrameSize 是TAP模式下流中可以传输的最大帧长度
+	maxL2FrameSize = 1<<(8*l2LengthSize) - 1
+)
+
+// macEntry 是学习到的MAC地址所在的对等节点
+type macEntry struct {
+	peer peer.ID
+	seen time.Time
+}
+
+// macTable 是TAP模式下的MAC地址学习表，记录每个MAC地址位于哪个对等节点之后
+type macTable struct {
+	cache *lru.Cache // MAC地址到macEntry
+}
+
+// newMACTable 创建新的MAC地址表
+func newMACTable() *macTable {
+	cache, _ := lru.New(macTableSize)
+	return &macTable{cache: cache}
+}
+
+// learn 记录从对等节点收到的帧的源MAC地址
+// 参数 mac 为源MAC地址，p 为发送帧的对等节点
+func (t *macTable) learn(mac net.HardwareAddr, p peer.ID) {
+	// 组播地址不能作为源地址
+	if isMulticast(mac) {
+		return
+	}
+	t.cache.Add(mac.String(), macEntry{peer: p, seen: time.Now()})
+}
+
+// lookup 返回MAC地址所在的对等节点，过期的条目被忽略
+// 参数 mac 为目标MAC地址
+func (t *macTable) lookup(mac net.HardwareAddr) (peer.ID, bool) {
+	v, exists := t.cache.Get(mac.String())
+	if !exists {
+		return "", false
+	}
+	e := v.(macEntry)
+	if time.Since(e.seen) > macAgeTime {
+		t.cache.Remove(mac.String())
+		return "", false
+	}
+	return e.peer, true
+}
+
+// isMulticast 如果MAC地址是广播或组播地址则返回true
+func isMulticast(mac net.HardwareAddr) bool {
+	return len(mac) > 0 && mac[0]&1 == 1
+}
+
+// floodPeers 返回网络中除自己以外的所有对等节点，用于泛洪广播、组播和目标未知的帧
+// 参数 n 为节点，ledger 为账本，nc 为节点配置
+func floodPeers(n *node.Node, ledger *blockchain.Ledger, nc node.Config) []peer.ID {
+	self := n.Host().ID()
+	seen := map[peer.ID]bool{self: true}
+	peers := []peer.ID{}
+	add := func(p peer.ID) {
+		if !seen[p] {
+			seen[p] = true
+			peers = append(peers, p)
+		}
+	}
+
+	if len(nc.PeerTable) > 0 {
+		for _, p := range nc.PeerTable {
+			add(p)
+		}
+		return peers
+	}
+	for _, m := range types.Machines(ledger).List() {
+		if p, err := peer.Decode(m.PeerID); err == nil {
+			add(p)
+		}
+	}
+	return peers
+}
+
+// handleL2Frame 在TAP模式下处理以太网帧，按目标MAC地址转发到对等节点。
+// 广播、组播（ARP、DHCP、mDNS等）和目标MAC地址未知的帧泛洪到所有对等节点
+// 参数 mgr 为流管理器，frame 为以太网帧，c 为配置，n 为节点，ledger 为账本，nc 为节点配置，macs 为MAC地址表
+func handleL2Frame(mgr streamManager, frame ethernet.Frame, c *Config, n *node.Node, ledger *blockchain.Ledger, nc node.Config, macs *macTable) error {
+	if len(frame) < ethernetHeaderSize {
+		return fmt.Errorf("无效的以太网帧，长度为 %d", len(frame))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
+	defer cancel()
+
+	// 流是字节流，一次读取不一定是一个完整的帧，每个帧之前加上长度前缀
+	framed, err := encodeL2Frame(frame)
+	if err != nil {
+		return err
+	}
+
+	dst := frame.Destination()
+	if !isMulticast(dst) {
+		if d, found := macs.lookup(dst); found {
+			return sendFrame(ctx, mgr, framed, n, d)
+		}
+	}
+
+	// 并发发送，使无法连接的对等节点不会阻塞其他节点
+	wg := sync.WaitGroup{}
+	for _, p := range floodPeers(n, ledger, nc) {
+		wg.Add(1)
+		go func(p peer.ID) {
+			defer wg.Done()
+			if err := sendFrame(ctx, mgr, framed, n, p); err != nil {
+				c.Logger.Debugf("无法泛洪帧到 %s: %s", p.String(), err.Error())
+			}
+		}(p)
+	}
+	wg.Wait()
+	return nil
+}
+
+// encodeL2Frame 返回带有大端序长度前缀的帧，用于在TAP模式下写入流
+// 参数 frame 为以太网帧
+func encodeL2Frame(frame ethernet.Frame) (ethernet.Frame, error) {
+	if len(frame) > maxL2FrameSize {
+		return nil, fmt.Errorf("以太网帧太大，长度为 %d", len(frame))
+	}
+	framed := make([]byte, l2LengthSize+len(frame))
+	binary.BigEndian.PutUint16(framed, uint16(len(frame)))
+	copy(framed[l2LengthSize:], frame)
+	return framed, nil
+}
+
+// readL2Frame 从流中读取一个带有长度前缀的完整帧
+// 参数 r 为流，buf 为至少maxL2FrameSize字节的缓冲区
+func readL2Frame(r io.Reader, buf []byte) (ethernet.Frame, error) {
+	var length [l2LengthSize]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	n := int(binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// copyFrames 在TAP模式下将流中的以太网帧写入接口，同时学习帧的源MAC地址
+// 每次写入接口的都是一个完整的帧
+// 参数 w 为网络接口，stream 为对等节点的流，c 为配置，macs 为MAC地址表
+func copyFrames(w io.Writer, stream network.Stream, c *Config, macs *macTable) error {
+	return copyL2Frames(w, stream, stream.Conn().RemotePeer(), macs)
+}
+
+// copyL2Frames 将r中带有长度前缀的帧逐个写入w，并学习帧的源MAC地址
+// 参数 w 为网络接口，r 为流，from 为发送帧的对等节点，macs 为MAC地址表
+func copyL2Frames(w io.Writer, r io.Reader, from peer.ID, macs *macTable) error {
+	br := bufio.NewReader(r)
+	buf := make([]byte, maxL2FrameSize)
+	for {
+		frame, err := readL2Frame(br, buf)
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(frame) < ethernetHeaderSize {
+			continue
+		}
+		macs.learn(frame.Source(), from)
+		if _, err := w.Write(frame); err != nil {
+			return err
+		}
+	}
+}
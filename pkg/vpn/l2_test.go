@@ -0,0 +1,100 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"bytes"
+	"io"
+	"net"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"github.com/songgao/packets/ethernet"
+)
+
+// chunked returns at most n bytes per read, like a stream that splits frames
+type chunked struct {
+	r io.Reader
+	n int
+}
+
+func (c chunked) Read(p []byte) (int, error) {
+	if len(p) > c.n {
+		p = p[:c.n]
+	}
+	return c.r.Read(p)
+}
+
+var _ = Describe("TAP frames", func() {
+	src := net.HardwareAddr{0x02, 0, 0, 0, 0, 1}
+	dst := net.HardwareAddr{0x02, 0, 0, 0, 0, 2}
+
+	frame := func(size int) ethernet.Frame {
+		var f ethernet.Frame
+		f.Prepare(dst, src, ethernet.NotTagged, ethernet.IPv4, size)
+		for i := range f.Payload() {
+			f.Payload()[i] = byte(i)
+		}
+		return f
+	}
+
+	encode := func(frames ...ethernet.Frame) []byte {
+		buf := &bytes.Buffer{}
+		for _, f := range frames {
+			framed, err := encodeL2Frame(f)
+			Expect(err).ToNot(HaveOccurred())
+			buf.Write(framed)
+		}
+		return buf.Bytes()
+	}
+
+	It("writes whole frames however the stream splits them", func() {
+		_, p := identity()
+		frames := []ethernet.Frame{frame(46), frame(1500), frame(100)}
+		for _, n := range []int{1, 7, 1000, 1 << 16} {
+			var out [][]byte
+			w := writerFunc(func(b []byte) (int, error) {
+				out = append(out, append([]byte{}, b...))
+				return len(b), nil
+			})
+			macs := newMACTable()
+			Expect(copyL2Frames(w, chunked{bytes.NewReader(encode(frames...)), n}, p, macs)).To(Succeed())
+
+			Expect(out).To(HaveLen(len(frames)))
+			for i, f := range frames {
+				Expect(out[i]).To(Equal([]byte(f)))
+			}
+			learned, found := macs.lookup(src)
+			Expect(found).To(BeTrue())
+			Expect(learned).To(Equal(p))
+		}
+	})
+
+	It("fails on a truncated frame", func() {
+		_, p := identity()
+		dat := encode(frame(100))
+		err := copyL2Frames(io.Discard, bytes.NewReader(dat[:len(dat)-1]), p, newMACTable())
+		Expect(err).To(MatchError(io.ErrUnexpectedEOF))
+	})
+
+	It("rejects frames that do not fit the length prefix", func() {
+		_, err := encodeL2Frame(make(ethernet.Frame, maxL2FrameSize+1))
+		Expect(err).To(HaveOccurred())
+	})
+})
+
+// writerFunc adapts a function to io.Writer
+type writerFunc func([]byte) (int, error)
+
+func (f writerFunc) Write(b []byte) (int, error) { return f(b) }
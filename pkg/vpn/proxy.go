@@ -0,0 +1,225 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/ipfs/go-log"
+)
+
+// SOCKS5协议常量，参见RFC 1928
+const (
+	socks5Version      = 0x05
+	socks5NoAuth       = 0x00
+	socks5NoAcceptable = 0xff
+	socks5Connect      = 0x01
+	socks5IPv4         = 0x01
+	socks5Domain       = 0x03
+	socks5IPv6         = 0x04
+
+	socks5Succeeded          = 0x00
+	socks5HostUnreachable    = 0x04
+	socks5CommandUnsupported = 0x07
+	socks5AddressUnsupported = 0x08
+)
+
+// dialer 连接网络中的地址，代理通过它建立到目标的连接
+type dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// serveSOCKS5 在监听器上提供SOCKS5代理，只支持无认证的CONNECT命令
+// 参数 l 为监听器，d 为用户空间拨号器，ll 为日志记录器
+func serveSOCKS5(l net.Listener, d *userspaceDialer, ll log.StandardLogger) {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			if err := handleSOCKS5(conn, d); err != nil {
+				ll.Debugf("SOCKS5: %s", err.Error())
+			}
+		}()
+	}
+}
+
+// handleSOCKS5 处理一个SOCKS5连接
+// 参数 conn 为客户端连接，d 为拨号器
+func handleSOCKS5(conn net.Conn, d dialer) error {
+	r := bufio.NewReader(conn)
+
+	// 协商认证方法
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return err
+	}
+	if header[0] != socks5Version {
+		return fmt.Errorf("不支持的SOCKS版本 %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(r, methods); err != nil {
+		return err
+	}
+	method := byte(socks5NoAcceptable)
+	for _, m := range methods {
+		if m == socks5NoAuth {
+			method = socks5NoAuth
+		}
+	}
+	if _, err := conn.Write([]byte{socks5Version, method}); err != nil {
+		return err
+	}
+	if method == socks5NoAcceptable {
+		return errors.New("客户端不支持无认证方法")
+	}
+
+	// 读取请求
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(r, request); err != nil {
+		return err
+	}
+	if request[1] != socks5Connect {
+		socks5Reply(conn, socks5CommandUnsupported)
+		return fmt.Errorf("不支持的命令 %d", request[1])
+	}
+
+	var host string
+	switch request[3] {
+	case socks5IPv4, socks5IPv6:
+		ip := make(net.IP, net.IPv4len)
+		if request[3] == socks5IPv6 {
+			ip = make(net.IP, net.IPv6len)
+		}
+		if _, err := io.ReadFull(r, ip); err != nil {
+			return err
+		}
+		host = ip.String()
+	case socks5Domain:
+		size, err := r.ReadByte()
+		if err != nil {
+			return err
+		}
+		domain := make([]byte, size)
+		if _, err := io.ReadFull(r, domain); err != nil {
+			return err
+		}
+		host = string(domain)
+	default:
+		socks5Reply(conn, socks5AddressUnsupported)
+		return fmt.Errorf("不支持的地址类型 %d", request[3])
+	}
+	port := make([]byte, 2)
+	if _, err := io.ReadFull(r, port); err != nil {
+		return err
+	}
+	address := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port))))
+
+	dst, err := d.DialContext(context.Background(), "tcp", address)
+	if err != nil {
+		socks5Reply(conn, socks5HostUnreachable)
+		return fmt.Errorf("无法连接到 %s: %w", address, err)
+	}
+	defer dst.Close()
+	if err := socks5Reply(conn, socks5Succeeded); err != nil {
+		return err
+	}
+
+	// 客户端可能已经在请求之后发送了数据
+	if r.Buffered() > 0 {
+		buffered, _ := r.Peek(r.Buffered())
+		if _, err := dst.Write(buffered); err != nil {
+			return err
+		}
+	}
+	pipe(conn, dst)
+	return nil
+}
+
+// socks5Reply 发送SOCKS5应答，绑定地址总是 0.0.0.0:0
+// 参数 w 为客户端连接，status 为应答状态
+func socks5Reply(w io.Writer, status byte) error {
+	_, err := w.Write([]byte{socks5Version, status, 0x00, socks5IPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
+
+// serveHTTPProxy 在监听器上提供HTTP代理，HTTPS等连接使用CONNECT方法建立隧道
+// 参数 l 为监听器，d 为用户空间拨号器，ll 为日志记录器
+func serveHTTPProxy(l net.Listener, d *userspaceDialer, ll log.StandardLogger) {
+	transport := &http.Transport{DialContext: d.DialContext}
+	http.Serve(l, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodConnect {
+			dst, err := d.DialContext(r.Context(), "tcp", r.Host)
+			if err != nil {
+				ll.Debugf("HTTP代理: 无法连接到 %s: %s", r.Host, err.Error())
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return
+			}
+			defer dst.Close()
+
+			hijacker, ok := w.(http.Hijacker)
+			if !ok {
+				http.Error(w, "不支持连接劫持", http.StatusInternalServerError)
+				return
+			}
+			conn, buf, err := hijacker.Hijack()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+			if _, err := conn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n")); err != nil {
+				return
+			}
+			if buf.Reader.Buffered() > 0 {
+				buffered, _ := buf.Reader.Peek(buf.Reader.Buffered())
+				if _, err := dst.Write(buffered); err != nil {
+					return
+				}
+			}
+			pipe(conn, dst)
+			return
+		}
+
+		if r.URL.Host == "" {
+			http.Error(w, "需要绝对URL", http.StatusBadRequest)
+			return
+		}
+		out := r.Clone(r.Context())
+		out.RequestURI = ""
+		out.Header.Del("Proxy-Connection")
+		out.Header.Del("Proxy-Authorization")
+		resp, err := transport.RoundTrip(out)
+		if err != nil {
+			ll.Debugf("HTTP代理: %s", err.Error())
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		for k, v := range resp.Header {
+			w.Header()[k] = v
+		}
+		w.WriteHeader(resp.StatusCode)
+		io.Copy(w, resp.Body)
+	}))
+}
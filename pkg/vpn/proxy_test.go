@@ -0,0 +1,165 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// pipeDialer answers every dial with one end of an in-memory pipe and keeps the other end
+type pipeDialer struct {
+	addresses chan string
+	remotes   chan net.Conn
+}
+
+func newPipeDialer() *pipeDialer {
+	return &pipeDialer{addresses: make(chan string, 1), remotes: make(chan net.Conn, 1)}
+}
+
+func (d *pipeDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	local, remote := net.Pipe()
+	d.addresses <- address
+	d.remotes <- remote
+	return local, nil
+}
+
+// socks5Request builds a CONNECT request for the given address type and address
+func socks5Request(command, atyp byte, addr []byte, port uint16) []byte {
+	req := []byte{socks5Version, command, 0x00, atyp}
+	if atyp == socks5Domain {
+		req = append(req, byte(len(addr)))
+	}
+	req = append(req, addr...)
+	return binary.BigEndian.AppendUint16(req, port)
+}
+
+var _ = Describe("SOCKS5 proxy", func() {
+	var (
+		client net.Conn
+		d      *pipeDialer
+		done   chan error
+	)
+
+	BeforeEach(func() {
+		var server net.Conn
+		client, server = net.Pipe()
+		d = newPipeDialer()
+		done = make(chan error, 1)
+		go func() {
+			defer server.Close()
+			done <- handleSOCKS5(server, d)
+		}()
+		DeferCleanup(client.Close)
+	})
+
+	// handshake negotiates no authentication and sends the request
+	handshake := func(req []byte) {
+		_, err := client.Write([]byte{socks5Version, 1, socks5NoAuth})
+		Expect(err).ToNot(HaveOccurred())
+		reply := make([]byte, 2)
+		_, err = io.ReadFull(client, reply)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reply).To(Equal([]byte{socks5Version, socks5NoAuth}))
+		_, err = client.Write(req)
+		Expect(err).ToNot(HaveOccurred())
+	}
+
+	readReply := func() byte {
+		reply := make([]byte, 10)
+		_, err := io.ReadFull(client, reply)
+		Expect(err).ToNot(HaveOccurred())
+		return reply[1]
+	}
+
+	// relays checks that data flows both ways between the client and the dialed connection
+	relays := func(remote net.Conn) {
+		go func() {
+			buf := make([]byte, 4)
+			if _, err := io.ReadFull(remote, buf); err == nil {
+				remote.Write(buf)
+			}
+		}()
+		_, err := client.Write([]byte("ping"))
+		Expect(err).ToNot(HaveOccurred())
+		buf := make([]byte, 4)
+		_, err = io.ReadFull(client, buf)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(buf)).To(Equal("ping"))
+		remote.Close()
+		Eventually(done).Should(Receive(BeNil()))
+	}
+
+	DescribeTable("connects to the requested address",
+		func(atyp byte, addr []byte, expected string) {
+			handshake(socks5Request(socks5Connect, atyp, addr, 8080))
+			Eventually(d.addresses).Should(Receive(Equal(expected)))
+			Expect(readReply()).To(Equal(byte(socks5Succeeded)))
+			relays(<-d.remotes)
+		},
+		Entry("IPv4", byte(socks5IPv4), []byte{10, 1, 0, 12}, "10.1.0.12:8080"),
+		Entry("IPv6", byte(socks5IPv6), net.ParseIP("fd00::12").To16(), "[fd00::12]:8080"),
+		Entry("domain", byte(socks5Domain), []byte("node.edgevpn"), "node.edgevpn:8080"),
+	)
+
+	It("rejects commands other than CONNECT", func() {
+		handshake(socks5Request(0x02, socks5IPv4, []byte{10, 1, 0, 12}, 8080))
+		Expect(readReply()).To(Equal(byte(socks5CommandUnsupported)))
+		Eventually(done).Should(Receive(HaveOccurred()))
+		Expect(d.addresses).ToNot(Receive())
+	})
+
+	It("rejects clients without the no-authentication method", func() {
+		_, err := client.Write([]byte{socks5Version, 1, 0x02})
+		Expect(err).ToNot(HaveOccurred())
+		reply := make([]byte, 2)
+		_, err = io.ReadFull(client, reply)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reply).To(Equal([]byte{socks5Version, socks5NoAcceptable}))
+		Eventually(done).Should(Receive(HaveOccurred()))
+	})
+
+	It("forwards data the client sends before the reply", func() {
+		// greeting, request and payload in a single write, as optimistic clients do
+		msg := []byte{socks5Version, 1, socks5NoAuth}
+		msg = append(msg, socks5Request(socks5Connect, socks5IPv4, []byte{10, 1, 0, 12}, 22)...)
+		msg = append(msg, []byte("early")...)
+		_, err := client.Write(msg)
+		Expect(err).ToNot(HaveOccurred())
+
+		reply := make([]byte, 2)
+		_, err = io.ReadFull(client, reply)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(reply).To(Equal([]byte{socks5Version, socks5NoAuth}))
+		Expect(readReply()).To(Equal(byte(socks5Succeeded)))
+		Expect(<-d.addresses).To(Equal("10.1.0.12:22"))
+
+		remote := <-d.remotes
+		buf := make([]byte, 5)
+		_, err = io.ReadFull(remote, buf)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(buf)).To(Equal("early"))
+
+		client.Close()
+		_, err = remote.Read(buf)
+		Expect(errors.Is(err, io.EOF) || errors.Is(err, io.ErrClosedPipe)).To(BeTrue())
+		Eventually(done).Should(Receive(BeNil()))
+	})
+})
@@ -0,0 +1,275 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"context"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	lru "github.com/hashicorp/golang-lru"
+	"github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p/core/peer"
+
+	"github.com/purpose168/edgevpn/pkg/blockchain"
+	"github.com/purpose168/edgevpn/pkg/protocol"
+	"github.com/purpose168/edgevpn/pkg/services"
+	"github.com/purpose168/edgevpn/pkg/types"
+)
+
+const (
+	// stickyRoutesSize 是粘性路由记住的目标地址数量
+	stickyRoutesSize = 4096
+	// routeHealthInterval 是重新评估路由器健康状态的间隔
+	routeHealthInterval = 5 * time.Second
+	// routeFailBackoff 是无法连接的下一跳被跳过的时间
+	routeFailBackoff = routeHealthInterval
+)
+
+// subnetRoute 是一个子网和公告它的候选对等节点
+type subnetRoute struct {
+	prefix netip.Prefix
+	peers  []peer.ID // 按优先级从高到低排序
+}
+
+// has 如果对等节点是子网的候选者则返回true
+func (r subnetRoute) has(p peer.ID) bool {
+	for _, pp := range r.peers {
+		if pp == p {
+			return true
+		}
+	}
+	return false
+}
+
+// routeTable 是从账本中的子网路由公告构建的路由表，使用最长前缀匹配查找目标对等节点
+// 同一个子网有多个候选对等节点时使用优先级最高的健康节点，它不可用时自动切换到下一个
+type routeTable struct {
+	sync.RWMutex
+	routes  []subnetRoute         // 按前缀长度从长到短排序
+	healthy map[peer.ID]bool      // 健康的对等节点，为nil时不检查健康状态
+	failed  map[peer.ID]time.Time // 最近无法连接的对等节点及其失败时间
+	sticky  *lru.Cache            // 目标地址到上次选择的对等节点，为nil时禁用粘性路由
+}
+
+// newRouteTable 创建新的路由表
+// 参数 sticky 为是否为每个目标地址保持选择的对等节点
+func newRouteTable(sticky bool) *routeTable {
+	t := &routeTable{}
+	if sticky {
+		t.sticky, _ = lru.New(stickyRoutesSize)
+	}
+	return t
+}
+
+// alive 如果对等节点是健康的且最近没有连接失败则返回true，调用者必须持有读锁
+func (t *routeTable) alive(p peer.ID) bool {
+	if f, exists := t.failed[p]; exists && time.Since(f) < routeFailBackoff {
+		return false
+	}
+	return t.healthy == nil || t.healthy[p]
+}
+
+// fail 将对等节点标记为暂时不可用，使查找在routeFailBackoff内切换到下一个候选者。
+// 如果对等节点是某个子网的候选者则返回true
+// 参数 p 为无法连接的对等节点
+func (t *routeTable) fail(p peer.ID) bool {
+	t.Lock()
+	defer t.Unlock()
+	for _, r := range t.routes {
+		if r.has(p) {
+			if t.failed == nil {
+				t.failed = map[peer.ID]time.Time{}
+			}
+			t.failed[p] = time.Now()
+			return true
+		}
+	}
+	return false
+}
+
+// lookup 返回公告了包含ip的最长前缀子网的健康对等节点，
+// 子网的所有候选者都不健康时尝试更短的前缀。
+// 启用粘性路由时，只要上次为目标地址选择的对等节点仍然健康就继续使用它，长连接不会被重新分配
+// 参数 ip 为目标地址
+func (t *routeTable) lookup(ip netip.Addr) (peer.ID, bool) {
+	t.RLock()
+	defer t.RUnlock()
+	ip = ip.Unmap()
+	for _, r := range t.routes {
+		if !r.prefix.Contains(ip) {
+			continue
+		}
+		if t.sticky != nil {
+			if v, exists := t.sticky.Get(ip); exists {
+				if p := v.(peer.ID); r.has(p) && t.alive(p) {
+					return p, true
+				}
+			}
+		}
+		for _, p := range r.peers {
+			if t.alive(p) {
+				if t.sticky != nil {
+					t.sticky.Add(ip, p)
+				}
+				return p, true
+			}
+		}
+	}
+	return "", false
+}
+
+// prefixes 返回路由表中的所有子网
+func (t *routeTable) prefixes() map[netip.Prefix]bool {
+	t.RLock()
+	defer t.RUnlock()
+	prefixes := map[netip.Prefix]bool{}
+	for _, r := range t.routes {
+		prefixes[r.prefix] = true
+	}
+	return prefixes
+}
+
+// setHealthy 设置健康的对等节点
+// 参数 nodes 为健康的对等节点ID
+func (t *routeTable) setHealthy(nodes []string) {
+	healthy := map[peer.ID]bool{}
+	for _, n := range nodes {
+		if id, err := peer.Decode(n); err == nil {
+			healthy[id] = true
+		}
+	}
+	t.Lock()
+	t.healthy = healthy
+	for p, f := range t.failed {
+		if time.Since(f) >= routeFailBackoff {
+			delete(t.failed, p)
+		}
+	}
+	t.Unlock()
+}
+
+// update 使用账本中的路由公告重建路由表，忽略自己公告的子网
+// 多个对等节点公告同一个子网时，按优先级从高到低排序，优先级相同时按对等节点ID排序，保证所有节点的选择一致
+// 参数 announced 为路由公告，self 为自己的对等节点ID，l 为日志记录器
+func (t *routeTable) update(announced map[string]types.Route, self peer.ID, l log.StandardLogger) {
+	owners := map[netip.Prefix][]peer.ID{}
+	priority := map[peer.ID]int{}
+	for key, r := range announced {
+		// 键是公告者的对等节点ID，值中的对等节点ID必须与之相同
+		id, err := peer.Decode(key)
+		if err != nil || r.PeerID != key {
+			l.Warnf("忽略无效的路由公告 '%s'", key)
+			continue
+		}
+		if id == self {
+			continue
+		}
+		prefixes, err := r.Prefixes()
+		if err != nil {
+			l.Warnf("忽略来自 %s 的路由公告: %s", key, err)
+			continue
+		}
+		priority[id] = r.Priority
+		for _, p := range prefixes {
+			owners[p] = append(owners[p], id)
+		}
+	}
+
+	routes := []subnetRoute{}
+	for p, peers := range owners {
+		sort.Slice(peers, func(i, j int) bool {
+			if priority[peers[i]] != priority[peers[j]] {
+				return priority[peers[i]] > priority[peers[j]]
+			}
+			return peers[i] < peers[j]
+		})
+		if len(peers) > 1 {
+			l.Debugf("子网 %s 的候选对等节点 %v", p, peers)
+		}
+		routes = append(routes, subnetRoute{prefix: p, peers: peers})
+	}
+	sort.Slice(routes, func(i, j int) bool {
+		if routes[i].prefix.Bits() != routes[j].prefix.Bits() {
+			return routes[i].prefix.Bits() > routes[j].prefix.Bits()
+		}
+		return routes[i].prefix.String() < routes[j].prefix.String()
+	})
+
+	t.Lock()
+	t.routes = routes
+	t.Unlock()
+}
+
+// syncRoutes 在ctx的生命周期内保持路由表与账本一致。
+// 如果设置了RouteHealthTimeout，定期使用健康检查更新候选对等节点的健康状态。
+// 如果启用了NetLink引导，同时在系统中为其他节点公告的子网安装经过VPN接口的路由
+// 参数 ctx 为上下文，c 为配置，self 为自己的对等节点ID，b 为账本，t 为路由表
+func syncRoutes(ctx context.Context, c *Config, self peer.ID, b *blockchain.Ledger, t *routeTable) {
+	routes := types.Routes(b)
+	events := b.Watch(ctx, protocol.RoutesLedgerKey, "")
+
+	installed := map[netip.Prefix]bool{}
+	apply := func() {
+		t.update(routes.List(), self, c.Logger)
+		if c.RouteHealthTimeout > 0 {
+			t.setHealthy(services.AvailableNodes(b, c.RouteHealthTimeout))
+		}
+		if !c.NetLinkBootstrap {
+			return
+		}
+
+		wanted := t.prefixes()
+		for p := range wanted {
+			if installed[p] {
+				continue
+			}
+			// 默认路由会使到对等节点的连接也经过VPN接口，由用户决定哪些流量经过路由器
+			if p.Bits() == 0 {
+				continue
+			}
+			if err := addRoute(c, p); err != nil {
+				c.Logger.Warnf("无法添加到 %s 的路由: %s", p, err)
+				continue
+			}
+			installed[p] = true
+		}
+		for p := range installed {
+			if wanted[p] {
+				continue
+			}
+			if err := delRoute(c, p); err != nil {
+				c.Logger.Warnf("无法删除到 %s 的路由: %s", p, err)
+			}
+			delete(installed, p)
+		}
+	}
+
+	ticker := time.NewTicker(routeHealthInterval)
+	defer ticker.Stop()
+	for {
+		apply()
+		select {
+		case _, ok := <-events:
+			if !ok {
+				return
+			}
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
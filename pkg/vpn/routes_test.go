@@ -0,0 +1,302 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"io"
+	"net"
+	"net/netip"
+	"sort"
+	"time"
+
+	"github.com/ipfs/go-log"
+	"github.com/libp2p/go-libp2p/core/crypto"
+	"github.com/libp2p/go-libp2p/core/peer"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/purpose168/edgevpn/pkg/blockchain"
+	"github.com/purpose168/edgevpn/pkg/logger"
+	"github.com/purpose168/edgevpn/pkg/node"
+	"github.com/purpose168/edgevpn/pkg/types"
+)
+
+// identity generates a new peer identity
+func identity() (crypto.PrivKey, peer.ID) {
+	k, _, err := crypto.GenerateEd25519Key(nil)
+	Expect(err).ToNot(HaveOccurred())
+	id, err := peer.IDFromPrivateKey(k)
+	Expect(err).ToNot(HaveOccurred())
+	return k, id
+}
+
+// ordered generates n peers sorted by ID
+func ordered(n int) []peer.ID {
+	ids := []peer.ID{}
+	for i := 0; i < n; i++ {
+		_, id := identity()
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
+}
+
+// announce returns a route announced by p
+func announce(p peer.ID, priority int, networks ...string) types.Route {
+	return types.Route{PeerID: p.String(), Networks: networks, Priority: priority}
+}
+
+var quiet = logger.New(log.LevelFatal)
+
+var _ = Describe("Route table", func() {
+	var (
+		a, b, self peer.ID
+		t          *routeTable
+	)
+
+	BeforeEach(func() {
+		ids := ordered(3)
+		a, b, self = ids[0], ids[1], ids[2]
+		t = newRouteTable(false)
+	})
+
+	DescribeTable("looks up the announcing peer",
+		func(announced func() map[string]types.Route, dst string, expected func() peer.ID) {
+			t.update(announced(), self, quiet)
+			p, found := t.lookup(netip.MustParseAddr(dst))
+			if expected == nil {
+				Expect(found).To(BeFalse())
+				return
+			}
+			Expect(found).To(BeTrue())
+			Expect(p).To(Equal(expected()))
+		},
+		Entry("the longest of nested prefixes",
+			func() map[string]types.Route {
+				return map[string]types.Route{a.String(): announce(a, 0, "10.0.0.0/8"), b.String(): announce(b, 0, "10.1.0.0/16")}
+			}, "10.1.2.3", func() peer.ID { return b }),
+		Entry("the shorter prefix outside the nested one",
+			func() map[string]types.Route {
+				return map[string]types.Route{a.String(): announce(a, 0, "10.0.0.0/8"), b.String(): announce(b, 0, "10.1.0.0/16")}
+			}, "10.2.0.1", func() peer.ID { return a }),
+		Entry("no peer outside all prefixes",
+			func() map[string]types.Route {
+				return map[string]types.Route{a.String(): announce(a, 0, "10.0.0.0/8")}
+			}, "192.168.0.1", nil),
+		Entry("the lowest peer ID for the same prefix and priority",
+			func() map[string]types.Route {
+				return map[string]types.Route{b.String(): announce(b, 0, "10.1.0.0/16"), a.String(): announce(a, 0, "10.1.0.0/16")}
+			}, "10.1.0.1", func() peer.ID { return a }),
+		Entry("the higher priority for the same prefix",
+			func() map[string]types.Route {
+				return map[string]types.Route{a.String(): announce(a, 0, "10.1.0.0/16"), b.String(): announce(b, 1, "10.1.0.0/16")}
+			}, "10.1.0.1", func() peer.ID { return b }),
+		Entry("nobody when the key does not match the announced peer",
+			func() map[string]types.Route {
+				return map[string]types.Route{a.String(): announce(b, 0, "10.1.0.0/16")}
+			}, "10.1.0.1", nil),
+		Entry("nobody when the key is not a peer ID",
+			func() map[string]types.Route {
+				return map[string]types.Route{"foo": {PeerID: "foo", Networks: []string{"10.1.0.0/16"}}}
+			}, "10.1.0.1", nil),
+		Entry("other peers than ourselves",
+			func() map[string]types.Route {
+				return map[string]types.Route{self.String(): announce(self, 10, "10.1.0.0/16"), a.String(): announce(a, 0, "10.0.0.0/8")}
+			}, "10.1.0.1", func() peer.ID { return a }),
+		Entry("IPv4-mapped destinations in IPv4 prefixes",
+			func() map[string]types.Route {
+				return map[string]types.Route{a.String(): announce(a, 0, "10.1.0.0/16")}
+			}, "::ffff:10.1.2.3", func() peer.ID { return a }),
+		Entry("IPv4 destinations in IPv4-mapped prefixes",
+			func() map[string]types.Route {
+				return map[string]types.Route{a.String(): announce(a, 0, "::ffff:10.1.0.0/112")}
+			}, "10.1.2.3", func() peer.ID { return a }),
+		Entry("IPv6 destinations",
+			func() map[string]types.Route {
+				return map[string]types.Route{a.String(): announce(a, 0, "fd00::/64"), b.String(): announce(b, 0, "10.0.0.0/8")}
+			}, "fd00::1", func() peer.ID { return a }),
+	)
+
+	It("skips announcements with invalid networks", func() {
+		t.update(map[string]types.Route{a.String(): announce(a, 0, "10.1.0.0/16", "foo"), b.String(): announce(b, 0, "10.0.0.0/8")}, self, quiet)
+		Expect(t.prefixes()).To(Equal(map[netip.Prefix]bool{netip.MustParsePrefix("10.0.0.0/8"): true}))
+	})
+})
+
+var _ = Describe("Route failover", func() {
+	var (
+		primary, secondary, fallback, self peer.ID
+		announced                          map[string]types.Route
+		dst                                = netip.MustParseAddr("10.1.0.1")
+	)
+
+	BeforeEach(func() {
+		ids := ordered(4)
+		// the primary has the highest ID, so only its priority puts it first
+		secondary, fallback, self, primary = ids[0], ids[1], ids[2], ids[3]
+		announced = map[string]types.Route{
+			primary.String():   announce(primary, 10, "10.1.0.0/24"),
+			secondary.String(): announce(secondary, 5, "10.1.0.0/24"),
+			fallback.String():  announce(fallback, 0, "10.0.0.0/8"),
+		}
+	})
+
+	table := func(sticky bool) *routeTable {
+		t := newRouteTable(sticky)
+		t.update(announced, self, quiet)
+		return t
+	}
+
+	lookup := func(t *routeTable) peer.ID {
+		p, found := t.lookup(dst)
+		Expect(found).To(BeTrue())
+		return p
+	}
+
+	It("orders candidates by priority", func() {
+		t := table(false)
+		Expect(t.routes[0].peers).To(Equal([]peer.ID{primary, secondary}))
+		Expect(lookup(t)).To(Equal(primary))
+	})
+
+	It("fails over after a failure and recovers after the backoff", func() {
+		t := table(false)
+		Expect(t.fail(primary)).To(BeTrue())
+		Expect(lookup(t)).To(Equal(secondary))
+
+		t.Lock()
+		t.failed[primary] = time.Now().Add(-routeFailBackoff)
+		t.Unlock()
+		Expect(lookup(t)).To(Equal(primary))
+
+		// the expired failure is forgotten on the next health update
+		t.setHealthy([]string{primary.String(), secondary.String(), fallback.String()})
+		Expect(t.failed).ToNot(HaveKey(primary))
+	})
+
+	It("does not mark peers without routes as failed", func() {
+		t := table(false)
+		Expect(t.fail(self)).To(BeFalse())
+		Expect(t.failed).To(BeEmpty())
+	})
+
+	It("skips unhealthy candidates", func() {
+		t := table(false)
+		t.setHealthy([]string{secondary.String(), fallback.String()})
+		Expect(lookup(t)).To(Equal(secondary))
+	})
+
+	It("falls back to a shorter prefix when all candidates are unhealthy", func() {
+		t := table(false)
+		t.setHealthy([]string{fallback.String()})
+		Expect(lookup(t)).To(Equal(fallback))
+
+		t.fail(fallback)
+		_, found := t.lookup(dst)
+		Expect(found).To(BeFalse())
+	})
+
+	It("keeps a sticky choice when a higher-priority peer comes back", func() {
+		t := table(true)
+		t.fail(primary)
+		Expect(lookup(t)).To(Equal(secondary))
+
+		t.Lock()
+		delete(t.failed, primary)
+		t.Unlock()
+		Expect(lookup(t)).To(Equal(secondary))
+
+		// other destinations use the primary again
+		p, found := t.lookup(netip.MustParseAddr("10.1.0.2"))
+		Expect(found).To(BeTrue())
+		Expect(p).To(Equal(primary))
+
+		// the sticky choice is dropped once it becomes unhealthy
+		t.fail(secondary)
+		Expect(lookup(t)).To(Equal(primary))
+	})
+})
+
+var _ = Describe("resolve", func() {
+	var (
+		ledger              *blockchain.Ledger
+		t                   *routeTable
+		machine, subnet, gw peer.ID
+		c                   *Config
+		local               = []net.IP{net.ParseIP("10.1.0.1")}
+	)
+
+	BeforeEach(func() {
+		ledger = blockchain.New(io.Discard, &blockchain.MemoryStore{})
+
+		// machines can only be written by themselves
+		put := func(address string) peer.ID {
+			k, id := identity()
+			Expect(ledger.SetIdentity(k)).To(Succeed())
+			Expect(types.Machines(ledger).Put(address, types.Machine{PeerID: id.String(), Address: address})).To(Succeed())
+			return id
+		}
+		machine = put("10.1.0.5")
+		gw = put("10.1.0.254")
+
+		_, subnet = identity()
+		t = newRouteTable(false)
+		t.update(map[string]types.Route{subnet.String(): announce(subnet, 0, "10.1.0.0/24", "192.168.1.0/24")}, "", quiet)
+
+		c = &Config{RouterAddress: "10.1.0.254"}
+	})
+
+	resolves := func(dst, src string) (peer.ID, error) {
+		return resolve(net.ParseIP(dst), net.ParseIP(src), c, local, ledger, node.Config{}, t)
+	}
+
+	It("prefers machines over subnet routes", func() {
+		Expect(resolves("10.1.0.5", "10.1.0.1")).To(Equal(machine))
+	})
+
+	It("uses subnet routes for addresses without a machine", func() {
+		Expect(resolves("10.1.0.7", "10.1.0.1")).To(Equal(subnet))
+		Expect(resolves("192.168.1.1", "10.1.0.1")).To(Equal(subnet))
+	})
+
+	It("does not route traffic of other hosts through subnet routes", func() {
+		t.update(map[string]types.Route{subnet.String(): announce(subnet, 0, "0.0.0.0/0")}, "", quiet)
+		Expect(resolves("172.16.0.1", "10.1.0.1")).To(Equal(subnet))
+		_, err := resolves("172.16.0.1", "10.1.0.9")
+		Expect(err).To(HaveOccurred())
+		_, err = resolves("10.1.0.7", "192.168.5.1")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("sends other local traffic to the router", func() {
+		Expect(resolves("172.16.0.1", "10.1.0.1")).To(Equal(gw))
+	})
+
+	It("does not route traffic of other hosts through the router", func() {
+		_, err := resolves("172.16.0.1", "10.1.0.9")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("fails without router", func() {
+		c.RouterAddress = ""
+		_, err := resolves("172.16.0.1", "10.1.0.1")
+		Expect(err).To(HaveOccurred())
+	})
+
+	It("uses the peer table instead of the ledger", func() {
+		_, p := identity()
+		nc := node.Config{PeerTable: map[string]peer.ID{"10.1.0.5": p}}
+		Expect(resolve(net.ParseIP("10.1.0.5"), net.ParseIP("10.1.0.1"), c, local, ledger, nc, t)).To(Equal(p))
+	})
+})
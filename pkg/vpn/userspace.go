@@ -0,0 +1,198 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+
+	"github.com/ipfs/go-log"
+	"golang.zx2c4.com/wireguard/tun"
+	"golang.zx2c4.com/wireguard/tun/netstack"
+)
+
+// userspaceDevice 是用户空间TCP/IP协议栈的虚拟设备，每次读写一个IP数据包
+type userspaceDevice struct {
+	dev       tun.Device
+	listeners []net.Listener // 代理和端口转发的监听器，关闭设备时一起关闭
+}
+
+// Read 读取协议栈发出的一个数据包
+func (d *userspaceDevice) Read(p []byte) (int, error) {
+	sizes := []int{0}
+	if _, err := d.dev.Read([][]byte{p}, sizes, 0); err != nil {
+		return 0, err
+	}
+	return sizes[0], nil
+}
+
+// Write 将一个数据包注入协议栈
+func (d *userspaceDevice) Write(p []byte) (int, error) {
+	if _, err := d.dev.Write([][]byte{p}, 0); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// Close 关闭监听器和协议栈
+func (d *userspaceDevice) Close() error {
+	for _, l := range d.listeners {
+		l.Close()
+	}
+	return d.dev.Close()
+}
+
+// userspaceDialer 通过用户空间协议栈连接网络中的地址
+type userspaceDialer struct {
+	net *netstack.Net
+}
+
+// DialContext 连接网络中的地址，主机名使用系统解析器解析，例如由DNS服务提供的名称
+// 参数 ctx 为上下文，network 为网络类型，address 为 主机:端口
+func (d *userspaceDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := netip.ParseAddr(host); err != nil {
+		addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+		if err != nil {
+			return nil, err
+		}
+		if len(addrs) == 0 {
+			return nil, fmt.Errorf("无法解析 '%s'", host)
+		}
+		address = net.JoinHostPort(addrs[0].Unmap().String(), port)
+	}
+	return d.net.DialContext(ctx, network, address)
+}
+
+// createUserspace 创建用户空间TCP/IP协议栈代替TUN设备，不需要root权限。
+// 本地进程通过SOCKS5代理、HTTP代理和端口转发访问网络中的地址
+// 参数 c 为VPN配置，addresses 为协议栈的本地地址
+func createUserspace(c *Config, addresses ...netip.Addr) (io.ReadWriteCloser, error) {
+	dev, tnet, err := netstack.CreateNetTUN(addresses, nil, c.InterfaceMTU)
+	if err != nil {
+		return nil, err
+	}
+	d := &userspaceDevice{dev: dev}
+	dialer := &userspaceDialer{net: tnet}
+
+	listen := func(address string, serve func(net.Listener, *userspaceDialer, log.StandardLogger)) error {
+		l, err := net.Listen("tcp", address)
+		if err != nil {
+			return err
+		}
+		d.listeners = append(d.listeners, l)
+		go serve(l, dialer, c.Logger)
+		return nil
+	}
+
+	if c.SOCKS5Listen != "" {
+		if err := listen(c.SOCKS5Listen, serveSOCKS5); err != nil {
+			d.Close()
+			return nil, err
+		}
+	}
+	if c.HTTPProxyListen != "" {
+		if err := listen(c.HTTPProxyListen, serveHTTPProxy); err != nil {
+			d.Close()
+			return nil, err
+		}
+	}
+	for _, f := range c.Forwards {
+		local, remote, err := ParseForward(f)
+		if err != nil {
+			d.Close()
+			return nil, err
+		}
+		if err := listen(local, forwardTo(remote)); err != nil {
+			d.Close()
+			return nil, err
+		}
+	}
+	return d, nil
+}
+
+// ParseForward 解析端口转发，格式为 本地地址=网络中的地址，例如 127.0.0.1:8022=10.1.0.12:22
+// 参数 f 为端口转发
+// 返回本地监听地址和网络中的目标地址
+func ParseForward(f string) (string, string, error) {
+	local, remote, found := strings.Cut(f, "=")
+	if !found {
+		return "", "", fmt.Errorf("无效的端口转发 '%s'，格式为 本地地址=网络中的地址", f)
+	}
+	for _, a := range []string{local, remote} {
+		if _, _, err := net.SplitHostPort(a); err != nil {
+			return "", "", fmt.Errorf("无效的端口转发 '%s': %w", f, err)
+		}
+	}
+	return local, remote, nil
+}
+
+// forwardTo 返回将接受的连接转发到网络中的地址的服务函数
+// 参数 remote 为网络中的目标地址
+func forwardTo(remote string) func(net.Listener, *userspaceDialer, log.StandardLogger) {
+	return func(l net.Listener, d *userspaceDialer, ll log.StandardLogger) {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				dst, err := d.DialContext(context.Background(), "tcp", remote)
+				if err != nil {
+					ll.Debugf("无法连接到 %s: %s", remote, err.Error())
+					return
+				}
+				defer dst.Close()
+				pipe(conn, dst)
+			}()
+		}
+	}
+}
+
+// closeWriter 是可以只关闭写方向的连接，例如TCP连接
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// pipe 在两个连接之间双向复制数据，直到两个方向都结束。
+// 一个方向读到EOF时只关闭另一端的写方向，另一个方向的应答仍然可以送达；
+// 连接不支持半关闭或者复制出错时关闭两个连接
+// 参数 a 和 b 为两个连接
+func pipe(a, b net.Conn) {
+	var wg sync.WaitGroup
+	copy := func(dst, src net.Conn) {
+		defer wg.Done()
+		_, err := io.Copy(dst, src)
+		if cw, ok := dst.(closeWriter); ok && err == nil {
+			if cw.CloseWrite() == nil {
+				return
+			}
+		}
+		dst.Close()
+		src.Close()
+	}
+	wg.Add(2)
+	go copy(a, b)
+	go copy(b, a)
+	wg.Wait()
+}
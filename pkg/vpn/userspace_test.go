@@ -0,0 +1,101 @@
+/*
+Copyright © 2021-2022 Ettore Di Giacinto <mudler@mocaccino.org>
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+    http://www.apache.org/licenses/LICENSE-2.0
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+
+package vpn
+
+import (
+	"io"
+	"net"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+)
+
+// tcpPair returns both ends of a loopback TCP connection
+func tcpPair() (net.Conn, net.Conn) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	Expect(err).ToNot(HaveOccurred())
+	defer l.Close()
+
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	dialed, err := net.Dial("tcp", l.Addr().String())
+	Expect(err).ToNot(HaveOccurred())
+	var conn net.Conn
+	Eventually(accepted).Should(Receive(&conn))
+	DeferCleanup(func() {
+		dialed.Close()
+		conn.Close()
+	})
+	return dialed, conn
+}
+
+var _ = Describe("Userspace forwarding", func() {
+	DescribeTable("parses forwards",
+		func(f, local, remote string) {
+			l, r, err := ParseForward(f)
+			Expect(err).ToNot(HaveOccurred())
+			Expect(l).To(Equal(local))
+			Expect(r).To(Equal(remote))
+		},
+		Entry("IPv4", "127.0.0.1:8022=10.1.0.12:22", "127.0.0.1:8022", "10.1.0.12:22"),
+		Entry("IPv6", "[::1]:8022=[fd00::12]:22", "[::1]:8022", "[fd00::12]:22"),
+		Entry("hostname and any local address", ":8080=node.edgevpn:80", ":8080", "node.edgevpn:80"),
+	)
+
+	DescribeTable("rejects invalid forwards",
+		func(f string) {
+			_, _, err := ParseForward(f)
+			Expect(err).To(HaveOccurred())
+		},
+		Entry("empty", ""),
+		Entry("missing separator", "127.0.0.1:8022"),
+		Entry("missing local port", "127.0.0.1=10.1.0.12:22"),
+		Entry("missing remote port", "127.0.0.1:8022=10.1.0.12"),
+		Entry("empty remote", "127.0.0.1:8022="),
+	)
+
+	It("delivers the response after the client half-closes", func() {
+		client, proxyIn := tcpPair()
+		proxyOut, server := tcpPair()
+
+		done := make(chan struct{})
+		go func() {
+			defer close(done)
+			pipe(proxyIn, proxyOut)
+		}()
+
+		// the server answers only once the request is complete
+		go func() {
+			defer server.Close()
+			request, err := io.ReadAll(server)
+			if err == nil {
+				server.Write(append([]byte("re: "), request...))
+			}
+		}()
+
+		_, err := client.Write([]byte("request"))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(client.(*net.TCPConn).CloseWrite()).To(Succeed())
+
+		response, err := io.ReadAll(client)
+		Expect(err).ToNot(HaveOccurred())
+		Expect(string(response)).To(Equal("re: request"))
+		Eventually(done).Should(BeClosed())
+	})
+})
@@ -18,6 +18,7 @@ import (
 	"fmt"
 	"io"
 	"net"
+	"net/netip"
 	"os"
 	"runtime"
 	"sync"
@@ -36,6 +37,7 @@ import (
 	"github.com/purpose168/edgevpn/pkg/protocol"
 	"github.com/purpose168/edgevpn/pkg/stream"
 	"github.com/purpose168/edgevpn/pkg/types"
+	"github.com/purpose168/edgevpn/pkg/utils"
 
 	"github.com/mudler/water"
 	"github.com/pkg/errors"
@@ -67,8 +69,51 @@ func VPNNetworkService(p ...Option) node.NetworkService {
 			return err
 		}
 
-		// 创建网络接口
-		ifce, err := createInterface(c)
+		if c.Userspace {
+			if c.DeviceType == water.TAP {
+				return errors.New("用户空间模式不支持TAP")
+			}
+			// 用户空间模式下没有需要配置的系统接口
+			c.NetLinkBootstrap = false
+		}
+		if c.DeviceType == water.TAP && len(c.Routes) > 0 {
+			return errors.New("TAP模式不支持子网路由，使用网桥连接子网")
+		}
+
+		// 解析我们的IP地址
+		ip, _, err := net.ParseCIDR(c.InterfaceAddress)
+		if err != nil {
+			return err
+		}
+
+		// 双栈时的IPv6地址
+		var ip6 net.IP
+		if c.InterfaceAddress6 != "" {
+			if c.InterfaceAddress6 == AutoAddress6 {
+				prefix := utils.ULAPrefix(nc.ExchangeKey)
+				addr := utils.HostAddress(prefix, n.Host().ID().String())
+				c.InterfaceAddress6 = netip.PrefixFrom(addr, prefix.Bits()).String()
+			}
+			ip6, _, err = net.ParseCIDR(c.InterfaceAddress6)
+			if err != nil {
+				return err
+			}
+			if ip6.To4() != nil {
+				return fmt.Errorf("'%s' 不是IPv6地址", c.InterfaceAddress6)
+			}
+			// 阻止经过VPN的对等节点连接
+			if err := n.BlockSubnet(c.InterfaceAddress6); err != nil {
+				return err
+			}
+		}
+
+		// 创建网络接口，用户空间模式下使用用户空间TCP/IP协议栈
+		var ifce io.ReadWriteCloser
+		if c.Userspace {
+			ifce, err = createUserspace(c, localAddrs(ip, ip6)...)
+		} else {
+			ifce, err = createInterface(c)
+		}
 		if err != nil {
 			return err
 		}
@@ -89,33 +134,61 @@ func VPNNetworkService(p ...Option) node.NetworkService {
 			}()
 		}
 
+		// TAP模式下学习的MAC地址
+		macs := newMACTable()
+
 		// 在运行时设置流处理器
-		n.Host().SetStreamHandler(protocol.EdgeVPN.ID(), streamHandler(b, ifce, c, nc))
+		n.Host().SetStreamHandler(protocol.EdgeVPN.ID(), streamHandler(b, ifce, c, nc, macs))
 
-		// 公告我们的IP地址
-		ip, _, err := net.ParseCIDR(c.InterfaceAddress)
-		if err != nil {
-			return err
+		machine := newBlockChainData(n, ip, ip6)
+		// 机器信息以每个地址为键保存，使两个地址族都可以被路由
+		keys := []string{ip.String()}
+		if machine.Address6 != "" {
+			keys = append(keys, machine.Address6)
 		}
 
-		// 定期向账本公告我们的IP信息
-		b.Announce(
-			ctx,
-			c.LedgerAnnounceTime,
-			func() {
-				machine := &types.Machine{}
+		machines := types.Machines(b)
+		announce := func() {
+			for _, k := range keys {
 				// 从区块链中检索当前IP对应的ID
-				existingValue, found := b.GetKey(protocol.MachinesLedgerKey, ip.String())
-				existingValue.Unmarshal(machine)
+				current, found := machines.Get(k)
 
 				// 如果不匹配，则更新区块链
-				if !found || machine.PeerID != n.Host().ID().String() {
-					updatedMap := map[string]interface{}{}
-					updatedMap[ip.String()] = newBlockChainData(n, ip.String())
-					b.Add(protocol.MachinesLedgerKey, updatedMap)
+				if !found || current.PeerID != machine.PeerID || current.Address6 != machine.Address6 {
+					machines.Put(k, machine)
 				}
-			},
-		)
+			}
+		}
+
+		// 定期向账本公告我们的IP信息
+		b.Announce(ctx, c.LedgerAnnounceTime, announce)
+
+		// 我们的IP被删除或覆盖时立即重新公告
+		events := b.Watch(ctx, protocol.MachinesLedgerKey, "")
+		go func() {
+			for e := range events {
+				if e.Type == blockchain.KeyResync {
+					announce()
+					continue
+				}
+				if e.Type == blockchain.KeyAdded {
+					continue
+				}
+				for _, k := range keys {
+					if e.Key == k {
+						announce()
+					}
+				}
+			}
+		}()
+
+		// 公告可以通过我们到达的子网
+		if len(c.Routes) > 0 {
+			route := types.Route{PeerID: n.Host().ID().String(), Networks: c.Routes, Priority: c.RoutePriority}
+			if err := types.Routes(b).Announce(ctx, c.LedgerAnnounceTime, route.PeerID, route); err != nil {
+				return err
+			}
+		}
 
 		// 如果启用了NetLink引导，则准备网络接口
 		if c.NetLinkBootstrap {
@@ -124,8 +197,14 @@ func VPNNetworkService(p ...Option) node.NetworkService {
 			}
 		}
 
+		// 其他节点公告的子网。TAP模式按MAC地址转发，不使用子网路由
+		routes := newRouteTable(c.StickyRoutes)
+		if c.DeviceType != water.TAP {
+			go syncRoutes(ctx, c, n.Host().ID(), b, routes)
+		}
+
 		// 从接口读取数据包
-		return readPackets(ctx, mgr, c, n, b, ifce, nc)
+		return readPackets(ctx, mgr, c, n, b, ifce, nc, routes, macs)
 	}
 }
 
@@ -139,14 +218,12 @@ func Register(p ...Option) ([]node.Option, error) {
 }
 
 // streamHandler 返回一个流处理函数，用于处理传入的数据流
-// 参数 l 为区块链账本，ifce 为网络接口，c 为配置，nc 为节点配置
-func streamHandler(l *blockchain.Ledger, ifce *water.Interface, c *Config, nc node.Config) func(stream network.Stream) {
+// 参数 l 为区块链账本，ifce 为网络接口，c 为配置，nc 为节点配置，macs 为MAC地址表
+func streamHandler(l *blockchain.Ledger, ifce io.ReadWriteCloser, c *Config, nc node.Config, macs *macTable) func(stream network.Stream) {
 	return func(stream network.Stream) {
 		// 检查对等节点是否在允许列表中
-		if len(nc.PeerTable) == 0 && !l.Exists(protocol.MachinesLedgerKey,
-			func(d blockchain.Data) bool {
-				machine := &types.Machine{}
-				d.Unmarshal(machine)
+		if len(nc.PeerTable) == 0 && !types.Machines(l).Exists(
+			func(machine types.Machine) bool {
 				return machine.PeerID == stream.Conn().RemotePeer().String()
 			}) {
 			stream.Reset()
@@ -166,7 +243,12 @@ func streamHandler(l *blockchain.Ledger, ifce *water.Interface, c *Config, nc no
 			}
 		}
 		// 将流数据复制到网络接口
-		_, err := io.Copy(ifce.ReadWriteCloser, stream)
+		var err error
+		if c.DeviceType == water.TAP {
+			err = copyFrames(ifce, stream, c, macs)
+		} else {
+			_, err = io.Copy(ifce, stream)
+		}
 		if err != nil {
 			stream.Reset()
 		}
@@ -175,23 +257,27 @@ func streamHandler(l *blockchain.Ledger, ifce *water.Interface, c *Config, nc no
 }
 
 // newBlockChainData 创建新的区块链数据，包含节点信息
-// 参数 n 为节点实例，address 为IP地址
-func newBlockChainData(n *node.Node, address string) types.Machine {
+// 参数 n 为节点实例，address 为IP地址，address6 为双栈时的IPv6地址，可以为nil
+func newBlockChainData(n *node.Node, address, address6 net.IP) types.Machine {
 	hostname, _ := os.Hostname()
 
-	return types.Machine{
+	m := types.Machine{
 		PeerID:   n.Host().ID().String(), // 对等节点ID
 		Hostname: hostname,               // 主机名
 		OS:       runtime.GOOS,           // 操作系统
 		Arch:     runtime.GOARCH,         // 架构
 		Version:  internal.Version,       // 版本
-		Address:  address,                // IP地址
+		Address:  address.String(),       // IP地址
+	}
+	if address6 != nil {
+		m.Address6 = address6.String()
 	}
+	return m
 }
 
 // getFrame 从网络接口读取以太网帧
 // 参数 ifce 为网络接口，c 为配置
-func getFrame(ifce *water.Interface, c *Config) (ethernet.Frame, error) {
+func getFrame(ifce io.ReadWriteCloser, c *Config) (ethernet.Frame, error) {
 	var frame ethernet.Frame
 	frame.Resize(c.MTU)
 
@@ -204,9 +290,83 @@ func getFrame(ifce *water.Interface, c *Config) (ethernet.Frame, error) {
 	return frame, nil
 }
 
+// resolve 查找数据包的目标对等节点：网络中的机器优先，
+// 其次是公告了包含目标地址的最长前缀子网的健康对等节点，最后是路由器地址。
+// 与路由器地址一样，子网路由只用于本节点发出的数据包，
+// 否则公告了0.0.0.0/0的对等节点会吸引本节点转发的所有未知流量
+// 参数 dstIP 为目标IP，srcIP 为源IP，c 为配置，local 为本地IP地址，ledger 为账本，nc 为节点配置，routes 为子网路由表
+func resolve(dstIP, srcIP net.IP, c *Config, local []net.IP, ledger *blockchain.Ledger, nc node.Config, routes *routeTable) (peer.ID, error) {
+	dst := dstIP.String()
+
+	machine := func(dst string) (peer.ID, bool, error) {
+		// 检查对等节点表
+		if len(nc.PeerTable) > 0 {
+			p, found := nc.PeerTable[dst]
+			return p, found, nil
+		}
+		// 查询路由表
+		m, found := types.Machines(ledger).Get(dst)
+		if !found {
+			return "", false, nil
+		}
+		// 解码对等节点ID
+		d, err := peer.Decode(m.PeerID)
+		if err != nil {
+			return "", false, errors.Wrap(err, "无法解码对等节点")
+		}
+		return d, true, nil
+	}
+
+	if d, found, err := machine(dst); found || err != nil {
+		return d, err
+	}
+
+	if !isLocal(srcIP, local) {
+		return "", fmt.Errorf("路由表中未找到 '%s'", dst)
+	}
+
+	if addr, ok := netip.AddrFromSlice(dstIP); ok {
+		if d, found := routes.lookup(addr); found {
+			return d, nil
+		}
+	}
+
+	// 如果配置了路由地址，则发送给路由器
+	if c.RouterAddress != "" {
+		if d, found, err := machine(c.RouterAddress); found || err != nil {
+			return d, err
+		}
+		dst = c.RouterAddress
+	}
+
+	return "", fmt.Errorf("路由表中未找到 '%s'", dst)
+}
+
+// localAddrs 将本地接口的地址转换为netip地址，忽略nil
+func localAddrs(ips ...net.IP) []netip.Addr {
+	addrs := []netip.Addr{}
+	for _, ip := range ips {
+		if a, ok := netip.AddrFromSlice(ip); ok {
+			addrs = append(addrs, a.Unmap())
+		}
+	}
+	return addrs
+}
+
+// isLocal 如果ip是本地接口的地址则返回true
+// 参数 ip 为要检查的地址，local 为本地接口的地址
+func isLocal(ip net.IP, local []net.IP) bool {
+	for _, l := range local {
+		if ip.Equal(l) {
+			return true
+		}
+	}
+	return false
+}
+
 // handleFrame 处理以太网帧，将其转发到目标对等节点
-// 参数 mgr 为流管理器，frame 为以太网帧，c 为配置，n 为节点，ip 为本地IP，ledger 为账本，ifce 为接口，nc 为节点配置
-func handleFrame(mgr streamManager, frame ethernet.Frame, c *Config, n *node.Node, ip net.IP, ledger *blockchain.Ledger, ifce *water.Interface, nc node.Config) error {
+// 参数 mgr 为流管理器，frame 为以太网帧，c 为配置，n 为节点，local 为本地IP地址，ledger 为账本，ifce 为接口，nc 为节点配置，routes 为子网路由表
+func handleFrame(mgr streamManager, frame ethernet.Frame, c *Config, n *node.Node, local []net.IP, ledger *blockchain.Ledger, ifce io.ReadWriteCloser, nc node.Config, routes *routeTable) error {
 	ctx, cancel := context.WithTimeout(context.Background(), c.Timeout)
 	defer cancel()
 
@@ -227,47 +387,27 @@ func handleFrame(mgr streamManager, frame ethernet.Frame, c *Config, n *node.Nod
 		srcIP = packet.SrcIP
 	}
 
-	dst := dstIP.String()
-	// 如果配置了路由地址且源IP是本地IP，则检查目标是否在账本中
-	if c.RouterAddress != "" && srcIP.Equal(ip) {
-		if _, found := ledger.GetKey(protocol.MachinesLedgerKey, dst); !found {
-			dst = c.RouterAddress
-		}
+	d, err := resolve(dstIP, srcIP, c, local, ledger, nc, routes)
+	if err != nil {
+		return err
 	}
 
-	var d peer.ID
-	var err error
-	notFoundErr := fmt.Errorf("路由表中未找到 '%s'", dst)
-	// 检查对等节点表
-	if len(nc.PeerTable) > 0 {
-		found := false
-		for ip, p := range nc.PeerTable {
-			if ip == dst {
-				found = true
-				d = peer.ID(p)
-			}
+	err = sendFrame(ctx, mgr, frame, n, d)
+	// 如果下一跳是子网的候选者，将它标记为不可用并切换到下一个候选者
+	if err != nil && routes.fail(d) {
+		if next, rerr := resolve(dstIP, srcIP, c, local, ledger, nc, routes); rerr == nil && next != d {
+			c.Logger.Debugf("无法发送到 %s，切换到 %s", d.String(), next.String())
+			return sendFrame(ctx, mgr, frame, n, next)
 		}
-		if !found {
-			return notFoundErr
-		}
-	} else {
-		// 查询路由表
-		value, found := ledger.GetKey(protocol.MachinesLedgerKey, dst)
-		if !found {
-			return notFoundErr
-		}
-		machine := &types.Machine{}
-		value.Unmarshal(machine)
-
-		// 解码对等节点ID
-		d, err = peer.Decode(machine.PeerID)
-	}
-
-	if err != nil {
-		return errors.Wrap(err, "无法解码对等节点")
 	}
+	return err
+}
 
+// sendFrame 将帧发送到对等节点，优先复用流管理器中已有的流
+// 参数 ctx 为上下文，mgr 为流管理器，frame 为以太网帧，n 为节点，d 为目标对等节点
+func sendFrame(ctx context.Context, mgr streamManager, frame ethernet.Frame, n *node.Node, d peer.ID) error {
 	var stream network.Stream
+	var err error
 	if mgr != nil {
 		// 如果需要，打开一个流
 		stream, err = mgr.HasStream(n.Host().Network(), d)
@@ -296,32 +436,48 @@ func handleFrame(mgr streamManager, frame ethernet.Frame, c *Config, n *node.Nod
 }
 
 // connectionWorker 连接工作协程，从通道中读取帧并处理
-// 参数 p 为帧通道，mgr 为流管理器，c 为配置，n 为节点，ip 为本地IP，wg 为等待组，ledger 为账本，ifce 为接口，nc 为节点配置
+// 参数 p 为帧通道，mgr 为流管理器，c 为配置，n 为节点，local 为本地IP地址，wg 为等待组，ledger 为账本，ifce 为接口，nc 为节点配置，routes 为子网路由表，macs 为MAC地址表
 func connectionWorker(
 	p chan ethernet.Frame,
 	mgr streamManager,
 	c *Config,
 	n *node.Node,
-	ip net.IP,
+	local []net.IP,
 	wg *sync.WaitGroup,
 	ledger *blockchain.Ledger,
-	ifce *water.Interface,
-	nc node.Config) {
+	ifce io.ReadWriteCloser,
+	nc node.Config,
+	routes *routeTable,
+	macs *macTable) {
 	defer wg.Done()
 	for f := range p {
-		if err := handleFrame(mgr, f, c, n, ip, ledger, ifce, nc); err != nil {
+		var err error
+		if c.DeviceType == water.TAP {
+			err = handleL2Frame(mgr, f, c, n, ledger, nc, macs)
+		} else {
+			err = handleFrame(mgr, f, c, n, local, ledger, ifce, nc, routes)
+		}
+		if err != nil {
 			c.Logger.Debugf("无法处理帧: %s", err.Error())
 		}
 	}
 }
 
 // readPackets 从接口读取数据包，并使用区块链中的路由表将其转发到节点
-// 参数 ctx 为上下文，mgr 为流管理器，c 为配置，n 为节点，ledger 为账本，ifce 为接口，nc 为节点配置
-func readPackets(ctx context.Context, mgr streamManager, c *Config, n *node.Node, ledger *blockchain.Ledger, ifce *water.Interface, nc node.Config) error {
+// 参数 ctx 为上下文，mgr 为流管理器，c 为配置，n 为节点，ledger 为账本，ifce 为接口，nc 为节点配置，routes 为子网路由表，macs 为MAC地址表
+func readPackets(ctx context.Context, mgr streamManager, c *Config, n *node.Node, ledger *blockchain.Ledger, ifce io.ReadWriteCloser, nc node.Config, routes *routeTable, macs *macTable) error {
 	ip, _, err := net.ParseCIDR(c.InterfaceAddress)
 	if err != nil {
 		return err
 	}
+	local := []net.IP{ip}
+	if c.InterfaceAddress6 != "" {
+		ip6, _, err := net.ParseCIDR(c.InterfaceAddress6)
+		if err != nil {
+			return err
+		}
+		local = append(local, ip6)
+	}
 
 	wg := new(sync.WaitGroup)
 
@@ -335,7 +491,7 @@ func readPackets(ctx context.Context, mgr streamManager, c *Config, n *node.Node
 	// 启动多个并发工作协程处理数据包
 	for i := 0; i < c.Concurrency; i++ {
 		wg.Add(1)
-		go connectionWorker(packets, mgr, c, n, ip, wg, ledger, ifce, nc)
+		go connectionWorker(packets, mgr, c, n, local, wg, ledger, ifce, nc, routes, macs)
 	}
 
 	for {